@@ -72,12 +72,28 @@ func serve(confPath string) error {
 
 	logger.Infof("setting up the API server")
 	cfg := charmstore.ServerParams{
-		AuthUsername:        conf.AuthUsername,
-		AuthPassword:        conf.AuthPassword,
-		IdentityLocation:    conf.IdentityLocation,
-		IdentityAPIURL:      conf.IdentityAPIURL,
-		IdentityAPIUsername: conf.IdentityAPIUsername,
-		IdentityAPIPassword: conf.IdentityAPIPassword,
+		AuthUsername:          conf.AuthUsername,
+		AuthPassword:          conf.AuthPassword,
+		IdentityLocation:      conf.IdentityLocation,
+		IdentityAPIURL:        conf.IdentityAPIURL,
+		IdentityAPIUsername:   conf.IdentityAPIUsername,
+		IdentityAPIPassword:   conf.IdentityAPIPassword,
+		BlobStore:             conf.BlobStore,
+		BlobStorePath:         conf.BlobStorePath,
+		S3Endpoint:            conf.S3Endpoint,
+		S3Region:              conf.S3Region,
+		S3Bucket:              conf.S3Bucket,
+		S3AccessKey:           conf.S3AccessKey,
+		S3SecretKey:           conf.S3SecretKey,
+		ScrubRate:             conf.ScrubRate,
+		PolicyMaxArchiveSize:  conf.PolicyMaxArchiveSize,
+		PolicyForbiddenFiles:  conf.PolicyForbiddenFiles,
+		PolicyRequireReadme:   conf.PolicyRequireReadme,
+		PolicyAllowedLicences: conf.PolicyAllowedLicences,
+		PolicyRequiredHooks:   conf.PolicyRequiredHooks,
+		QuotaMaxEntities:      conf.QuotaMaxEntities,
+		QuotaMaxBytes:         conf.QuotaMaxBytes,
+		DeliverWebhooks:       conf.DeliverWebhooks,
 	}
 	var identityPublicKey bakery.PublicKey
 	err = identityPublicKey.UnmarshalText([]byte(conf.IdentityPublicKey))
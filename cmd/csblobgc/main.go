@@ -0,0 +1,101 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// This command removes archive blobs that are not referred to
+// by any entity in the charm store.
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/juju/loggo"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v4/config"
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+)
+
+var (
+	logger        = loggo.GetLogger("csblobgc")
+	loggingConfig = flag.String("logging-config", "", "specify log levels for modules e.g. <root>=TRACE")
+	dryRun        = flag.Bool("dry-run", false, "report orphaned blobs without removing them")
+	gracePeriod   = flag.Duration("grace-period", charmstore.DefaultBlobGCGracePeriod, "minimum age of blobs to be considered")
+)
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "usage: %s [options] <config path>\n", filepath.Base(os.Args[0]))
+		flag.PrintDefaults()
+		os.Exit(2)
+	}
+	flag.Parse()
+	if flag.NArg() != 1 {
+		flag.Usage()
+	}
+	if *loggingConfig != "" {
+		if err := loggo.ConfigureLoggers(*loggingConfig); err != nil {
+			fmt.Fprintf(os.Stderr, "cannot configure loggers: %v", err)
+			os.Exit(1)
+		}
+	}
+	if err := run(flag.Arg(0)); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		os.Exit(1)
+	}
+}
+
+func run(confPath string) error {
+	logger.Infof("reading configuration")
+	conf, err := config.Read(confPath)
+	if err != nil {
+		return errgo.Notef(err, "cannot read config file %q", confPath)
+	}
+
+	logger.Infof("connecting to mongo")
+	session, err := mgo.Dial(conf.MongoURL)
+	if err != nil {
+		return errgo.Notef(err, "cannot dial mongo at %q", conf.MongoURL)
+	}
+	defer session.Close()
+	db := session.DB("juju")
+
+	bs, err := blobstore.NewFromConfig(db, conf)
+	if err != nil {
+		return errgo.Notef(err, "cannot create blob store")
+	}
+
+	logger.Infof("instantiating the store")
+	pool, err := charmstore.NewPool(db, nil, nil, bs)
+	if err != nil {
+		return errgo.Notef(err, "cannot create a new store")
+	}
+	store := pool.Store()
+	defer store.Close()
+
+	logger.Infof("collecting orphaned blobs")
+	result, err := store.CollectBlobGarbage(charmstore.BlobGCParams{
+		DryRun:      *dryRun,
+		GracePeriod: *gracePeriod,
+	})
+	if err != nil {
+		return errgo.Notef(err, "cannot collect orphaned blobs")
+	}
+	for _, name := range result.Orphans {
+		fmt.Println(name)
+	}
+	if *dryRun {
+		logger.Infof("%d orphaned blobs found", len(result.Orphans))
+		return nil
+	}
+	logger.Infof("%d of %d orphaned blobs removed", len(result.Removed), len(result.Orphans))
+	if len(result.Errors) > 0 {
+		return errgo.Newf("cannot remove %d orphaned blobs", len(result.Errors))
+	}
+	return nil
+}
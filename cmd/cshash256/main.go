@@ -22,6 +22,7 @@ import (
 	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v4/config"
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
 	"gopkg.in/juju/charmstore.v4/internal/charmstore"
 	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
 )
@@ -68,8 +69,13 @@ func run(confPath string) error {
 	defer session.Close()
 	db := session.DB("juju")
 
+	bs, err := blobstore.NewFromConfig(db, conf)
+	if err != nil {
+		return errgo.Notef(err, "cannot create blob store")
+	}
+
 	logger.Infof("instantiating the store")
-	pool, err := charmstore.NewPool(db, nil, nil)
+	pool, err := charmstore.NewPool(db, nil, nil, bs)
 	if err != nil {
 		return errgo.Notef(err, "cannot create a new store")
 	}
@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path"
 	"strings"
 
 	"gopkg.in/errgo.v1"
@@ -28,8 +29,65 @@ type Config struct {
 	IdentityAPIURL      string `yaml:"identity-api-url"`
 	IdentityAPIUsername string `yaml:"identity-api-username"`
 	IdentityAPIPassword string `yaml:"identity-api-password"`
+	// BlobStore holds the kind of storage used for archive
+	// blobs. It is optional and defaults to BlobStoreMongoDB.
+	BlobStore string `yaml:"blobstore"`
+	// BlobStorePath holds the directory used by the
+	// filesystem blob store.
+	BlobStorePath string `yaml:"blobstore-path"`
+	// The S3 fields configure the S3 blob store. The region
+	// is optional.
+	S3Endpoint  string `yaml:"s3-endpoint"`
+	S3Region    string `yaml:"s3-region"`
+	S3Bucket    string `yaml:"s3-bucket"`
+	S3AccessKey string `yaml:"s3-access-key"`
+	S3SecretKey string `yaml:"s3-secret-key"`
+	// ScrubRate holds the number of entities per second
+	// checked by the archive integrity scrubber. If it is
+	// zero, the scrubber is disabled. When several servers
+	// share a database, only one of them scrubs at a time.
+	ScrubRate float64 `yaml:"scrub-rate"`
+	// The policy fields configure the content policy
+	// applied to uploaded archives. All of them are optional.
+	//
+	// PolicyMaxArchiveSize holds the maximum size of an
+	// archive in bytes. If it is zero, the size is unlimited.
+	PolicyMaxArchiveSize int64 `yaml:"policy-max-archive-size"`
+	// PolicyForbiddenFiles holds shell file name patterns
+	// (see path.Match) that must not match the base name
+	// of any file in an archive, for instance "*.exe".
+	PolicyForbiddenFiles []string `yaml:"policy-forbidden-files"`
+	// PolicyRequireReadme specifies that archives must
+	// hold a README file.
+	PolicyRequireReadme bool `yaml:"policy-require-readme"`
+	// PolicyAllowedLicences holds the licences that charms
+	// may declare in their copyright file. If it is empty,
+	// any licence is allowed.
+	PolicyAllowedLicences []string `yaml:"policy-allowed-licences"`
+	// PolicyRequiredHooks holds the names of the hooks
+	// that every charm must implement.
+	PolicyRequiredHooks []string `yaml:"policy-required-hooks"`
+	// QuotaMaxEntities and QuotaMaxBytes hold the maximum
+	// number of entities that a user may own and the maximum
+	// total size in bytes of their archives, resources and
+	// upload chunks. If either is
+	// zero, the respective usage is unlimited.
+	QuotaMaxEntities int   `yaml:"quota-max-entities"`
+	QuotaMaxBytes    int64 `yaml:"quota-max-bytes"`
+	// DeliverWebhooks specifies that the server delivers
+	// change events to registered webhooks. When several
+	// servers share a database, it may be set on any number
+	// of them.
+	DeliverWebhooks bool `yaml:"deliver-webhooks"`
 }
 
+// Possible values of Config.BlobStore.
+const (
+	BlobStoreMongoDB    = "mongodb"
+	BlobStoreFilesystem = "filesystem"
+	BlobStoreS3         = "s3"
+)
+
 func (c *Config) validate() error {
 	var missing []string
 	if c.MongoURL == "" {
@@ -47,6 +105,45 @@ func (c *Config) validate() error {
 	if c.AuthPassword == "" {
 		missing = append(missing, "auth-password")
 	}
+	switch c.BlobStore {
+	case "", BlobStoreMongoDB:
+	case BlobStoreFilesystem:
+		if c.BlobStorePath == "" {
+			missing = append(missing, "blobstore-path")
+		}
+	case BlobStoreS3:
+		if c.S3Endpoint == "" {
+			missing = append(missing, "s3-endpoint")
+		}
+		if c.S3Bucket == "" {
+			missing = append(missing, "s3-bucket")
+		}
+		if c.S3AccessKey == "" {
+			missing = append(missing, "s3-access-key")
+		}
+		if c.S3SecretKey == "" {
+			missing = append(missing, "s3-secret-key")
+		}
+	default:
+		return fmt.Errorf("unknown blobstore %q", c.BlobStore)
+	}
+	if c.ScrubRate < 0 {
+		return fmt.Errorf("invalid scrub-rate %v (must not be negative)", c.ScrubRate)
+	}
+	if c.PolicyMaxArchiveSize < 0 {
+		return fmt.Errorf("invalid policy-max-archive-size %d (must not be negative)", c.PolicyMaxArchiveSize)
+	}
+	if c.QuotaMaxEntities < 0 {
+		return fmt.Errorf("invalid quota-max-entities %d (must not be negative)", c.QuotaMaxEntities)
+	}
+	if c.QuotaMaxBytes < 0 {
+		return fmt.Errorf("invalid quota-max-bytes %d (must not be negative)", c.QuotaMaxBytes)
+	}
+	for _, pattern := range c.PolicyForbiddenFiles {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return fmt.Errorf("invalid policy-forbidden-files pattern %q", pattern)
+		}
+	}
 	if len(missing) != 0 {
 		return fmt.Errorf("missing fields %s in config file", strings.Join(missing, ", "))
 	}
@@ -70,3 +70,101 @@ func (s *ConfigSuite) TestValidateConfigError(c *gc.C) {
 	c.Assert(err, gc.ErrorMatches, "missing fields mongo-url, api-addr, auth-username, auth-password in config file")
 	c.Assert(cfg, gc.IsNil)
 }
+
+func (s *ConfigSuite) TestReadBlobStore(c *gc.C) {
+	conf, err := s.readConfig(c, testConfig+`
+blobstore: s3
+s3-endpoint: http://localhost:9000
+s3-bucket: charms
+s3-access-key: access
+s3-secret-key: secret
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conf.BlobStore, gc.Equals, config.BlobStoreS3)
+	c.Assert(conf.S3Endpoint, gc.Equals, "http://localhost:9000")
+	c.Assert(conf.S3Region, gc.Equals, "")
+	c.Assert(conf.S3Bucket, gc.Equals, "charms")
+	c.Assert(conf.S3AccessKey, gc.Equals, "access")
+	c.Assert(conf.S3SecretKey, gc.Equals, "secret")
+}
+
+func (s *ConfigSuite) TestReadPolicy(c *gc.C) {
+	conf, err := s.readConfig(c, testConfig+`
+policy-max-archive-size: 1048576
+policy-forbidden-files: ["*.exe", "*.dll"]
+policy-require-readme: true
+policy-allowed-licences: [GPL-3, Apache-2.0]
+policy-required-hooks: [install, start]
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conf.PolicyMaxArchiveSize, gc.Equals, int64(1048576))
+	c.Assert(conf.PolicyForbiddenFiles, jc.DeepEquals, []string{"*.exe", "*.dll"})
+	c.Assert(conf.PolicyRequireReadme, jc.IsTrue)
+	c.Assert(conf.PolicyAllowedLicences, jc.DeepEquals, []string{"GPL-3", "Apache-2.0"})
+	c.Assert(conf.PolicyRequiredHooks, jc.DeepEquals, []string{"install", "start"})
+}
+
+func (s *ConfigSuite) TestReadQuota(c *gc.C) {
+	conf, err := s.readConfig(c, testConfig+`
+quota-max-entities: 100
+quota-max-bytes: 1073741824
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conf.QuotaMaxEntities, gc.Equals, 100)
+	c.Assert(conf.QuotaMaxBytes, gc.Equals, int64(1073741824))
+}
+
+func (s *ConfigSuite) TestReadDeliverWebhooks(c *gc.C) {
+	conf, err := s.readConfig(c, testConfig+`
+deliver-webhooks: true
+`)
+	c.Assert(err, gc.IsNil)
+	c.Assert(conf.DeliverWebhooks, jc.IsTrue)
+}
+
+var validateConfigTests = []struct {
+	about       string
+	config      string
+	expectError string
+}{{
+	about:       "filesystem without path",
+	config:      "blobstore: filesystem",
+	expectError: "missing fields blobstore-path in config file",
+}, {
+	about:       "s3 without parameters",
+	config:      "blobstore: s3",
+	expectError: "missing fields s3-endpoint, s3-bucket, s3-access-key, s3-secret-key in config file",
+}, {
+	about:       "unknown blob store",
+	config:      "blobstore: floppy",
+	expectError: `unknown blobstore "floppy"`,
+}, {
+	about:       "negative scrub rate",
+	config:      "scrub-rate: -1",
+	expectError: `invalid scrub-rate -1 \(must not be negative\)`,
+}, {
+	about:       "negative maximum archive size",
+	config:      "policy-max-archive-size: -1",
+	expectError: `invalid policy-max-archive-size -1 \(must not be negative\)`,
+}, {
+	about:       "negative entity quota",
+	config:      "quota-max-entities: -1",
+	expectError: `invalid quota-max-entities -1 \(must not be negative\)`,
+}, {
+	about:       "negative byte quota",
+	config:      "quota-max-bytes: -1",
+	expectError: `invalid quota-max-bytes -1 \(must not be negative\)`,
+}, {
+	about:       "invalid forbidden file pattern",
+	config:      `policy-forbidden-files: ["[a-"]`,
+	expectError: `invalid policy-forbidden-files pattern "\[a-"`,
+}}
+
+func (s *ConfigSuite) TestValidateFieldError(c *gc.C) {
+	for i, test := range validateConfigTests {
+		c.Logf("test %d: %s", i, test.about)
+		cfg, err := s.readConfig(c, testConfig+test.config+"\n")
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(cfg, gc.IsNil)
+	}
+}
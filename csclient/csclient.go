@@ -111,6 +111,16 @@ func (c *Client) SetHTTPHeader(header http.Header) {
 // reader its data can be read from, the fully qualified id of the
 // corresponding entity, the SHA384 hash of the data and its size.
 func (c *Client) GetArchive(id *charm.Reference) (r io.ReadCloser, eid *charm.Reference, hash string, size int64, err error) {
+	return c.GetArchiveWithOptions(id, GetArchiveOptions{})
+}
+
+// GetArchiveWithOptions is like GetArchive but allows options to be
+// specified. When a trust policy is specified, the archive's signatures
+// are checked against the policy before the reader is returned, and
+// reading from the reader fails if the data does not match the signed
+// hash. If the archive is not trusted, the returned error has an
+// ErrUntrusted cause.
+func (c *Client) GetArchiveWithOptions(id *charm.Reference, opts GetArchiveOptions) (r io.ReadCloser, eid *charm.Reference, hash string, size int64, err error) {
 	// Create the request.
 	req, err := http.NewRequest("GET", "", nil)
 	if err != nil {
@@ -160,7 +170,14 @@ func (c *Client) GetArchive(id *charm.Reference) (r io.ReadCloser, eid *charm.Re
 		resp.Body.Close()
 		return nil, nil, "", 0, errgo.Newf("no content length found in response")
 	}
-	return resp.Body, eid, hash, resp.ContentLength, nil
+	if opts.TrustPolicy == nil {
+		return resp.Body, eid, hash, resp.ContentLength, nil
+	}
+	if err := c.checkTrust(eid, hash, opts.TrustPolicy); err != nil {
+		resp.Body.Close()
+		return nil, nil, "", 0, errgo.Mask(err, errgo.Is(ErrUntrusted))
+	}
+	return newHashCheckingReader(resp.Body, hash), eid, hash, resp.ContentLength, nil
 }
 
 // UploadCharm uploads the given charm to the charm store with the given id,
@@ -241,6 +258,81 @@ func (c *Client) UploadBundleWithRevision(id *charm.Reference, b charm.Bundle, p
 	return errgo.Mask(err)
 }
 
+// ValidateCharm checks whether the given charm could be uploaded to
+// the charm store with the given id, which must not specify a revision,
+// without uploading it. It returns all the problems found with the
+// charm, which is empty if the charm can be uploaded.
+// The accepted charm implementations are charm.CharmDir and
+// charm.CharmArchive.
+func (c *Client) ValidateCharm(id *charm.Reference, ch charm.Charm) ([]*params.Error, error) {
+	r, hash, size, err := openArchive(ch)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open charm archive")
+	}
+	defer r.Close()
+	return c.validateArchive(id, r, hash, size)
+}
+
+// ValidateBundle checks whether the given bundle could be uploaded to
+// the charm store with the given id, which must not specify a revision,
+// without uploading it. It returns all the problems found with the
+// bundle, which is empty if the bundle can be uploaded.
+// The accepted bundle implementations are charm.BundleDir and
+// charm.BundleArchive.
+func (c *Client) ValidateBundle(id *charm.Reference, b charm.Bundle) ([]*params.Error, error) {
+	r, hash, size, err := openArchive(b)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open bundle archive")
+	}
+	defer r.Close()
+	return c.validateArchive(id, r, hash, size)
+}
+
+// validateArchive sends the archive represented by the given body,
+// its SHA384 hash and its size for a dry-run upload to the given id
+// and returns the problems found with it.
+func (c *Client) validateArchive(id *charm.Reference, body io.ReadSeeker, hash string, size int64) ([]*params.Error, error) {
+	if id.Series == "" {
+		return nil, errgo.Newf("no series specified in %q", id)
+	}
+	if id.Revision != -1 {
+		return nil, errgo.Newf("revision specified in %q, but should not be specified", id)
+	}
+	// See uploadArchive for why we log in first.
+	if c.params.User == "" {
+		if err := c.Login(); err != nil {
+			return nil, errgo.Notef(err, "cannot log in")
+		}
+	}
+	req, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot make new request")
+	}
+	path := "/" + id.Path() + "/archive?dry-run=1&hash=" + hash
+	getBody := httpbakery.SeekerBody(body)
+	if size > uploadChunkSize {
+		uploadId, err := c.uploadChunks(body, size)
+		if err != nil {
+			return nil, errgo.NoteMask(err, "cannot upload archive", errgo.Any)
+		}
+		path += "&upload=" + uploadId
+		getBody = noBody
+	} else {
+		req.Header.Set("Content-Type", "application/zip")
+		req.ContentLength = size
+	}
+	resp, err := c.DoWithBody(req, path, getBody)
+	if err != nil {
+		return nil, errgo.NoteMask(err, "cannot validate archive", errgo.Any)
+	}
+	defer resp.Body.Close()
+	var result params.ArchiveValidateResponse
+	if err := parseResponseBody(resp.Body, &result); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result.Problems, nil
+}
+
 // uploadArchive pushes the archive for the charm or bundle represented by
 // the given body, its SHA384 hash and its size. It returns the resulting
 // entity reference. The given id should include the series and should not
@@ -278,20 +370,38 @@ func (c *Client) uploadArchive(id *charm.Reference, body io.ReadSeeker, hash str
 		}
 	}
 
+	path := "/" + id.Path() + "/archive?hash=" + hash + promulgatedArg
+
+	// The charm store may already hold the archive content, in which
+	// case we only need to prove that we have it too.
+	resultId, err := c.addExistingArchive(method, path, body, size)
+	if errgo.Cause(err) != errArchiveContentRequired {
+		return resultId, errgo.Mask(err, errgo.Any)
+	}
+
 	// Prepare the request.
 	req, err := http.NewRequest(method, "", nil)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot make new request")
 	}
-	req.Header.Set("Content-Type", "application/zip")
-	req.ContentLength = size
+	getBody := httpbakery.SeekerBody(body)
+	if size > uploadChunkSize {
+		// The archive is large, so send it in chunks that can be
+		// resent individually if the connection fails, and then
+		// commit the upload with an empty request body.
+		uploadId, err := c.uploadChunks(body, size)
+		if err != nil {
+			return nil, errgo.NoteMask(err, "cannot upload archive", errgo.Any)
+		}
+		path += "&upload=" + uploadId
+		getBody = noBody
+	} else {
+		req.Header.Set("Content-Type", "application/zip")
+		req.ContentLength = size
+	}
 
 	// Send the request.
-	resp, err := c.DoWithBody(
-		req,
-		"/"+id.Path()+"/archive?hash="+hash+promulgatedArg,
-		httpbakery.SeekerBody(body),
-	)
+	resp, err := c.DoWithBody(req, path, getBody)
 	if err != nil {
 		return nil, errgo.NoteMask(err, "cannot post archive", errgo.Any)
 	}
@@ -446,28 +556,48 @@ func hyphenate(s string) string {
 // be a pointer to the expected data, but may be nil if no result is
 // desired.
 func (c *Client) Get(path string, result interface{}) error {
+	_, err := c.GetWithETag(path, result)
+	return errgo.Mask(err, errgo.Any)
+}
+
+// GetWithETag is like Get except that it also returns the entity tag
+// of the response, or the empty string if the response has none.
+// The tag of a metadata response may be passed to PutIfMatch.
+func (c *Client) GetWithETag(path string, result interface{}) (string, error) {
 	req, err := http.NewRequest("GET", "", nil)
 	if err != nil {
-		return errgo.Notef(err, "cannot make new request")
+		return "", errgo.Notef(err, "cannot make new request")
 	}
 	resp, err := c.Do(req, path)
 	if err != nil {
-		return errgo.Mask(err, errgo.Any)
+		return "", errgo.Mask(err, errgo.Any)
 	}
 	defer resp.Body.Close()
 	// Parse the response.
 	if err := parseResponseBody(resp.Body, result); err != nil {
-		return errgo.Mask(err)
+		return "", errgo.Mask(err)
 	}
-	return nil
+	return resp.Header.Get("ETag"), nil
 }
 
 // Put makes a PUT request to the given path in the charm store (not
 // including the host name or version prefix, but including a leading
 // /), marshaling the given value as JSON to use as the request body.
 func (c *Client) Put(path string, val interface{}) error {
+	return c.PutIfMatch(path, val, "")
+}
+
+// PutIfMatch is like Put except that, if etag is not empty, the
+// request succeeds only if the entity tag of the metadata at the given
+// path still matches etag, as returned by GetWithETag. If it does not,
+// because the metadata has been changed since it was retrieved, the
+// returned error has a params.ErrPreconditionFailed cause.
+func (c *Client) PutIfMatch(path string, val interface{}, etag string) error {
 	req, _ := http.NewRequest("PUT", "", nil)
 	req.Header.Set("Content-Type", "application/json")
+	if etag != "" {
+		req.Header.Set("If-Match", etag)
+	}
 	data, err := json.Marshal(val)
 	if err != nil {
 		return errgo.Notef(err, "cannot marshal PUT body")
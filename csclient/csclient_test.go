@@ -5,6 +5,10 @@ package csclient_test
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
 	"crypto/sha512"
 	"encoding/json"
 	"fmt"
@@ -286,6 +290,39 @@ func (s *suite) TestPutSuccess(c *gc.C) {
 	c.Assert(got, jc.DeepEquals, perms)
 }
 
+func (s *suite) TestPutIfMatch(c *gc.C) {
+	err := s.client.UploadCharmWithRevision(
+		charm.MustParseReference("~charmers/utopic/wordpress-42"),
+		charmRepo.CharmDir("wordpress"),
+		42)
+	c.Assert(err, gc.IsNil)
+
+	// Metadata tags are per entity, so any metadata
+	// request can be used to get the tag.
+	etag, err := s.client.GetWithETag("/~charmers/utopic/wordpress-42/meta/extra-info", nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(etag, gc.Not(gc.Equals), "")
+
+	path := "/~charmers/utopic/wordpress-42/meta/extra-info/foo"
+	err = s.client.PutIfMatch(path, "first", etag)
+	c.Assert(err, gc.IsNil)
+
+	// The metadata has changed since the tag was retrieved,
+	// so a second write with the same tag fails.
+	err = s.client.PutIfMatch(path, "second", etag)
+	c.Assert(err, gc.ErrorMatches, "metadata of cs:~charmers/utopic/wordpress-42 has been modified")
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrPreconditionFailed)
+
+	var got string
+	etag1, err := s.client.GetWithETag(path, &got)
+	c.Assert(err, gc.IsNil)
+	c.Assert(got, gc.Equals, "first")
+	c.Assert(etag1, gc.Not(gc.Equals), etag)
+
+	err = s.client.PutIfMatch(path, "second", etag1)
+	c.Assert(err, gc.IsNil)
+}
+
 func (s *suite) TestGetArchive(c *gc.C) {
 	key := s.checkGetArchive(c)
 
@@ -611,6 +648,123 @@ func archiveHashAndSize(c *gc.C, path string) (r csclient.ReadSeekCloser, hash s
 	return f, fmt.Sprintf("%x", h.Sum(nil)), size
 }
 
+func (s *suite) TestUploadArchiveInChunks(c *gc.C) {
+	s.PatchValue(csclient.UploadChunkSize, int64(500))
+	path := charmRepo.CharmArchivePath(c.MkDir(), "wordpress")
+	s.checkUploadArchive(c, path, "~charmers/utopic/wordpress", "cs:~charmers/utopic/wordpress-0")
+
+	// The upload has been removed after being committed.
+	n, err := s.Session.DB("charmstore").C("uploads").Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *suite) TestUploadArchiveInChunksResumes(c *gc.C) {
+	s.PatchValue(csclient.UploadChunkSize, int64(500))
+	transport := &flakyChunkTransport{}
+	client := csclient.New(csclient.Params{
+		URL:      s.srv.URL,
+		User:     s.serverParams.AuthUsername,
+		Password: s.serverParams.AuthPassword,
+		HTTPClient: &http.Client{
+			Transport: transport,
+		},
+	})
+	path := charmRepo.CharmArchivePath(c.MkDir(), "wordpress")
+	body, hash, size := archiveHashAndSize(c, path)
+	defer body.Close()
+	c.Assert(size > 3*500, gc.Equals, true)
+
+	id, err := csclient.UploadArchive(client, charm.MustParseReference("~charmers/utopic/wordpress"), body, hash, size, -1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~charmers/utopic/wordpress-0")
+	c.Assert(transport.failed, gc.Equals, true)
+
+	// Each chunk has been received by the server exactly once.
+	numChunks := int((size + 499) / 500)
+	c.Assert(transport.puts, gc.HasLen, numChunks)
+	seen := make(map[string]bool)
+	for _, chunk := range transport.puts {
+		c.Assert(seen[chunk], gc.Equals, false, gc.Commentf("chunk %s sent twice", chunk))
+		seen[chunk] = true
+	}
+
+	_, _, resultingHash, _, err := s.client.GetArchive(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resultingHash, gc.Equals, hash)
+}
+
+// flakyChunkTransport is an http.RoundTripper that fails
+// the first attempt to put chunk 1 of an upload, and records
+// the numbers of the chunks that are sent to the server.
+type flakyChunkTransport struct {
+	failed bool
+	puts   []string
+}
+
+func (t *flakyChunkTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method == "PUT" && strings.Contains(req.URL.Path, "/upload/") {
+		chunk := req.URL.Path[strings.LastIndex(req.URL.Path, "/")+1:]
+		if chunk == "1" && !t.failed {
+			t.failed = true
+			if req.Body != nil {
+				req.Body.Close()
+			}
+			return nil, errgo.New("connection reset")
+		}
+		t.puts = append(t.puts, chunk)
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func (s *suite) TestUploadArchiveWithKnownContent(c *gc.C) {
+	path := charmRepo.CharmArchivePath(c.MkDir(), "wordpress")
+	s.checkUploadArchive(c, path, "~charmers/trusty/wordpress", "cs:~charmers/trusty/wordpress-0")
+
+	transport := &archiveBodyTransport{}
+	client := csclient.New(csclient.Params{
+		URL:      s.srv.URL,
+		User:     s.serverParams.AuthUsername,
+		Password: s.serverParams.AuthPassword,
+		HTTPClient: &http.Client{
+			Transport: transport,
+		},
+	})
+	body, hash, size := archiveHashAndSize(c, path)
+	defer body.Close()
+
+	// The store already holds the archive content, so
+	// only the proof of ownership is sent.
+	id, err := csclient.UploadArchive(client, charm.MustParseReference("~bob/trusty/wordpress"), body, hash, size, -1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(id.String(), gc.Equals, "cs:~bob/trusty/wordpress-0")
+	c.Assert(transport.requests, gc.Equals, 2)
+	c.Assert(transport.bodyBytes, gc.Equals, int64(0))
+
+	_, _, resultingHash, resultingSize, err := s.client.GetArchive(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resultingHash, gc.Equals, hash)
+	c.Assert(resultingSize, gc.Equals, size)
+}
+
+// archiveBodyTransport is an http.RoundTripper that records
+// the number of archive upload requests sent to the server
+// and the total size of their bodies.
+type archiveBodyTransport struct {
+	requests  int
+	bodyBytes int64
+}
+
+func (t *archiveBodyTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if strings.HasSuffix(req.URL.Path, "/archive") {
+		t.requests++
+		if req.ContentLength > 0 {
+			t.bodyBytes += req.ContentLength
+		}
+	}
+	return http.DefaultTransport.RoundTrip(req)
+}
+
 func (s *suite) TestUploadCharmDir(c *gc.C) {
 	ch := charmRepo.CharmDir("wordpress")
 	id, err := s.client.UploadCharm(charm.MustParseReference("~charmers/utopic/wordpress"), ch)
@@ -676,6 +830,43 @@ func (s *suite) TestUploadCharmErrorArchiveTo(c *gc.C) {
 	c.Assert(id, gc.IsNil)
 }
 
+func (s *suite) TestValidateCharm(c *gc.C) {
+	id := charm.MustParseReference("~charmers/trusty/wordpress")
+	problems, err := s.client.ValidateCharm(id, charmRepo.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(problems, gc.HasLen, 0)
+
+	// The charm has not been uploaded.
+	_, err = s.client.Meta(id, nil)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *suite) TestValidateBundle(c *gc.C) {
+	problems, err := s.client.ValidateBundle(
+		charm.MustParseReference("~charmers/bundle/wordpress-simple"),
+		charmRepo.BundleArchive(c.MkDir(), "wordpress-simple"),
+	)
+	c.Assert(err, gc.IsNil)
+	c.Assert(problems, jc.DeepEquals, []*params.Error{{
+		Message: `bundle verification failed: [` +
+			`"service \"mysql\" refers to non-existent charm \"mysql\"",` +
+			`"service \"wordpress\" refers to non-existent charm \"wordpress\""]`,
+	}})
+
+	s.prepareBundleCharms(c)
+	problems, err = s.client.ValidateBundle(
+		charm.MustParseReference("~charmers/bundle/wordpress-simple"),
+		charmRepo.BundleArchive(c.MkDir(), "wordpress-simple"),
+	)
+	c.Assert(err, gc.IsNil)
+	c.Assert(problems, gc.HasLen, 0)
+}
+
+func (s *suite) TestValidateCharmWithUnwantedRevision(c *gc.C) {
+	_, err := s.client.ValidateCharm(charm.MustParseReference("~charmers/trusty/wordpress-20"), charmRepo.CharmDir("wordpress"))
+	c.Assert(err, gc.ErrorMatches, `revision specified in "cs:~charmers/trusty/wordpress-20", but should not be specified`)
+}
+
 type failingArchiverTo struct {
 	charm.Charm
 }
@@ -1291,3 +1482,117 @@ func (s *suite) TestLogin(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(result.IdRevision.Revision, gc.Equals, url.Revision)
 }
+
+func (s *suite) TestResources(c *gc.C) {
+	id := charm.MustParseReference("~charmers/utopic/wordpress-42")
+	err := s.client.UploadCharmWithRevision(id, charmRepo.CharmDir("wordpress"), -1)
+	c.Assert(err, gc.IsNil)
+
+	resources, err := s.client.ListResources(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 0)
+
+	for i, content := range []string{"first", "second"} {
+		rev, err := s.client.UploadResource(id, "data", strings.NewReader(content))
+		c.Assert(err, gc.IsNil)
+		c.Assert(rev, gc.Equals, i)
+	}
+
+	// The latest uploaded revision is linked to the charm.
+	resources, err = s.client.ListResources(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 1)
+	c.Assert(resources[0].Name, gc.Equals, "data")
+	c.Assert(resources[0].Revision, gc.Equals, 1)
+	s.checkGetResource(c, id, -1, 1, "second")
+	s.checkGetResource(c, id, 0, 0, "first")
+
+	// An earlier revision can be linked again.
+	err = s.client.LinkResource(id, "data", 0)
+	c.Assert(err, gc.IsNil)
+	s.checkGetResource(c, id, -1, 0, "first")
+
+	_, _, _, _, err = s.client.GetResource(id, "no-such", -1)
+	c.Assert(err, gc.ErrorMatches, `cannot get resource: resource "no-such" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *suite) checkGetResource(c *gc.C, id *charm.Reference, revision, expectRevision int, expectContent string) {
+	r, rev, hash, size, err := s.client.GetResource(id, "data", revision)
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+	c.Assert(rev, gc.Equals, expectRevision)
+	c.Assert(size, gc.Equals, int64(len(expectContent)))
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, expectContent)
+	c.Assert(hash, gc.Equals, fmt.Sprintf("%x", sha512.Sum384(data)))
+}
+
+func (s *suite) TestSignatures(c *gc.C) {
+	id := charm.MustParseReference("~charmers/utopic/wordpress-42")
+	err := s.client.UploadCharmWithRevision(id, charmRepo.CharmDir("wordpress"), -1)
+	c.Assert(err, gc.IsNil)
+	r, _, _, _, err := s.client.GetArchive(id)
+	c.Assert(err, gc.IsNil)
+	archive, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	policy := &csclient.TrustPolicy{
+		Keys: []crypto.PublicKey{key.Public()},
+	}
+
+	// An unsigned archive is not trusted.
+	_, _, _, _, err = s.client.GetArchiveWithOptions(id, csclient.GetArchiveOptions{
+		TrustPolicy: policy,
+	})
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/utopic/wordpress-42 is not signed`)
+	c.Assert(errgo.Cause(err), gc.Equals, csclient.ErrUntrusted)
+
+	// The archive cannot be signed until the key has been added.
+	err = s.client.SignArchive(id, "charmers", bytes.NewReader(archive), key)
+	c.Assert(err, gc.ErrorMatches, `cannot add signature: no public keys found for user "charmers"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	added, err := s.client.AddPublicKey("charmers", key.Public())
+	c.Assert(err, gc.IsNil)
+	keys, err := s.client.PublicKeys("charmers")
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Id, gc.Equals, added.Id)
+
+	// An archive that differs from the one held
+	// by the charm store is not signed.
+	err = s.client.SignArchive(id, "charmers", strings.NewReader("other"), key)
+	c.Assert(err, gc.ErrorMatches, `archive hash mismatch; local [0-9a-f]+, charm store [0-9a-f]+`)
+
+	err = s.client.SignArchive(id, "charmers", bytes.NewReader(archive), key)
+	c.Assert(err, gc.IsNil)
+
+	r, _, _, _, err = s.client.GetArchiveWithOptions(id, csclient.GetArchiveOptions{
+		TrustPolicy: policy,
+	})
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+
+	// The archive is not trusted by a policy with another key.
+	_, _, _, _, err = s.client.GetArchiveWithOptions(id, csclient.GetArchiveOptions{
+		TrustPolicy: &csclient.TrustPolicy{
+			Keys: []crypto.PublicKey{otherKey.Public()},
+		},
+	})
+	c.Assert(err, gc.ErrorMatches, `cs:~charmers/utopic/wordpress-42 has no signature verified by a trusted key`)
+	c.Assert(errgo.Cause(err), gc.Equals, csclient.ErrUntrusted)
+
+	err = s.client.RemovePublicKey("charmers", added.Id)
+	c.Assert(err, gc.IsNil)
+	keys, err = s.client.PublicKeys("charmers")
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 0)
+}
@@ -0,0 +1,103 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/macaroon-bakery.v0/httpbakery"
+
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// ListResources returns the resource revisions linked
+// to the charm with the given id, sorted by name.
+func (c *Client) ListResources(id *charm.Reference) ([]params.Resource, error) {
+	var result []params.Resource
+	if err := c.Get("/"+id.Path()+"/resources", &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot list resources", errgo.Any)
+	}
+	return result, nil
+}
+
+// UploadResource uploads the data read from r as a new revision of the
+// named resource of the charm with the given id, which must be fully
+// specified, and links the new revision to the charm. It returns the
+// new resource revision.
+func (c *Client) UploadResource(id *charm.Reference, name string, r io.ReadSeeker) (int, error) {
+	if id.Series == "" || id.Revision == -1 {
+		return 0, errgo.Newf("charm id %q is not fully specified", id)
+	}
+	hash, size, err := readerHashAndSize(r)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot make new request")
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.ContentLength = size
+	path := fmt.Sprintf("/%s/resources/%s?hash=%s", id.Path(), name, hash)
+	resp, err := c.DoWithBody(req, path, httpbakery.SeekerBody(r))
+	if err != nil {
+		return 0, errgo.NoteMask(err, "cannot upload resource", errgo.Any)
+	}
+	defer resp.Body.Close()
+	var result params.ResourceUploadResponse
+	if err := parseResponseBody(resp.Body, &result); err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return result.Revision, nil
+}
+
+// LinkResource links the given revision of the named resource
+// to the charm with the given id, which must be fully specified.
+func (c *Client) LinkResource(id *charm.Reference, name string, revision int) error {
+	return c.Put("/"+id.Path()+"/resources/"+name, params.ResourceRequest{
+		Revision: revision,
+	})
+}
+
+// GetResource retrieves the data of the given revision of the named
+// resource of the charm with the given id. If revision is -1, the
+// revision linked to the charm is retrieved. It returns a reader the
+// data can be read from, the revision of the resource, the SHA384 hash
+// of the data and its size.
+func (c *Client) GetResource(id *charm.Reference, name string, revision int) (r io.ReadCloser, rev int, hash string, size int64, err error) {
+	req, err := http.NewRequest("GET", "", nil)
+	if err != nil {
+		return nil, 0, "", 0, errgo.Notef(err, "cannot make new request")
+	}
+	path := "/" + id.Path() + "/resources/" + name
+	if revision != -1 {
+		path += "/" + strconv.Itoa(revision)
+	}
+	resp, err := c.Do(req, path)
+	if err != nil {
+		return nil, 0, "", 0, errgo.NoteMask(err, "cannot get resource", errgo.Any)
+	}
+
+	// Validate the response headers.
+	rev, err = strconv.Atoi(resp.Header.Get(params.ResourceRevisionHeader))
+	if err != nil {
+		resp.Body.Close()
+		return nil, 0, "", 0, errgo.Newf("no valid %s header found in response", params.ResourceRevisionHeader)
+	}
+	hash = resp.Header.Get(params.ContentHashHeader)
+	if hash == "" {
+		resp.Body.Close()
+		return nil, 0, "", 0, errgo.Newf("no %s header found in response", params.ContentHashHeader)
+	}
+	if resp.ContentLength < 0 {
+		resp.Body.Close()
+		return nil, 0, "", 0, errgo.Newf("no content length found in response")
+	}
+	return resp.Body, rev, hash, resp.ContentLength, nil
+}
@@ -0,0 +1,209 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/sha512"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/macaroon-bakery.v0/httpbakery"
+
+	"gopkg.in/juju/charmstore.v4/params"
+	"gopkg.in/juju/charmstore.v4/signature"
+)
+
+// ErrUntrusted is the cause of the error returned by
+// GetArchiveWithOptions when an archive is not signed in
+// accordance with the requested trust policy.
+var ErrUntrusted = errgo.New("archive not trusted")
+
+// TrustPolicy specifies the signatures that an archive
+// must have to be trusted.
+type TrustPolicy struct {
+	// Keys holds the public keys trusted to sign archives,
+	// which must be *rsa.PublicKey or *ecdsa.PublicKey values.
+	// An archive is trusted when at least one of its signatures
+	// is verified by one of the keys.
+	Keys []crypto.PublicKey
+}
+
+// GetArchiveOptions holds options for Client.GetArchiveWithOptions.
+type GetArchiveOptions struct {
+	// TrustPolicy optionally holds the policy that the
+	// signatures of the archive must satisfy.
+	TrustPolicy *TrustPolicy
+}
+
+// checkTrust checks that the archive of the entity with the given fully
+// specified id, which has the given SHA384 hash, is signed in accordance
+// with the given policy.
+func (c *Client) checkTrust(id *charm.Reference, hash string, policy *TrustPolicy) error {
+	trusted := make(map[string]crypto.PublicKey)
+	for _, key := range policy.Keys {
+		keyId, err := signature.KeyId(key)
+		if err != nil {
+			return errgo.Notef(err, "invalid trusted key")
+		}
+		trusted[keyId] = key
+	}
+	var sigs []params.Signature
+	if err := c.Get("/"+id.Path()+"/meta/signatures", &sigs); err != nil {
+		if errgo.Cause(err) == params.ErrMetadataNotFound {
+			return errgo.WithCausef(nil, ErrUntrusted, "%s is not signed", id)
+		}
+		return errgo.NoteMask(err, "cannot get signatures", errgo.Any)
+	}
+	for _, sig := range sigs {
+		key, ok := trusted[sig.KeyId]
+		if !ok {
+			continue
+		}
+		err := signature.Verify(key, hash, sig.Signature)
+		if err == nil {
+			return nil
+		}
+		if err != signature.ErrVerificationFailed {
+			return errgo.Notef(err, "cannot verify signature")
+		}
+	}
+	return errgo.WithCausef(nil, ErrUntrusted, "%s has no signature verified by a trusted key", id)
+}
+
+// hashCheckingReader checks that the data read
+// from it has the expected SHA384 hash.
+type hashCheckingReader struct {
+	io.ReadCloser
+	hash   hash.Hash
+	expect string
+}
+
+func newHashCheckingReader(r io.ReadCloser, expect string) *hashCheckingReader {
+	return &hashCheckingReader{
+		ReadCloser: r,
+		hash:       sha512.New384(),
+		expect:     expect,
+	}
+}
+
+// Read implements io.Reader.Read by reading from the underlying
+// reader. It returns an error instead of io.EOF if the data read
+// does not have the expected hash.
+func (r *hashCheckingReader) Read(buf []byte) (int, error) {
+	n, err := r.ReadCloser.Read(buf)
+	r.hash.Write(buf[0:n])
+	if err == io.EOF {
+		if hash := fmt.Sprintf("%x", r.hash.Sum(nil)); hash != r.expect {
+			return n, errgo.Newf("archive hash mismatch; got %s want %s", hash, r.expect)
+		}
+	}
+	return n, err
+}
+
+// SignArchive signs the archive of the entity with the given id, which
+// must be fully specified, with the given private key and adds the
+// signature to the entity as made by the given user. The archive
+// contents are read from the given reader and hashed locally; the
+// archive is not signed if its hash differs from the hash of the
+// archive held by the charm store. The matching public key must have
+// been added to the keys trusted for the user (see AddPublicKey).
+func (c *Client) SignArchive(id *charm.Reference, user string, archive io.Reader, key crypto.Signer) error {
+	if id.Series == "" || id.Revision == -1 {
+		return errgo.Newf("entity id %q is not fully specified", id)
+	}
+	h := sha512.New384()
+	if _, err := io.Copy(h, archive); err != nil {
+		return errgo.Notef(err, "cannot read archive")
+	}
+	localHash := fmt.Sprintf("%x", h.Sum(nil))
+	var hash params.HashResponse
+	if err := c.Get("/"+id.Path()+"/meta/hash", &hash); err != nil {
+		return errgo.NoteMask(err, "cannot get archive hash", errgo.Any)
+	}
+	if hash.Sum != localHash {
+		return errgo.Newf("archive hash mismatch; local %s, charm store %s", localHash, hash.Sum)
+	}
+	sig, err := signature.Sign(key, localHash)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := c.postJSON("/"+id.Path()+"/signatures", &params.SignatureRequest{
+		User:      user,
+		Signature: sig,
+	}, nil); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return nil
+}
+
+// AddPublicKey adds the given public key, which must be an
+// *rsa.PublicKey or an *ecdsa.PublicKey, to the keys trusted
+// to verify the signatures made by the given user.
+func (c *Client) AddPublicKey(user string, key crypto.PublicKey) (*params.PublicKey, error) {
+	data, err := signature.MarshalPublicKey(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result params.PublicKey
+	if err := c.postJSON("/keys/"+user, &params.PublicKeyRequest{
+		Key: string(data),
+	}, &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot add public key", errgo.Any)
+	}
+	return &result, nil
+}
+
+// PublicKeys returns the keys trusted to verify
+// the signatures made by the given user.
+func (c *Client) PublicKeys(user string) ([]params.PublicKey, error) {
+	var result []params.PublicKey
+	if err := c.Get("/keys/"+user, &result); err != nil {
+		return nil, errgo.NoteMask(err, "cannot get public keys", errgo.Any)
+	}
+	return result, nil
+}
+
+// RemovePublicKey removes the key with the given id from the
+// keys trusted to verify the signatures made by the given user.
+func (c *Client) RemovePublicKey(user, id string) error {
+	req, err := http.NewRequest("DELETE", "", nil)
+	if err != nil {
+		return errgo.Notef(err, "cannot make new request")
+	}
+	resp, err := c.Do(req, "/keys/"+user+"/"+id)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot remove public key", errgo.Any)
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// postJSON makes a POST request to the given path in the charm store,
+// marshaling the given value as JSON to use as the request body and
+// parsing the result as JSON into the given result value, which may
+// be nil if no result is desired.
+func (c *Client) postJSON(path string, val, result interface{}) error {
+	req, _ := http.NewRequest("POST", "", nil)
+	req.Header.Set("Content-Type", "application/json")
+	data, err := json.Marshal(val)
+	if err != nil {
+		return errgo.Notef(err, "cannot marshal POST body")
+	}
+	resp, err := c.DoWithBody(req, path, httpbakery.SeekerBody(bytes.NewReader(data)))
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	defer resp.Body.Close()
+	if err := parseResponseBody(resp.Body, result); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
@@ -0,0 +1,211 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+package csclient
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/macaroon-bakery.v0/httpbakery"
+
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// uploadChunkSize holds the size of the chunks used when
+// uploading archives. Archives larger than this are sent
+// using a resumable upload.
+var uploadChunkSize int64 = 8 * 1024 * 1024
+
+// maxUploadAttempts holds the maximum number of times
+// that sending the chunks of a resumable upload will
+// be attempted.
+const maxUploadAttempts = 5
+
+// uploadChunks sends the size bytes of data read from body to a new
+// resumable upload and returns the id of the upload.
+//
+// If sending the chunks fails because of a network error, the chunks
+// that the server has not received are sent again, up to
+// maxUploadAttempts times.
+func (c *Client) uploadChunks(body io.ReadSeeker, size int64) (string, error) {
+	req, err := http.NewRequest("POST", "", nil)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot make new request")
+	}
+	resp, err := c.Do(req, "/upload")
+	if err != nil {
+		return "", errgo.NoteMask(err, "cannot create upload", errgo.Any)
+	}
+	var upload params.NewUploadResponse
+	err = parseResponseBody(resp.Body, &upload)
+	resp.Body.Close()
+	if err != nil {
+		return "", errgo.Mask(err)
+	}
+	for attempt := 1; ; attempt++ {
+		err = c.putMissingChunks(upload.UploadId, body, size)
+		if err == nil {
+			return upload.UploadId, nil
+		}
+		if isServerError(err) || attempt >= maxUploadAttempts {
+			// The server has rejected the upload or we
+			// have run out of attempts.
+			c.removeUpload(upload.UploadId)
+			return "", errgo.Mask(err, errgo.Any)
+		}
+	}
+}
+
+// putMissingChunks sends all the chunks of the data read from body
+// that the server does not yet hold for the upload with the given id.
+func (c *Client) putMissingChunks(id string, body io.ReadSeeker, size int64) error {
+	var info params.UploadInfoResponse
+	if err := c.Get("/upload/"+id, &info); err != nil {
+		return errgo.NoteMask(err, "cannot get upload information", errgo.Any)
+	}
+	done := make(map[int]params.UploadChunk)
+	for _, chunk := range info.Chunks {
+		done[chunk.Number] = chunk
+	}
+	buf := make([]byte, uploadChunkSize)
+	for n := 0; int64(n)*uploadChunkSize < size; n++ {
+		offset := int64(n) * uploadChunkSize
+		data := buf
+		if size-offset < uploadChunkSize {
+			data = buf[0 : size-offset]
+		}
+		if _, err := body.Seek(offset, 0); err != nil {
+			return errgo.Notef(err, "cannot seek")
+		}
+		if _, err := io.ReadFull(body, data); err != nil {
+			return errgo.Notef(err, "cannot read chunk %d", n)
+		}
+		hash := fmt.Sprintf("%x", sha512.Sum384(data))
+		if chunk, ok := done[n]; ok && chunk.Size == int64(len(data)) && chunk.Hash == hash {
+			// The server already has this chunk.
+			continue
+		}
+		req, err := http.NewRequest("PUT", "", nil)
+		if err != nil {
+			return errgo.Notef(err, "cannot make new request")
+		}
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.ContentLength = int64(len(data))
+		resp, err := c.DoWithBody(
+			req,
+			"/upload/"+id+"/"+strconv.Itoa(n)+"?hash="+hash,
+			httpbakery.SeekerBody(bytes.NewReader(data)),
+		)
+		if err != nil {
+			return errgo.NoteMask(err, fmt.Sprintf("cannot put chunk %d", n), errgo.Any)
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// removeUpload discards the upload with the given id. Errors
+// are ignored because the upload will expire in time anyway.
+func (c *Client) removeUpload(id string) {
+	req, err := http.NewRequest("DELETE", "", nil)
+	if err != nil {
+		return
+	}
+	if resp, err := c.Do(req, "/upload/"+id); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// isServerError reports whether the given error was returned
+// by the charm store rather than being caused by a failure
+// to communicate with it.
+func isServerError(err error) bool {
+	switch errgo.Cause(err).(type) {
+	case *params.Error, params.ErrorCode:
+		return true
+	}
+	return false
+}
+
+// errArchiveContentRequired is returned by addExistingArchive
+// when the archive content must be sent to the charm store.
+var errArchiveContentRequired = errgo.New("archive content required")
+
+// addExistingArchive tries to add the archive at the given path
+// without sending its content, answering the content ownership
+// challenge issued by the charm store if it already holds
+// an archive with the same hash. If the content must be sent,
+// it returns an error with an errArchiveContentRequired cause.
+func (c *Client) addExistingArchive(method, path string, body io.ReadSeeker, size int64) (*charm.Reference, error) {
+	path += "&size=" + strconv.FormatInt(size, 10)
+	id, err := c.postArchiveNoBody(method, path)
+	if err == nil {
+		return id, nil
+	}
+	perr, ok := err.(*params.Error)
+	if !ok {
+		return nil, errgo.Mask(err)
+	}
+	if perr.Code != params.ErrContentChallenge {
+		// The content is unknown to the charm store, or the
+		// charm store does not support content challenges.
+		return nil, errgo.WithCausef(err, errArchiveContentRequired, "")
+	}
+	challenge, err := params.ContentChallengeFromError(perr)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read content challenge")
+	}
+	if challenge.RangeStart < 0 || challenge.RangeLength < 0 || challenge.RangeStart+challenge.RangeLength > size {
+		return nil, errgo.Newf("content challenge range out of bounds")
+	}
+	if _, err := body.Seek(challenge.RangeStart, 0); err != nil {
+		return nil, errgo.Notef(err, "cannot seek")
+	}
+	hash := sha512.New384()
+	if _, err := io.CopyN(hash, body, challenge.RangeLength); err != nil {
+		return nil, errgo.Notef(err, "cannot read challenge range")
+	}
+	path += "&challenge-id=" + url.QueryEscape(challenge.RequestId)
+	path += "&challenge-hash=" + fmt.Sprintf("%x", hash.Sum(nil))
+	id, err = c.postArchiveNoBody(method, path)
+	if err == nil {
+		return id, nil
+	}
+	if _, ok := err.(*params.Error); ok {
+		// The content may have been removed since the
+		// challenge was issued, so fall back to sending it.
+		return nil, errgo.WithCausef(err, errArchiveContentRequired, "")
+	}
+	return nil, errgo.Mask(err)
+}
+
+// postArchiveNoBody sends an archive upload request with no body
+// to the given path and returns the resulting entity id. Errors
+// returned by the charm store are returned unchanged.
+func (c *Client) postArchiveNoBody(method, path string) (*charm.Reference, error) {
+	req, err := http.NewRequest(method, "", nil)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot make new request")
+	}
+	resp, err := c.DoWithBody(req, path, noBody)
+	if err != nil {
+		if _, ok := err.(*params.Error); ok {
+			return nil, err
+		}
+		return nil, errgo.Notef(err, "cannot post archive")
+	}
+	defer resp.Body.Close()
+	var result params.ArchiveUploadResponse
+	if err := parseResponseBody(resp.Body, &result); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result.Id, nil
+}
@@ -8,14 +8,20 @@ import (
 	"fmt"
 	"hash"
 	"io"
+	"path"
 	"strconv"
 
 	"github.com/juju/blobstore"
 	"github.com/juju/errors"
+	"github.com/juju/loggo"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
 )
 
+var logger = loggo.GetLogger("charmstore.internal.blobstore")
+
+// ReadSeekCloser is the type of a blob opened for reading.
 type ReadSeekCloser interface {
 	io.Reader
 	io.Seeker
@@ -76,22 +82,53 @@ func NewContentChallengeResponse(chal *ContentChallenge, r io.ReadSeeker) (*Cont
 	}, nil
 }
 
-// Store stores data blobs in mongodb, de-duplicating by
+// Store is the interface implemented by blob storage
+// backends.
+type Store interface {
+	// Put tries to stream the content from the given reader into blob
+	// storage, with the provided name. The content should have the
+	// given size and hash. If the content is already in the store, an
+	// implementation may return a ContentChallenge that must be
+	// satisfied by a client to prove that they have access to the
+	// content. If the proof has already been acquired, it should be
+	// passed in as the proof argument.
+	Put(r io.Reader, name string, size int64, hash string, proof *ContentChallengeResponse) (*ContentChallenge, error)
+
+	// PutUnchallenged streams the content from the given reader into
+	// blob storage, with the provided name. The content should have
+	// the given size and hash. In this case a challenge is never
+	// returned and a proof is not required.
+	PutUnchallenged(r io.Reader, name string, size int64, hash string) error
+
+	// Open opens the entry with the given name, returning
+	// its contents and its size.
+	Open(name string) (ReadSeekCloser, int64, error)
+
+	// Remove removes the entry with the given name.
+	Remove(name string) error
+
+	// List returns the names of all the entries in the store.
+	List() ([]string, error)
+}
+
+// mongoStore stores data blobs in mongodb, de-duplicating by
 // blob hash.
-type Store struct {
+type mongoStore struct {
+	db     *mgo.Database
 	mstore blobstore.ManagedStorage
 }
 
 // New returns a new blob store that writes to the given database,
 // prefixing its collections with the given prefix.
-func New(db *mgo.Database, prefix string) *Store {
+func New(db *mgo.Database, prefix string) Store {
 	rs := blobstore.NewGridFS(db.Name, prefix, db.Session)
-	return &Store{
+	return &mongoStore{
+		db:     db,
 		mstore: blobstore.NewManagedStorage(db, rs),
 	}
 }
 
-func (s *Store) challengeResponse(resp *ContentChallengeResponse) error {
+func (s *mongoStore) challengeResponse(resp *ContentChallengeResponse) error {
 	id, err := strconv.ParseInt(resp.RequestId, 10, 64)
 	if err != nil {
 		return errgo.Newf("invalid request id %q", id)
@@ -99,14 +136,10 @@ func (s *Store) challengeResponse(resp *ContentChallengeResponse) error {
 	return s.mstore.ProofOfAccessResponse(blobstore.NewPutResponse(id, resp.Hash))
 }
 
-// Put tries to stream the content from the given reader into blob
-// storage, with the provided name. The content should have the given
-// size and hash. If the content is already in the store, a
-// ContentChallengeError is returned containing a challenge that must be
-// satisfied by a client to prove that they have access to the content.
-// If the proof has already been acquired, it should be passed in as the
-// proof argument.
-func (s *Store) Put(r io.Reader, name string, size int64, hash string, proof *ContentChallengeResponse) (*ContentChallenge, error) {
+// Put implements Store.Put. Content is de-duplicated
+// by hash, so if the content is already in the store,
+// a challenge is returned.
+func (s *mongoStore) Put(r io.Reader, name string, size int64, hash string, proof *ContentChallengeResponse) (*ContentChallenge, error) {
 	if proof != nil {
 		err := s.challengeResponse(proof)
 		if err == nil {
@@ -136,16 +169,13 @@ func (s *Store) Put(r io.Reader, name string, size int64, hash string, proof *Co
 	}, nil
 }
 
-// PutUnchallenged stream the content from the given reader into blob
-// storage, with the provided name. The content should have the given
-// size and hash. In this case a challenge is never returned and a proof
-// is not required.
-func (s *Store) PutUnchallenged(r io.Reader, name string, size int64, hash string) error {
+// PutUnchallenged implements Store.PutUnchallenged.
+func (s *mongoStore) PutUnchallenged(r io.Reader, name string, size int64, hash string) error {
 	return s.mstore.PutForEnvironmentAndCheckHash("", name, r, size, hash)
 }
 
-// Open opens the entry with the given name.
-func (s *Store) Open(name string) (ReadSeekCloser, int64, error) {
+// Open implements Store.Open.
+func (s *mongoStore) Open(name string) (ReadSeekCloser, int64, error) {
 	r, length, err := s.mstore.GetForEnvironment("", name)
 	if err != nil {
 		return nil, 0, errgo.Mask(err)
@@ -153,7 +183,31 @@ func (s *Store) Open(name string) (ReadSeekCloser, int64, error) {
 	return r.(ReadSeekCloser), length, nil
 }
 
-// Remove the given name from the Store.
-func (s *Store) Remove(name string) error {
+// Remove implements Store.Remove.
+func (s *mongoStore) Remove(name string) error {
 	return s.mstore.RemoveForEnvironment("", name)
 }
+
+// managedResourcesCollection holds the name of the collection
+// used by the managed storage to record the stored entries.
+const managedResourcesCollection = "managedStoredResources"
+
+// List implements Store.List.
+func (s *mongoStore) List() ([]string, error) {
+	session := s.db.Session.Copy()
+	defer session.Close()
+	iter := s.db.With(session).C(managedResourcesCollection).Find(nil).Select(bson.D{{"path", 1}}).Iter()
+	var names []string
+	var doc struct {
+		Path string `bson:"path"`
+	}
+	for iter.Next(&doc) {
+		// The managed storage prefixes each name with
+		// the environment path, so strip it off.
+		names = append(names, path.Base(doc.Path))
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot list blobs")
+	}
+	return names, nil
+}
@@ -7,11 +7,13 @@ import (
 	"fmt"
 	"io"
 	"io/ioutil"
+	"sort"
 	"strconv"
 	"strings"
 	"testing"
 
 	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
 
 	"gopkg.in/juju/charmstore.v4/internal/blobstore"
@@ -138,6 +140,25 @@ func (s *BlobStoreSuite) TestLarge(c *gc.C) {
 	c.Assert(hashOfReader(c, rc), gc.Equals, hash)
 }
 
+func (s *BlobStoreSuite) TestList(c *gc.C) {
+	store := blobstore.New(s.Session.DB("db"), "blobstore")
+	names, err := store.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 0)
+
+	for _, name := range []string{"x", "y", "z"} {
+		err := store.PutUnchallenged(strings.NewReader(name), name, 1, hashOf(name))
+		c.Assert(err, gc.IsNil)
+	}
+	err = store.Remove("y")
+	c.Assert(err, gc.IsNil)
+
+	names, err = store.List()
+	c.Assert(err, gc.IsNil)
+	sort.Strings(names)
+	c.Assert(names, jc.DeepEquals, []string{"x", "z"})
+}
+
 func hashOfReader(c *gc.C, r io.Reader) string {
 	h := blobstore.NewHash()
 	_, err := io.Copy(h, r)
@@ -0,0 +1,31 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+
+	"gopkg.in/juju/charmstore.v4/config"
+)
+
+// NewFromConfig returns the blob store selected by the given
+// configuration. The MongoDB store uses the given database.
+func NewFromConfig(db *mgo.Database, conf *config.Config) (Store, error) {
+	switch conf.BlobStore {
+	case "", config.BlobStoreMongoDB:
+		return New(db, "entitystore"), nil
+	case config.BlobStoreFilesystem:
+		return NewFilesystem(conf.BlobStorePath)
+	case config.BlobStoreS3:
+		return NewS3(S3Params{
+			Endpoint:  conf.S3Endpoint,
+			Region:    conf.S3Region,
+			Bucket:    conf.S3Bucket,
+			AccessKey: conf.S3AccessKey,
+			SecretKey: conf.S3SecretKey,
+		})
+	}
+	return nil, errgo.Newf("unknown blob store type %q", conf.BlobStore)
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+)
+
+// fileStore stores data blobs as files in a local directory.
+type fileStore struct {
+	dir string
+}
+
+// NewFilesystem returns a new blob store that keeps
+// each blob in a file inside the given directory,
+// which is created if it does not already exist.
+//
+// Blobs are not de-duplicated, so Put never
+// returns a content challenge.
+func NewFilesystem(dir string) (Store, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errgo.Notef(err, "cannot create blob store directory")
+	}
+	return &fileStore{
+		dir: dir,
+	}, nil
+}
+
+// Put implements Store.Put.
+func (s *fileStore) Put(r io.Reader, name string, size int64, hash string, proof *ContentChallengeResponse) (*ContentChallenge, error) {
+	if err := s.PutUnchallenged(r, name, size, hash); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return nil, nil
+}
+
+// PutUnchallenged implements Store.PutUnchallenged.
+func (s *fileStore) PutUnchallenged(r io.Reader, name string, size int64, hash string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	// Write the content to a temporary file first so that
+	// a partially written or corrupt blob is never visible.
+	f, err := ioutil.TempFile(s.dir, ".tmp-")
+	if err != nil {
+		return errgo.Notef(err, "cannot create temporary file")
+	}
+	defer func() {
+		if f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	cr := newCheckReader(r)
+	if _, err := io.Copy(f, cr); err != nil {
+		return errgo.Notef(err, "cannot write blob")
+	}
+	if err := cr.check(size, hash); err != nil {
+		return errgo.Mask(err)
+	}
+	if err := f.Close(); err != nil {
+		return errgo.Notef(err, "cannot write blob")
+	}
+	if err := os.Rename(f.Name(), path); err != nil {
+		return errgo.Notef(err, "cannot rename blob")
+	}
+	f = nil
+	return nil
+}
+
+// Open implements Store.Open.
+func (s *fileStore) Open(name string) (ReadSeekCloser, int64, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, 0, notFoundError(name)
+	}
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, errgo.Mask(err)
+	}
+	return f, info.Size(), nil
+}
+
+// Remove implements Store.Remove.
+func (s *fileStore) Remove(name string) error {
+	path, err := s.path(name)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	err = os.Remove(path)
+	if os.IsNotExist(err) {
+		return notFoundError(name)
+	}
+	return errgo.Mask(err)
+}
+
+// List implements Store.List.
+func (s *fileStore) List() ([]string, error) {
+	infos, err := ioutil.ReadDir(s.dir)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot list blobs")
+	}
+	names := make([]string, 0, len(infos))
+	for _, info := range infos {
+		// Ignore temporary files.
+		if strings.HasPrefix(info.Name(), ".") || info.IsDir() {
+			continue
+		}
+		names = append(names, info.Name())
+	}
+	return names, nil
+}
+
+// path returns the path of the file holding the blob with
+// the given name.
+func (s *fileStore) path(name string) (string, error) {
+	if name == "" || strings.HasPrefix(name, ".") || strings.ContainsAny(name, `/\`) {
+		return "", errgo.Newf("invalid blob name %q", name)
+	}
+	return filepath.Join(s.dir, name), nil
+}
+
+// notFoundError returns the error returned when the
+// blob with the given name does not exist.
+func notFoundError(name string) error {
+	return errgo.Newf("resource at path %q not found", name)
+}
+
+// checkReader wraps a reader, keeping track of the
+// size and hash of the data read through it.
+type checkReader struct {
+	r    io.Reader
+	hash hash.Hash
+	n    int64
+}
+
+func newCheckReader(r io.Reader) *checkReader {
+	return &checkReader{
+		r:    r,
+		hash: NewHash(),
+	}
+}
+
+// Read implements io.Reader.
+func (r *checkReader) Read(buf []byte) (int, error) {
+	n, err := r.r.Read(buf)
+	r.hash.Write(buf[0:n])
+	r.n += int64(n)
+	return n, err
+}
+
+// check checks that the data read so far has
+// the given size and hash.
+func (r *checkReader) check(size int64, hash string) error {
+	if r.n != size {
+		return errgo.Newf("size mismatch")
+	}
+	if fmt.Sprintf("%x", r.hash.Sum(nil)) != hash {
+		return errgo.Newf("hash mismatch")
+	}
+	return nil
+}
@@ -0,0 +1,133 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
+)
+
+type FilesystemSuite struct {
+	jujutesting.IsolationSuite
+	dir   string
+	store blobstore.Store
+}
+
+var _ = gc.Suite(&FilesystemSuite{})
+
+func (s *FilesystemSuite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.dir = filepath.Join(c.MkDir(), "blobs")
+	store, err := blobstore.NewFilesystem(s.dir)
+	c.Assert(err, gc.IsNil)
+	s.store = store
+}
+
+func (s *FilesystemSuite) TestPutOpen(c *gc.C) {
+	content := "some data"
+	chal, err := s.store.Put(strings.NewReader(content), "x", int64(len(content)), hashOf(content), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(chal, gc.IsNil)
+
+	rc, length, err := s.store.Open("x")
+	c.Assert(err, gc.IsNil)
+	defer rc.Close()
+	c.Assert(length, gc.Equals, int64(len(content)))
+
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, content)
+
+	// Putting the resource again never generates a challenge.
+	chal, err = s.store.Put(strings.NewReader(content), "y", int64(len(content)), hashOf(content), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(chal, gc.IsNil)
+}
+
+func (s *FilesystemSuite) TestPutInvalidHash(c *gc.C) {
+	content := "some data"
+	err := s.store.PutUnchallenged(strings.NewReader(content), "x", int64(len(content)), hashOf("wrong"))
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+
+	rc, length, err := s.store.Open("x")
+	c.Assert(err, gc.ErrorMatches, `resource at path "x" not found`)
+	c.Assert(rc, gc.Equals, nil)
+	c.Assert(length, gc.Equals, int64(0))
+
+	// No temporary files should be left behind.
+	infos, err := ioutil.ReadDir(s.dir)
+	c.Assert(err, gc.IsNil)
+	c.Assert(infos, gc.HasLen, 0)
+}
+
+func (s *FilesystemSuite) TestPutInvalidSize(c *gc.C) {
+	content := "some data"
+	err := s.store.PutUnchallenged(strings.NewReader(content), "x", int64(len(content))+1, hashOf(content))
+	c.Assert(err, gc.ErrorMatches, "size mismatch")
+}
+
+func (s *FilesystemSuite) TestInvalidName(c *gc.C) {
+	content := "some data"
+	for _, name := range []string{"", ".x", "../x", "x/y"} {
+		err := s.store.PutUnchallenged(strings.NewReader(content), name, int64(len(content)), hashOf(content))
+		c.Assert(err, gc.ErrorMatches, `invalid blob name ".*"`)
+	}
+}
+
+func (s *FilesystemSuite) TestRemove(c *gc.C) {
+	content := "some data"
+	err := s.store.PutUnchallenged(strings.NewReader(content), "x", int64(len(content)), hashOf(content))
+	c.Assert(err, gc.IsNil)
+	_, err = os.Stat(filepath.Join(s.dir, "x"))
+	c.Assert(err, gc.IsNil)
+
+	err = s.store.Remove("x")
+	c.Assert(err, gc.IsNil)
+
+	_, _, err = s.store.Open("x")
+	c.Assert(err, gc.ErrorMatches, `resource at path "x" not found`)
+
+	err = s.store.Remove("x")
+	c.Assert(err, gc.ErrorMatches, `resource at path "x" not found`)
+}
+
+func (s *FilesystemSuite) TestLarge(c *gc.C) {
+	size := int64(20 * 1024 * 1024)
+	hash := hashOfReader(c, newDataSource(123, size))
+
+	err := s.store.PutUnchallenged(newDataSource(123, size), "x", size, hash)
+	c.Assert(err, gc.IsNil)
+
+	rc, length, err := s.store.Open("x")
+	c.Assert(err, gc.IsNil)
+	defer rc.Close()
+	c.Assert(length, gc.Equals, size)
+	c.Assert(hashOfReader(c, rc), gc.Equals, hash)
+}
+
+func (s *FilesystemSuite) TestList(c *gc.C) {
+	names, err := s.store.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 0)
+
+	for _, name := range []string{"z", "x", "y"} {
+		err := s.store.PutUnchallenged(strings.NewReader(name), name, 1, hashOf(name))
+		c.Assert(err, gc.IsNil)
+	}
+	// Temporary files are ignored.
+	err = ioutil.WriteFile(filepath.Join(s.dir, ".tmp-123"), nil, 0666)
+	c.Assert(err, gc.IsNil)
+
+	names, err = s.store.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, jc.DeepEquals, []string{"x", "y", "z"})
+}
@@ -0,0 +1,356 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+)
+
+// S3Params holds the parameters for a blob store
+// backed by an S3-compatible object storage service.
+type S3Params struct {
+	// Endpoint holds the base URL of the service,
+	// for example https://s3.amazonaws.com.
+	// Objects are addressed using path-style URLs
+	// relative to this endpoint.
+	Endpoint string
+
+	// Region holds the region used to sign requests.
+	// If it is empty, "us-east-1" is used.
+	Region string
+
+	// Bucket holds the name of the bucket that holds
+	// the blobs. The bucket must already exist.
+	Bucket string
+
+	// AccessKey and SecretKey hold the credentials
+	// used to sign requests.
+	AccessKey string
+	SecretKey string
+
+	// Client holds the HTTP client used to make requests.
+	// If it is nil, http.DefaultClient is used.
+	Client *http.Client
+}
+
+// s3Store stores data blobs as objects in an
+// S3-compatible object storage service.
+type s3Store struct {
+	params S3Params
+	client *http.Client
+}
+
+// NewS3 returns a new blob store that keeps each blob as an
+// object in an S3-compatible object storage service.
+//
+// Blobs are not de-duplicated, so Put never
+// returns a content challenge.
+func NewS3(p S3Params) (Store, error) {
+	if p.Endpoint == "" {
+		return nil, errgo.New("no S3 endpoint specified")
+	}
+	if p.Bucket == "" {
+		return nil, errgo.New("no S3 bucket specified")
+	}
+	if _, err := url.Parse(p.Endpoint); err != nil {
+		return nil, errgo.Notef(err, "invalid S3 endpoint")
+	}
+	p.Endpoint = strings.TrimSuffix(p.Endpoint, "/")
+	if p.Region == "" {
+		p.Region = "us-east-1"
+	}
+	client := p.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	return &s3Store{
+		params: p,
+		client: client,
+	}, nil
+}
+
+// Put implements Store.Put.
+func (s *s3Store) Put(r io.Reader, name string, size int64, hash string, proof *ContentChallengeResponse) (*ContentChallenge, error) {
+	if err := s.PutUnchallenged(r, name, size, hash); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return nil, nil
+}
+
+// PutUnchallenged implements Store.PutUnchallenged.
+func (s *s3Store) PutUnchallenged(r io.Reader, name string, size int64, hash string) error {
+	cr := newCheckReader(io.LimitReader(r, size))
+	req, err := s.newRequest("PUT", name, ioutil.NopCloser(cr))
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	req.ContentLength = size
+	resp, err := s.do(req)
+	if err != nil {
+		return errgo.Notef(err, "cannot put blob")
+	}
+	resp.Body.Close()
+	// The content is checked only after it has been sent,
+	// so remove the object if it turns out to be invalid.
+	if err := cr.check(size, hash); err != nil {
+		if err := s.Remove(name); err != nil {
+			logger.Errorf("cannot remove invalid blob %q: %v", name, err)
+		}
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// Open implements Store.Open.
+func (s *s3Store) Open(name string) (ReadSeekCloser, int64, error) {
+	req, err := s.newRequest("HEAD", name, nil)
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return nil, 0, errgo.Mask(err)
+	}
+	resp.Body.Close()
+	return &s3Reader{
+		store: s,
+		name:  name,
+		size:  resp.ContentLength,
+	}, resp.ContentLength, nil
+}
+
+// Remove implements Store.Remove.
+func (s *s3Store) Remove(name string) error {
+	req, err := s.newRequest("DELETE", name, nil)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	resp, err := s.do(req)
+	if err != nil {
+		return errgo.Notef(err, "cannot remove blob")
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// List implements Store.List.
+func (s *s3Store) List() ([]string, error) {
+	var names []string
+	marker := ""
+	for {
+		u := s.params.Endpoint + "/" + s3Escape(s.params.Bucket)
+		if marker != "" {
+			u += "?marker=" + s3Escape(marker)
+		}
+		req, err := http.NewRequest("GET", u, nil)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		resp, err := s.do(req)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot list blobs")
+		}
+		var result listBucketResult
+		err = xml.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot decode bucket listing")
+		}
+		for _, obj := range result.Contents {
+			names = append(names, obj.Key)
+		}
+		if !result.IsTruncated || len(result.Contents) == 0 {
+			return names, nil
+		}
+		marker = result.Contents[len(result.Contents)-1].Key
+	}
+}
+
+// listBucketResult holds the response to a
+// bucket listing request.
+type listBucketResult struct {
+	IsTruncated bool
+	Contents    []struct {
+		Key string
+	}
+}
+
+// newRequest returns a new request to act on the
+// object with the given name.
+func (s *s3Store) newRequest(method, name string, body io.ReadCloser) (*http.Request, error) {
+	if name == "" || strings.Contains(name, "/") {
+		return nil, errgo.Newf("invalid blob name %q", name)
+	}
+	u := s.params.Endpoint + "/" + s3Escape(s.params.Bucket) + "/" + s3Escape(name)
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if body != nil {
+		req.Body = body
+	}
+	return req, nil
+}
+
+// do signs and sends the given request. If the response
+// has an unexpected status, it is closed and an error
+// is returned.
+func (s *s3Store) do(req *http.Request) (*http.Response, error) {
+	s.sign(req, time.Now())
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	switch resp.StatusCode {
+	case http.StatusOK, http.StatusNoContent, http.StatusPartialContent:
+		return resp, nil
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, notFoundError(req.URL.Path)
+	}
+	data, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+	return nil, errgo.Newf("%s %s: %s: %s", req.Method, req.URL, resp.Status, strings.TrimSpace(string(data)))
+}
+
+const unsignedPayload = "UNSIGNED-PAYLOAD"
+
+// sign signs the given request using AWS signature version 4.
+// The payload is not included in the signature, which
+// allows the content to be streamed.
+func (s *s3Store) sign(req *http.Request, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[0:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", unsignedPayload)
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		"host:" + req.URL.Host,
+		"x-amz-content-sha256:" + unsignedPayload,
+		"x-amz-date:" + amzDate,
+		"",
+		signedHeaders,
+		unsignedPayload,
+	}, "\n")
+	scope := date + "/" + s.params.Region + "/s3/aws4_request"
+	stringToSign := strings.Join([]string{
+		"AWS4-HMAC-SHA256",
+		amzDate,
+		scope,
+		fmt.Sprintf("%x", sha256.Sum256([]byte(canonicalRequest))),
+	}, "\n")
+	key := hmacSHA256([]byte("AWS4"+s.params.SecretKey), date)
+	key = hmacSHA256(key, s.params.Region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	req.Header.Set("Authorization", fmt.Sprintf(
+		"AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%x",
+		s.params.AccessKey,
+		scope,
+		signedHeaders,
+		hmacSHA256(key, stringToSign),
+	))
+}
+
+// s3Escape URI-encodes the given path segment or query value as
+// required by AWS signature version 4, which escapes every byte
+// other than the unreserved characters of RFC 3986. The escaped
+// form is used as is in both the request and its canonical form.
+func s3Escape(s string) string {
+	var buf bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || c == '-' || c == '_' || c == '.' || c == '~' {
+			buf.WriteByte(c)
+			continue
+		}
+		fmt.Fprintf(&buf, "%%%02X", c)
+	}
+	return buf.String()
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Reader implements ReadSeekCloser by making ranged
+// GET requests for an object.
+type s3Reader struct {
+	store  *s3Store
+	name   string
+	size   int64
+	offset int64
+	body   io.ReadCloser
+}
+
+// Read implements io.Reader.
+func (r *s3Reader) Read(buf []byte) (int, error) {
+	if r.offset >= r.size {
+		return 0, io.EOF
+	}
+	if r.body == nil {
+		req, err := r.store.newRequest("GET", r.name, nil)
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", r.offset))
+		resp, err := r.store.do(req)
+		if err != nil {
+			return 0, errgo.Mask(err)
+		}
+		r.body = resp.Body
+	}
+	n, err := r.body.Read(buf)
+	r.offset += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (r *s3Reader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += r.offset
+	case 2:
+		offset += r.size
+	default:
+		return 0, errgo.Newf("invalid whence %d", whence)
+	}
+	if offset < 0 {
+		return 0, errgo.Newf("negative seek offset")
+	}
+	if offset != r.offset && r.body != nil {
+		r.body.Close()
+		r.body = nil
+	}
+	r.offset = offset
+	return offset, nil
+}
+
+// Close implements io.Closer.
+func (r *s3Reader) Close() error {
+	if r.body == nil {
+		return nil
+	}
+	err := r.body.Close()
+	r.body = nil
+	return err
+}
@@ -0,0 +1,230 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package blobstore_test
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	jujutesting "github.com/juju/testing"
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
+)
+
+type S3Suite struct {
+	jujutesting.IsolationSuite
+	server *fakeS3
+	srv    *httptest.Server
+	store  blobstore.Store
+}
+
+var _ = gc.Suite(&S3Suite{})
+
+func (s *S3Suite) SetUpTest(c *gc.C) {
+	s.IsolationSuite.SetUpTest(c)
+	s.server = &fakeS3{
+		objects: make(map[string][]byte),
+	}
+	s.srv = httptest.NewServer(s.server)
+	store, err := blobstore.NewS3(blobstore.S3Params{
+		Endpoint:  s.srv.URL,
+		Bucket:    "bucket",
+		AccessKey: "access",
+		SecretKey: "secret",
+	})
+	c.Assert(err, gc.IsNil)
+	s.store = store
+}
+
+func (s *S3Suite) TearDownTest(c *gc.C) {
+	s.srv.Close()
+	s.IsolationSuite.TearDownTest(c)
+}
+
+func (s *S3Suite) TestNewS3Error(c *gc.C) {
+	_, err := blobstore.NewS3(blobstore.S3Params{Bucket: "bucket"})
+	c.Assert(err, gc.ErrorMatches, "no S3 endpoint specified")
+	_, err = blobstore.NewS3(blobstore.S3Params{Endpoint: s.srv.URL})
+	c.Assert(err, gc.ErrorMatches, "no S3 bucket specified")
+}
+
+func (s *S3Suite) TestPutOpen(c *gc.C) {
+	content := "some data"
+	chal, err := s.store.Put(strings.NewReader(content), "x", int64(len(content)), hashOf(content), nil)
+	c.Assert(err, gc.IsNil)
+	c.Assert(chal, gc.IsNil)
+	c.Assert(string(s.server.objects["/bucket/x"]), gc.Equals, content)
+
+	rc, length, err := s.store.Open("x")
+	c.Assert(err, gc.IsNil)
+	defer rc.Close()
+	c.Assert(length, gc.Equals, int64(len(content)))
+
+	data, err := ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, content)
+
+	// Check that seeking works.
+	_, err = rc.Seek(5, 0)
+	c.Assert(err, gc.IsNil)
+	data, err = ioutil.ReadAll(rc)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "data")
+}
+
+func (s *S3Suite) TestPutInvalidHash(c *gc.C) {
+	content := "some data"
+	err := s.store.PutUnchallenged(strings.NewReader(content), "x", int64(len(content)), hashOf("wrong"))
+	c.Assert(err, gc.ErrorMatches, "hash mismatch")
+	c.Assert(s.server.objects, gc.HasLen, 0)
+
+	_, _, err = s.store.Open("x")
+	c.Assert(err, gc.ErrorMatches, `resource at path "/bucket/x" not found`)
+}
+
+func (s *S3Suite) TestRemove(c *gc.C) {
+	content := "some data"
+	err := s.store.PutUnchallenged(strings.NewReader(content), "x", int64(len(content)), hashOf(content))
+	c.Assert(err, gc.IsNil)
+
+	err = s.store.Remove("x")
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.server.objects, gc.HasLen, 0)
+
+	_, _, err = s.store.Open("x")
+	c.Assert(err, gc.ErrorMatches, `resource at path "/bucket/x" not found`)
+}
+
+func (s *S3Suite) TestRequestsAreSigned(c *gc.C) {
+	content := "some data"
+	err := s.store.PutUnchallenged(strings.NewReader(content), "x", int64(len(content)), hashOf(content))
+	c.Assert(err, gc.IsNil)
+	c.Assert(s.server.lastAuth, gc.Matches, `AWS4-HMAC-SHA256 Credential=access/[0-9]{8}/us-east-1/s3/aws4_request, SignedHeaders=host;x-amz-content-sha256;x-amz-date, Signature=[0-9a-f]{64}`)
+}
+
+func (s *S3Suite) TestServerError(c *gc.C) {
+	s.server.fail = true
+	content := "some data"
+	err := s.store.PutUnchallenged(strings.NewReader(content), "x", int64(len(content)), hashOf(content))
+	c.Assert(err, gc.ErrorMatches, `cannot put blob: PUT .*/bucket/x: 500 Internal Server Error: failed`)
+}
+
+func (s *S3Suite) TestList(c *gc.C) {
+	names, err := s.store.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 0)
+
+	for _, name := range []string{"z", "x", "y"} {
+		err := s.store.PutUnchallenged(strings.NewReader(name), name, 1, hashOf(name))
+		c.Assert(err, gc.IsNil)
+	}
+	// The fake server returns at most two objects in each
+	// response, so this checks that the listing is paged.
+	names, err = s.store.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, jc.DeepEquals, []string{"x", "y", "z"})
+}
+
+func (s *S3Suite) TestNamesAreEscaped(c *gc.C) {
+	name := "a b+c"
+	err := s.store.PutUnchallenged(strings.NewReader(name), name, int64(len(name)), hashOf(name))
+	c.Assert(err, gc.IsNil)
+	// Spaces must be encoded as %20 rather than "+" in the
+	// canonical path used to sign the request.
+	c.Assert(s.server.lastURI, gc.Equals, "/bucket/a%20b%2Bc")
+
+	r, _, err := s.store.Open(name)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(r)
+	r.Close()
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, name)
+
+	names, err := s.store.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, jc.DeepEquals, []string{name})
+}
+
+// fakeS3 implements a minimal in-memory S3 service.
+type fakeS3 struct {
+	mu       sync.Mutex
+	objects  map[string][]byte
+	lastAuth string
+	lastURI  string
+	fail     bool
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lastAuth = req.Header.Get("Authorization")
+	s.lastURI = req.RequestURI
+	if s.fail {
+		http.Error(w, "failed", http.StatusInternalServerError)
+		return
+	}
+	switch req.Method {
+	case "PUT":
+		data, err := ioutil.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.objects[req.URL.Path] = data
+	case "HEAD", "GET":
+		if req.URL.Path == "/bucket" {
+			s.serveList(w, req)
+			return
+		}
+		data, ok := s.objects[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		start := 0
+		if r := req.Header.Get("Range"); r != "" {
+			start, _ = strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(r, "bytes="), "-"))
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(data)-1, len(data)))
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)-start))
+		if req.Method == "GET" {
+			w.Write(data[start:])
+		}
+	case "DELETE":
+		delete(s.objects, req.URL.Path)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "bad method", http.StatusMethodNotAllowed)
+	}
+}
+
+// serveList serves a bucket listing, returning at most
+// two objects at a time.
+func (s *fakeS3) serveList(w http.ResponseWriter, req *http.Request) {
+	var keys []string
+	for path := range s.objects {
+		key := strings.TrimPrefix(path, "/bucket/")
+		if key > req.URL.Query().Get("marker") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	truncated := len(keys) > 2
+	if truncated {
+		keys = keys[0:2]
+	}
+	fmt.Fprintf(w, "<ListBucketResult><IsTruncated>%v</IsTruncated>", truncated)
+	for _, key := range keys {
+		fmt.Fprintf(w, "<Contents><Key>%s</Key></Contents>", key)
+	}
+	fmt.Fprintf(w, "</ListBucketResult>")
+}
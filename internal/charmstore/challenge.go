@@ -0,0 +1,57 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// contentChallengeExpiry holds the length of time for which
+// a content challenge can be answered.
+var contentChallengeExpiry = 15 * time.Minute
+
+// AddContentChallenge records a content challenge made by the blob
+// store, with the given request id, for the blob with the given name
+// holding content with the given hash and size. It returns the id of
+// the challenge to be sent to the client.
+func (s *Store) AddContentChallenge(blobName, requestId, hash string, size int64) (string, error) {
+	chal := &mongodoc.ContentChallenge{
+		Id:        bson.NewObjectId().Hex(),
+		BlobName:  blobName,
+		RequestId: requestId,
+		Hash:      hash,
+		Size:      size,
+		Expires:   time.Now().Add(contentChallengeExpiry),
+	}
+	if err := s.DB.ContentChallenges().Insert(chal); err != nil {
+		return "", errgo.Notef(err, "cannot add content challenge")
+	}
+	return chal.Id, nil
+}
+
+// TakeContentChallenge removes and returns the unexpired content
+// challenge with the given id, so that a challenge can be answered
+// only once. If there is no such challenge, it returns an error with
+// a params.ErrNotFound cause.
+func (s *Store) TakeContentChallenge(id string) (*mongodoc.ContentChallenge, error) {
+	var chal mongodoc.ContentChallenge
+	_, err := s.DB.ContentChallenges().Find(bson.D{
+		{"_id", id},
+		{"expires", bson.D{{"$gt", time.Now()}}},
+	}).Apply(mgo.Change{Remove: true}, &chal)
+	if err == mgo.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "content challenge %q not found", id)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get content challenge %q", id)
+	}
+	return &chal, nil
+}
@@ -0,0 +1,50 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+func (s *StoreSuite) TestContentChallenge(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id, err := store.AddContentChallenge("blob", "42", "hash", 10)
+	c.Assert(err, gc.IsNil)
+
+	chal, err := store.TakeContentChallenge(id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(chal.Id, gc.Equals, id)
+	c.Assert(chal.BlobName, gc.Equals, "blob")
+	c.Assert(chal.RequestId, gc.Equals, "42")
+	c.Assert(chal.Hash, gc.Equals, "hash")
+	c.Assert(chal.Size, gc.Equals, int64(10))
+
+	// A challenge can be taken only once.
+	_, err = store.TakeContentChallenge(id)
+	c.Assert(err, gc.ErrorMatches, `content challenge ".*" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestContentChallengeExpiry(c *gc.C) {
+	s.PatchValue(&contentChallengeExpiry, -time.Second)
+	store := s.newStore(c, false)
+	defer store.Close()
+	id, err := store.AddContentChallenge("blob", "42", "hash", 10)
+	c.Assert(err, gc.IsNil)
+	_, err = store.TakeContentChallenge(id)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Expired challenges are removed by the garbage collector.
+	_, err = store.CollectBlobGarbage(BlobGCParams{})
+	c.Assert(err, gc.IsNil)
+	n, err := store.DB.ContentChallenges().Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
@@ -0,0 +1,149 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// ValidChannel reports whether the given channel is known.
+func ValidChannel(channel params.Channel) bool {
+	switch channel {
+	case params.UnpublishedChannel, params.DevelopmentChannel, params.StableChannel:
+		return true
+	}
+	return false
+}
+
+// channelFilter returns a query document that matches the
+// entities published in the given channel.
+func channelFilter(channel params.Channel) (bson.D, error) {
+	switch channel {
+	case params.UnpublishedChannel:
+		return nil, nil
+	case params.DevelopmentChannel:
+		return bson.D{{"development", true}}, nil
+	case params.StableChannel:
+		return bson.D{{"stable", true}}, nil
+	}
+	return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", channel)
+}
+
+// notYankedFilter matches entities that have not been yanked.
+var notYankedFilter = bson.DocElem{"deprecation.yanked", bson.D{{"$ne", true}}}
+
+// ChannelEntitiesQuery is like EntitiesQuery except that, unless
+// the given URL specifies both series and revision, the returned
+// query only matches entities published in the given channel
+// that have not been yanked.
+func (s *Store) ChannelEntitiesQuery(url *charm.Reference, channel params.Channel) (*mgo.Query, error) {
+	filter, err := channelFilter(channel)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	if url.Series != "" && url.Revision != -1 {
+		// A specific revision can always be found,
+		// whether it has been published or yanked or not.
+		return s.EntitiesQuery(url), nil
+	}
+	q := append(entitiesFilter(url), filter...)
+	q = append(q, notYankedFilter)
+	return s.DB.Entities().Find(q), nil
+}
+
+// setPublished marks the given entity as published in the given
+// channel at the given time. An empty channel or
+// params.UnpublishedChannel leaves the entity unchanged.
+func setPublished(e *mongodoc.Entity, channel params.Channel, t time.Time) error {
+	switch channel {
+	case "", params.UnpublishedChannel:
+		return nil
+	case params.StableChannel:
+		e.Stable = true
+		e.StablePublishTime = t
+		fallthrough
+	case params.DevelopmentChannel:
+		e.Development = true
+		e.DevelopmentPublishTime = t
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrBadRequest, "invalid channel %q", channel)
+}
+
+// Publish publishes the entity with the given id in the given channel,
+// which must be either params.DevelopmentChannel or
+// params.StableChannel. An entity published in the stable channel is
+// also published in the development channel. Publishing an entity
+// again in the same channel has no effect.
+func (s *Store) Publish(id *router.ResolvedURL, channel params.Channel) error {
+	if channel != params.DevelopmentChannel && channel != params.StableChannel {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "cannot publish in %q channel", channel)
+	}
+	entity, err := s.FindEntity(id, "development", "stable")
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	now := time.Now()
+	var update bson.D
+	if !entity.Development {
+		update = append(update, bson.DocElem{"development", true}, bson.DocElem{"developmentpublishtime", now})
+	}
+	if channel == params.StableChannel && !entity.Stable {
+		update = append(update, bson.DocElem{"stable", true}, bson.DocElem{"stablepublishtime", now})
+	}
+	if len(update) == 0 {
+		return nil
+	}
+	if err := s.DB.Entities().UpdateId(&id.URL, bson.D{{"$set", update}, incModifications}); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "entity not found")
+		}
+		return errgo.Notef(err, "cannot publish %s", id)
+	}
+	if err := s.UpdateSearch(id); err != nil {
+		return errgo.Notef(err, "cannot update search record for %s", id)
+	}
+	if err := s.AddEvent(&mongodoc.Event{
+		Kind:          string(params.EventPublish),
+		Id:            &id.URL,
+		PromulgatedId: id.PromulgatedURL(),
+		Channel:       string(channel),
+	}); err != nil {
+		return errgo.Notef(err, "cannot record publish event for %s", id)
+	}
+	return nil
+}
+
+// latestSeriesEntity returns the latest revision published in the given
+// channel of the entity with the user, name and series of the given URL.
+// Yanked revisions are ignored.
+func (s *Store) latestSeriesEntity(url *charm.Reference, channel params.Channel) (*mongodoc.Entity, error) {
+	filter, err := channelFilter(channel)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	q := append(bson.D{
+		{"user", url.User},
+		{"name", url.Name},
+		{"series", url.Series},
+		notYankedFilter,
+	}, filter...)
+	var entity mongodoc.Entity
+	if err := s.DB.Entities().Find(q).Sort("-revision").One(&entity); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "no %s revision of %s found", channel, url)
+		}
+		return nil, errgo.Notef(err, "cannot get latest revision of %s", url)
+	}
+	return &entity, nil
+}
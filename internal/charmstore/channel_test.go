@@ -0,0 +1,212 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// addChannelCharm adds the wordpress charm to the store
+// with the given id, published in the given channel.
+func addChannelCharm(c *gc.C, store *Store, id string, channel params.Channel) *router.ResolvedURL {
+	url := newResolvedURL(id, -1)
+	err := store.AddCharm(storetesting.Charms.CharmDir("wordpress"), AddParams{
+		URL:      url,
+		BlobName: "blobName",
+		BlobHash: fakeBlobHash,
+		BlobSize: fakeBlobSize,
+		Channel:  channel,
+	})
+	c.Assert(err, gc.IsNil)
+	return url
+}
+
+func (s *StoreSuite) TestAddUnpublished(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := addChannelCharm(c, store, "~charmers/precise/wordpress-0", "")
+	entity, err := store.FindEntity(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Development, gc.Equals, false)
+	c.Assert(entity.DevelopmentPublishTime.IsZero(), gc.Equals, true)
+	c.Assert(entity.Stable, gc.Equals, false)
+	c.Assert(entity.StablePublishTime.IsZero(), gc.Equals, true)
+}
+
+func (s *StoreSuite) TestPublish(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := addChannelCharm(c, store, "~charmers/precise/wordpress-0", "")
+
+	// Publishing in the development channel does not publish
+	// in the stable channel.
+	before := time.Now()
+	err := store.Publish(url, params.DevelopmentChannel)
+	c.Assert(err, gc.IsNil)
+	after := time.Now()
+	entity, err := store.FindEntity(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Development, gc.Equals, true)
+	c.Assert(entity.DevelopmentPublishTime, jc.TimeBetween(before, after))
+	c.Assert(entity.Stable, gc.Equals, false)
+	devTime := entity.DevelopmentPublishTime
+
+	// Publishing in the stable channel leaves the development
+	// publish time unchanged.
+	before = time.Now()
+	err = store.Publish(url, params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	after = time.Now()
+	entity, err = store.FindEntity(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Development, gc.Equals, true)
+	c.Assert(entity.DevelopmentPublishTime.Equal(devTime), gc.Equals, true)
+	c.Assert(entity.Stable, gc.Equals, true)
+	c.Assert(entity.StablePublishTime, jc.TimeBetween(before, after))
+	stableTime := entity.StablePublishTime
+
+	// Publishing again has no effect.
+	err = store.Publish(url, params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	entity, err = store.FindEntity(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.StablePublishTime.Equal(stableTime), gc.Equals, true)
+}
+
+func (s *StoreSuite) TestPublishStableAlsoPublishesDevelopment(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := addChannelCharm(c, store, "~charmers/precise/wordpress-0", "")
+	err := store.Publish(url, params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	entity, err := store.FindEntity(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Development, gc.Equals, true)
+	c.Assert(entity.Stable, gc.Equals, true)
+	c.Assert(entity.DevelopmentPublishTime.Equal(entity.StablePublishTime), gc.Equals, true)
+}
+
+func (s *StoreSuite) TestPublishErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := addChannelCharm(c, store, "~charmers/precise/wordpress-0", "")
+	for _, channel := range []params.Channel{"", params.UnpublishedChannel, "bad-wolf"} {
+		err := store.Publish(url, channel)
+		c.Assert(err, gc.ErrorMatches, `cannot publish in ".*" channel`)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	}
+	err := store.Publish(newResolvedURL("~charmers/precise/no-such-0", -1), params.StableChannel)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+var findBestEntityChannelTests = []struct {
+	url       string
+	channel   params.Channel
+	expectURL string
+	expectErr string
+}{{
+	url:       "~charmers/wordpress",
+	channel:   params.StableChannel,
+	expectURL: "~charmers/precise/wordpress-0",
+}, {
+	url:       "~charmers/wordpress",
+	channel:   params.DevelopmentChannel,
+	expectURL: "~charmers/precise/wordpress-1",
+}, {
+	url:       "~charmers/wordpress",
+	channel:   params.UnpublishedChannel,
+	expectURL: "~charmers/precise/wordpress-2",
+}, {
+	url:       "~charmers/precise/wordpress-2",
+	channel:   params.StableChannel,
+	expectURL: "~charmers/precise/wordpress-2",
+}, {
+	url:       "~charmers/wordpress-2",
+	channel:   params.StableChannel,
+	expectErr: `entity not found`,
+}, {
+	url:       "~charmers/utopic/wordpress",
+	channel:   params.StableChannel,
+	expectErr: `entity not found`,
+}, {
+	url:       "~charmers/utopic/wordpress",
+	channel:   params.DevelopmentChannel,
+	expectURL: "~charmers/utopic/wordpress-3",
+}, {
+	url:       "~charmers/wordpress",
+	channel:   "bad-wolf",
+	expectErr: `invalid channel "bad-wolf"`,
+}}
+
+func (s *StoreSuite) TestFindBestEntityChannel(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	addChannelCharm(c, store, "~charmers/precise/wordpress-0", params.StableChannel)
+	addChannelCharm(c, store, "~charmers/precise/wordpress-1", params.DevelopmentChannel)
+	addChannelCharm(c, store, "~charmers/precise/wordpress-2", "")
+	addChannelCharm(c, store, "~charmers/utopic/wordpress-3", params.DevelopmentChannel)
+	for i, test := range findBestEntityChannelTests {
+		c.Logf("test %d: %s in %q", i, test.url, test.channel)
+		entity, err := store.FindBestEntity(charm.MustParseReference(test.url), test.channel)
+		if test.expectErr != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectErr)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(entity.URL, jc.DeepEquals, charm.MustParseReference(test.expectURL))
+	}
+}
+
+func (s *StoreSuite) TestSearchChannels(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	addChannelCharm(c, store, "~charmers/precise/wordpress-0", params.StableChannel)
+	url1 := addChannelCharm(c, store, "~charmers/precise/wordpress-1", "")
+	err := store.SetPerms(charm.MustParseReference("~charmers/wordpress"), "read", params.Everyone)
+	c.Assert(err, gc.IsNil)
+	err = store.UpdateSearchBaseURL(charm.MustParseReference("~charmers/wordpress"))
+	c.Assert(err, gc.IsNil)
+
+	search := func(channel params.Channel) []*router.ResolvedURL {
+		err := store.ES.RefreshIndex(s.TestIndex)
+		c.Assert(err, gc.IsNil)
+		res, err := store.Search(SearchParams{Channel: channel})
+		c.Assert(err, gc.IsNil)
+		return res.Results
+	}
+	// The unpublished revision is not found anywhere, and
+	// stable revisions are also found in the development channel.
+	c.Assert(search(""), jc.DeepEquals, []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-0", -1),
+	})
+	c.Assert(search(params.DevelopmentChannel), jc.DeepEquals, []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-0", -1),
+	})
+
+	// Once published in development, the later revision
+	// replaces the stable revision in the development channel only.
+	err = store.Publish(url1, params.DevelopmentChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(search(params.StableChannel), jc.DeepEquals, []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-0", -1),
+	})
+	c.Assert(search(params.DevelopmentChannel), jc.DeepEquals, []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-1", -1),
+	})
+
+	err = store.Publish(url1, params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(search(params.StableChannel), jc.DeepEquals, []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-1", -1),
+	})
+}
@@ -0,0 +1,483 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/elasticsearch"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// deletedEntityRetention holds the length of time for which
+// a deleted entity and its archive blob are kept so that
+// the entity can be restored.
+var deletedEntityRetention = 7 * 24 * time.Hour
+
+// DeleteEntity deletes the entity with the given id. The entity is
+// moved out of the entities collection, so that it can no longer be
+// resolved or found by search, but it is kept along with its archive
+// blob until it expires, so that it can be restored with RestoreEntity.
+//
+// If the entity is the last remaining revision of its base entity, the
+// base entity is also removed.
+func (s *Store) DeleteEntity(id *router.ResolvedURL) error {
+	entity, err := s.FindEntity(id)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	now := time.Now()
+	deleted := &mongodoc.DeletedEntity{
+		Entity:     *entity,
+		DeleteTime: now,
+		Expires:    now.Add(deletedEntityRetention),
+	}
+	// Note that an entity with the same id may already have been
+	// deleted and uploaded again, in which case the earlier deleted
+	// entity is replaced and its blob will be collected as an orphan.
+	if _, err := s.DB.DeletedEntities().UpsertId(entity.URL, deleted); err != nil {
+		return errgo.Notef(err, "cannot save deleted entity")
+	}
+	if err := s.DB.Entities().RemoveId(entity.URL); err != nil {
+		if err == mgo.ErrNotFound {
+			// The entity was deleted concurrently.
+			return errgo.WithCausef(nil, params.ErrNotFound, "entity not found")
+		}
+		return errgo.Notef(err, "cannot remove %s", entity.URL)
+	}
+	n, err := s.DB.Entities().Find(bson.D{{"baseurl", entity.BaseURL}}).Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot count remaining revisions of %s", entity.BaseURL)
+	}
+	if n == 0 {
+		if err := s.removeBaseEntity(deleted); err != nil {
+			return errgo.Mask(err)
+		}
+	} else {
+		// The deletion changes the metadata of the
+		// remaining revisions, such as their revision info.
+		if err := s.incBaseModifications(entity.BaseURL); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := s.updateSearchSeries(entity.URL); err != nil {
+		return errgo.Notef(err, "cannot update search record for %s", entity.URL)
+	}
+	if err := s.addEntityEvent(params.EventDelete, entity, ""); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
+
+// removeBaseEntity removes the base entity of the given deleted entity,
+// saving it in the deleted entity so that it can be restored along
+// with the entity.
+func (s *Store) removeBaseEntity(deleted *mongodoc.DeletedEntity) error {
+	var baseEntity mongodoc.BaseEntity
+	_, err := s.DB.BaseEntities().FindId(deleted.BaseURL).Apply(mgo.Change{Remove: true}, &baseEntity)
+	if err == mgo.ErrNotFound {
+		return nil
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot remove base entity %s", deleted.BaseURL)
+	}
+	deleted.BaseEntity = &baseEntity
+	if err := s.DB.DeletedEntities().UpdateId(deleted.URL, bson.D{{"$set", bson.D{{"baseentity", &baseEntity}}}}); err != nil {
+		return errgo.Notef(err, "cannot save base entity %s", deleted.BaseURL)
+	}
+	return nil
+}
+
+// incBaseModifications increments the modification counter of the
+// base entity with the given URL, if it exists.
+func (s *Store) incBaseModifications(url *charm.Reference) error {
+	if err := s.DB.BaseEntities().UpdateId(url, bson.D{incModifications}); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot update base entity %s", url)
+	}
+	return nil
+}
+
+// DeletedEntity returns the unexpired deleted entity with the given
+// id, which must be fully qualified. If the id has no user, it is
+// assumed to be a promulgated id.
+func (s *Store) DeletedEntity(id *charm.Reference) (*mongodoc.DeletedEntity, error) {
+	q := bson.D{{"expires", bson.D{{"$gt", time.Now()}}}}
+	if id.User != "" {
+		q = append(q, bson.DocElem{"_id", id})
+	} else {
+		q = append(q, bson.DocElem{"promulgated-url", id})
+	}
+	var deleted mongodoc.DeletedEntity
+	err := s.DB.DeletedEntities().Find(q).Sort("-deletetime").One(&deleted)
+	if err == mgo.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "deleted entity %s not found", id)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get deleted entity %s", id)
+	}
+	return &deleted, nil
+}
+
+// RestoreEntity restores the unexpired deleted entity with the given
+// id, along with its base entity if that was removed when the entity
+// was deleted. If an entity with the same id has been added since
+// the entity was deleted, it returns an error with a
+// params.ErrDuplicateUpload cause.
+func (s *Store) RestoreEntity(id *charm.Reference) (*router.ResolvedURL, error) {
+	deleted, err := s.DeletedEntity(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if deleted.BaseEntity != nil {
+		err := s.DB.BaseEntities().Insert(deleted.BaseEntity)
+		if err != nil && !mgo.IsDup(err) {
+			return nil, errgo.Notef(err, "cannot restore base entity %s", deleted.BaseURL)
+		}
+	}
+	if err := s.DB.Entities().Insert(&deleted.Entity); err != nil {
+		if mgo.IsDup(err) {
+			return nil, errgo.WithCausef(nil, params.ErrDuplicateUpload, "cannot restore %s: entity already exists", deleted.URL)
+		}
+		return nil, errgo.Notef(err, "cannot restore %s", deleted.URL)
+	}
+	// The restored revision changes the metadata of the other
+	// revisions. A restored base entity is bumped too, so that
+	// its metadata is not mistaken for that before the deletion.
+	if err := s.incBaseModifications(deleted.BaseURL); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := s.DB.DeletedEntities().RemoveId(deleted.URL); err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot remove deleted entity %s", deleted.URL)
+	}
+	if err := s.updateSearchSeries(deleted.URL); err != nil {
+		return nil, errgo.Notef(err, "cannot update search record for %s", deleted.URL)
+	}
+	if err := s.addEntityEvent(params.EventRestore, &deleted.Entity, ""); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return EntityResolvedURL(&deleted.Entity), nil
+}
+
+// PurgeEntity permanently removes the deleted entity with the
+// given id along with its archive blob.
+func (s *Store) PurgeEntity(id *charm.Reference) error {
+	deleted, err := s.DeletedEntity(id)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.DB.DeletedEntities().RemoveId(deleted.URL); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "deleted entity %s not found", id)
+		}
+		return errgo.Notef(err, "cannot remove deleted entity %s", deleted.URL)
+	}
+	if err := s.incBaseModifications(deleted.BaseURL); err != nil {
+		return errgo.Mask(err)
+	}
+	// Note that if the blob cannot be removed, it is no longer
+	// referenced, so it will be removed by the blob garbage
+	// collector in time.
+	if err := s.BlobStore.Remove(deleted.BlobName); err != nil {
+		return errgo.Notef(err, "cannot remove blob %s", deleted.BlobName)
+	}
+	return nil
+}
+
+// RemoveEntity permanently removes the entity with the given id along
+// with its archive blob. Unlike DeleteEntity, the entity cannot be
+// restored: it is intended for backing out an entity that has only
+// just been added. The base entity is removed too if no other
+// revisions of it remain.
+func (s *Store) RemoveEntity(id *router.ResolvedURL) error {
+	entity, err := s.FindEntity(id, "_id", "baseurl", "blobname", "promulgated-url")
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.DB.Entities().RemoveId(entity.URL); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "entity not found")
+		}
+		return errgo.Notef(err, "cannot remove %s", entity.URL)
+	}
+	n, err := s.DB.Entities().Find(bson.D{{"baseurl", entity.BaseURL}}).Count()
+	if err != nil {
+		return errgo.Notef(err, "cannot count remaining revisions of %s", entity.BaseURL)
+	}
+	if n == 0 {
+		if err := s.DB.BaseEntities().RemoveId(entity.BaseURL); err != nil && err != mgo.ErrNotFound {
+			return errgo.Notef(err, "cannot remove base entity %s", entity.BaseURL)
+		}
+	} else {
+		// The removal changes the metadata of the
+		// remaining revisions, such as their revision info.
+		if err := s.incBaseModifications(entity.BaseURL); err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	if err := s.updateSearchSeries(entity.URL); err != nil {
+		return errgo.Notef(err, "cannot update search record for %s", entity.URL)
+	}
+	if err := s.addEntityEvent(params.EventDelete, entity, ""); err != nil {
+		return errgo.Mask(err)
+	}
+	// Note that if the blob cannot be removed, it is no longer
+	// referenced, so it will be removed by the blob garbage
+	// collector in time.
+	if err := s.BlobStore.Remove(entity.BlobName); err != nil {
+		return errgo.Notef(err, "cannot remove blob %s", entity.BlobName)
+	}
+	return nil
+}
+
+// MaxDeletedRevision returns the highest revision of the unexpired
+// deleted entities matching the given URL, which must hold a series
+// but no revision. If the URL has no user, promulgated revisions
+// are considered. It returns -1 if there are no matching deleted
+// entities.
+//
+// Revisions of deleted entities are not given to new uploads
+// so that the deleted entities can be restored.
+func (s *Store) MaxDeletedRevision(url *charm.Reference) (int, error) {
+	q := bson.D{
+		{"name", url.Name},
+		{"series", url.Series},
+		{"expires", bson.D{{"$gt", time.Now()}}},
+	}
+	field := "revision"
+	if url.User != "" {
+		q = append(q, bson.DocElem{"user", url.User})
+	} else {
+		q = append(q, bson.DocElem{"promulgated-url", bson.D{{"$exists", true}}})
+		field = "promulgated-revision"
+	}
+	var deleted mongodoc.DeletedEntity
+	err := s.DB.DeletedEntities().Find(q).Sort("-" + field).Select(bson.D{{field, 1}}).One(&deleted)
+	if err == mgo.ErrNotFound {
+		return -1, nil
+	}
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot find deleted revisions of %s", url)
+	}
+	if url.User == "" {
+		return deleted.PromulgatedRevision, nil
+	}
+	return deleted.Revision, nil
+}
+
+// updateSearchSeries updates the search records for the series of
+// the given entity after the entity has been deleted or restored.
+// The latest remaining revision in the series published in each
+// channel is indexed, and the record for a channel is removed if
+// no such revisions remain.
+func (s *Store) updateSearchSeries(url *charm.Reference) error {
+	if s.ES == nil || s.ES.Database == nil {
+		return nil
+	}
+	if deprecatedSeries[url.Series] {
+		return nil
+	}
+	var baseEntity *mongodoc.BaseEntity
+	for _, channel := range searchChannels {
+		docId := s.ES.getChannelID(url, channel)
+		entity, err := s.latestSeriesEntity(url, channel)
+		if errgo.Cause(err) == params.ErrNotFound {
+			err := s.ES.DeleteDocument(s.ES.Index, typeName, docId)
+			if err != nil && err != elasticsearch.ErrNotFound {
+				return errgo.Notef(err, "cannot remove search record")
+			}
+			continue
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if baseEntity == nil {
+			baseEntity, err = s.FindBaseEntity(entity.BaseURL)
+			if err != nil {
+				return errgo.Notef(err, "cannot get %s", entity.BaseURL)
+			}
+		}
+		doc, err := s.searchDocFromEntity(entity, baseEntity, channel)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		// The search record is versioned by revision, so the record
+		// of an earlier revision must be given the version of the
+		// record it replaces.
+		current, err := s.ES.GetESDocument(s.ES.Index, typeName, docId)
+		if err != nil {
+			return errgo.Notef(err, "cannot get search record")
+		}
+		version := int64(entity.URL.Revision)
+		if current.Found && current.Version > version {
+			version = current.Version
+		}
+		if err := s.ES.put(doc, version); err != nil {
+			return errgo.Notef(err, "cannot update search index")
+		}
+	}
+	return nil
+}
+
+// BaseEntityRemoveResult holds the result of a call to
+// Store.RemoveBaseEntity.
+type BaseEntityRemoveResult struct {
+	// Entities holds the ids of the entities that were removed,
+	// including deleted entities that had not yet been purged,
+	// sorted by id.
+	Entities []*charm.Reference
+
+	// Blobs holds the number of archive blobs removed.
+	Blobs int
+
+	// SearchRecords holds the number of search records removed.
+	SearchRecords int
+
+	// Counters holds the number of statistics counter
+	// data points removed.
+	Counters int
+
+	// Errors holds any errors encountered when
+	// removing blobs, keyed by blob name.
+	Errors map[string]string
+}
+
+// entityStatsKinds holds the kinds of statistics
+// that are recorded for individual entities.
+var entityStatsKinds = []string{
+	params.StatsArchiveDownload,
+	params.StatsArchiveDelete,
+	params.StatsArchiveUpload,
+	params.StatsArchiveFailedUpload,
+}
+
+// RemoveBaseEntity permanently removes the base entity with the given
+// URL, which must have a user but no series or revision, along with
+// all of its entities in every series, any of its deleted entities,
+// their archive blobs, resources, search records and statistics.
+//
+// Statistics recorded under promulgated ids are left in place,
+// because they may be shared with other base entities.
+func (s *Store) RemoveBaseEntity(url *charm.Reference) (*BaseEntityRemoveResult, error) {
+	if url.User == "" || url.Series != "" || url.Revision != -1 {
+		return nil, errgo.Newf("invalid base entity URL %q", url)
+	}
+	var entities []*mongodoc.Entity
+	fields := bson.D{{"_id", 1}, {"series", 1}, {"blobname", 1}}
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", url}}).Select(fields).All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities of %s", url)
+	}
+	var deleted []*mongodoc.DeletedEntity
+	if err := s.DB.DeletedEntities().Find(bson.D{{"baseurl", url}}).Select(fields).All(&deleted); err != nil {
+		return nil, errgo.Notef(err, "cannot find deleted entities of %s", url)
+	}
+	for _, d := range deleted {
+		entities = append(entities, &d.Entity)
+	}
+	err := s.DB.BaseEntities().RemoveId(url)
+	if err == mgo.ErrNotFound && len(entities) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "base entity %s not found", url)
+	}
+	if err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot remove base entity %s", url)
+	}
+	// Note that any entity added concurrently is removed too; its
+	// blob will be collected as an orphan by the blob garbage collector.
+	if _, err := s.DB.Entities().RemoveAll(bson.D{{"baseurl", url}}); err != nil {
+		return nil, errgo.Notef(err, "cannot remove entities of %s", url)
+	}
+	if _, err := s.DB.DeletedEntities().RemoveAll(bson.D{{"baseurl", url}}); err != nil {
+		return nil, errgo.Notef(err, "cannot remove deleted entities of %s", url)
+	}
+	var resources []*mongodoc.Resource
+	if err := s.DB.Resources().Find(bson.D{{"baseurl", url}}).Select(bson.D{{"blobname", 1}}).All(&resources); err != nil {
+		return nil, errgo.Notef(err, "cannot find resources of %s", url)
+	}
+	if _, err := s.DB.Resources().RemoveAll(bson.D{{"baseurl", url}}); err != nil {
+		return nil, errgo.Notef(err, "cannot remove resources of %s", url)
+	}
+	result := &BaseEntityRemoveResult{
+		Entities: make([]*charm.Reference, 0, len(entities)),
+	}
+	allSeries := make(map[string]bool)
+	for _, e := range entities {
+		result.Entities = append(result.Entities, e.URL)
+		allSeries[e.Series] = true
+		if err := s.BlobStore.Remove(e.BlobName); err != nil {
+			logger.Errorf("cannot remove blob %q of %s: %v", e.BlobName, e.URL, err)
+			if result.Errors == nil {
+				result.Errors = make(map[string]string)
+			}
+			result.Errors[e.BlobName] = err.Error()
+			continue
+		}
+		result.Blobs++
+	}
+	for _, res := range resources {
+		if err := s.BlobStore.Remove(res.BlobName); err != nil {
+			logger.Errorf("cannot remove blob %q of resource %q of %s: %v", res.BlobName, res.Name, url, err)
+			if result.Errors == nil {
+				result.Errors = make(map[string]string)
+			}
+			result.Errors[res.BlobName] = err.Error()
+			continue
+		}
+		result.Blobs++
+	}
+	sort.Sort(referencesByString(result.Entities))
+	for series := range allSeries {
+		id := *url
+		id.Series = series
+		removed, err := s.removeSearchRecords(&id)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot remove search records for %s", &id)
+		}
+		result.SearchRecords += removed
+		for _, kind := range entityStatsKinds {
+			n, err := s.RemoveCounters(EntityStatsKey(&id, kind), true)
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot remove statistics for %s", &id)
+			}
+			result.Counters += n
+		}
+	}
+	if err := s.addBaseEntityEvent(params.EventDelete, url, nil); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	return result, nil
+}
+
+// removeSearchRecords removes the search records in all channels
+// for the given entity URL, which must not hold a revision. It
+// returns the number of records removed.
+func (s *Store) removeSearchRecords(url *charm.Reference) (int, error) {
+	if s.ES == nil || s.ES.Database == nil {
+		return 0, nil
+	}
+	n := 0
+	for _, channel := range searchChannels {
+		err := s.ES.DeleteDocument(s.ES.Index, typeName, s.ES.getChannelID(url, channel))
+		if err == elasticsearch.ErrNotFound {
+			continue
+		}
+		if err != nil {
+			return n, errgo.Mask(err)
+		}
+		n++
+	}
+	return n, nil
+}
+
+type referencesByString []*charm.Reference
+
+func (r referencesByString) Len() int           { return len(r) }
+func (r referencesByString) Swap(i, j int)      { r[i], r[j] = r[j], r[i] }
+func (r referencesByString) Less(i, j int) bool { return r[i].String() < r[j].String() }
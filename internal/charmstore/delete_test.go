@@ -0,0 +1,385 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/elasticsearch"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+func (s *StoreSuite) TestDeleteEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	url1 := newResolvedURL("~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+	entity, err := store.FindEntity(url1)
+	c.Assert(err, gc.IsNil)
+
+	err = store.DeleteEntity(url1)
+	c.Assert(err, gc.IsNil)
+
+	// The entity can no longer be found, but its archive is kept.
+	_, err = store.FindEntity(url1)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	r, _, err := store.BlobStore.Open(entity.BlobName)
+	c.Assert(err, gc.IsNil)
+	r.Close()
+
+	deleted, err := store.DeletedEntity(&url1.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deleted.Entity, jc.DeepEquals, *entity)
+	c.Assert(deleted.Expires.Sub(deleted.DeleteTime), gc.Equals, deletedEntityRetention)
+	c.Assert(deleted.BaseEntity, gc.IsNil)
+
+	// The base entity remains while other revisions exist.
+	_, err = store.FindBaseEntity(&url1.URL)
+	c.Assert(err, gc.IsNil)
+
+	// Deleting the last revision removes the base entity.
+	err = store.DeleteEntity(url0)
+	c.Assert(err, gc.IsNil)
+	_, err = store.FindBaseEntity(&url0.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	deleted, err = store.DeletedEntity(&url0.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deleted.BaseEntity, gc.NotNil)
+	c.Assert(deleted.BaseEntity.URL.String(), gc.Equals, "cs:~charmers/wordpress")
+
+	err = store.DeleteEntity(url0)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestRestoreEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-3", 3)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = store.SetPerms(&url.URL, "read", "bob")
+	c.Assert(err, gc.IsNil)
+	entity, err := store.FindEntity(url)
+	c.Assert(err, gc.IsNil)
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.IsNil)
+
+	// The entity can be restored using its promulgated id.
+	rurl, err := store.RestoreEntity(charm.MustParseReference("precise/wordpress-3"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(rurl, jc.DeepEquals, url)
+	restored, err := store.FindEntity(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(restored, jc.DeepEquals, entity)
+
+	// The base entity has been restored with its permissions.
+	baseEntity, err := store.FindBaseEntity(&url.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(baseEntity.ACLs.Read, jc.DeepEquals, []string{"bob"})
+
+	_, err = store.DeletedEntity(&url.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.RestoreEntity(&url.URL)
+	c.Assert(err, gc.ErrorMatches, `deleted entity cs:~charmers/precise/wordpress-3 not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestRestoreEntityAlreadyExists(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.IsNil)
+	err = store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+
+	_, err = store.RestoreEntity(&url.URL)
+	c.Assert(err, gc.ErrorMatches, `cannot restore cs:~charmers/precise/wordpress-0: entity already exists`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrDuplicateUpload)
+}
+
+func (s *StoreSuite) TestPurgeEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	blobName, _, err := store.BlobNameAndHash(url)
+	c.Assert(err, gc.IsNil)
+
+	// Only deleted entities can be purged.
+	err = store.PurgeEntity(&url.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.IsNil)
+	err = store.PurgeEntity(&url.URL)
+	c.Assert(err, gc.IsNil)
+
+	_, err = store.DeletedEntity(&url.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, _, err = store.BlobStore.Open(blobName)
+	c.Assert(err, gc.ErrorMatches, `resource at path ".*" not found`)
+}
+
+func (s *StoreSuite) TestRemoveEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	url1 := newResolvedURL("~charmers/precise/wordpress-1", -1)
+	err := store.AddCharmWithArchive(url0, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = store.AddCharmWithArchive(url1, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = store.SetPerms(&url1.URL, "read", "bob")
+	c.Assert(err, gc.IsNil)
+	blobName, _, err := store.BlobNameAndHash(url1)
+	c.Assert(err, gc.IsNil)
+	baseEntity, err := store.FindBaseEntity(&url0.URL)
+	c.Assert(err, gc.IsNil)
+
+	// Removing an entity removes the entity and its archive
+	// for good, but leaves other changes to the base entity.
+	err = store.RemoveEntity(url1)
+	c.Assert(err, gc.IsNil)
+	_, err = store.FindEntity(url1)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = store.DeletedEntity(&url1.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, _, err = store.BlobStore.Open(blobName)
+	c.Assert(err, gc.ErrorMatches, `resource at path ".*" not found`)
+	remaining, err := store.FindBaseEntity(&url0.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(remaining.ACLs.Read, jc.DeepEquals, []string{"bob"})
+	c.Assert(remaining.Modifications, gc.Equals, baseEntity.Modifications+1)
+
+	// The removal is recorded in the change feed, so that
+	// clients that have seen the upload see the removal too.
+	events, err := store.Events(0, 0)
+	c.Assert(err, gc.IsNil)
+	last := events[len(events)-1]
+	c.Assert(last.Kind, gc.Equals, string(params.EventDelete))
+	c.Assert(last.Id, jc.DeepEquals, &url1.URL)
+
+	// Removing the last revision removes the base entity.
+	err = store.RemoveEntity(url0)
+	c.Assert(err, gc.IsNil)
+	_, err = store.FindBaseEntity(&url0.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	err = store.RemoveEntity(url0)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestDeletedEntityExpiry(c *gc.C) {
+	s.PatchValue(&deletedEntityRetention, -time.Second)
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	blobName, _, err := store.BlobNameAndHash(url)
+	c.Assert(err, gc.IsNil)
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.IsNil)
+
+	// An expired deleted entity cannot be restored.
+	_, err = store.RestoreEntity(&url.URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// Its blob is collected as an orphan and the
+	// deleted entity itself is removed.
+	result, err := store.CollectBlobGarbage(BlobGCParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Removed, jc.DeepEquals, []string{blobName})
+	n, err := store.DB.DeletedEntities().Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *StoreSuite) TestCollectBlobGarbageWithDeletedEntity(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = store.DeleteEntity(url)
+	c.Assert(err, gc.IsNil)
+
+	result, err := store.CollectBlobGarbage(BlobGCParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Orphans, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestMaxDeletedRevision(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, url := range []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-2", 5),
+		newResolvedURL("~charmers/precise/wordpress-4", 6),
+		newResolvedURL("~charmers/trusty/wordpress-7", -1),
+	} {
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+		err = store.DeleteEntity(url)
+		c.Assert(err, gc.IsNil)
+	}
+	for i, test := range []struct {
+		url    string
+		expect int
+	}{
+		{"~charmers/precise/wordpress", 4},
+		{"~charmers/trusty/wordpress", 7},
+		{"~bob/precise/wordpress", -1},
+		{"precise/wordpress", 6},
+		{"trusty/wordpress", -1},
+	} {
+		c.Logf("test %d: %s", i, test.url)
+		rev, err := store.MaxDeletedRevision(charm.MustParseReference(test.url))
+		c.Assert(err, gc.IsNil)
+		c.Assert(rev, gc.Equals, test.expect)
+	}
+}
+
+func (s *StoreSuite) TestDeleteEntityUpdatesSearch(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	url1 := newResolvedURL("~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+	docId := store.ES.getID(&url0.URL)
+	assertIndexed := func(expect *charm.Reference) {
+		var doc SearchDoc
+		err := store.ES.GetDocument(s.TestIndex, typeName, docId, &doc)
+		if expect == nil {
+			c.Assert(err, gc.Equals, elasticsearch.ErrNotFound)
+			return
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(doc.URL, jc.DeepEquals, expect)
+	}
+	assertIndexed(&url1.URL)
+
+	// Deleting the latest revision indexes the previous one.
+	err := store.DeleteEntity(url1)
+	c.Assert(err, gc.IsNil)
+	assertIndexed(&url0.URL)
+
+	// Deleting the last revision removes the search record.
+	err = store.DeleteEntity(url0)
+	c.Assert(err, gc.IsNil)
+	assertIndexed(nil)
+
+	// Restoring a revision indexes it again.
+	_, err = store.RestoreEntity(&url1.URL)
+	c.Assert(err, gc.IsNil)
+	assertIndexed(&url1.URL)
+}
+
+func (s *StoreSuite) TestRemoveBaseEntity(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	urls := []*router.ResolvedURL{
+		newResolvedURL("~charmers/precise/wordpress-0", -1),
+		newResolvedURL("~charmers/precise/wordpress-1", -1),
+		newResolvedURL("~charmers/trusty/wordpress-2", -1),
+		newResolvedURL("~bob/precise/wordpress-0", -1),
+	}
+	for _, url := range urls {
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+	var blobNames []string
+	for _, url := range urls {
+		blobName, _, err := store.BlobNameAndHash(url)
+		c.Assert(err, gc.IsNil)
+		blobNames = append(blobNames, blobName)
+	}
+	// Deleted entities are removed too.
+	err := store.DeleteEntity(urls[1])
+	c.Assert(err, gc.IsNil)
+
+	now := time.Now()
+	for _, url := range urls[1:] {
+		for i := 0; i < 2; i++ {
+			key := EntityStatsKey(&url.URL, params.StatsArchiveDownload)
+			err := store.IncCounterAtTime(key, now.Add(time.Duration(-i)*time.Hour))
+			c.Assert(err, gc.IsNil)
+		}
+	}
+
+	result, err := store.RemoveBaseEntity(charm.MustParseReference("~charmers/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &BaseEntityRemoveResult{
+		Entities: []*charm.Reference{
+			&urls[0].URL,
+			&urls[1].URL,
+			&urls[2].URL,
+		},
+		Blobs:         3,
+		SearchRecords: 4,
+		Counters:      4,
+	})
+
+	_, err = store.FindBaseEntity(charm.MustParseReference("~charmers/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	for _, url := range urls[0:3] {
+		_, err := store.FindEntity(url)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	}
+	_, err = store.DeletedEntity(&urls[1].URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	for _, blobName := range blobNames[0:3] {
+		_, _, err := store.BlobStore.Open(blobName)
+		c.Assert(err, gc.ErrorMatches, `resource at path ".*" not found`)
+	}
+	for _, series := range []string{"precise", "trusty"} {
+		id := charm.MustParseReference("~charmers/" + series + "/wordpress")
+		var doc SearchDoc
+		err := store.ES.GetDocument(s.TestIndex, typeName, store.ES.getID(id), &doc)
+		c.Assert(err, gc.Equals, elasticsearch.ErrNotFound)
+	}
+
+	// Other base entities with the same name are unaffected.
+	_, err = store.FindEntity(urls[3])
+	c.Assert(err, gc.IsNil)
+	r, _, err := store.BlobStore.Open(blobNames[3])
+	c.Assert(err, gc.IsNil)
+	r.Close()
+	counters, err := store.Counters(&CounterRequest{
+		Key: EntityStatsKey(&urls[3].URL, params.StatsArchiveDownload),
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(counters, gc.HasLen, 1)
+	c.Assert(counters[0].Count, gc.Equals, int64(2))
+
+	_, err = store.RemoveBaseEntity(charm.MustParseReference("~charmers/wordpress"))
+	c.Assert(err, gc.ErrorMatches, `base entity cs:~charmers/wordpress not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestRemoveBaseEntityInvalidURL(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, url := range []string{"wordpress", "~charmers/precise/wordpress", "~charmers/wordpress-1"} {
+		_, err := store.RemoveBaseEntity(charm.MustParseReference(url))
+		c.Assert(err, gc.ErrorMatches, `invalid base entity URL ".*"`)
+	}
+}
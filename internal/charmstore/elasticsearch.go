@@ -10,7 +10,7 @@ var (
 	esMapping = mustParseJSON(esMappingJSON)
 )
 
-const esSettingsVersion = 7
+const esSettingsVersion = 9
 
 func mustParseJSON(s string) interface{} {
 	var j json.RawMessage
@@ -318,6 +318,9 @@ const esMappingJSON = `
         "omit_norms" : true,
         "index_options" : "docs"
       },
+      "ReleaseNotes" : {
+        "type" : "string"
+      },
       "BundleCharms": {
         "type": "string",
         "index": "not_analyzed",
@@ -344,6 +347,12 @@ const esMappingJSON = `
         "index": "not_analyzed",
         "omit_norms" : true,
         "index_options" : "docs"
+      },
+      "Channel" : {
+        "type" : "string",
+        "index": "not_analyzed",
+        "omit_norms" : true,
+        "index_options" : "docs"
       }
     }
   }
@@ -0,0 +1,230 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// eventsCollectionSize holds the maximum size in bytes of the
+// capped collection that holds the change feed. When the
+// collection is full, the oldest events are discarded.
+var eventsCollectionSize = 256 * 1024 * 1024
+
+// maxAddEventAttempts holds the number of times AddEvent will try
+// to insert an event when the sequence number it chose has been
+// taken by a concurrent insert.
+const maxAddEventAttempts = 100
+
+// errCollectionExists is the code of the error returned by
+// MongoDB when creating a collection that already exists.
+const errCollectionExists = 48
+
+// ensureEventsCollection creates the capped collection that
+// holds the change feed if it does not already exist.
+func (s *Store) ensureEventsCollection() error {
+	err := s.DB.Events().Create(&mgo.CollectionInfo{
+		Capped:   true,
+		MaxBytes: eventsCollectionSize,
+	})
+	if err == nil {
+		return nil
+	}
+	if qerr, ok := err.(*mgo.QueryError); ok {
+		if qerr.Code == errCollectionExists || qerr.Message == "collection already exists" {
+			return nil
+		}
+	}
+	return errgo.Notef(err, "cannot create events collection")
+}
+
+// AddEvent adds the given event to the change feed, setting its
+// sequence number and time.
+//
+// An event is given the sequence number following that of the last
+// event in the feed, relying on the unique index on sequence numbers
+// to serialize concurrent inserts. This ensures that events become
+// visible in sequence order, so that a client following the feed
+// cannot miss an event that is inserted after a later one.
+func (s *Store) AddEvent(e *mongodoc.Event) error {
+	e.Time = time.Now()
+	for i := 0; i < maxAddEventAttempts; i++ {
+		last, err := s.LastEventSeq()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		e.Seq = last + 1
+		err = s.DB.Events().Insert(e)
+		if err == nil {
+			return nil
+		}
+		if !mgo.IsDup(err) {
+			return errgo.Notef(err, "cannot insert event")
+		}
+	}
+	return errgo.Newf("cannot insert event: too many concurrent inserts")
+}
+
+// LastEventSeq returns the sequence number of the last event
+// in the change feed, or zero if the feed is empty.
+func (s *Store) LastEventSeq() (int64, error) {
+	var last mongodoc.Event
+	err := s.DB.Events().Find(nil).Sort("-_id").Select(bson.D{{"_id", 1}}).One(&last)
+	if err != nil && err != mgo.ErrNotFound {
+		return 0, errgo.Notef(err, "cannot find last event")
+	}
+	return last.Seq, nil
+}
+
+// Events returns the events in the change feed with sequence numbers
+// greater than after, in sequence order. If limit is greater than
+// zero, at most limit events are returned.
+//
+// If after is greater than zero and any of the events following it
+// have been discarded from the feed, it returns an error with a
+// params.ErrCursorExpired cause.
+func (s *Store) Events(after int64, limit int) ([]mongodoc.Event, error) {
+	query := s.DB.Events().Find(bson.D{{"_id", bson.D{{"$gt", after}}}}).Sort("_id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	events := []mongodoc.Event{}
+	if err := query.All(&events); err != nil {
+		return nil, errgo.Notef(err, "cannot get events")
+	}
+	if after == 0 {
+		return events, nil
+	}
+	// Check for discarded events only after retrieving the events,
+	// so that events discarded while the query was running are
+	// detected too.
+	var first mongodoc.Event
+	err := s.DB.Events().Find(nil).Sort("_id").Select(bson.D{{"_id", 1}}).One(&first)
+	if err == mgo.ErrNotFound {
+		return events, nil
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot find first event")
+	}
+	if first.Seq > after+1 {
+		return nil, errgo.WithCausef(nil, params.ErrCursorExpired, "events following %d have expired", after)
+	}
+	return events, nil
+}
+
+// EventParams returns the external representation of the given event.
+func EventParams(e *mongodoc.Event) params.Event {
+	return params.Event{
+		Seq:           e.Seq,
+		Time:          e.Time.UTC(),
+		Kind:          params.EventKind(e.Kind),
+		Id:            e.Id,
+		PromulgatedId: e.PromulgatedId,
+		Channel:       params.Channel(e.Channel),
+		Fields:        e.Fields,
+	}
+}
+
+// addEntityEvent adds an event of the given kind for the given entity
+// to the change feed.
+func (s *Store) addEntityEvent(kind params.EventKind, e *mongodoc.Entity, channel params.Channel) error {
+	if err := s.AddEvent(&mongodoc.Event{
+		Kind:          string(kind),
+		Id:            e.URL,
+		PromulgatedId: e.PromulgatedURL,
+		Channel:       string(channel),
+	}); err != nil {
+		return errgo.Notef(err, "cannot record %s event for %s", kind, e.URL)
+	}
+	return nil
+}
+
+// addBaseEntityEvent adds an event of the given kind for the
+// base entity with the given URL to the change feed.
+func (s *Store) addBaseEntityEvent(kind params.EventKind, url *charm.Reference, fields []string) error {
+	if err := s.AddEvent(&mongodoc.Event{
+		Kind:   string(kind),
+		Id:     url,
+		Fields: fields,
+	}); err != nil {
+		return errgo.Notef(err, "cannot record %s event for %s", kind, url)
+	}
+	return nil
+}
+
+// AddUpdateEvents adds the events recording an update to the given
+// fields of the entity with the given id to the change feed.
+func (s *Store) AddUpdateEvents(id *router.ResolvedURL, fields map[string]interface{}) error {
+	return s.addUpdateEvents(&id.URL, id.PromulgatedURL(), fields)
+}
+
+// AddBaseUpdateEvents adds the events recording an update to the
+// given fields of the base entity of the entity with the given id to
+// the change feed.
+func (s *Store) AddBaseUpdateEvents(id *router.ResolvedURL, fields map[string]interface{}) error {
+	return s.addUpdateEvents(baseURL(&id.URL), nil, fields)
+}
+
+func (s *Store) addUpdateEvents(url, purl *charm.Reference, fields map[string]interface{}) error {
+	for _, e := range updateEvents(fields) {
+		e.Id = url
+		e.PromulgatedId = purl
+		if err := s.AddEvent(e); err != nil {
+			return errgo.Notef(err, "cannot record %s event for %s", e.Kind, url)
+		}
+	}
+	return nil
+}
+
+// updateEvents returns the events that record an update
+// to the given entity or base entity fields.
+func updateEvents(fields map[string]interface{}) []*mongodoc.Event {
+	var extraInfo, perms []string
+	meta := false
+	for field := range fields {
+		switch {
+		case strings.HasPrefix(field, "extrainfo."):
+			extraInfo = append(extraInfo, strings.TrimPrefix(field, "extrainfo."))
+		case strings.HasPrefix(field, "acls."):
+			perms = append(perms, strings.TrimPrefix(field, "acls."))
+		case field == "public":
+			// The public field is derived from the read
+			// permissions, so it needs no event of its own.
+		default:
+			meta = true
+		}
+	}
+	var events []*mongodoc.Event
+	if len(perms) > 0 {
+		sort.Strings(perms)
+		events = append(events, &mongodoc.Event{
+			Kind:   string(params.EventPerm),
+			Fields: perms,
+		})
+	}
+	if len(extraInfo) > 0 {
+		sort.Strings(extraInfo)
+		events = append(events, &mongodoc.Event{
+			Kind:   string(params.EventExtraInfo),
+			Fields: extraInfo,
+		})
+	}
+	if meta {
+		events = append(events, &mongodoc.Event{
+			Kind: string(params.EventMeta),
+		})
+	}
+	return events
+}
@@ -0,0 +1,180 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+func (s *StoreSuite) TestAddEvent(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	seq, err := store.LastEventSeq()
+	c.Assert(err, gc.IsNil)
+	c.Assert(seq, gc.Equals, int64(0))
+	for i := 0; i < 3; i++ {
+		e := &mongodoc.Event{
+			Kind: string(params.EventMeta),
+			Id:   charm.MustParseReference("~charmers/wordpress"),
+		}
+		err := store.AddEvent(e)
+		c.Assert(err, gc.IsNil)
+		c.Assert(e.Seq, gc.Equals, int64(i+1))
+		c.Assert(e.Time.IsZero(), gc.Equals, false)
+	}
+	seq, err = store.LastEventSeq()
+	c.Assert(err, gc.IsNil)
+	c.Assert(seq, gc.Equals, int64(3))
+	events, err := store.Events(0, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(eventSeqs(events), jc.DeepEquals, []int64{1, 2, 3})
+
+	events, err = store.Events(1, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(eventSeqs(events), jc.DeepEquals, []int64{2})
+
+	events, err = store.Events(3, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(events, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestEventsCursorExpired(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	// Simulate the first four events having been
+	// discarded from the capped collection.
+	for seq := int64(5); seq <= 6; seq++ {
+		err := store.DB.Events().Insert(&mongodoc.Event{
+			Seq:  seq,
+			Kind: string(params.EventMeta),
+			Id:   charm.MustParseReference("~charmers/wordpress"),
+		})
+		c.Assert(err, gc.IsNil)
+	}
+	_, err := store.Events(3, 0)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrCursorExpired)
+	c.Assert(err, gc.ErrorMatches, "events following 3 have expired")
+
+	events, err := store.Events(4, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(eventSeqs(events), jc.DeepEquals, []int64{5, 6})
+
+	// Reading from the start returns the events that remain.
+	events, err = store.Events(0, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(eventSeqs(events), jc.DeepEquals, []int64{5, 6})
+}
+
+func (s *StoreSuite) TestChangeEvents(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = store.SetPerms(&id.URL, "read", params.Everyone)
+	c.Assert(err, gc.IsNil)
+	err = store.SetPromulgated(id, true)
+	c.Assert(err, gc.IsNil)
+	err = store.DeleteEntity(id)
+	c.Assert(err, gc.IsNil)
+	_, err = store.RestoreEntity(&id.URL)
+	c.Assert(err, gc.IsNil)
+
+	events, err := store.Events(0, 0)
+	c.Assert(err, gc.IsNil)
+	for i := range events {
+		c.Assert(events[i].Time.IsZero(), gc.Equals, false)
+		events[i].Time = time.Time{}
+	}
+	baseURL := charm.MustParseReference("cs:~charmers/wordpress")
+	promulgatedURL := charm.MustParseReference("cs:precise/wordpress-0")
+	c.Assert(events, jc.DeepEquals, []mongodoc.Event{{
+		Seq:     1,
+		Kind:    "upload",
+		Id:      &id.URL,
+		Channel: "stable",
+	}, {
+		Seq:    2,
+		Kind:   "perm",
+		Id:     baseURL,
+		Fields: []string{"read"},
+	}, {
+		Seq:  3,
+		Kind: "promulgate",
+		Id:   baseURL,
+	}, {
+		Seq:           4,
+		Kind:          "delete",
+		Id:            &id.URL,
+		PromulgatedId: promulgatedURL,
+	}, {
+		Seq:           5,
+		Kind:          "restore",
+		Id:            &id.URL,
+		PromulgatedId: promulgatedURL,
+	}})
+}
+
+var updateEventsTests = []struct {
+	about        string
+	fields       map[string]interface{}
+	expectEvents []*mongodoc.Event
+}{{
+	about: "extra-info",
+	fields: map[string]interface{}{
+		"extrainfo.b": "x",
+		"extrainfo.a": "y",
+	},
+	expectEvents: []*mongodoc.Event{{
+		Kind:   "extra-info",
+		Fields: []string{"a", "b"},
+	}},
+}, {
+	about: "perms",
+	fields: map[string]interface{}{
+		"acls.read":  []string{"everyone"},
+		"public":     true,
+		"acls.write": []string{"charmers"},
+	},
+	expectEvents: []*mongodoc.Event{{
+		Kind:   "perm",
+		Fields: []string{"read", "write"},
+	}},
+}, {
+	about: "other metadata",
+	fields: map[string]interface{}{
+		"releasenotes": "notes",
+		"extrainfo.a":  "y",
+	},
+	expectEvents: []*mongodoc.Event{{
+		Kind:   "extra-info",
+		Fields: []string{"a"},
+	}, {
+		Kind: "meta",
+	}},
+}}
+
+func (s *StoreSuite) TestUpdateEvents(c *gc.C) {
+	for i, test := range updateEventsTests {
+		c.Logf("test %d: %s", i, test.about)
+		c.Assert(updateEvents(test.fields), jc.DeepEquals, test.expectEvents)
+	}
+}
+
+func eventSeqs(events []mongodoc.Event) []int64 {
+	seqs := make([]int64, len(events))
+	for i, e := range events {
+		seqs[i] = e.Seq
+	}
+	return seqs
+}
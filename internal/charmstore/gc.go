@@ -0,0 +1,155 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+)
+
+// DefaultBlobGCGracePeriod holds the default age below which
+// unreferenced blobs are not considered to be orphans, so that
+// blobs belonging to uploads that are still in progress are not
+// collected.
+const DefaultBlobGCGracePeriod = 24 * time.Hour
+
+// BlobGCParams holds parameters for Store.CollectBlobGarbage.
+type BlobGCParams struct {
+	// DryRun specifies that orphaned blobs should
+	// be reported but not removed.
+	DryRun bool
+
+	// GracePeriod holds the minimum age of a blob
+	// before it can be treated as an orphan.
+	GracePeriod time.Duration
+}
+
+// BlobGCResult holds the result of a blob garbage collection.
+type BlobGCResult struct {
+	// Orphans holds the names of all the blobs found that
+	// are not referred to by any entity, sorted by name.
+	Orphans []string
+
+	// Removed holds the names of the orphans that
+	// were removed.
+	Removed []string
+
+	// Errors holds any errors encountered when
+	// removing blobs, keyed by blob name.
+	Errors map[string]string
+}
+
+// CollectBlobGarbage finds blobs in the blob store that are not
+// referred to by any entity, unexpired upload or unexpired deleted
+// entity and, unless p.DryRun is set, removes them along with any
+// expired uploads and deleted entities.
+//
+// Blob names are created from object ids, so the age of each
+// blob is known; blobs younger than p.GracePeriod are ignored
+// so that uploads that are still in flight are not affected.
+// Blobs with names that do not hold an object id are never
+// considered to be orphans.
+func (s *Store) CollectBlobGarbage(p BlobGCParams) (*BlobGCResult, error) {
+	// Note that we list the blobs before finding the referenced
+	// blobs so that a blob that is added between the two steps
+	// will not be considered an orphan.
+	names, err := s.BlobStore.List()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot list blobs")
+	}
+	now := time.Now()
+	referenced, err := s.referencedBlobs(now)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	deadline := now.Add(-p.GracePeriod)
+	result := &BlobGCResult{
+		Orphans: []string{},
+		Removed: []string{},
+	}
+	for _, name := range names {
+		if referenced[name] {
+			continue
+		}
+		if !bson.IsObjectIdHex(name) || bson.ObjectIdHex(name).Time().After(deadline) {
+			continue
+		}
+		result.Orphans = append(result.Orphans, name)
+	}
+	sort.Strings(result.Orphans)
+	if p.DryRun {
+		return result, nil
+	}
+	// The chunks of expired uploads and the archives of expired
+	// deleted entities are no longer referenced, so the uploads
+	// and deleted entities themselves can be discarded.
+	if _, err := s.DB.Uploads().RemoveAll(bson.D{{"expires", bson.D{{"$lte", now}}}}); err != nil {
+		return nil, errgo.Notef(err, "cannot remove expired uploads")
+	}
+	if _, err := s.DB.DeletedEntities().RemoveAll(bson.D{{"expires", bson.D{{"$lte", now}}}}); err != nil {
+		return nil, errgo.Notef(err, "cannot remove expired deleted entities")
+	}
+	if _, err := s.DB.ContentChallenges().RemoveAll(bson.D{{"expires", bson.D{{"$lte", now}}}}); err != nil {
+		return nil, errgo.Notef(err, "cannot remove expired content challenges")
+	}
+	for _, name := range result.Orphans {
+		if err := s.BlobStore.Remove(name); err != nil {
+			logger.Errorf("cannot remove orphaned blob %q: %v", name, err)
+			if result.Errors == nil {
+				result.Errors = make(map[string]string)
+			}
+			result.Errors[name] = err.Error()
+			continue
+		}
+		result.Removed = append(result.Removed, name)
+	}
+	logger.Infof("removed %d of %d orphaned blobs", len(result.Removed), len(result.Orphans))
+	return result, nil
+}
+
+// referencedBlobs returns the set of the names of all
+// the blobs that are referred to by the store at the given time.
+func (s *Store) referencedBlobs(now time.Time) (map[string]bool, error) {
+	referenced := make(map[string]bool)
+	var entity mongodoc.Entity
+	iter := s.DB.Entities().Find(nil).Select(bson.D{{"blobname", 1}}).Iter()
+	for iter.Next(&entity) {
+		referenced[entity.BlobName] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate entities")
+	}
+	var upload mongodoc.Upload
+	iter = s.DB.Uploads().Find(bson.D{{"expires", bson.D{{"$gt", now}}}}).Select(bson.D{{"chunks", 1}}).Iter()
+	for iter.Next(&upload) {
+		for _, chunk := range upload.Chunks {
+			referenced[chunk.BlobName] = true
+		}
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate uploads")
+	}
+	var deleted mongodoc.DeletedEntity
+	iter = s.DB.DeletedEntities().Find(bson.D{{"expires", bson.D{{"$gt", now}}}}).Select(bson.D{{"blobname", 1}}).Iter()
+	for iter.Next(&deleted) {
+		referenced[deleted.BlobName] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate deleted entities")
+	}
+	var res mongodoc.Resource
+	iter = s.DB.Resources().Find(nil).Select(bson.D{{"blobname", 1}}).Iter()
+	for iter.Next(&res) {
+		referenced[res.BlobName] = true
+	}
+	if err := iter.Close(); err != nil {
+		return nil, errgo.Notef(err, "cannot iterate resources")
+	}
+	return referenced, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"sort"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+)
+
+func (s *StoreSuite) putBlob(c *gc.C, store *Store, name, content string) {
+	hash := hashOfReader(c, strings.NewReader(content))
+	err := store.BlobStore.PutUnchallenged(strings.NewReader(content), name, int64(len(content)), hash)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StoreSuite) TestCollectBlobGarbage(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("cs:~charmers/precise/wordpress-23", 23)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	blobName, _, err := store.BlobNameAndHash(url)
+	c.Assert(err, gc.IsNil)
+
+	old := time.Now().Add(-2 * time.Hour)
+	orphan1 := bson.NewObjectIdWithTime(old).Hex()
+	orphan2 := bson.NewObjectIdWithTime(old.Add(time.Second)).Hex()
+	recent := bson.NewObjectId().Hex()
+	s.putBlob(c, store, orphan1, "orphan1")
+	s.putBlob(c, store, orphan2, "orphan2")
+	s.putBlob(c, store, recent, "recent")
+	// A blob without an object id name is never collected.
+	s.putBlob(c, store, "not-an-object-id", "other")
+
+	expectOrphans := []string{orphan1, orphan2}
+	sort.Strings(expectOrphans)
+
+	// A dry run reports orphans without removing them.
+	result, err := store.CollectBlobGarbage(BlobGCParams{
+		DryRun:      true,
+		GracePeriod: time.Hour,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &BlobGCResult{
+		Orphans: expectOrphans,
+		Removed: []string{},
+	})
+	names, err := store.BlobStore.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 5)
+
+	result, err = store.CollectBlobGarbage(BlobGCParams{
+		GracePeriod: time.Hour,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &BlobGCResult{
+		Orphans: expectOrphans,
+		Removed: expectOrphans,
+	})
+	names, err = store.BlobStore.List()
+	c.Assert(err, gc.IsNil)
+	sort.Strings(names)
+	expectNames := []string{blobName, recent, "not-an-object-id"}
+	sort.Strings(expectNames)
+	c.Assert(names, jc.DeepEquals, expectNames)
+
+	// The referenced blob is still available.
+	r, _, err := store.BlobStore.Open(blobName)
+	c.Assert(err, gc.IsNil)
+	r.Close()
+
+	// With no grace period, the recent blob is collected too.
+	result, err = store.CollectBlobGarbage(BlobGCParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &BlobGCResult{
+		Orphans: []string{recent},
+		Removed: []string{recent},
+	})
+}
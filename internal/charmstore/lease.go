@@ -0,0 +1,40 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+// acquireLease attempts to acquire the lease with the given name on
+// behalf of the given holder, or to renew it if the holder already
+// holds it, so that it expires after the given duration. It reports
+// whether the lease is now held by the holder; it is not if it is
+// held by another holder and has not yet expired.
+func (s *Store) acquireLease(name, holder string, d time.Duration) (bool, error) {
+	now := time.Now()
+	_, err := s.DB.Leases().Upsert(bson.D{
+		{"_id", name},
+		{"$or", []bson.D{
+			{{"holder", holder}},
+			{{"expires", bson.D{{"$lt", now}}}},
+		}},
+	}, bson.D{{"$set", bson.D{
+		{"holder", holder},
+		{"expires", now.Add(d)},
+	}}})
+	if mgo.IsDup(err) {
+		// The lease exists but does not match the selector, so
+		// the upsert tried to insert a new one.
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Notef(err, "cannot acquire lease %q", name)
+	}
+	return true, nil
+}
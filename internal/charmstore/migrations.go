@@ -31,6 +31,9 @@ var migrations = []migration{{
 }, {
 	name:    "write acl creation",
 	migrate: populateWriteACL,
+}, {
+	name:    "stable channel publication",
+	migrate: publishEntitiesStable,
 }}
 
 // migration holds a migration function with its corresponding name.
@@ -222,3 +225,36 @@ func populateWriteACL(db StoreDatabase) error {
 	logger.Infof("%d base entities updated", counter)
 	return nil
 }
+
+// publishEntitiesStable publishes in the stable channel all the entities
+// that were uploaded before channels were introduced, so that they
+// can still be resolved.
+func publishEntitiesStable(db StoreDatabase) error {
+	entities := db.Entities()
+	var entity mongodoc.Entity
+	iter := entities.Find(bson.D{{
+		"stable", bson.D{{"$exists", false}},
+	}}).Select(bson.D{{"_id", 1}, {"uploadtime", 1}}).Iter()
+
+	defer iter.Close()
+
+	counter := 0
+	for iter.Next(&entity) {
+		if err := entities.UpdateId(entity.URL, bson.D{{
+			"$set", bson.D{
+				{"development", true},
+				{"developmentpublishtime", entity.UploadTime},
+				{"stable", true},
+				{"stablepublishtime", entity.UploadTime},
+			},
+		}}); err != nil {
+			return errgo.Notef(err, "cannot publish entity %s", entity.URL)
+		}
+		counter++
+	}
+	if err := iter.Close(); err != nil {
+		return errgo.Notef(err, "cannot iterate entities")
+	}
+	logger.Infof("%d entities published", counter)
+	return nil
+}
@@ -7,6 +7,7 @@ import (
 	"net/http"
 	"sort"
 	"sync"
+	"time"
 
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
@@ -186,6 +187,7 @@ func (s *migrationsSuite) TestMigrateMigrationList(c *gc.C) {
 		"base entities creation",
 		"read acl creation",
 		"write acl creation",
+		"stable channel publication",
 	}
 	for i, name := range existing {
 		m := migrations[i]
@@ -793,6 +795,38 @@ func (s *migrationsSuite) TestPopulateWriteACLSomeUpdates(c *gc.C) {
 	})
 }
 
+func (s *migrationsSuite) TestPublishEntitiesStable(c *gc.C) {
+	s.patchMigrations(c, getMigrations("stable channel publication"))
+	id1 := charm.MustParseReference("~who/trusty/django-42")
+	id2 := charm.MustParseReference("~who/utopic/rails-47")
+	s.insertEntity(c, id1, "django", 12)
+	s.insertEntity(c, id2, "rails", 13)
+	uploadTime := time.Now().Add(-time.Hour)
+	err := s.db.Entities().UpdateId(id2, bson.D{{"$set", bson.D{{"uploadtime", uploadTime}}}})
+	c.Assert(err, gc.IsNil)
+
+	// Start the server.
+	err = s.newServer(c)
+	c.Assert(err, gc.IsNil)
+
+	// Ensure the entities have been published in the stable channel.
+	s.checkEntity(c, &mongodoc.Entity{
+		URL:         id1,
+		BaseURL:     baseURL(id1),
+		Name:        "django",
+		Size:        12,
+		Development: true,
+		Stable:      true,
+	})
+	var entity mongodoc.Entity
+	err = s.db.Entities().FindId(id2).One(&entity)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Development, jc.IsTrue)
+	c.Assert(entity.Stable, jc.IsTrue)
+	c.Assert(entity.DevelopmentPublishTime.Equal(entity.UploadTime), jc.IsTrue)
+	c.Assert(entity.StablePublishTime.Equal(entity.UploadTime), jc.IsTrue)
+}
+
 func (s *migrationsSuite) checkEntity(c *gc.C, expectEntity *mongodoc.Entity) {
 	var entity mongodoc.Entity
 	err := s.db.Entities().FindId(expectEntity.URL).One(&entity)
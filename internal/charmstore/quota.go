@@ -0,0 +1,89 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"regexp"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+)
+
+// UserUsage returns the number of entities owned by the given
+// user and the total size in bytes of the blobs stored for them:
+// their archives, the resources of their charms and the chunks of
+// their unexpired uploads. Deleted entities are not included.
+func (s *Store) UserUsage(user string) (entities int, bytes int64, err error) {
+	entities, archiveBytes, err := s.sumSizes(s.DB.Entities(), bson.D{{"user", user}})
+	if err != nil {
+		return 0, 0, errgo.Notef(err, "cannot get usage of user %q", user)
+	}
+	// The base URLs of resources are stored as strings, so
+	// the resources of the user's charms are found by prefix.
+	_, resourceBytes, err := s.sumSizes(s.DB.Resources(), bson.D{{
+		"baseurl", bson.D{{"$regex", "^" + regexp.QuoteMeta("cs:~"+user+"/")}},
+	}})
+	if err != nil {
+		return 0, 0, errgo.Notef(err, "cannot get resource usage of user %q", user)
+	}
+	uploadBytes, err := s.uploadUsage(user)
+	if err != nil {
+		return 0, 0, errgo.Notef(err, "cannot get upload usage of user %q", user)
+	}
+	return entities, archiveBytes + resourceBytes + uploadBytes, nil
+}
+
+// sumSizes returns the number of documents in the given collection
+// that match the given query and the sum of their size fields.
+func (s *Store) sumSizes(c *mgo.Collection, query bson.D) (count int, size int64, err error) {
+	var result struct {
+		Count int
+		Size  int64
+	}
+	err = c.Pipe([]bson.D{
+		{{"$match", query}},
+		{{"$group", bson.D{
+			{"_id", nil},
+			{"count", bson.D{{"$sum", 1}}},
+			{"size", bson.D{{"$sum", "$size"}}},
+		}}},
+	}).One(&result)
+	if err != nil && err != mgo.ErrNotFound {
+		return 0, 0, errgo.Mask(err)
+	}
+	return result.Count, result.Size, nil
+}
+
+// uploadUsage returns the total size of the chunks of the
+// unexpired uploads created by the given user.
+func (s *Store) uploadUsage(user string) (int64, error) {
+	iter := s.DB.Uploads().Find(bson.D{
+		{"user", user},
+		{"expires", bson.D{{"$gt", time.Now()}}},
+	}).Select(bson.D{{"chunks", 1}}).Iter()
+	var upload mongodoc.Upload
+	var size int64
+	for iter.Next(&upload) {
+		size += UploadSize(&upload)
+		upload = mongodoc.Upload{}
+	}
+	if err := iter.Close(); err != nil {
+		return 0, errgo.Mask(err)
+	}
+	return size, nil
+}
+
+// UploadSize returns the total size of the chunks
+// of the given upload.
+func UploadSize(upload *mongodoc.Upload) int64 {
+	var size int64
+	for _, chunk := range upload.Chunks {
+		size += chunk.Size
+	}
+	return size
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+)
+
+func (s *StoreSuite) TestUserUsage(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	entities, bytes, err := store.UserUsage("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entities, gc.Equals, 0)
+	c.Assert(bytes, gc.Equals, int64(0))
+
+	var total int64
+	for _, url := range []string{"~bob/precise/wordpress-0", "~bob/trusty/wordpress-1", "~alice/trusty/wordpress-0"} {
+		id := newResolvedURL(url, -1)
+		err := store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+		if id.URL.User == "bob" {
+			entity, err := store.FindEntity(id, "size")
+			c.Assert(err, gc.IsNil)
+			total += entity.Size
+		}
+	}
+	entities, bytes, err = store.UserUsage("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entities, gc.Equals, 2)
+	c.Assert(bytes, gc.Equals, total)
+}
+
+func (s *StoreSuite) TestUserUsageIncludesResourcesAndUploads(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+
+	id := newResolvedURL("~bob/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	entity, err := store.FindEntity(id, "size")
+	c.Assert(err, gc.IsNil)
+	addResource(c, store, id, "data", "0123456789")
+
+	// Resources of other users with names that share
+	// a prefix with the user's name are not counted.
+	otherId := newResolvedURL("~bobby/precise/wordpress-0", -1)
+	err = store.AddCharmWithArchive(otherId, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	addResource(c, store, otherId, "data", "abc")
+
+	upload, err := store.NewUpload("bob")
+	c.Assert(err, gc.IsNil)
+	s.putUploadChunk(c, store, upload.Id, 0, "01234")
+	s.putUploadChunk(c, store, upload.Id, 1, "567")
+
+	entities, bytes, err := store.UserUsage("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entities, gc.Equals, 1)
+	c.Assert(bytes, gc.Equals, entity.Size+10+8)
+
+	// Expired uploads are not counted.
+	err = store.DB.Uploads().UpdateId(upload.Id, bson.D{{"$set", bson.D{{"expires", time.Now()}}}})
+	c.Assert(err, gc.IsNil)
+	entities, bytes, err = store.UserUsage("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entities, gc.Equals, 1)
+	c.Assert(bytes, gc.Equals, entity.Size+10)
+}
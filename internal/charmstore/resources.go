@@ -0,0 +1,184 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"regexp"
+	"sort"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// validResourceName matches valid charm resource names,
+// for instance "data" or "server-binary".
+var validResourceName = regexp.MustCompile(`^[a-z][a-z0-9]*(-[a-z0-9]+)*$`)
+
+// ValidResourceName reports whether the given
+// name is a valid charm resource name.
+func ValidResourceName(name string) bool {
+	return validResourceName.MatchString(name)
+}
+
+// AddResource adds the data read from r, which must have the given
+// SHA384 hash and size, to the blob store as a new revision of the
+// named resource of the charm with the given id. The new revision is
+// linked to the charm and returned.
+func (s *Store) AddResource(id *router.ResolvedURL, name string, r io.Reader, hash string, size int64) (_ *mongodoc.Resource, err error) {
+	if !ValidResourceName(name) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid resource name %q", name)
+	}
+	entity, err := s.FindEntity(id, "_id", "baseurl")
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if entity.URL.Series == "bundle" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "cannot add resources to a bundle")
+	}
+	// Calculate the SHA256 hash while uploading the blob in the blob store.
+	hash256 := sha256.New()
+	blobName := bson.NewObjectId().Hex()
+	if err := s.BlobStore.PutUnchallenged(io.TeeReader(r, hash256), blobName, size, hash); err != nil {
+		return nil, errgo.Notef(err, "cannot put resource blob")
+	}
+	defer func() {
+		if err != nil {
+			if err := s.BlobStore.Remove(blobName); err != nil {
+				// The blob will be reclaimed by the blob
+				// garbage collector.
+				logger.Errorf("cannot remove blob %q after failed upload: %v", blobName, err)
+			}
+		}
+	}()
+	res := &mongodoc.Resource{
+		BaseURL:     entity.BaseURL,
+		Name:        name,
+		BlobName:    blobName,
+		BlobHash:    hash,
+		BlobHash256: fmt.Sprintf("%x", hash256.Sum(nil)),
+		Size:        size,
+		UploadTime:  time.Now(),
+	}
+	if err := s.insertResource(res); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if err := s.linkResource(entity.URL, name, res.Revision); err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return res, nil
+}
+
+// insertResource inserts the given resource,
+// giving it the next available revision.
+func (s *Store) insertResource(res *mongodoc.Resource) error {
+	// Retry a few times in case revisions are
+	// added concurrently.
+	for i := 0; i < 5; i++ {
+		latest, err := s.FindResource(res.BaseURL, res.Name, -1)
+		switch errgo.Cause(err) {
+		case nil:
+			res.Revision = latest.Revision + 1
+		case params.ErrNotFound:
+			res.Revision = 0
+		default:
+			return errgo.Mask(err)
+		}
+		err = s.DB.Resources().Insert(res)
+		if err == nil {
+			return nil
+		}
+		if !mgo.IsDup(err) {
+			return errgo.Notef(err, "cannot insert resource %q", res.Name)
+		}
+	}
+	return errgo.Newf("cannot find free revision for resource %q", res.Name)
+}
+
+// LinkResource links the given revision of the named resource
+// to the charm with the given id, so that the revision is used
+// whenever the charm is deployed.
+func (s *Store) LinkResource(id *router.ResolvedURL, name string, revision int) error {
+	if _, err := s.FindResource(baseURL(&id.URL), name, revision); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if err := s.linkResource(&id.URL, name, revision); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
+func (s *Store) linkResource(url *charm.Reference, name string, revision int) error {
+	err := s.DB.Entities().UpdateId(url, bson.D{
+		{"$set", bson.D{{"resources." + name, revision}}},
+		incModifications,
+	})
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "entity not found")
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot link resource %q to %s", name, url)
+	}
+	return nil
+}
+
+// FindResource returns the given revision of the named resource of
+// the charm with the given base URL. If revision is -1, the latest
+// revision is returned.
+func (s *Store) FindResource(baseURL *charm.Reference, name string, revision int) (*mongodoc.Resource, error) {
+	q := bson.D{{"baseurl", baseURL}, {"name", name}}
+	if revision != -1 {
+		q = append(q, bson.DocElem{"revision", revision})
+	}
+	var res mongodoc.Resource
+	err := s.DB.Resources().Find(q).Sort("-revision").One(&res)
+	if err == mgo.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "resource %q not found", name)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get resource %q", name)
+	}
+	return &res, nil
+}
+
+// EntityResources returns the resource revisions linked to
+// the charm with the given id, sorted by resource name.
+func (s *Store) EntityResources(id *router.ResolvedURL) ([]*mongodoc.Resource, error) {
+	entity, err := s.FindEntity(id, "baseurl", "resources")
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	names := make([]string, 0, len(entity.Resources))
+	for name := range entity.Resources {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	resources := make([]*mongodoc.Resource, len(names))
+	for i, name := range names {
+		resources[i], err = s.FindResource(entity.BaseURL, name, entity.Resources[name])
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+	}
+	return resources, nil
+}
+
+// OpenResource opens the blob holding the data of the given resource.
+func (s *Store) OpenResource(res *mongodoc.Resource) (blobstore.ReadSeekCloser, error) {
+	r, _, err := s.BlobStore.Open(res.BlobName)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot open resource blob")
+	}
+	return r, nil
+}
@@ -0,0 +1,166 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"io/ioutil"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// addResource adds the given content as a new revision
+// of the named resource of the charm with the given id.
+func addResource(c *gc.C, store *Store, id *router.ResolvedURL, name, content string) *mongodoc.Resource {
+	hash := hashOfReader(c, strings.NewReader(content))
+	res, err := store.AddResource(id, name, strings.NewReader(content), hash, int64(len(content)))
+	c.Assert(err, gc.IsNil)
+	return res
+}
+
+func (s *StoreSuite) TestAddResource(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	url1 := newResolvedURL("~charmers/trusty/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+
+	before := time.Now()
+	res := addResource(c, store, url0, "data", "first")
+	after := time.Now()
+	c.Assert(res.UploadTime, jc.TimeBetween(before, after))
+	c.Assert(res.BlobHash256, gc.Equals, "a7937b64b8caa58f03721bb6bacf5c78cb235febe0e70b1b84cd99541461a08e")
+	res.UploadTime = time.Time{}
+	c.Assert(res, jc.DeepEquals, &mongodoc.Resource{
+		BaseURL:     charm.MustParseReference("cs:~charmers/wordpress"),
+		Name:        "data",
+		Revision:    0,
+		BlobName:    res.BlobName,
+		BlobHash:    hashOfReader(c, strings.NewReader("first")),
+		BlobHash256: res.BlobHash256,
+		Size:        5,
+	})
+	r, err := store.OpenResource(res)
+	c.Assert(err, gc.IsNil)
+	defer r.Close()
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "first")
+
+	// Revisions are shared between all the revisions
+	// of the charm, and only linked to the charm they
+	// are uploaded for.
+	res = addResource(c, store, url1, "data", "second")
+	c.Assert(res.Revision, gc.Equals, 1)
+	addResource(c, store, url1, "config", "third")
+
+	resources, err := store.EntityResources(url0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 1)
+	c.Assert(resources[0].Revision, gc.Equals, 0)
+	resources, err = store.EntityResources(url1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 2)
+	c.Assert(resources[0].Name, gc.Equals, "config")
+	c.Assert(resources[0].Revision, gc.Equals, 0)
+	c.Assert(resources[1].Name, gc.Equals, "data")
+	c.Assert(resources[1].Revision, gc.Equals, 1)
+
+	// The latest revision can be found.
+	res, err = store.FindResource(charm.MustParseReference("~charmers/wordpress"), "data", -1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Revision, gc.Equals, 1)
+}
+
+func (s *StoreSuite) TestAddResourceErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	bundleURL := newResolvedURL("~charmers/bundle/wordpress-simple-0", -1)
+	err = store.AddBundleWithArchive(bundleURL, storetesting.Charms.BundleDir("wordpress-simple"))
+	c.Assert(err, gc.IsNil)
+	hash := hashOfReader(c, strings.NewReader("content"))
+
+	_, err = store.AddResource(url, "Bad_Name", strings.NewReader("content"), hash, 7)
+	c.Assert(err, gc.ErrorMatches, `invalid resource name "Bad_Name"`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	_, err = store.AddResource(bundleURL, "data", strings.NewReader("content"), hash, 7)
+	c.Assert(err, gc.ErrorMatches, `cannot add resources to a bundle`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	_, err = store.AddResource(newResolvedURL("~charmers/precise/wordpress-1", -1), "data", strings.NewReader("content"), hash, 7)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	_, err = store.AddResource(url, "data", strings.NewReader("other"), hash, 5)
+	c.Assert(err, gc.ErrorMatches, `cannot put resource blob: .*`)
+
+	// No resources have been added.
+	resources, err := store.EntityResources(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 0)
+	_, err = store.FindResource(charm.MustParseReference("~charmers/wordpress"), "data", -1)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestLinkResource(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	addResource(c, store, url, "data", "first")
+	addResource(c, store, url, "data", "second")
+
+	err = store.LinkResource(url, "data", 0)
+	c.Assert(err, gc.IsNil)
+	entity, err := store.FindEntity(url, "resources")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Resources, jc.DeepEquals, map[string]int{"data": 0})
+
+	err = store.LinkResource(url, "data", 2)
+	c.Assert(err, gc.ErrorMatches, `resource "data" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.LinkResource(newResolvedURL("~charmers/precise/wordpress-1", -1), "data", 0)
+	c.Assert(err, gc.ErrorMatches, `entity not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestResourceBlobsAreReferenced(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	res := addResource(c, store, url, "data", "first")
+
+	result, err := store.CollectBlobGarbage(BlobGCParams{
+		DryRun: true,
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result.Orphans, gc.HasLen, 0)
+
+	// Resources are removed along with their base entity.
+	removed, err := store.RemoveBaseEntity(charm.MustParseReference("~charmers/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(removed.Blobs, gc.Equals, 2)
+	_, _, err = store.BlobStore.Open(res.BlobName)
+	c.Assert(err, gc.ErrorMatches, `resource at path ".*" not found`)
+	_, err = store.FindResource(charm.MustParseReference("~charmers/wordpress"), "data", -1)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
@@ -0,0 +1,218 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// scrubInterval holds the time between the end of one
+// scrub and the start of the next.
+var scrubInterval = 24 * time.Hour
+
+// scrubBatchSize holds the number of entities that are
+// fetched from the database at a time while scrubbing.
+// Entities are fetched in batches rather than with a
+// single iterator so that the cursor cannot time out
+// when the scrub rate is low.
+const scrubBatchSize = 100
+
+// scrubLease holds the name of the lease that a server must
+// hold to scrub the archives, so that when several servers
+// share a database, only one of them scrubs at a time.
+const scrubLease = "scrub"
+
+// scrubLeaseDuration holds how long the scrub lease lasts, beyond
+// the delay between entities, unless it is renewed. It is also
+// the interval at which servers not holding the lease try to
+// acquire it.
+var scrubLeaseDuration = 10 * time.Minute
+
+// ScrubResult holds the result of Store.ScrubArchives.
+type ScrubResult struct {
+	// Checked holds the number of entities checked.
+	Checked int
+
+	// Problems holds the number of problems found.
+	Problems int
+}
+
+// scrubArchivesForever repeatedly scrubs all the archives
+// in the store, waiting for the given delay before
+// checking each entity. It scrubs only while it holds
+// the scrub lease.
+func (s *Store) scrubArchivesForever(delay time.Duration) {
+	holder := bson.NewObjectId().Hex()
+	for {
+		s.DB.Session.Refresh()
+		scrubbed, err := s.scrubArchivesIfLeased(holder, delay)
+		if err != nil {
+			logger.Errorf("cannot scrub archives: %v", err)
+		}
+		if scrubbed {
+			time.Sleep(scrubInterval)
+		} else {
+			time.Sleep(scrubLeaseDuration)
+		}
+	}
+}
+
+// scrubArchivesIfLeased scrubs the archives as ScrubArchives does
+// if the scrub lease can be acquired on behalf of the given holder,
+// and reports whether it did. The lease is renewed while scrubbing,
+// and then kept until the next scrub is due, so that no other server
+// scrubs in the meantime.
+func (s *Store) scrubArchivesIfLeased(holder string, delay time.Duration) (bool, error) {
+	leaseDuration := scrubLeaseDuration + 2*delay
+	held, err := s.acquireLease(scrubLease, holder, leaseDuration)
+	if err != nil || !held {
+		return false, errgo.Mask(err)
+	}
+	renewed := time.Now()
+	renew := func() error {
+		if time.Since(renewed) < leaseDuration/2 {
+			return nil
+		}
+		held, err := s.acquireLease(scrubLease, holder, leaseDuration)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if !held {
+			return errgo.Newf("scrub lease lost")
+		}
+		renewed = time.Now()
+		return nil
+	}
+	if _, err := s.scrubArchives(delay, renew); err != nil {
+		return true, errgo.Mask(err)
+	}
+	if _, err := s.acquireLease(scrubLease, holder, scrubInterval); err != nil {
+		return true, errgo.Mask(err)
+	}
+	return true, nil
+}
+
+// ScrubArchives reads the archive blob of every entity in the
+// store, checking that its size and hashes match those recorded
+// in the entity. It waits for the given delay before checking
+// each entity so that the load on the blob store can be limited.
+//
+// Each problem found is recorded as an error log of type
+// mongodoc.ScrubType associated with the entity. Info logs
+// are recorded when the scrub starts and completes.
+func (s *Store) ScrubArchives(delay time.Duration) (*ScrubResult, error) {
+	return s.scrubArchives(delay, nil)
+}
+
+// scrubArchives implements ScrubArchives. If renew is not nil,
+// it is called before each entity is checked, and the scrub is
+// abandoned if it returns an error.
+func (s *Store) scrubArchives(delay time.Duration, renew func() error) (*ScrubResult, error) {
+	if err := s.addScrubLog(mongodoc.InfoLevel, params.ScrubStart, nil); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	var result ScrubResult
+	var last *charm.Reference
+	for {
+		var query bson.D
+		if last != nil {
+			query = bson.D{{"_id", bson.D{{"$gt", last}}}}
+		}
+		var entities []*mongodoc.Entity
+		err := s.DB.Entities().
+			Find(query).
+			Select(bson.D{{"_id", 1}, {"promulgated-url", 1}, {"blobname", 1}, {"blobhash", 1}, {"blobhash256", 1}, {"size", 1}}).
+			Sort("_id").
+			Limit(scrubBatchSize).
+			All(&entities)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot fetch entities")
+		}
+		if len(entities) == 0 {
+			break
+		}
+		for _, entity := range entities {
+			time.Sleep(delay)
+			if renew != nil {
+				if err := renew(); err != nil {
+					return nil, errgo.Mask(err)
+				}
+			}
+			problems := s.scrubEntity(entity)
+			urls := []*charm.Reference{entity.URL}
+			if entity.PromulgatedURL != nil {
+				urls = append(urls, entity.PromulgatedURL)
+			}
+			for _, problem := range problems {
+				logger.Errorf("scrub: %s: %s", entity.URL, problem)
+				msg := fmt.Sprintf("%s: %s", entity.URL, problem)
+				if err := s.addScrubLog(mongodoc.ErrorLevel, msg, urls); err != nil {
+					return nil, errgo.Mask(err)
+				}
+			}
+			result.Checked++
+			result.Problems += len(problems)
+		}
+		last = entities[len(entities)-1].URL
+	}
+	msg := fmt.Sprintf("%s: %d entities checked, %d problems found", params.ScrubComplete, result.Checked, result.Problems)
+	if err := s.addScrubLog(mongodoc.InfoLevel, msg, nil); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	logger.Infof("%s", msg)
+	return &result, nil
+}
+
+// scrubEntity checks the archive blob of the given entity,
+// returning a description of each problem found.
+func (s *Store) scrubEntity(entity *mongodoc.Entity) []string {
+	r, _, err := s.BlobStore.Open(entity.BlobName)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot open archive blob %q: %v", entity.BlobName, err)}
+	}
+	defer r.Close()
+	hash := blobstore.NewHash()
+	hash256 := sha256.New()
+	size, err := io.Copy(io.MultiWriter(hash, hash256), r)
+	if err != nil {
+		return []string{fmt.Sprintf("cannot read archive blob %q: %v", entity.BlobName, err)}
+	}
+	var problems []string
+	if size != entity.Size {
+		problems = append(problems, fmt.Sprintf("archive size mismatch: blob holds %d bytes, expected %d", size, entity.Size))
+	}
+	if sum := fmt.Sprintf("%x", hash.Sum(nil)); sum != entity.BlobHash {
+		problems = append(problems, fmt.Sprintf("archive hash mismatch: blob has hash %s, expected %s", sum, entity.BlobHash))
+	}
+	// The SHA256 hash may not have been computed yet for old entities.
+	if sum := fmt.Sprintf("%x", hash256.Sum(nil)); entity.BlobHash256 != "" && sum != entity.BlobHash256 {
+		problems = append(problems, fmt.Sprintf("archive hash256 mismatch: blob has hash %s, expected %s", sum, entity.BlobHash256))
+	}
+	return problems
+}
+
+// addScrubLog adds a scrub log holding the given message.
+func (s *Store) addScrubLog(level mongodoc.LogLevel, msg string, urls []*charm.Reference) error {
+	data, err := json.Marshal(msg)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	rawData := json.RawMessage(data)
+	if err := s.AddLog(&rawData, level, mongodoc.ScrubType, urls); err != nil {
+		return errgo.Notef(err, "cannot add scrub log")
+	}
+	return nil
+}
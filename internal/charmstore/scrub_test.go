@@ -0,0 +1,186 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+func (s *StoreSuite) TestScrubArchives(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	urls := []string{
+		"cs:~charmers/precise/wordpress-0",
+		"cs:~charmers/precise/wordpress-1",
+		"cs:~charmers/precise/wordpress-2",
+		"cs:~charmers/precise/wordpress-3",
+	}
+	for _, url := range urls {
+		err := store.AddCharmWithArchive(newResolvedURL(url, -1), storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+
+	// A clean store has no problems.
+	result, err := store.ScrubArchives(0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &ScrubResult{
+		Checked: 4,
+	})
+	s.assertScrubLogs(c, store, mongodoc.ErrorLevel, nil)
+	s.assertScrubLogs(c, store, mongodoc.InfoLevel, []string{
+		params.ScrubStart,
+		params.ScrubComplete + ": 4 entities checked, 0 problems found",
+	})
+	_, err = store.DB.Logs().RemoveAll(nil)
+	c.Assert(err, gc.IsNil)
+
+	// Remove the blob of one entity and tamper with the
+	// details recorded for two others.
+	var entity mongodoc.Entity
+	err = store.DB.Entities().FindId(charm.MustParseReference(urls[0])).One(&entity)
+	c.Assert(err, gc.IsNil)
+	err = store.UpdateEntity(newResolvedURL(urls[0], -1), bson.D{{"$set", bson.D{{"blobname", "no-such-blob"}}}})
+	c.Assert(err, gc.IsNil)
+	err = store.UpdateEntity(newResolvedURL(urls[1], -1), bson.D{{"$set", bson.D{{"size", entity.Size + 1}}}})
+	c.Assert(err, gc.IsNil)
+	err = store.UpdateEntity(newResolvedURL(urls[2], -1), bson.D{{"$set", bson.D{
+		{"blobhash", "bad-hash"},
+		{"blobhash256", "bad-hash256"},
+	}}})
+	c.Assert(err, gc.IsNil)
+
+	result, err = store.ScrubArchives(0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &ScrubResult{
+		Checked:  4,
+		Problems: 4,
+	})
+	s.assertScrubLogs(c, store, mongodoc.ErrorLevel, []string{
+		urls[0] + `: cannot open archive blob "no-such-blob": resource at path "[^"]+" not found`,
+		urls[1] + fmt.Sprintf(": archive size mismatch: blob holds %d bytes, expected %d", entity.Size, entity.Size+1),
+		urls[2] + `: archive hash mismatch: blob has hash [0-9a-f]+, expected bad-hash`,
+		urls[2] + `: archive hash256 mismatch: blob has hash [0-9a-f]+, expected bad-hash256`,
+	})
+	s.assertScrubLogs(c, store, mongodoc.InfoLevel, []string{
+		params.ScrubStart,
+		params.ScrubComplete + ": 4 entities checked, 4 problems found",
+	})
+
+	// The error logs are associated with the entities.
+	n, err := store.DB.Logs().Find(bson.D{
+		{"level", mongodoc.ErrorLevel},
+		{"urls", charm.MustParseReference(urls[2])},
+	}).Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 2)
+}
+
+func (s *StoreSuite) TestScrubArchivesBatches(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	n := scrubBatchSize + 5
+	for i := 0; i < n; i++ {
+		err := store.DB.Entities().Insert(&mongodoc.Entity{
+			URL:      charm.MustParseReference(fmt.Sprintf("cs:~charmers/precise/wordpress-%d", i)),
+			BlobName: "no-such-blob",
+		})
+		c.Assert(err, gc.IsNil)
+	}
+	result, err := store.ScrubArchives(0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &ScrubResult{
+		Checked:  n,
+		Problems: n,
+	})
+}
+
+// assertScrubLogs asserts that the scrub logs with the given
+// level match the given regular expressions, in order.
+func (s *StoreSuite) assertScrubLogs(c *gc.C, store *Store, level mongodoc.LogLevel, expect []string) {
+	var logs []mongodoc.Log
+	err := store.DB.Logs().Find(bson.D{
+		{"level", level},
+		{"type", mongodoc.ScrubType},
+	}).Sort("time", "_id").All(&logs)
+	c.Assert(err, gc.IsNil)
+	c.Assert(logs, gc.HasLen, len(expect))
+	for i, log := range logs {
+		var msg string
+		err := json.Unmarshal(log.Data, &msg)
+		c.Assert(err, gc.IsNil)
+		c.Assert(msg, gc.Matches, expect[i])
+	}
+}
+
+func (s *StoreSuite) TestScrubArchivesIfLeased(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.AddCharmWithArchive(newResolvedURL("cs:~charmers/precise/wordpress-0", -1), storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+
+	// The first server acquires the lease and scrubs.
+	scrubbed, err := store.scrubArchivesIfLeased("server0", 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(scrubbed, gc.Equals, true)
+
+	// The lease is kept until the next scrub is due,
+	// so another server does not scrub.
+	scrubbed, err = store.scrubArchivesIfLeased("server1", 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(scrubbed, gc.Equals, false)
+	s.assertScrubLogs(c, store, mongodoc.InfoLevel, []string{
+		params.ScrubStart,
+		params.ScrubComplete + ": 1 entities checked, 0 problems found",
+	})
+
+	// The holder of the lease scrubs again when it is due.
+	scrubbed, err = store.scrubArchivesIfLeased("server0", 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(scrubbed, gc.Equals, true)
+
+	// Once the lease has expired, another server can acquire it.
+	s.PatchValue(&scrubInterval, -time.Second)
+	scrubbed, err = store.scrubArchivesIfLeased("server0", 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(scrubbed, gc.Equals, true)
+	scrubbed, err = store.scrubArchivesIfLeased("server1", 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(scrubbed, gc.Equals, true)
+}
+
+func (s *StoreSuite) TestAcquireLease(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	held, err := store.acquireLease("foo", "server0", time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(held, gc.Equals, true)
+
+	// The lease cannot be acquired by another holder
+	// until it expires, but its holder can renew it.
+	held, err = store.acquireLease("foo", "server1", time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(held, gc.Equals, false)
+	held, err = store.acquireLease("foo", "server0", -time.Second)
+	c.Assert(err, gc.IsNil)
+	c.Assert(held, gc.Equals, true)
+	held, err = store.acquireLease("foo", "server1", time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(held, gc.Equals, true)
+
+	// Other leases are independent.
+	held, err = store.acquireLease("bar", "server0", time.Minute)
+	c.Assert(err, gc.IsNil)
+	c.Assert(held, gc.Equals, true)
+}
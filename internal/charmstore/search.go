@@ -7,13 +7,13 @@ import (
 	"crypto/sha1"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"strings"
 	"time"
 
 	"github.com/juju/utils"
 	"gopkg.in/errgo.v1"
 	"gopkg.in/juju/charm.v5"
-	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v4/internal/elasticsearch"
@@ -58,12 +58,24 @@ var deprecatedSeries = map[string]bool{
 	"saucy":   true,
 }
 
+// searchChannels holds the channels that can be searched. The search
+// index holds a separate record for the latest revision of each entity
+// series published in each of these channels.
+var searchChannels = []params.Channel{
+	params.StableChannel,
+	params.DevelopmentChannel,
+}
+
 // SearchDoc is a mongodoc.Entity with additional fields useful for searching.
 // This is the document that is stored in the search index.
 type SearchDoc struct {
 	*mongodoc.Entity
 	TotalDownloads int64
 	ReadACLs       []string
+
+	// Channel holds the channel that the document
+	// is the latest revision for.
+	Channel params.Channel
 }
 
 // UpdateSearchAsync will update the search record for the entity
@@ -77,8 +89,9 @@ func (s *Store) UpdateSearchAsync(r *router.ResolvedURL) {
 }
 
 // UpdateSearch updates the search record for the entity reference r.
-// The search index only includes the latest revision of each entity so
-// the latest revision of the charm specified by r will be indexed.
+// The search index only includes the latest revision of each entity
+// published in each searchable channel, so the latest published
+// revisions of the charm specified by r will be indexed.
 func (s *Store) UpdateSearch(r *router.ResolvedURL) error {
 	if s.ES == nil || s.ES.Database == nil {
 		return nil
@@ -86,26 +99,22 @@ func (s *Store) UpdateSearch(r *router.ResolvedURL) error {
 	if deprecatedSeries[r.URL.Series] {
 		return nil
 	}
-
-	var query *mgo.Query
-	query = s.DB.Entities().Find(bson.D{
-		{"user", r.URL.User},
-		{"name", r.URL.Name},
-		{"series", r.URL.Series},
-	}).Sort("-revision")
-	var entity mongodoc.Entity
-	if err := query.One(&entity); err != nil {
-		if err == mgo.ErrNotFound {
-			return errgo.WithCausef(nil, params.ErrNotFound, "entity not found %s", r)
-		}
-		return errgo.Notef(err, "cannot get %s", r)
-	}
-	baseEntity, err := s.FindBaseEntity(entity.BaseURL)
+	baseEntity, err := s.FindBaseEntity(&r.URL)
 	if err != nil {
-		return errgo.Notef(err, "cannot get %s", entity.BaseURL)
+		return errgo.NoteMask(err, fmt.Sprintf("cannot get base entity of %s", r), errgo.Is(params.ErrNotFound))
 	}
-	if err := s.updateSearchEntity(&entity, baseEntity); err != nil {
-		return errgo.Notef(err, "cannot update search record for %q", entity.URL)
+	for _, channel := range searchChannels {
+		entity, err := s.latestSeriesEntity(&r.URL, channel)
+		if errgo.Cause(err) == params.ErrNotFound {
+			// Nothing has been published in the channel.
+			continue
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if err := s.updateSearchEntity(entity, baseEntity, channel); err != nil {
+			return errgo.Notef(err, "cannot update search record for %q", entity.URL)
+		}
 	}
 	return nil
 }
@@ -156,8 +165,8 @@ func (s *Store) UpdateSearchBaseURL(baseURL *charm.Reference) error {
 	return nil
 }
 
-func (s *Store) updateSearchEntity(entity *mongodoc.Entity, baseEntity *mongodoc.BaseEntity) error {
-	doc, err := s.searchDocFromEntity(entity, baseEntity)
+func (s *Store) updateSearchEntity(entity *mongodoc.Entity, baseEntity *mongodoc.BaseEntity, channel params.Channel) error {
+	doc, err := s.searchDocFromEntity(entity, baseEntity, channel)
 	if err != nil {
 		return errgo.Mask(err)
 	}
@@ -176,9 +185,16 @@ func (s *Store) UpdateSearchFields(r *router.ResolvedURL, fields map[string]inte
 	var needUpdate bool
 	for k := range fields {
 		// Add any additional fields here that should update the search index.
-		if k == "extrainfo.legacy-download-stats" {
+		if k == "extrainfo.legacy-download-stats" || k == "releasenotes" {
 			needUpdate = true
 		}
+		if k == "deprecation" {
+			// Yanking the latest revision means that an earlier
+			// revision may need to replace it in the index.
+			if err := s.updateSearchSeries(&r.URL); err != nil {
+				return errgo.Mask(err)
+			}
+		}
 	}
 	if !needUpdate {
 		return nil
@@ -191,9 +207,9 @@ func (s *Store) UpdateSearchFields(r *router.ResolvedURL, fields map[string]inte
 
 // searchDocFromEntity performs the processing required to convert a
 // mongodoc.Entity and the corresponding mongodoc.BaseEntity to an esDoc
-// for indexing.
-func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity) (*SearchDoc, error) {
-	doc := SearchDoc{Entity: e}
+// for indexing in the given channel.
+func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity, channel params.Channel) (*SearchDoc, error) {
+	doc := SearchDoc{Entity: e, Channel: channel}
 	doc.ReadACLs = be.ACLs.Read
 	// There should only be one record for the promulgated entity, which
 	// should be the latest promulgated revision. In the case that the base
@@ -215,14 +231,21 @@ func (s *Store) searchDocFromEntity(e *mongodoc.Entity, be *mongodoc.BaseEntity)
 // is configured. The entity with id r is extracted from mongodb
 // and written into elasticsearch.
 func (si *SearchIndex) update(doc *SearchDoc) error {
+	return si.put(doc, int64(doc.URL.Revision))
+}
+
+// put writes the given document to elasticsearch with the given
+// version, unless a document with a later version is already
+// present.
+func (si *SearchIndex) put(doc *SearchDoc, version int64) error {
 	if si == nil || si.Database == nil {
 		return nil
 	}
 	err := si.PutDocumentVersionWithType(
 		si.Index,
 		typeName,
-		si.getID(doc.URL),
-		int64(doc.URL.Revision),
+		si.getChannelID(doc.URL, doc.Channel),
+		version,
 		elasticsearch.ExternalGTE,
 		doc)
 	if err != nil && err != elasticsearch.ErrConflict {
@@ -243,6 +266,17 @@ func (si *SearchIndex) getID(r *charm.Reference) string {
 	return strings.TrimRight(s, "=")
 }
 
+// getChannelID returns the ID of the elasticsearch document holding
+// the latest revision of the given entity published in the given channel.
+// Documents in the stable channel keep the ID used before channels
+// were introduced.
+func (si *SearchIndex) getChannelID(r *charm.Reference, channel params.Channel) string {
+	if channel == "" || channel == params.StableChannel {
+		return si.getID(r)
+	}
+	return si.getID(r) + "-" + string(channel)
+}
+
 // Search searches for matching entities in the configured elasticsearch index.
 // If there is no elasticsearch index configured then it will return an empty
 // SearchResult, as if no results were found.
@@ -452,6 +486,9 @@ type SearchParams struct {
 	// Admin searches will not filter on the ACL and will show results for all matching
 	// charms.
 	Admin bool
+	// Channel holds the channel to search. If it is empty, the stable
+	// channel is searched.
+	Channel params.Channel
 	// Sort the returned items.
 	sort []sortParam
 }
@@ -517,6 +554,7 @@ func queryFields(sp SearchParams) map[string]float64 {
 		"CharmRequiredInterfaces": 3,
 		"CharmMeta.Description":   1,
 		"BundleReadMe":            1,
+		"ReleaseNotes":            1,
 	}
 	if sp.AutoComplete {
 		fields["CharmMeta.Name.ngrams"] = 10
@@ -583,7 +621,7 @@ func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
 	// Filters
 	qdsl.Query = elasticsearch.FilteredQuery{
 		Query:  q,
-		Filter: createFilters(sp.Filters, sp.Admin, sp.Groups),
+		Filter: createFilters(sp.Filters, sp.Admin, sp.Groups, sp.Channel),
 	}
 
 	// Sorting
@@ -602,8 +640,17 @@ func createSearchDSL(sp SearchParams) elasticsearch.QueryDSL {
 // that key. The created filter will only match when at least one of the
 // requested values matches for all of the requested keys. Any filter names
 // that are not defined in the filters map will be silently skipped.
-func createFilters(f map[string][]string, admin bool, groups []string) elasticsearch.Filter {
-	af := make(elasticsearch.AndFilter, 0, len(f)+1)
+// Only documents for the given channel, or the stable channel if
+// it is empty, are matched.
+func createFilters(f map[string][]string, admin bool, groups []string, channel params.Channel) elasticsearch.Filter {
+	if channel == "" {
+		channel = params.StableChannel
+	}
+	af := make(elasticsearch.AndFilter, 0, len(f)+2)
+	af = append(af, elasticsearch.TermFilter{
+		Field: "Channel",
+		Value: string(channel),
+	})
 	for k, vals := range f {
 		filter, ok := filters[k]
 		if !ok {
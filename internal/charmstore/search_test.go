@@ -11,6 +11,7 @@ import (
 
 	jc "github.com/juju/testing/checkers"
 	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
 
 	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
 	"gopkg.in/juju/charmstore.v4/internal/router"
@@ -41,7 +42,7 @@ func (s *StoreSearchSuite) SetUpTest(c *gc.C) {
 
 	s.index = SearchIndex{s.ES, s.TestIndex}
 	s.ES.RefreshIndex(".versions")
-	pool, err := NewPool(s.Session.DB("foo"), &s.index, nil)
+	pool, err := NewPool(s.Session.DB("foo"), &s.index, nil, nil)
 	c.Assert(err, gc.IsNil)
 	s.store = pool.Store()
 	s.addCharmsToStore(c)
@@ -88,6 +89,7 @@ func (s *StoreSearchSuite) TestSuccessfulExport(c *gc.C) {
 			Entity:         entity,
 			TotalDownloads: int64(charmDownloadCounts[name]),
 			ReadACLs:       readACLs,
+			Channel:        params.StableChannel,
 		}
 		c.Assert(string(actual), jc.JSONEquals, doc)
 	}
@@ -126,7 +128,7 @@ func (s *StoreSearchSuite) TestExportOnlyLatest(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(old.URL), &actual)
 	c.Assert(err, gc.IsNil)
-	doc := SearchDoc{Entity: expected, ReadACLs: []string{"charmers", params.Everyone}}
+	doc := SearchDoc{Entity: expected, ReadACLs: []string{"charmers", params.Everyone}, Channel: params.StableChannel}
 	c.Assert(string(actual), jc.JSONEquals, doc)
 }
 
@@ -135,7 +137,7 @@ func (s *StoreSearchSuite) TestExportSearchDocument(c *gc.C) {
 	var actual json.RawMessage
 	err := s.store.DB.Entities().FindId("cs:~charmers/precise/wordpress-23").One(&entity)
 	c.Assert(err, gc.IsNil)
-	doc := SearchDoc{Entity: entity, TotalDownloads: 4000}
+	doc := SearchDoc{Entity: entity, TotalDownloads: 4000, Channel: params.StableChannel}
 	err = s.store.ES.update(&doc)
 	c.Assert(err, gc.IsNil)
 	err = s.store.ES.GetDocument(s.TestIndex, typeName, s.store.ES.getID(entity.URL), &actual)
@@ -531,6 +533,24 @@ func (s *StoreSearchSuite) TestLimitTestSearch(c *gc.C) {
 	c.Assert(res.Results, gc.HasLen, 1)
 }
 
+func (s *StoreSearchSuite) TestSearchReleaseNotes(c *gc.C) {
+	url := exportTestCharms["varnish"]
+	fields := map[string]interface{}{
+		"releasenotes": "Added the frobnicator relation.",
+	}
+	err := s.store.UpdateEntity(url, bson.D{{"$set", fields}})
+	c.Assert(err, gc.IsNil)
+	err = s.store.UpdateSearchFields(url, fields)
+	c.Assert(err, gc.IsNil)
+	err = s.store.ES.Database.RefreshIndex(s.TestIndex)
+	c.Assert(err, gc.IsNil)
+	res, err := s.store.Search(SearchParams{
+		Text: "frobnicator",
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(res.Results, jc.DeepEquals, []*router.ResolvedURL{url})
+}
+
 func (s *StoreSearchSuite) TestPromulgatedRank(c *gc.C) {
 	charmArchive := storetesting.Charms.CharmDir("varnish")
 	url := newResolvedURL("cs:~charmers/trusty/varnish-1", 1)
@@ -9,11 +9,14 @@ package charmstore
 import (
 	"net/http"
 	"strings"
+	"time"
 
 	"gopkg.in/errgo.v1"
 	"gopkg.in/macaroon-bakery.v0/bakery"
 	"gopkg.in/mgo.v2"
 
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
+	"gopkg.in/juju/charmstore.v4/internal/policy"
 	"gopkg.in/juju/charmstore.v4/internal/router"
 )
 
@@ -46,6 +49,30 @@ type ServerParams struct {
 	// to be used when querying the identity manager API.
 	IdentityAPIUsername string
 	IdentityAPIPassword string
+
+	// BlobStore holds the store used for archive blobs.
+	// If it is nil, blobs are stored in the database.
+	BlobStore blobstore.Store
+
+	// ScrubRate holds the number of entities per second
+	// checked by the archive integrity scrubber.
+	// If it is zero, the scrubber is not started.
+	ScrubRate float64
+
+	// Policy holds the content policy applied to
+	// uploaded archives. It may be nil.
+	Policy *policy.Policy
+
+	// QuotaMaxEntities and QuotaMaxBytes hold the maximum
+	// number of entities that a user may own and the maximum
+	// total size of their archives, resources and upload chunks.
+	// Zero values mean no limit.
+	QuotaMaxEntities int
+	QuotaMaxBytes    int64
+
+	// DeliverWebhooks specifies that the server delivers
+	// the events in the change feed to registered webhooks.
+	DeliverWebhooks bool
 }
 
 // NewServer returns a handler that serves the given charm store API
@@ -74,7 +101,7 @@ func NewServer(db *mgo.Database, si *SearchIndex, config ServerParams, versions
 		Location: "charmstore",
 		Locator:  config.PublicKeyLocator,
 	}
-	pool, err := NewPool(db, si, &bparams)
+	pool, err := NewPool(db, si, &bparams, config.BlobStore)
 	if err != nil {
 		return nil, errgo.Notef(err, "cannot make store")
 	}
@@ -88,6 +115,17 @@ func NewServer(db *mgo.Database, si *SearchIndex, config ServerParams, versions
 			logger.Errorf("Cannot populate elasticsearch: %v", err)
 		}
 	})
+	if config.ScrubRate > 0 {
+		delay := time.Duration(float64(time.Second) / config.ScrubRate)
+		store.Go(func(store *Store) {
+			store.scrubArchivesForever(delay)
+		})
+	}
+	if config.DeliverWebhooks {
+		store.Go(func(store *Store) {
+			store.deliverWebhooksForever()
+		})
+	}
 	mux := router.NewServeMux()
 	// Version independent API.
 	handle(mux, "/debug", newServiceDebugHandler(pool, config, mux))
@@ -0,0 +1,175 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+	"gopkg.in/juju/charmstore.v4/signature"
+)
+
+// AddPublicKey adds the given PEM-encoded public key to the keys
+// trusted to verify the signatures made by the given user, and
+// returns the stored key. Adding a key that is already trusted
+// returns the existing key.
+func (s *Store) AddPublicKey(user string, data []byte) (*mongodoc.PublicKey, error) {
+	if !validUser(user) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid user name %q", user)
+	}
+	key, err := signature.ParsePublicKey(data)
+	if err != nil {
+		return nil, errgo.WithCausef(err, params.ErrBadRequest, "invalid public key")
+	}
+	id, err := signature.KeyId(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	// Store the key in canonical form.
+	data, err = signature.MarshalPublicKey(key)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	doc := &mongodoc.PublicKey{
+		User:    user,
+		Id:      id,
+		Key:     data,
+		AddTime: time.Now(),
+	}
+	err = s.DB.PublicKeys().Insert(doc)
+	if mgo.IsDup(err) {
+		return s.publicKey(user, id)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot insert public key")
+	}
+	return doc, nil
+}
+
+// PublicKeys returns all the public keys trusted to verify
+// the signatures made by the given user, oldest first.
+func (s *Store) PublicKeys(user string) ([]*mongodoc.PublicKey, error) {
+	var keys []*mongodoc.PublicKey
+	if err := s.DB.PublicKeys().Find(bson.D{{"user", user}}).Sort("addtime", "id").All(&keys); err != nil {
+		return nil, errgo.Notef(err, "cannot get public keys for %q", user)
+	}
+	return keys, nil
+}
+
+// RemovePublicKey removes the public key with the given id from the
+// keys trusted to verify the signatures made by the given user.
+// Signatures already verified with the key are kept but are no
+// longer reported as trusted.
+func (s *Store) RemovePublicKey(user, id string) error {
+	err := s.DB.PublicKeys().Remove(bson.D{{"user", user}, {"id", id}})
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "public key %q not found", id)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot remove public key %q", id)
+	}
+	return nil
+}
+
+// IsTrustedKey reports whether the public key with the given
+// id is trusted to verify the signatures made by the given user.
+func (s *Store) IsTrustedKey(user, id string) (bool, error) {
+	_, err := s.publicKey(user, id)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return false, nil
+	}
+	if err != nil {
+		return false, errgo.Mask(err)
+	}
+	return true, nil
+}
+
+func (s *Store) publicKey(user, id string) (*mongodoc.PublicKey, error) {
+	var key mongodoc.PublicKey
+	err := s.DB.PublicKeys().Find(bson.D{{"user", user}, {"id", id}}).One(&key)
+	if err == mgo.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "public key %q not found", id)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get public key %q", id)
+	}
+	return &key, nil
+}
+
+// AddSignature adds the given detached signature of the archive of the
+// entity with the given id, made by the given user. The signature must
+// be verified by one of the public keys trusted for the user, otherwise
+// an error with a params.ErrBadRequest cause is returned. Any earlier
+// signature verified by the same key is replaced.
+func (s *Store) AddSignature(id *router.ResolvedURL, user string, sig []byte) (*mongodoc.Signature, error) {
+	entity, err := s.FindEntity(id, "_id", "blobhash")
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	doc, err := s.VerifySignature(user, entity.BlobHash, sig)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	// MongoDB cannot pull from and push to the same
+	// array in a single update, so two are required.
+	if err := s.DB.Entities().UpdateId(entity.URL, bson.D{{
+		"$pull", bson.D{{"signatures", bson.D{{"keyid", doc.KeyId}}}},
+	}}); err != nil {
+		return nil, errgo.Notef(err, "cannot remove old signature from %s", entity.URL)
+	}
+	if err := s.DB.Entities().UpdateId(entity.URL, bson.D{
+		{"$push", bson.D{{"signatures", doc}}},
+		incModifications,
+	}); err != nil {
+		return nil, errgo.Notef(err, "cannot add signature to %s", entity.URL)
+	}
+	return doc, nil
+}
+
+// VerifySignature checks that the given detached signature of an
+// archive with the given hash was made by the given user, and returns
+// the signature as it would be stored. The signature must be verified
+// by one of the public keys trusted for the user, otherwise an error
+// with a params.ErrBadRequest cause is returned.
+func (s *Store) VerifySignature(user, hash string, sig []byte) (*mongodoc.Signature, error) {
+	keys, err := s.PublicKeys(user)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if len(keys) == 0 {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "no public keys found for user %q", user)
+	}
+	for _, k := range keys {
+		key, err := signature.ParsePublicKey(k.Key)
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse public key %q", k.Id)
+		}
+		err = signature.Verify(key, hash, sig)
+		if err == nil {
+			return &mongodoc.Signature{
+				User:      user,
+				KeyId:     k.Id,
+				Signature: sig,
+				Time:      time.Now(),
+			}, nil
+		}
+		if err != signature.ErrVerificationFailed {
+			return nil, errgo.Notef(err, "cannot verify signature")
+		}
+	}
+	return nil, errgo.WithCausef(nil, params.ErrBadRequest, "signature not verified by any public key of user %q", user)
+}
+
+// validUser reports whether the given name is a valid user name.
+func validUser(user string) bool {
+	url, err := charm.ParseReference("cs:~" + user + "/x")
+	return err == nil && url.User == user && url.Series == ""
+}
@@ -0,0 +1,161 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+	"gopkg.in/juju/charmstore.v4/signature"
+)
+
+func newSigningKey(c *gc.C) (*ecdsa.PrivateKey, []byte) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	data, err := signature.MarshalPublicKey(key.Public())
+	c.Assert(err, gc.IsNil)
+	return key, data
+}
+
+func (s *StoreSuite) TestPublicKeys(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	key0, data0 := newSigningKey(c)
+	_, data1 := newSigningKey(c)
+	id0, err := signature.KeyId(key0.Public())
+	c.Assert(err, gc.IsNil)
+
+	before := time.Now()
+	doc0, err := store.AddPublicKey("bob", data0)
+	c.Assert(err, gc.IsNil)
+	after := time.Now()
+	c.Assert(doc0.AddTime, jc.TimeBetween(before, after))
+	c.Assert(doc0.User, gc.Equals, "bob")
+	c.Assert(doc0.Id, gc.Equals, id0)
+	c.Assert(string(doc0.Key), gc.Equals, string(data0))
+
+	// Adding the same key again returns the existing key.
+	doc, err := store.AddPublicKey("bob", data0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(doc.Id, gc.Equals, doc0.Id)
+	c.Assert(doc.AddTime.Equal(doc0.AddTime), jc.IsTrue)
+
+	doc1, err := store.AddPublicKey("bob", data1)
+	c.Assert(err, gc.IsNil)
+
+	keys, err := store.PublicKeys("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 2)
+	c.Assert(keys[0].Id, gc.Equals, doc0.Id)
+	c.Assert(keys[1].Id, gc.Equals, doc1.Id)
+
+	trusted, err := store.IsTrustedKey("bob", doc0.Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(trusted, jc.IsTrue)
+	trusted, err = store.IsTrustedKey("alice", doc0.Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(trusted, jc.IsFalse)
+
+	err = store.RemovePublicKey("bob", doc0.Id)
+	c.Assert(err, gc.IsNil)
+	trusted, err = store.IsTrustedKey("bob", doc0.Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(trusted, jc.IsFalse)
+	err = store.RemovePublicKey("bob", doc0.Id)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	c.Assert(err, gc.ErrorMatches, `public key "[0-9a-f]+" not found`)
+
+	keys, err = store.PublicKeys("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(keys, gc.HasLen, 1)
+	c.Assert(keys[0].Id, gc.Equals, doc1.Id)
+}
+
+func (s *StoreSuite) TestAddPublicKeyErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	_, data := newSigningKey(c)
+	_, err := store.AddPublicKey("bad/user", data)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	c.Assert(err, gc.ErrorMatches, `invalid user name "bad/user"`)
+	_, err = store.AddPublicKey("bob", []byte("bad key"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	c.Assert(err, gc.ErrorMatches, `invalid public key: no PEM data found`)
+}
+
+func (s *StoreSuite) TestAddSignature(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	entity, err := store.FindEntity(url, "blobhash")
+	c.Assert(err, gc.IsNil)
+
+	key, data := newSigningKey(c)
+	sig, err := signature.Sign(key, entity.BlobHash)
+	c.Assert(err, gc.IsNil)
+
+	// The signature cannot be added until the user has a key.
+	_, err = store.AddSignature(url, "bob", sig)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	c.Assert(err, gc.ErrorMatches, `no public keys found for user "bob"`)
+
+	// A key of another user does not verify the signature.
+	_, err = store.AddPublicKey("alice", data)
+	c.Assert(err, gc.IsNil)
+	otherKey, otherData := newSigningKey(c)
+	_, err = store.AddPublicKey("bob", otherData)
+	c.Assert(err, gc.IsNil)
+	_, err = store.AddSignature(url, "bob", sig)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	c.Assert(err, gc.ErrorMatches, `signature not verified by any public key of user "bob"`)
+
+	keyDoc, err := store.AddPublicKey("bob", data)
+	c.Assert(err, gc.IsNil)
+	before := time.Now()
+	doc, err := store.AddSignature(url, "bob", sig)
+	c.Assert(err, gc.IsNil)
+	after := time.Now()
+	c.Assert(doc.Time, jc.TimeBetween(before, after))
+	c.Assert(doc.KeyId, gc.Equals, keyDoc.Id)
+
+	// Signing again with the same key replaces the signature,
+	// while a signature with another key is added.
+	sig1, err := signature.Sign(key, entity.BlobHash)
+	c.Assert(err, gc.IsNil)
+	_, err = store.AddSignature(url, "bob", sig1)
+	c.Assert(err, gc.IsNil)
+	sig2, err := signature.Sign(otherKey, entity.BlobHash)
+	c.Assert(err, gc.IsNil)
+	_, err = store.AddSignature(url, "bob", sig2)
+	c.Assert(err, gc.IsNil)
+
+	entity, err = store.FindEntity(url, "signatures")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Signatures, gc.HasLen, 2)
+	for i := range entity.Signatures {
+		entity.Signatures[i].Time = time.Time{}
+	}
+	otherId, err := signature.KeyId(otherKey.Public())
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Signatures, jc.DeepEquals, []mongodoc.Signature{{
+		User:      "bob",
+		KeyId:     keyDoc.Id,
+		Signature: sig1,
+	}, {
+		User:      "bob",
+		KeyId:     otherId,
+		Signature: sig2,
+	}})
+}
@@ -200,6 +200,73 @@ func (s *Store) IncCounterAtTime(key []string, t time.Time) error {
 	return err
 }
 
+// RemoveCounters removes all the counters with the given key and,
+// if prefix is true, all the counters with keys that begin with it.
+// It returns the number of counter data points removed.
+func (s *Store) RemoveCounters(key []string, prefix bool) (int, error) {
+	skey, err := s.stats.key(s.DB, key, false)
+	if errgo.Cause(err) == params.ErrNotFound {
+		// No counter has ever been recorded with the key.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	regex := "^" + skey + "$"
+	if prefix {
+		regex = "^" + skey
+	}
+	info, err := s.DB.StatCounters().RemoveAll(bson.D{{"k", bson.D{{"$regex", regex}}}})
+	if err != nil {
+		return 0, errgo.Notef(err, "cannot remove counters")
+	}
+	return info.Removed, nil
+}
+
+// MoveCounters moves all the counters with keys that begin with the
+// from key so that they begin with the to key instead, adding them to
+// any counters already recorded under the new keys. It returns the
+// number of counter data points moved.
+func (s *Store) MoveCounters(from, to []string) (int, error) {
+	fromKey, err := s.stats.key(s.DB, from, false)
+	if errgo.Cause(err) == params.ErrNotFound {
+		// No counter has ever been recorded with the key.
+		return 0, nil
+	}
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	toKey, err := s.stats.key(s.DB, to, true)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	counters := s.DB.StatCounters()
+	iter := counters.Find(bson.D{{"k", bson.D{{"$regex", "^" + fromKey}}}}).Iter()
+	var counter struct {
+		Id    bson.ObjectId `bson:"_id"`
+		Key   string        `bson:"k"`
+		Time  int32         `bson:"t"`
+		Count int           `bson:"c"`
+	}
+	n := 0
+	for iter.Next(&counter) {
+		key := toKey + strings.TrimPrefix(counter.Key, fromKey)
+		if _, err := counters.Upsert(bson.D{{"k", key}, {"t", counter.Time}}, bson.D{{"$inc", bson.D{{"c", counter.Count}}}}); err != nil {
+			iter.Close()
+			return n, errgo.Notef(err, "cannot update counter")
+		}
+		if err := counters.RemoveId(counter.Id); err != nil {
+			iter.Close()
+			return n, errgo.Notef(err, "cannot remove counter")
+		}
+		n++
+	}
+	if err := iter.Close(); err != nil {
+		return n, errgo.Notef(err, "cannot iterate counters")
+	}
+	return n, nil
+}
+
 // CounterRequest represents a request to aggregate counter values.
 type CounterRequest struct {
 	// Key and Prefix determine the counter keys to match.
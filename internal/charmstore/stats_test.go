@@ -29,7 +29,7 @@ var _ = gc.Suite(&StatsSuite{})
 
 func (s *StatsSuite) SetUpTest(c *gc.C) {
 	s.IsolatedMgoSuite.SetUpTest(c)
-	pool, err := charmstore.NewPool(s.Session.DB("foo"), nil, nil)
+	pool, err := charmstore.NewPool(s.Session.DB("foo"), nil, nil, nil)
 	c.Assert(err, gc.IsNil)
 	s.store = pool.Store()
 }
@@ -269,7 +269,7 @@ func (s *StatsSuite) TestListCounters(c *gc.C) {
 	}
 
 	// Use a different store to exercise cache filling.
-	pool, err := charmstore.NewPool(s.store.DB.Database, nil, nil)
+	pool, err := charmstore.NewPool(s.store.DB.Database, nil, nil, nil)
 	c.Assert(err, gc.IsNil)
 	st := pool.Store()
 	defer st.Close()
@@ -9,6 +9,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	"github.com/juju/loggo"
@@ -33,7 +34,7 @@ var logger = loggo.GetLogger("charmstore.internal.charmstore")
 // to access and modify the store.
 type Pool struct {
 	db        StoreDatabase
-	blobStore *blobstore.Store
+	blobStore blobstore.Store
 	es        *SearchIndex
 	Bakery    *bakery.Service
 	stats     stats
@@ -43,10 +44,15 @@ type Pool struct {
 // and search index. If bakeryParams is not nil,
 // the Bakery field in the resulting Store will be set
 // to a new Service that stores macaroons in mongo.
-func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceParams) (*Pool, error) {
+// If blobStore is nil, archive blobs will be stored
+// in the given database.
+func NewPool(db *mgo.Database, si *SearchIndex, bakeryParams *bakery.NewServiceParams, blobStore blobstore.Store) (*Pool, error) {
+	if blobStore == nil {
+		blobStore = blobstore.New(db, "entitystore")
+	}
 	p := &Pool{
 		db:        StoreDatabase{db},
-		blobStore: blobstore.New(db, "entitystore"),
+		blobStore: blobStore,
 		es:        si,
 	}
 	store := p.Store()
@@ -95,7 +101,7 @@ func (p *Pool) Store() *Store {
 // data stores that is appropriate for short term use.
 type Store struct {
 	DB        StoreDatabase
-	BlobStore *blobstore.Store
+	BlobStore blobstore.Store
 	ES        *SearchIndex
 	Bakery    *bakery.Service
 	stats     *stats
@@ -151,6 +157,9 @@ func (s *Store) Pool() *Pool {
 }
 
 func (s *Store) ensureIndexes() error {
+	if err := s.ensureEventsCollection(); err != nil {
+		return errgo.Mask(err)
+	}
 	indexes := []struct {
 		c *mgo.Collection
 		i mgo.Index
@@ -166,6 +175,9 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.Entities(),
 		mgo.Index{Key: []string{"uploadtime"}},
+	}, {
+		s.DB.Entities(),
+		mgo.Index{Key: []string{"user"}},
 	}, {
 		s.DB.Entities(),
 		mgo.Index{Key: []string{"promulgated-url"}, Unique: true, Sparse: true},
@@ -175,6 +187,42 @@ func (s *Store) ensureIndexes() error {
 	}, {
 		s.DB.Logs(),
 		mgo.Index{Key: []string{"urls"}},
+	}, {
+		s.DB.Uploads(),
+		mgo.Index{Key: []string{"expires"}},
+	}, {
+		s.DB.Uploads(),
+		mgo.Index{Key: []string{"user"}},
+	}, {
+		s.DB.ContentChallenges(),
+		mgo.Index{Key: []string{"expires"}},
+	}, {
+		s.DB.DeletedEntities(),
+		mgo.Index{Key: []string{"baseurl"}},
+	}, {
+		s.DB.DeletedEntities(),
+		mgo.Index{Key: []string{"expires"}},
+	}, {
+		s.DB.Redirects(),
+		mgo.Index{Key: []string{"target"}},
+	}, {
+		s.DB.Resources(),
+		mgo.Index{Key: []string{"baseurl", "name", "revision"}, Unique: true},
+	}, {
+		s.DB.PublicKeys(),
+		mgo.Index{Key: []string{"user", "id"}, Unique: true},
+	}, {
+		s.DB.Webhooks(),
+		mgo.Index{Key: []string{"user"}},
+	}, {
+		s.DB.WebhookDeliveries(),
+		mgo.Index{Key: []string{"webhookid", "time"}},
+	}, {
+		s.DB.WebhookDeliveries(),
+		mgo.Index{Key: []string{"status", "nextattempt"}},
+	}, {
+		s.DB.WebhookDeliveries(),
+		mgo.Index{Key: []string{"time"}, ExpireAfter: webhookDeliveryRetention},
 	}}
 	for _, idx := range indexes {
 		err := idx.c.EnsureIndex(idx.i)
@@ -206,7 +254,8 @@ func (s *Store) putArchive(archive blobstore.ReadSeekCloser) (blobName, blobHash
 // AddCharmWithArchive is like AddCharm but
 // also adds the charm archive to the blob store.
 // This method is provided principally so that
-// tests can easily create content in the store.
+// tests can easily create content in the store,
+// so the charm is published in the stable channel.
 //
 // If purl is not nil then the charm will also be
 // available at the promulgated url specified.
@@ -221,13 +270,15 @@ func (s *Store) AddCharmWithArchive(url *router.ResolvedURL, ch charm.Charm) err
 		BlobHash:    blobHash,
 		BlobHash256: blobHash256,
 		BlobSize:    blobSize,
+		Channel:     params.StableChannel,
 	})
 }
 
 // AddBundleWithArchive is like AddBundle but
 // also adds the charm archive to the blob store.
 // This method is provided principally so that
-// tests can easily create content in the store.
+// tests can easily create content in the store,
+// so the bundle is published in the stable channel.
 //
 // If purl is not nil then the bundle will also be
 // available at the promulgated url specified.
@@ -245,6 +296,7 @@ func (s *Store) AddBundleWithArchive(url *router.ResolvedURL, b charm.Bundle) er
 		BlobHash:    blobHash,
 		BlobHash256: blobHash256,
 		BlobSize:    size,
+		Channel:     params.StableChannel,
 	})
 }
 
@@ -280,6 +332,23 @@ type AddParams struct {
 	// Contents holds references to files inside the
 	// entity's archive blob.
 	Contents map[mongodoc.FileId]mongodoc.ZipFile
+
+	// Channel holds the channel in which the entity is
+	// published when it is added. If it is empty, the
+	// entity is not published.
+	Channel params.Channel
+
+	// ReleaseNotes optionally holds the release
+	// notes of the entity.
+	ReleaseNotes string
+
+	// Appearance optionally holds the appearance
+	// of a charm, derived from its icon.
+	Appearance *mongodoc.Appearance
+
+	// Signatures optionally holds verified signatures
+	// of the entity's archive blob (see VerifySignature).
+	Signatures []mongodoc.Signature
 }
 
 // AddCharm adds a charm entities collection with the given
@@ -311,9 +380,15 @@ func (s *Store) AddCharm(c charm.Charm, p AddParams) (err error) {
 		CharmProvidedInterfaces: interfacesForRelations(c.Meta().Provides),
 		CharmRequiredInterfaces: interfacesForRelations(c.Meta().Requires),
 		Contents:                p.Contents,
+		ReleaseNotes:            p.ReleaseNotes,
+		Appearance:              p.Appearance,
+		Signatures:              p.Signatures,
 		PromulgatedURL:          p.URL.PromulgatedURL(),
 		PromulgatedRevision:     p.URL.PromulgatedRevision,
 	}
+	if err := setPublished(entity, p.Channel, entity.UploadTime); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 
 	// Check that we're not going to create a charm that duplicates
 	// the name of a bundle. This is racy, but it's the best we can do.
@@ -352,6 +427,7 @@ func (s *Store) insertEntity(entity *mongodoc.Entity) (err error) {
 	if err != nil && !mgo.IsDup(err) {
 		return errgo.Notef(err, "cannot insert base entity")
 	}
+	baseExisted := err != nil
 
 	// Add the entity to the database.
 	err = s.DB.Entities().Insert(entity)
@@ -375,6 +451,23 @@ func (s *Store) insertEntity(entity *mongodoc.Entity) (err error) {
 	if err := s.UpdateSearch(EntityResolvedURL(entity)); err != nil {
 		return errgo.Notef(err, "cannot index %s to ElasticSearch", entity.URL)
 	}
+	if baseExisted {
+		// The new revision changes the metadata of the other
+		// revisions, such as their revision info.
+		if err := s.DB.BaseEntities().UpdateId(entity.BaseURL, bson.D{incModifications}); err != nil {
+			return errgo.Notef(err, "cannot update base entity %s", entity.BaseURL)
+		}
+	}
+	var channel params.Channel
+	switch {
+	case entity.Stable:
+		channel = params.StableChannel
+	case entity.Development:
+		channel = params.DevelopmentChannel
+	}
+	if err := s.addEntityEvent(params.EventUpload, entity, channel); err != nil {
+		return errgo.Mask(err)
+	}
 	return nil
 }
 
@@ -413,15 +506,21 @@ func (s *Store) FindEntities(url *charm.Reference, fields ...string) ([]*mongodo
 // FindBestEntity finds the entity that provides the preferred match to
 // the given URL. If any fields are specified, only those fields will be
 // populated in the returned entities. If the given URL has no user then
-// only promulgated entities will be queried.
-func (s *Store) FindBestEntity(url *charm.Reference, fields ...string) (*mongodoc.Entity, error) {
+// only promulgated entities will be queried. Unless the URL specifies
+// both series and revision, only entities published in the given
+// channel that have not been yanked will be considered.
+func (s *Store) FindBestEntity(url *charm.Reference, channel params.Channel, fields ...string) (*mongodoc.Entity, error) {
 	if len(fields) > 0 {
 		// Make sure we have all the fields we need to make a decision.
 		fields = append(fields, "_id", "promulgated-url", "promulgated-revision", "series", "revision")
 	}
-	entities, err := s.FindEntities(url, fields...)
+	query, err := s.ChannelEntitiesQuery(url, channel)
 	if err != nil {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	var entities []*mongodoc.Entity
+	if err := selectFields(query, fields).All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities matching %s", url)
 	}
 	if len(entities) == 0 {
 		return nil, errgo.WithCausef(nil, params.ErrNotFound, "entity not found")
@@ -474,7 +573,15 @@ func (s *Store) EntitiesQuery(url *charm.Reference) *mgo.Query {
 		return s.DB.Entities().Find(bson.D{{"promulgated-url", url}})
 	}
 	// Find all entities matching the URL.
-	q := make(bson.D, 0, 3)
+	return s.DB.Entities().Find(entitiesFilter(url))
+}
+
+// entitiesFilter returns a query document that matches all the
+// entities matching the given URL, which should not specify both
+// series and revision. If the URL has no user, only promulgated
+// entities are matched.
+func entitiesFilter(url *charm.Reference) bson.D {
+	q := make(bson.D, 0, 4)
 	q = append(q, bson.DocElem{"name", url.Name})
 	if url.User != "" {
 		q = append(q, bson.DocElem{"user", url.User})
@@ -492,7 +599,7 @@ func (s *Store) EntitiesQuery(url *charm.Reference) *mgo.Query {
 			q = append(q, bson.DocElem{"promulgated-revision", url.Revision})
 		}
 	}
-	return s.DB.Entities().Find(q)
+	return q
 }
 
 // FindBaseEntity finds the base entity in the store using the given URL,
@@ -528,9 +635,11 @@ func selectFields(query *mgo.Query, fields []string) *mgo.Query {
 	return query
 }
 
-// UpdateEntity applies the provided update to the entity described by url.
+// UpdateEntity applies the provided update to the entity described by
+// url. If the update is a bson.D holding update operators, the
+// modification counter of the entity is incremented too.
 func (s *Store) UpdateEntity(url *router.ResolvedURL, update interface{}) error {
-	if err := s.DB.Entities().Update(bson.D{{"_id", &url.URL}}, update); err != nil {
+	if err := s.DB.Entities().Update(bson.D{{"_id", &url.URL}}, withIncModifications(update)); err != nil {
 		if err == mgo.ErrNotFound {
 			return errgo.WithCausef(err, params.ErrNotFound, "cannot update %q", url)
 		}
@@ -539,9 +648,11 @@ func (s *Store) UpdateEntity(url *router.ResolvedURL, update interface{}) error
 	return nil
 }
 
-// UpdateBaseEntity applies the provided update to the base entity of url.
+// UpdateBaseEntity applies the provided update to the base entity of
+// url. As with UpdateEntity, the modification counter of the base
+// entity is incremented too.
 func (s *Store) UpdateBaseEntity(url *router.ResolvedURL, update interface{}) error {
-	if err := s.DB.BaseEntities().Update(bson.D{{"_id", baseURL(&url.URL)}}, update); err != nil {
+	if err := s.DB.BaseEntities().Update(bson.D{{"_id", baseURL(&url.URL)}}, withIncModifications(update)); err != nil {
 		if err == mgo.ErrNotFound {
 			return errgo.WithCausef(err, params.ErrNotFound, "cannot update base entity for %q", url)
 		}
@@ -550,6 +661,138 @@ func (s *Store) UpdateBaseEntity(url *router.ResolvedURL, update interface{}) er
 	return nil
 }
 
+// UpdateEntityIfUnmodified is like UpdateEntity except that the update
+// is made only if the modification counter of the entity still holds
+// the given value, so that it cannot overwrite changes made since the
+// counter was read. Otherwise, or if the entity does not exist, it
+// returns an error with a params.ErrPreconditionFailed cause.
+func (s *Store) UpdateEntityIfUnmodified(url *router.ResolvedURL, modifications int, update interface{}) error {
+	selector := bson.D{{"_id", &url.URL}, modificationsSelector(modifications)}
+	if err := s.DB.Entities().Update(selector, withIncModifications(update)); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrPreconditionFailed, "%q has been modified", url)
+		}
+		return errgo.Notef(err, "cannot update %q", url)
+	}
+	return nil
+}
+
+// UpdateBaseEntityIfUnmodified is like UpdateBaseEntity except that,
+// as with UpdateEntityIfUnmodified, the update is made only if the
+// modification counter of the base entity still holds the given value.
+func (s *Store) UpdateBaseEntityIfUnmodified(url *router.ResolvedURL, modifications int, update interface{}) error {
+	selector := bson.D{{"_id", baseURL(&url.URL)}, modificationsSelector(modifications)}
+	if err := s.DB.BaseEntities().Update(selector, withIncModifications(update)); err != nil {
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrPreconditionFailed, "base entity for %q has been modified", url)
+		}
+		return errgo.Notef(err, "cannot update base entity for %q", url)
+	}
+	return nil
+}
+
+// modificationsSelector returns a selector element that matches
+// documents whose modification counter holds the given value.
+// Note that a zero counter is not stored in the document.
+func modificationsSelector(modifications int) bson.DocElem {
+	if modifications == 0 {
+		return bson.DocElem{"modifications", bson.D{{"$in", []interface{}{nil, 0}}}}
+	}
+	return bson.DocElem{"modifications", modifications}
+}
+
+// incModifications holds the update operator that increments the
+// modification counter of an entity or base entity. It should be
+// part of every update that changes the metadata of either.
+var incModifications = bson.DocElem{"$inc", bson.D{{"modifications", 1}}}
+
+// withIncModifications returns the given update with the modification
+// counter incremented, if the update is a bson.D holding update
+// operators. Otherwise it returns the update unchanged.
+func withIncModifications(update interface{}) interface{} {
+	doc, ok := update.(bson.D)
+	if !ok || len(doc) == 0 {
+		return update
+	}
+	newDoc := make(bson.D, 0, len(doc)+1)
+	merged := false
+	for _, elem := range doc {
+		if !strings.HasPrefix(elem.Name, "$") {
+			// It is a replacement document.
+			return update
+		}
+		if inc, ok := elem.Value.(bson.D); ok && elem.Name == "$inc" {
+			elem.Value = append(append(bson.D(nil), inc...), incModifications.Value.(bson.D)...)
+			merged = true
+		}
+		newDoc = append(newDoc, elem)
+	}
+	if !merged {
+		newDoc = append(newDoc, incModifications)
+	}
+	return newDoc
+}
+
+// EntityFields returns the current values of the given fields of the
+// entity described by url. Each field may be a dotted path to a field
+// in an embedded document. Fields that are not set have no entry in
+// the returned map.
+func (s *Store) EntityFields(url *router.ResolvedURL, fields []string) (map[string]interface{}, error) {
+	values, err := fieldValues(s.DB.Entities().FindId(&url.URL), fields)
+	if err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get fields of %q", url), errgo.Is(params.ErrNotFound))
+	}
+	return values, nil
+}
+
+// BaseEntityFields is like EntityFields except that it returns
+// the values of fields of the base entity of url.
+func (s *Store) BaseEntityFields(url *router.ResolvedURL, fields []string) (map[string]interface{}, error) {
+	values, err := fieldValues(s.DB.BaseEntities().FindId(baseURL(&url.URL)), fields)
+	if err != nil {
+		return nil, errgo.NoteMask(err, fmt.Sprintf("cannot get fields of base entity for %q", url), errgo.Is(params.ErrNotFound))
+	}
+	return values, nil
+}
+
+// fieldValues returns the values of the given fields
+// in the document returned by the given query.
+func fieldValues(query *mgo.Query, fields []string) (map[string]interface{}, error) {
+	values := make(map[string]interface{})
+	if len(fields) == 0 {
+		return values, nil
+	}
+	var doc bson.M
+	if err := selectFields(query, fields).One(&doc); err != nil {
+		if err == mgo.ErrNotFound {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "document not found")
+		}
+		return nil, errgo.Mask(err)
+	}
+	for _, field := range fields {
+		if val, ok := lookupField(doc, field); ok {
+			values[field] = val
+		}
+	}
+	return values, nil
+}
+
+// lookupField returns the value of the given
+// possibly dotted field in doc, if it is set.
+func lookupField(doc bson.M, field string) (interface{}, bool) {
+	var val interface{} = doc
+	for _, name := range strings.Split(field, ".") {
+		m, ok := val.(bson.M)
+		if !ok {
+			return nil, false
+		}
+		if val, ok = m[name]; !ok {
+			return nil, false
+		}
+	}
+	return val, true
+}
+
 // SetPromulgated sets whether the base entity of url is promulgated, If
 // promulgated is true it also unsets promulgated on any other base
 // entity for entities with the same name. It also calculates the next
@@ -574,7 +817,10 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 	if !promulgate {
 		err := baseEntities.UpdateId(
 			base,
-			bson.D{{"$set", bson.D{{"promulgated", mongodoc.IntBool(false)}}}},
+			bson.D{
+				{"$set", bson.D{{"promulgated", mongodoc.IntBool(false)}}},
+				incModifications,
+			},
 		)
 		if err != nil {
 			if errgo.Cause(err) == mgo.ErrNotFound {
@@ -585,6 +831,9 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 		if err := s.UpdateSearchBaseURL(base); err != nil {
 			return errgo.Notef(err, "cannot update search entities for %q", base)
 		}
+		if err := s.addBaseEntityEvent(params.EventPromulgate, base, nil); err != nil {
+			return errgo.Mask(err)
+		}
 		return nil
 	}
 
@@ -603,7 +852,10 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 	for iter.Next(&baseEntity) {
 		err := baseEntities.UpdateId(
 			baseEntity.URL,
-			bson.D{{"$set", bson.D{{"promulgated", mongodoc.IntBool(false)}}}},
+			bson.D{
+				{"$set", bson.D{{"promulgated", mongodoc.IntBool(false)}}},
+				incModifications,
+			},
 		)
 		if err != nil {
 			return errgo.Notef(err, "cannot unpromulgate base entity %q", baseEntity.URL)
@@ -611,13 +863,19 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 		if err := s.UpdateSearchBaseURL(baseEntity.URL); err != nil {
 			return errgo.Notef(err, "cannot update search entities for %q", baseEntity.URL)
 		}
+		if err := s.addBaseEntityEvent(params.EventPromulgate, baseEntity.URL, nil); err != nil {
+			return errgo.Mask(err)
+		}
 	}
 	if err := iter.Close(); err != nil {
 		return errgo.Notef(err, "cannot close mgo iterator")
 	}
 
 	// Set the promulgated flag on the base entity.
-	err := s.DB.BaseEntities().UpdateId(base, bson.D{{"$set", bson.D{{"promulgated", mongodoc.IntBool(true)}}}})
+	err := s.DB.BaseEntities().UpdateId(base, bson.D{
+		{"$set", bson.D{{"promulgated", mongodoc.IntBool(true)}}},
+		incModifications,
+	})
 	if err != nil {
 		if errgo.Cause(err) == mgo.ErrNotFound {
 			return errgo.WithCausef(nil, params.ErrNotFound, "base entity %q not found", base)
@@ -681,6 +939,7 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 					{"promulgated-url", &pID},
 					{"promulgated-revision", pID.Revision},
 				}},
+				incModifications,
 			},
 		)
 		if err != nil && err != mgo.ErrNotFound {
@@ -694,6 +953,9 @@ func (s *Store) SetPromulgated(url *router.ResolvedURL, promulgate bool) error {
 	if err := s.UpdateSearchBaseURL(base); err != nil {
 		return errgo.Notef(err, "cannot update search entities for %q", base)
 	}
+	if err := s.addBaseEntityEvent(params.EventPromulgate, base, nil); err != nil {
+		return errgo.Mask(err)
+	}
 	return nil
 }
 
@@ -752,9 +1014,14 @@ func (s *Store) AddBundle(b charm.Bundle, p AddParams) error {
 		BundleReadMe:        b.ReadMe(),
 		BundleCharms:        urls,
 		Contents:            p.Contents,
+		ReleaseNotes:        p.ReleaseNotes,
+		Signatures:          p.Signatures,
 		PromulgatedURL:      p.URL.PromulgatedURL(),
 		PromulgatedRevision: p.URL.PromulgatedRevision,
 	}
+	if err := setPublished(entity, p.Channel, entity.UploadTime); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 
 	// Check that we're not going to create a bundle that duplicates
 	// the name of a charm. This is racy, but it's the best we can do.
@@ -893,9 +1160,14 @@ func (s *Store) findZipFile(blob io.ReadSeeker, size int64, isFile func(f *zip.F
 // the given id for "which" operations ("read" or "write")
 // to the given ACL. This is mostly provided for testing.
 func (s *Store) SetPerms(id *charm.Reference, which string, acl ...string) error {
-	return s.DB.BaseEntities().UpdateId(baseURL(id), bson.D{{"$set",
-		bson.D{{"acls." + which, acl}},
-	}})
+	err := s.DB.BaseEntities().UpdateId(baseURL(id), bson.D{
+		{"$set", bson.D{{"acls." + which, acl}}},
+		incModifications,
+	})
+	if err != nil {
+		return err
+	}
+	return s.addBaseEntityEvent(params.EventPerm, baseURL(id), []string{which})
 }
 
 func newInt(x int) *int {
@@ -1052,6 +1324,72 @@ func (s StoreDatabase) Macaroons() *mgo.Collection {
 	return s.C("macaroons")
 }
 
+// Uploads returns the Mongo collection where the state of
+// resumable archive uploads is stored.
+func (s StoreDatabase) Uploads() *mgo.Collection {
+	return s.C("uploads")
+}
+
+// DeletedEntities returns the Mongo collection where deleted
+// entities are kept until they expire.
+func (s StoreDatabase) DeletedEntities() *mgo.Collection {
+	return s.C("deletedentities")
+}
+
+// Resources returns the Mongo collection where
+// charm resource revisions are stored.
+func (s StoreDatabase) Resources() *mgo.Collection {
+	return s.C("resources")
+}
+
+// Redirects returns the Mongo collection where the redirects
+// left by ownership transfers are stored.
+func (s StoreDatabase) Redirects() *mgo.Collection {
+	return s.C("redirects")
+}
+
+// PublicKeys returns the Mongo collection where the public
+// keys trusted to verify users' signatures are stored.
+func (s StoreDatabase) PublicKeys() *mgo.Collection {
+	return s.C("publickeys")
+}
+
+// Events returns the Mongo collection where the
+// change feed is stored.
+func (s StoreDatabase) Events() *mgo.Collection {
+	return s.C("events")
+}
+
+// Webhooks returns the Mongo collection where
+// registered webhooks are stored.
+func (s StoreDatabase) Webhooks() *mgo.Collection {
+	return s.C("webhooks")
+}
+
+// WebhookDeliveries returns the Mongo collection where the
+// queue and history of webhook deliveries are stored.
+func (s StoreDatabase) WebhookDeliveries() *mgo.Collection {
+	return s.C("webhookdeliveries")
+}
+
+// Cursors returns the Mongo collection where the positions
+// of the consumers of the change feed are stored.
+func (s StoreDatabase) Cursors() *mgo.Collection {
+	return s.C("cursors")
+}
+
+// ContentChallenges returns the Mongo collection where the
+// content challenges pending for uploads are stored.
+func (s StoreDatabase) ContentChallenges() *mgo.Collection {
+	return s.C("contentchallenges")
+}
+
+// Leases returns the Mongo collection where the leases
+// held by servers for exclusive work are stored.
+func (s StoreDatabase) Leases() *mgo.Collection {
+	return s.C("leases")
+}
+
 // allCollections holds for each collection used by the charm store a
 // function returns that collection.
 var allCollections = []func(StoreDatabase) *mgo.Collection{
@@ -1062,6 +1400,17 @@ var allCollections = []func(StoreDatabase) *mgo.Collection{
 	StoreDatabase.Logs,
 	StoreDatabase.Migrations,
 	StoreDatabase.Macaroons,
+	StoreDatabase.Uploads,
+	StoreDatabase.ContentChallenges,
+	StoreDatabase.DeletedEntities,
+	StoreDatabase.Redirects,
+	StoreDatabase.Resources,
+	StoreDatabase.PublicKeys,
+	StoreDatabase.Events,
+	StoreDatabase.Webhooks,
+	StoreDatabase.WebhookDeliveries,
+	StoreDatabase.Cursors,
+	StoreDatabase.Leases,
 }
 
 // Collections returns a slice of all the collections used
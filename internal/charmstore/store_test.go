@@ -81,7 +81,12 @@ func (s *StoreSuite) checkAddCharm(c *gc.C, ch charm.Charm, addToES bool, url *r
 	// so that we can test the deterministic parts later.
 	c.Assert(doc.UploadTime, jc.TimeBetween(beforeAdding, afterAdding))
 
+	// The charm is published in the stable channel at upload time.
+	c.Assert(doc.DevelopmentPublishTime.Equal(doc.UploadTime), gc.Equals, true)
+	c.Assert(doc.StablePublishTime.Equal(doc.UploadTime), gc.Equals, true)
 	doc.UploadTime = time.Time{}
+	doc.DevelopmentPublishTime = time.Time{}
+	doc.StablePublishTime = time.Time{}
 
 	blobName := doc.BlobName
 	c.Assert(blobName, gc.Matches, "[0-9a-z]+")
@@ -97,6 +102,8 @@ func (s *StoreSuite) checkAddCharm(c *gc.C, ch charm.Charm, addToES bool, url *r
 		BlobHash:                hash,
 		BlobHash256:             hash256,
 		Size:                    size,
+		Development:             true,
+		Stable:                  true,
 		CharmMeta:               ch.Meta(),
 		CharmActions:            ch.Actions(),
 		CharmConfig:             ch.Config(),
@@ -166,7 +173,11 @@ func (s *StoreSuite) checkAddBundle(c *gc.C, bundle charm.Bundle, addToES bool,
 	// Check the upload time and then reset it to its zero value
 	// so that we can test the deterministic parts later.
 	c.Assert(doc.UploadTime, jc.TimeBetween(beforeAdding, afterAdding))
+	c.Assert(doc.DevelopmentPublishTime.Equal(doc.UploadTime), gc.Equals, true)
+	c.Assert(doc.StablePublishTime.Equal(doc.UploadTime), gc.Equals, true)
 	doc.UploadTime = time.Time{}
+	doc.DevelopmentPublishTime = time.Time{}
+	doc.StablePublishTime = time.Time{}
 
 	// The blob name is random, but we check that it's
 	// in the correct format, and non-empty.
@@ -186,6 +197,8 @@ func (s *StoreSuite) checkAddBundle(c *gc.C, bundle charm.Bundle, addToES bool,
 		BlobHash:     hash,
 		BlobHash256:  hash256,
 		Size:         size,
+		Development:  true,
+		Stable:       true,
 		BundleData:   bundle.Data(),
 		BundleReadMe: bundle.ReadMe(),
 		BundleCharms: []*charm.Reference{
@@ -1030,7 +1043,7 @@ func (s *StoreSuite) newStore(c *gc.C, withES bool) *Store {
 	if withES {
 		si = &SearchIndex{s.ES, s.TestIndex}
 	}
-	p, err := NewPool(s.Session.DB("juju_test"), si, nil)
+	p, err := NewPool(s.Session.DB("juju_test"), si, nil, nil)
 	c.Assert(err, gc.IsNil)
 	return p.Store()
 }
@@ -1282,6 +1295,8 @@ func (s *StoreSuite) TestCollections(c *gc.C) {
 	createdOnUse := map[string]bool{
 		"migrations": true,
 		"macaroons":  true,
+		"cursors":    true,
+		"leases":     true,
 	}
 	// Check that all collections mentioned by Collections are actually created.
 	for _, coll := range colls {
@@ -1702,7 +1717,7 @@ func (s *StoreSuite) TestFindBestEntity(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	for i, test := range findBestEntityTests {
 		c.Logf("test %d: %s", i, test.url)
-		entity, err := store.FindBestEntity(charm.MustParseReference(test.url))
+		entity, err := store.FindBestEntity(charm.MustParseReference(test.url), params.UnpublishedChannel)
 		if test.expectErr != "" {
 			c.Assert(err, gc.ErrorMatches, test.expectErr)
 		} else {
@@ -1712,6 +1727,70 @@ func (s *StoreSuite) TestFindBestEntity(c *gc.C) {
 	}
 }
 
+func (s *StoreSuite) TestFindBestEntitySkipsYanked(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	url1 := newResolvedURL("~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+	err := store.UpdateEntity(url1, bson.D{{"$set", bson.D{{"deprecation", &mongodoc.Deprecation{
+		Yanked: true,
+		Reason: "bad",
+	}}}}})
+	c.Assert(err, gc.IsNil)
+
+	entity, err := store.FindBestEntity(charm.MustParseReference("~charmers/wordpress"), params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.URL, jc.DeepEquals, &url0.URL)
+
+	// The yanked revision can still be found by its full id.
+	entity, err = store.FindBestEntity(&url1.URL, params.StableChannel)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.URL, jc.DeepEquals, &url1.URL)
+}
+
+func (s *StoreSuite) TestYankUpdatesSearch(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	url0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	url1 := newResolvedURL("~charmers/precise/wordpress-1", -1)
+	for _, url := range []*router.ResolvedURL{url0, url1} {
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+	indexedURL := func() *charm.Reference {
+		var doc SearchDoc
+		err := store.ES.GetDocument(s.TestIndex, typeName, store.ES.getID(&url0.URL), &doc)
+		c.Assert(err, gc.IsNil)
+		return doc.URL
+	}
+	c.Assert(indexedURL(), jc.DeepEquals, &url1.URL)
+
+	fields := map[string]interface{}{
+		"deprecation": &mongodoc.Deprecation{
+			Yanked: true,
+			Reason: "bad",
+		},
+	}
+	err := store.UpdateEntity(url1, bson.D{{"$set", fields}})
+	c.Assert(err, gc.IsNil)
+	err = store.UpdateSearchFields(url1, fields)
+	c.Assert(err, gc.IsNil)
+	c.Assert(indexedURL(), jc.DeepEquals, &url0.URL)
+
+	fields = map[string]interface{}{
+		"deprecation": nil,
+	}
+	err = store.UpdateEntity(url1, bson.D{{"$set", fields}})
+	c.Assert(err, gc.IsNil)
+	err = store.UpdateSearchFields(url1, fields)
+	c.Assert(err, gc.IsNil)
+	c.Assert(indexedURL(), jc.DeepEquals, &url1.URL)
+}
+
 var updateEntityTests = []struct {
 	url       string
 	expectErr string
@@ -1749,6 +1828,7 @@ func (s *StoreSuite) TestUpdateEntity(c *gc.C) {
 			entity, err := store.FindEntity(url)
 			c.Assert(err, gc.IsNil)
 			c.Assert(string(entity.ExtraInfo["test"]), gc.Equals, "PASS")
+			c.Assert(entity.Modifications, gc.Equals, 1)
 		}
 	}
 }
@@ -1788,10 +1868,137 @@ func (s *StoreSuite) TestUpdateBaseEntity(c *gc.C) {
 			baseEntity, err := store.FindBaseEntity(&url.URL)
 			c.Assert(err, gc.IsNil)
 			c.Assert(baseEntity.ACLs.Read, jc.DeepEquals, []string{"test"})
+			c.Assert(baseEntity.Modifications, gc.Equals, 1)
 		}
 	}
 }
 
+func (s *StoreSuite) TestModifications(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	assertModifications := func(entityMods, baseMods int) {
+		entity, err := store.FindEntity(url, "modifications")
+		c.Assert(err, gc.IsNil)
+		c.Assert(entity.Modifications, gc.Equals, entityMods)
+		baseEntity, err := store.FindBaseEntity(&url.URL, "modifications")
+		c.Assert(err, gc.IsNil)
+		c.Assert(baseEntity.Modifications, gc.Equals, baseMods)
+	}
+	assertModifications(0, 0)
+
+	// An existing $inc operator is merged with the
+	// increment of the counter.
+	err = store.UpdateEntity(url, bson.D{
+		{"$set", bson.D{{"extrainfo.foo", []byte("bar")}}},
+		{"$inc", bson.D{{"size", 1}}},
+	})
+	c.Assert(err, gc.IsNil)
+	assertModifications(1, 0)
+
+	err = store.SetPerms(&url.URL, "read", params.Everyone)
+	c.Assert(err, gc.IsNil)
+	assertModifications(1, 1)
+
+	err = store.SetPromulgated(url, true)
+	c.Assert(err, gc.IsNil)
+	assertModifications(2, 2)
+
+	// Adding a new revision modifies the base entity.
+	url1 := newResolvedURL("~charmers/precise/wordpress-1", -1)
+	err = store.AddCharmWithArchive(url1, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	assertModifications(2, 3)
+
+	// So do deleting, restoring and purging another revision.
+	err = store.DeleteEntity(url1)
+	c.Assert(err, gc.IsNil)
+	assertModifications(2, 4)
+
+	_, err = store.RestoreEntity(&url1.URL)
+	c.Assert(err, gc.IsNil)
+	assertModifications(2, 5)
+
+	err = store.DeleteEntity(url1)
+	c.Assert(err, gc.IsNil)
+	assertModifications(2, 6)
+
+	err = store.PurgeEntity(&url1.URL)
+	c.Assert(err, gc.IsNil)
+	assertModifications(2, 7)
+
+	// The transferred base entity is modified.
+	_, err = store.TransferBaseEntity(charm.MustParseReference("~charmers/wordpress"), "bob")
+	c.Assert(err, gc.IsNil)
+	baseEntity, err := store.FindBaseEntity(charm.MustParseReference("~bob/wordpress"), "modifications")
+	c.Assert(err, gc.IsNil)
+	c.Assert(baseEntity.Modifications, gc.Equals, 8)
+}
+
+func (s *StoreSuite) TestUpdateIfUnmodified(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	update := bson.D{{"$set", bson.D{{"extrainfo.foo", []byte("bar")}}}}
+
+	// The counters are initially zero, and not stored.
+	err = store.UpdateEntityIfUnmodified(url, 0, update)
+	c.Assert(err, gc.IsNil)
+	err = store.UpdateBaseEntityIfUnmodified(url, 0, bson.D{{"$set", bson.D{{"public", true}}}})
+	c.Assert(err, gc.IsNil)
+
+	err = store.UpdateEntityIfUnmodified(url, 0, update)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrPreconditionFailed)
+	c.Assert(err, gc.ErrorMatches, `"cs:~charmers/precise/wordpress-0" has been modified`)
+	err = store.UpdateBaseEntityIfUnmodified(url, 0, bson.D{{"$set", bson.D{{"public", false}}}})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrPreconditionFailed)
+	c.Assert(err, gc.ErrorMatches, `base entity for "cs:~charmers/precise/wordpress-0" has been modified`)
+
+	err = store.UpdateEntityIfUnmodified(url, 1, update)
+	c.Assert(err, gc.IsNil)
+	entity, err := store.FindEntity(url, "modifications")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Modifications, gc.Equals, 2)
+	baseEntity, err := store.FindBaseEntity(&url.URL, "modifications", "public")
+	c.Assert(err, gc.IsNil)
+	c.Assert(baseEntity.Modifications, gc.Equals, 1)
+	c.Assert(baseEntity.Public, gc.Equals, true)
+
+	// A missing entity fails the precondition too.
+	err = store.UpdateEntityIfUnmodified(newResolvedURL("~charmers/precise/wordpress-1", -1), 0, update)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrPreconditionFailed)
+}
+
+func (s *StoreSuite) TestEntityFields(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = store.UpdateEntity(url, bson.D{{"$set", bson.D{{"extrainfo.foo", []byte("bar")}}}})
+	c.Assert(err, gc.IsNil)
+
+	values, err := store.EntityFields(url, []string{"extrainfo.foo", "extrainfo.baz", "releasenotes", "name"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(values, jc.DeepEquals, map[string]interface{}{
+		"extrainfo.foo": []byte("bar"),
+		"name":          "wordpress",
+	})
+
+	values, err = store.BaseEntityFields(url, []string{"acls.read", "acls.other"})
+	c.Assert(err, gc.IsNil)
+	c.Assert(values, jc.DeepEquals, map[string]interface{}{
+		"acls.read": []interface{}{"charmers"},
+	})
+
+	_, err = store.EntityFields(newResolvedURL("~charmers/precise/wordpress-1", -1), []string{"name"})
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
 var promulgateTests = []struct {
 	about              string
 	entities           []*mongodoc.Entity
@@ -2030,14 +2237,10 @@ func (s *StoreSuite) TestSetPromulgated(c *gc.C) {
 		c.Assert(err, gc.IsNil)
 		c.Assert(n, gc.Equals, len(test.expectBaseEntities))
 		for _, expectEntity := range test.expectEntities {
-			entity, err := store.FindEntity(EntityResolvedURL(expectEntity))
-			c.Assert(err, gc.IsNil)
-			c.Assert(entity, jc.DeepEquals, expectEntity)
+			storetesting.AssertEntity(c, store.DB.Entities(), expectEntity)
 		}
 		for _, expectBaseEntity := range test.expectBaseEntities {
-			baseEntity, err := store.FindBaseEntity(expectBaseEntity.URL)
-			c.Assert(err, gc.IsNil)
-			c.Assert(baseEntity, jc.DeepEquals, expectBaseEntity)
+			storetesting.AssertBaseEntity(c, store.DB.BaseEntities(), expectBaseEntity)
 		}
 	}
 }
@@ -2059,6 +2262,9 @@ func (s *StoreSuite) TestSetPromulgatedUpdateSearch(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	err = store.DB.BaseEntities().Insert(baseEntity("~openstack-charmers/wordpress", false))
 	c.Assert(err, gc.IsNil)
+	// Only published entities are indexed.
+	_, err = store.DB.Entities().UpdateAll(nil, bson.D{{"$set", bson.D{{"development", true}, {"stable", true}}}})
+	c.Assert(err, gc.IsNil)
 	url := newResolvedURL("~openstack-charmers/trusty/wordpress-0", -1)
 
 	// Change the promulgated mysql version to openstack-charmers.
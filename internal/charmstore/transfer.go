@@ -0,0 +1,255 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"sort"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// TransferResult holds the result of a call to
+// Store.TransferBaseEntity.
+type TransferResult struct {
+	// URL holds the new base URL.
+	URL *charm.Reference
+
+	// Entities holds the new ids of the entities that were
+	// transferred, including deleted entities that had not
+	// yet been purged, sorted by id.
+	Entities []*charm.Reference
+
+	// Counters holds the number of statistics counter
+	// data points moved to the new ids.
+	Counters int
+}
+
+// TransferBaseEntity transfers the ownership of the base entity with
+// the given URL, which must have a user but no series or revision, to
+// the given user. All of its entities in every series, including any
+// deleted entities, are moved under the new user along with their
+// extra-info, resources, permissions, statistics and search records.
+// A redirect is left behind so that the old ids resolve to the new
+// ones (see Store.Redirect).
+//
+// Promulgated ids are unaffected by the transfer. If the new user
+// already owns a charm or bundle with the same name, it returns an
+// error with a params.ErrDuplicateUpload cause.
+func (s *Store) TransferBaseEntity(url *charm.Reference, user string) (*TransferResult, error) {
+	if url.User == "" || url.Series != "" || url.Revision != -1 {
+		return nil, errgo.Newf("invalid base entity URL %q", url)
+	}
+	newURL, err := charm.ParseReference("cs:~" + user + "/" + url.Name)
+	if err != nil || newURL.User != user || newURL.Series != "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid user name %q", user)
+	}
+	if user == url.User {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "%s is already owned by %s", url, user)
+	}
+	baseEntity, err := s.FindBaseEntity(url)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	// Deleted entities are transferred too, so there must be
+	// none under the new base URL.
+	n, err := s.DB.DeletedEntities().Find(bson.D{{"baseurl", newURL}}).Count()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot count deleted entities of %s", newURL)
+	}
+	if n > 0 {
+		return nil, errgo.WithCausef(nil, params.ErrDuplicateUpload, "%s has deleted entities", newURL)
+	}
+	newBaseEntity := transferBaseEntity(baseEntity, newURL)
+	// The transfer changes the owner and ACLs, so the
+	// metadata must not be taken as unmodified.
+	newBaseEntity.Modifications++
+	if err := s.DB.BaseEntities().Insert(newBaseEntity); err != nil {
+		if mgo.IsDup(err) {
+			return nil, errgo.WithCausef(nil, params.ErrDuplicateUpload, "%s already exists", newURL)
+		}
+		return nil, errgo.Notef(err, "cannot insert base entity %s", newURL)
+	}
+	result := &TransferResult{
+		URL: newURL,
+	}
+	allSeries := make(map[string]bool)
+
+	var entities []*mongodoc.Entity
+	if err := s.DB.Entities().Find(bson.D{{"baseurl", url}}).All(&entities); err != nil {
+		return nil, errgo.Notef(err, "cannot find entities of %s", url)
+	}
+	for _, e := range entities {
+		newEntity := transferEntity(e, newURL)
+		// The old entity must be removed before the new one is
+		// inserted because promulgated URLs are unique.
+		if err := s.DB.Entities().RemoveId(e.URL); err != nil {
+			if err == mgo.ErrNotFound {
+				// The entity was deleted concurrently.
+				continue
+			}
+			return nil, errgo.Notef(err, "cannot remove %s", e.URL)
+		}
+		if err := s.DB.Entities().Insert(newEntity); err != nil {
+			if err := s.DB.Entities().Insert(e); err != nil {
+				logger.Errorf("cannot reinstate %s: %v", e.URL, err)
+			}
+			return nil, errgo.Notef(err, "cannot insert %s", newEntity.URL)
+		}
+		result.Entities = append(result.Entities, newEntity.URL)
+		allSeries[e.Series] = true
+	}
+
+	var deleted []*mongodoc.DeletedEntity
+	if err := s.DB.DeletedEntities().Find(bson.D{{"baseurl", url}}).All(&deleted); err != nil {
+		return nil, errgo.Notef(err, "cannot find deleted entities of %s", url)
+	}
+	for _, d := range deleted {
+		newDeleted := *d
+		newDeleted.Entity = *transferEntity(&d.Entity, newURL)
+		if d.BaseEntity != nil {
+			newDeleted.BaseEntity = transferBaseEntity(d.BaseEntity, newURL)
+		}
+		if _, err := s.DB.DeletedEntities().UpsertId(newDeleted.URL, &newDeleted); err != nil {
+			return nil, errgo.Notef(err, "cannot save deleted entity %s", newDeleted.URL)
+		}
+		if err := s.DB.DeletedEntities().RemoveId(d.URL); err != nil && err != mgo.ErrNotFound {
+			return nil, errgo.Notef(err, "cannot remove deleted entity %s", d.URL)
+		}
+		result.Entities = append(result.Entities, newDeleted.URL)
+		allSeries[d.Series] = true
+	}
+	sort.Sort(referencesByString(result.Entities))
+
+	if _, err := s.DB.Resources().UpdateAll(bson.D{{"baseurl", url}}, bson.D{{"$set", bson.D{{"baseurl", newURL}}}}); err != nil {
+		return nil, errgo.Notef(err, "cannot transfer resources of %s", url)
+	}
+
+	// Note that any entity added concurrently under the old base URL
+	// is left without a base entity.
+	if err := s.DB.BaseEntities().RemoveId(url); err != nil && err != mgo.ErrNotFound {
+		return nil, errgo.Notef(err, "cannot remove base entity %s", url)
+	}
+	if err := s.addRedirect(url, newURL); err != nil {
+		return nil, errgo.Mask(err)
+	}
+	for series := range allSeries {
+		oldId := *url
+		oldId.Series = series
+		newId := *newURL
+		newId.Series = series
+		for _, kind := range entityStatsKinds {
+			n, err := s.MoveCounters(EntityStatsKey(&oldId, kind), EntityStatsKey(&newId, kind))
+			if err != nil {
+				return nil, errgo.Notef(err, "cannot move statistics for %s", &oldId)
+			}
+			result.Counters += n
+		}
+		if _, err := s.removeSearchRecords(&oldId); err != nil {
+			return nil, errgo.Notef(err, "cannot remove search records for %s", &oldId)
+		}
+	}
+	if err := s.UpdateSearchBaseURL(newURL); err != nil {
+		return nil, errgo.Notef(err, "cannot update search records for %s", newURL)
+	}
+	return result, nil
+}
+
+// addRedirect records that the base entity with the given URL
+// has been transferred to the target base URL.
+func (s *Store) addRedirect(url, target *charm.Reference) error {
+	redirects := s.DB.Redirects()
+	if _, err := redirects.UpsertId(url, &mongodoc.Redirect{
+		URL:    url,
+		Target: target,
+		Time:   time.Now(),
+	}); err != nil {
+		return errgo.Notef(err, "cannot add redirect from %s", url)
+	}
+	// Earlier transfers that led to the old base URL now
+	// lead to the new one.
+	if _, err := redirects.UpdateAll(bson.D{{"target", url}}, bson.D{{"$set", bson.D{{"target", target}}}}); err != nil {
+		return errgo.Notef(err, "cannot update redirects to %s", url)
+	}
+	// The target may itself have been transferred away earlier,
+	// in which case it must no longer be redirected.
+	if err := redirects.RemoveId(target); err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot remove redirect from %s", target)
+	}
+	return nil
+}
+
+// Redirect returns the URL that the given URL, which must have a user,
+// refers to after its base entity has been transferred to another
+// user. If the base entity has not been transferred, it returns an
+// error with a params.ErrNotFound cause.
+func (s *Store) Redirect(url *charm.Reference) (*charm.Reference, error) {
+	var redirect mongodoc.Redirect
+	err := s.DB.Redirects().FindId(baseURL(url)).One(&redirect)
+	if err == mgo.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "no redirect found for %s", url)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get redirect for %s", url)
+	}
+	target := *url
+	target.User = redirect.Target.User
+	return &target, nil
+}
+
+// transferEntity returns a copy of the given entity
+// with the given new base URL.
+func transferEntity(e *mongodoc.Entity, newBaseURL *charm.Reference) *mongodoc.Entity {
+	newEntity := *e
+	url := *e.URL
+	url.User = newBaseURL.User
+	newEntity.URL = &url
+	newEntity.BaseURL = newBaseURL
+	newEntity.User = newBaseURL.User
+	return &newEntity
+}
+
+// transferBaseEntity returns a copy of the given base entity with
+// the given new URL. Any permissions granted to the old owner are
+// granted to the new owner instead.
+func transferBaseEntity(b *mongodoc.BaseEntity, newURL *charm.Reference) *mongodoc.BaseEntity {
+	newBaseEntity := *b
+	newBaseEntity.URL = newURL
+	newBaseEntity.User = newURL.User
+	newBaseEntity.ACLs = mongodoc.ACL{
+		Read:  transferACL(b.ACLs.Read, b.User, newURL.User),
+		Write: transferACL(b.ACLs.Write, b.User, newURL.User),
+	}
+	return &newBaseEntity
+}
+
+// transferACL returns a copy of the given ACL with the
+// from user replaced by the to user.
+func transferACL(acl []string, from, to string) []string {
+	newACL := make([]string, 0, len(acl))
+	for _, name := range acl {
+		if name == from {
+			name = to
+		}
+		if !stringInSlice(name, newACL) {
+			newACL = append(newACL, name)
+		}
+	}
+	return newACL
+}
+
+func stringInSlice(s string, ss []string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
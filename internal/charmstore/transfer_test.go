@@ -0,0 +1,233 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/elasticsearch"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+func (s *StoreSuite) TestTransferBaseEntity(c *gc.C) {
+	store := s.newStore(c, true)
+	defer store.Close()
+	urls := []*router.ResolvedURL{
+		newResolvedURL("~alice/precise/wordpress-0", 3),
+		newResolvedURL("~alice/precise/wordpress-1", -1),
+		newResolvedURL("~alice/trusty/wordpress-2", -1),
+	}
+	for _, url := range urls {
+		err := store.AddCharmWithArchive(url, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+	err := store.DB.Entities().UpdateId(&urls[0].URL, bson.D{{"$set", bson.D{{"extrainfo.foo", []byte(`"bar"`)}}}})
+	c.Assert(err, gc.IsNil)
+	baseURL := charm.MustParseReference("~alice/wordpress")
+	err = store.SetPerms(baseURL, "read", params.Everyone, "alice")
+	c.Assert(err, gc.IsNil)
+	err = store.SetPerms(baseURL, "write", "alice", "bob")
+	c.Assert(err, gc.IsNil)
+	// Deleted entities are transferred too.
+	err = store.DeleteEntity(urls[1])
+	c.Assert(err, gc.IsNil)
+
+	now := time.Now()
+	for _, url := range urls[1:] {
+		for i := 0; i < 2; i++ {
+			key := EntityStatsKey(&url.URL, params.StatsArchiveDownload)
+			err := store.IncCounterAtTime(key, now.Add(time.Duration(-i)*time.Hour))
+			c.Assert(err, gc.IsNil)
+		}
+	}
+
+	result, err := store.TransferBaseEntity(baseURL, "bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &TransferResult{
+		URL: charm.MustParseReference("cs:~bob/wordpress"),
+		Entities: []*charm.Reference{
+			charm.MustParseReference("cs:~bob/precise/wordpress-0"),
+			charm.MustParseReference("cs:~bob/precise/wordpress-1"),
+			charm.MustParseReference("cs:~bob/trusty/wordpress-2"),
+		},
+		Counters: 4,
+	})
+
+	// The base entity has been moved and the permissions
+	// of the old owner given to the new owner.
+	_, err = store.FindBaseEntity(baseURL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	baseEntity, err := store.FindBaseEntity(result.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(baseEntity.User, gc.Equals, "bob")
+	c.Assert(baseEntity.ACLs, jc.DeepEquals, mongodoc.ACL{
+		Read:  []string{params.Everyone, "bob"},
+		Write: []string{"bob"},
+	})
+
+	// The entities have been moved, keeping their
+	// promulgated ids and extra-info.
+	for _, url := range []*router.ResolvedURL{urls[0], urls[2]} {
+		_, err := store.FindEntity(url)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	}
+	entity, err := store.FindEntity(newResolvedURL("~bob/precise/wordpress-0", -1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.BaseURL, jc.DeepEquals, result.URL)
+	c.Assert(entity.User, gc.Equals, "bob")
+	c.Assert(entity.PromulgatedURL, jc.DeepEquals, charm.MustParseReference("cs:precise/wordpress-3"))
+	c.Assert(entity.ExtraInfo, jc.DeepEquals, map[string][]byte{"foo": []byte(`"bar"`)})
+	entities, err := store.FindEntities(charm.MustParseReference("precise/wordpress-3"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entities, gc.HasLen, 1)
+	c.Assert(entities[0].URL, jc.DeepEquals, charm.MustParseReference("cs:~bob/precise/wordpress-0"))
+	_, err = store.FindEntity(newResolvedURL("~bob/trusty/wordpress-2", -1))
+	c.Assert(err, gc.IsNil)
+
+	_, err = store.DeletedEntity(&urls[1].URL)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	restored, err := store.RestoreEntity(charm.MustParseReference("~bob/precise/wordpress-1"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(restored, jc.DeepEquals, newResolvedURL("~bob/precise/wordpress-1", -1))
+
+	// The statistics have been moved.
+	for _, url := range urls[1:] {
+		counters, err := store.Counters(&CounterRequest{
+			Key: EntityStatsKey(&url.URL, params.StatsArchiveDownload),
+		})
+		c.Assert(err, gc.IsNil)
+		c.Assert(counters, gc.HasLen, 0)
+
+		newId := url.URL
+		newId.User = "bob"
+		counters, err = store.Counters(&CounterRequest{
+			Key: EntityStatsKey(&newId, params.StatsArchiveDownload),
+		})
+		c.Assert(err, gc.IsNil)
+		c.Assert(counters, gc.HasLen, 1)
+		c.Assert(counters[0].Count, gc.Equals, int64(2))
+	}
+
+	// The search records have been moved.
+	for _, series := range []string{"precise", "trusty"} {
+		var doc SearchDoc
+		id := charm.MustParseReference("~alice/" + series + "/wordpress")
+		err := store.ES.GetDocument(s.TestIndex, typeName, store.ES.getID(id), &doc)
+		c.Assert(err, gc.Equals, elasticsearch.ErrNotFound)
+		id.User = "bob"
+		err = store.ES.GetDocument(s.TestIndex, typeName, store.ES.getID(id), &doc)
+		c.Assert(err, gc.IsNil)
+		c.Assert(doc.User, gc.Equals, "bob")
+	}
+
+	// The old ids are redirected to the new ones.
+	for _, id := range []string{"~alice/wordpress", "~alice/trusty/wordpress-2"} {
+		target, err := store.Redirect(charm.MustParseReference(id))
+		c.Assert(err, gc.IsNil)
+		expect := charm.MustParseReference(id)
+		expect.User = "bob"
+		c.Assert(target, jc.DeepEquals, expect)
+	}
+	_, err = store.Redirect(charm.MustParseReference("~bob/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestTransferBaseEntityRedirects(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	err := store.AddCharmWithArchive(newResolvedURL("~alice/precise/wordpress-0", -1), storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+
+	_, err = store.TransferBaseEntity(charm.MustParseReference("~alice/wordpress"), "bob")
+	c.Assert(err, gc.IsNil)
+	_, err = store.TransferBaseEntity(charm.MustParseReference("~bob/wordpress"), "carol")
+	c.Assert(err, gc.IsNil)
+
+	// Earlier redirects lead to the latest owner.
+	for _, user := range []string{"alice", "bob"} {
+		target, err := store.Redirect(charm.MustParseReference("~" + user + "/wordpress"))
+		c.Assert(err, gc.IsNil)
+		c.Assert(target, jc.DeepEquals, charm.MustParseReference("~carol/wordpress"))
+	}
+
+	// Transferring back to an earlier owner
+	// removes its redirect.
+	_, err = store.TransferBaseEntity(charm.MustParseReference("~carol/wordpress"), "alice")
+	c.Assert(err, gc.IsNil)
+	_, err = store.Redirect(charm.MustParseReference("~alice/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	for _, user := range []string{"bob", "carol"} {
+		target, err := store.Redirect(charm.MustParseReference("~" + user + "/wordpress"))
+		c.Assert(err, gc.IsNil)
+		c.Assert(target, jc.DeepEquals, charm.MustParseReference("~alice/wordpress"))
+	}
+}
+
+var transferBaseEntityErrorsTests = []struct {
+	about       string
+	url         string
+	user        string
+	expectError string
+	expectCause error
+}{{
+	about:       "invalid base URL",
+	url:         "~alice/precise/wordpress",
+	user:        "bob",
+	expectError: `invalid base entity URL "cs:~alice/precise/wordpress"`,
+}, {
+	about:       "invalid user",
+	url:         "~alice/wordpress",
+	user:        "bad/wolf",
+	expectError: `invalid user name "bad/wolf"`,
+	expectCause: params.ErrBadRequest,
+}, {
+	about:       "same user",
+	url:         "~alice/wordpress",
+	user:        "alice",
+	expectError: `cs:~alice/wordpress is already owned by alice`,
+	expectCause: params.ErrBadRequest,
+}, {
+	about:       "not found",
+	url:         "~alice/mysql",
+	user:        "bob",
+	expectError: `base entity not found`,
+	expectCause: params.ErrNotFound,
+}, {
+	about:       "already exists",
+	url:         "~alice/wordpress",
+	user:        "charmers",
+	expectError: `cs:~charmers/wordpress already exists`,
+	expectCause: params.ErrDuplicateUpload,
+}}
+
+func (s *StoreSuite) TestTransferBaseEntityErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for _, id := range []string{"~alice/precise/wordpress-0", "~charmers/precise/wordpress-0"} {
+		err := store.AddCharmWithArchive(newResolvedURL(id, -1), storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+	for i, test := range transferBaseEntityErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		_, err := store.TransferBaseEntity(charm.MustParseReference(test.url), test.user)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		if test.expectCause != nil {
+			c.Assert(errgo.Cause(err), gc.Equals, test.expectCause)
+		}
+	}
+	// The entity has not been transferred.
+	_, err := store.FindEntity(newResolvedURL("~alice/precise/wordpress-0", -1))
+	c.Assert(err, gc.IsNil)
+	_, err = store.FindBaseEntity(charm.MustParseReference("~alice/wordpress"))
+	c.Assert(err, gc.IsNil)
+}
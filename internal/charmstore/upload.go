@@ -0,0 +1,223 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"io"
+	"strconv"
+	"time"
+
+	"github.com/juju/utils"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// uploadExpiry holds the length of time for which an
+// upload can be used after it has been created.
+var uploadExpiry = 24 * time.Hour
+
+// MaxUploadChunks holds the maximum number of chunks
+// that an upload can hold.
+const MaxUploadChunks = 10000
+
+// NewUpload creates a new resumable upload owned by the given
+// user, which should be empty if the upload is created by an admin.
+func (s *Store) NewUpload(user string) (*mongodoc.Upload, error) {
+	uuid, err := utils.NewUUID()
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot make upload id")
+	}
+	now := time.Now()
+	upload := &mongodoc.Upload{
+		Id:      uuid.String(),
+		User:    user,
+		Created: now,
+		Expires: now.Add(uploadExpiry),
+		Chunks:  make(map[string]mongodoc.UploadChunk),
+	}
+	if err := s.DB.Uploads().Insert(upload); err != nil {
+		return nil, errgo.Notef(err, "cannot insert upload")
+	}
+	return upload, nil
+}
+
+// Upload returns the upload with the given id. If the upload
+// does not exist or has expired, it returns an error with a
+// params.ErrNotFound cause.
+func (s *Store) Upload(id string) (*mongodoc.Upload, error) {
+	var upload mongodoc.Upload
+	err := s.DB.Uploads().FindId(id).One(&upload)
+	if err == mgo.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "upload %q not found", id)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get upload %q", id)
+	}
+	if !time.Now().Before(upload.Expires) {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "upload %q has expired", id)
+	}
+	if upload.Chunks == nil {
+		upload.Chunks = make(map[string]mongodoc.UploadChunk)
+	}
+	return &upload, nil
+}
+
+// PutUploadChunk stores the data read from r as chunk n of the given
+// upload, replacing any chunk with the same number that has already
+// been uploaded. The size and hash parameters hold the size
+// and SHA384 hash of the chunk data.
+func (s *Store) PutUploadChunk(upload *mongodoc.Upload, n int, r io.Reader, size int64, hash string) error {
+	if n < 0 || n >= MaxUploadChunks {
+		return errgo.WithCausef(nil, params.ErrBadRequest, "chunk number %d out of range", n)
+	}
+	name := bson.NewObjectId().Hex()
+	if err := s.BlobStore.PutUnchallenged(r, name, size, hash); err != nil {
+		return errgo.Notef(err, "cannot put chunk blob")
+	}
+	chunk := mongodoc.UploadChunk{
+		BlobName: name,
+		Size:     size,
+		Hash:     hash,
+	}
+	key := strconv.Itoa(n)
+	var old mongodoc.Upload
+	_, err := s.DB.Uploads().Find(bson.D{
+		{"_id", upload.Id},
+		{"expires", bson.D{{"$gt", time.Now()}}},
+	}).Select(bson.D{{"chunks." + key, 1}}).Apply(mgo.Change{
+		Update: bson.D{{"$set", bson.D{{"chunks." + key, chunk}}}},
+	}, &old)
+	if err != nil {
+		s.removeUploadBlob(name)
+		if err == mgo.ErrNotFound {
+			return errgo.WithCausef(nil, params.ErrNotFound, "upload %q not found", upload.Id)
+		}
+		return errgo.Notef(err, "cannot update upload %q", upload.Id)
+	}
+	if oldChunk, ok := old.Chunks[key]; ok {
+		s.removeUploadBlob(oldChunk.BlobName)
+	}
+	upload.Chunks[key] = chunk
+	return nil
+}
+
+// OpenUpload returns a reader that reads the data of all the chunks
+// of the given upload in order, and the total size of the data.
+// The chunks must be numbered contiguously from zero.
+// The returned reader must be closed after use.
+//
+// Each chunk is opened only when the data before it has been read,
+// and closed when its data has been read, so that a large upload
+// does not hold many chunks open at once.
+func (s *Store) OpenUpload(upload *mongodoc.Upload) (io.ReadCloser, int64, error) {
+	if len(upload.Chunks) == 0 {
+		return nil, 0, errgo.WithCausef(nil, params.ErrBadRequest, "upload %q has no chunks", upload.Id)
+	}
+	r := &uploadReader{
+		blobStore: s.BlobStore,
+		uploadId:  upload.Id,
+	}
+	var size int64
+	for i := 0; i < len(upload.Chunks); i++ {
+		chunk, ok := upload.Chunks[strconv.Itoa(i)]
+		if !ok {
+			return nil, 0, errgo.WithCausef(nil, params.ErrBadRequest, "upload %q is missing chunk %d", upload.Id, i)
+		}
+		r.blobNames = append(r.blobNames, chunk.BlobName)
+		size += chunk.Size
+	}
+	return r, size, nil
+}
+
+// uploadReader reads the concatenated data of
+// the chunks of an upload.
+type uploadReader struct {
+	blobStore blobstore.Store
+	uploadId  string
+
+	// blobNames holds the blob names of the chunks,
+	// in order.
+	blobNames []string
+
+	// chunk holds the index of the next chunk to be opened.
+	chunk int
+
+	// current holds the chunk currently being read,
+	// or nil if none is open.
+	current io.ReadCloser
+}
+
+// Read implements io.Reader by reading from each chunk
+// in turn, opening it when its data is first needed.
+func (r *uploadReader) Read(buf []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if r.chunk >= len(r.blobNames) {
+				return 0, io.EOF
+			}
+			cr, _, err := r.blobStore.Open(r.blobNames[r.chunk])
+			if err != nil {
+				return 0, errgo.Notef(err, "cannot open chunk %d of upload %q", r.chunk, r.uploadId)
+			}
+			r.current = cr
+			r.chunk++
+		}
+		n, err := r.current.Read(buf)
+		if err != io.EOF {
+			return n, err
+		}
+		closeErr := r.current.Close()
+		r.current = nil
+		if closeErr != nil {
+			return n, errgo.Notef(closeErr, "cannot close chunk %d of upload %q", r.chunk-1, r.uploadId)
+		}
+		if n > 0 {
+			return n, nil
+		}
+	}
+}
+
+// Close implements io.Closer by closing
+// the chunk currently being read, if any.
+func (r *uploadReader) Close() error {
+	if r.current == nil {
+		return nil
+	}
+	err := r.current.Close()
+	r.current = nil
+	return err
+}
+
+// RemoveUpload removes the upload with the given id
+// along with all its chunk data.
+func (s *Store) RemoveUpload(id string) error {
+	var upload mongodoc.Upload
+	_, err := s.DB.Uploads().FindId(id).Apply(mgo.Change{
+		Remove: true,
+	}, &upload)
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "upload %q not found", id)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot remove upload %q", id)
+	}
+	for _, chunk := range upload.Chunks {
+		s.removeUploadBlob(chunk.BlobName)
+	}
+	return nil
+}
+
+// removeUploadBlob removes the chunk blob with the given name.
+// Failures are logged rather than returned because the blob
+// will be reclaimed by the blob garbage collector.
+func (s *Store) removeUploadBlob(name string) {
+	if err := s.BlobStore.Remove(name); err != nil {
+		logger.Errorf("cannot remove upload chunk blob %q: %v", name, err)
+	}
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"io/ioutil"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+func (s *StoreSuite) putUploadChunk(c *gc.C, store *Store, id string, n int, content string) {
+	upload, err := store.Upload(id)
+	c.Assert(err, gc.IsNil)
+	hash := hashOfReader(c, strings.NewReader(content))
+	err = store.PutUploadChunk(upload, n, strings.NewReader(content), int64(len(content)), hash)
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *StoreSuite) TestUpload(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	upload, err := store.NewUpload("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(upload.User, gc.Equals, "bob")
+	c.Assert(upload.Chunks, gc.HasLen, 0)
+
+	// Chunks can be uploaded in any order.
+	s.putUploadChunk(c, store, upload.Id, 2, "!")
+	s.putUploadChunk(c, store, upload.Id, 0, "hello")
+	s.putUploadChunk(c, store, upload.Id, 1, " wrld")
+
+	// Uploading a chunk again replaces it and removes the old blob.
+	upload, err = store.Upload(upload.Id)
+	c.Assert(err, gc.IsNil)
+	oldBlob := upload.Chunks["1"].BlobName
+	s.putUploadChunk(c, store, upload.Id, 1, " world")
+	_, _, err = store.BlobStore.Open(oldBlob)
+	c.Assert(err, gc.ErrorMatches, `resource at path ".*" not found`)
+
+	upload, err = store.Upload(upload.Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(upload.User, gc.Equals, "bob")
+	c.Assert(upload.Chunks, gc.HasLen, 3)
+	c.Assert(upload.Chunks["1"].Size, gc.Equals, int64(6))
+	c.Assert(upload.Chunks["1"].Hash, gc.Equals, hashOfReader(c, strings.NewReader(" world")))
+
+	r, size, err := store.OpenUpload(upload)
+	c.Assert(err, gc.IsNil)
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(r.Close(), gc.IsNil)
+	c.Assert(string(data), gc.Equals, "hello world!")
+	c.Assert(size, gc.Equals, int64(len(data)))
+
+	// Removing the upload removes its chunk blobs.
+	err = store.RemoveUpload(upload.Id)
+	c.Assert(err, gc.IsNil)
+	_, err = store.Upload(upload.Id)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	names, err := store.BlobStore.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 0)
+
+	err = store.RemoveUpload(upload.Id)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestPutUploadChunkInvalid(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	upload, err := store.NewUpload("bob")
+	c.Assert(err, gc.IsNil)
+
+	err = store.PutUploadChunk(upload, -1, strings.NewReader("x"), 1, hashOfReader(c, strings.NewReader("x")))
+	c.Assert(err, gc.ErrorMatches, `chunk number -1 out of range`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	err = store.PutUploadChunk(upload, 0, strings.NewReader("x"), 1, hashOfReader(c, strings.NewReader("y")))
+	c.Assert(err, gc.ErrorMatches, `cannot put chunk blob: hash mismatch`)
+
+	upload, err = store.Upload(upload.Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(upload.Chunks, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestOpenUploadMissingChunk(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	upload, err := store.NewUpload("")
+	c.Assert(err, gc.IsNil)
+
+	_, _, err = store.OpenUpload(upload)
+	c.Assert(err, gc.ErrorMatches, `upload ".*" has no chunks`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+
+	s.putUploadChunk(c, store, upload.Id, 0, "hello")
+	s.putUploadChunk(c, store, upload.Id, 2, "world")
+	upload, err = store.Upload(upload.Id)
+	c.Assert(err, gc.IsNil)
+	_, _, err = store.OpenUpload(upload)
+	c.Assert(err, gc.ErrorMatches, `upload ".*" is missing chunk 1`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+}
+
+func (s *StoreSuite) TestOpenUploadOpensChunksInTurn(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	upload, err := store.NewUpload("")
+	c.Assert(err, gc.IsNil)
+	s.putUploadChunk(c, store, upload.Id, 0, "hello")
+	s.putUploadChunk(c, store, upload.Id, 1, " ")
+	s.putUploadChunk(c, store, upload.Id, 2, "world")
+	upload, err = store.Upload(upload.Id)
+	c.Assert(err, gc.IsNil)
+	bs := &countingBlobStore{Store: store.BlobStore}
+	store.BlobStore = bs
+
+	r, size, err := store.OpenUpload(upload)
+	c.Assert(err, gc.IsNil)
+	c.Assert(size, gc.Equals, int64(11))
+	c.Assert(bs.opened, gc.Equals, 0)
+
+	data, err := ioutil.ReadAll(r)
+	c.Assert(err, gc.IsNil)
+	c.Assert(string(data), gc.Equals, "hello world")
+	c.Assert(bs.opened, gc.Equals, 3)
+	c.Assert(bs.maxOpen, gc.Equals, 1)
+	c.Assert(bs.open, gc.Equals, 0)
+	c.Assert(r.Close(), gc.IsNil)
+
+	// Closing the reader part way through closes the open chunk.
+	bs.opened = 0
+	r, _, err = store.OpenUpload(upload)
+	c.Assert(err, gc.IsNil)
+	buf := make([]byte, 3)
+	_, err = r.Read(buf)
+	c.Assert(err, gc.IsNil)
+	c.Assert(bs.open, gc.Equals, 1)
+	c.Assert(r.Close(), gc.IsNil)
+	c.Assert(bs.open, gc.Equals, 0)
+	c.Assert(bs.opened, gc.Equals, 1)
+
+	// A chunk that cannot be opened is reported when it is reached.
+	err = bs.Remove(upload.Chunks["2"].BlobName)
+	c.Assert(err, gc.IsNil)
+	r, _, err = store.OpenUpload(upload)
+	c.Assert(err, gc.IsNil)
+	_, err = ioutil.ReadAll(r)
+	c.Assert(err, gc.ErrorMatches, `cannot open chunk 2 of upload ".*": .*`)
+	c.Assert(r.Close(), gc.IsNil)
+	c.Assert(bs.open, gc.Equals, 0)
+}
+
+// countingBlobStore wraps a blob store, counting
+// the blobs opened and those open at once.
+type countingBlobStore struct {
+	blobstore.Store
+	opened, open, maxOpen int
+}
+
+func (s *countingBlobStore) Open(name string) (blobstore.ReadSeekCloser, int64, error) {
+	r, size, err := s.Store.Open(name)
+	if err != nil {
+		return nil, 0, err
+	}
+	s.opened++
+	s.open++
+	if s.open > s.maxOpen {
+		s.maxOpen = s.open
+	}
+	return &countingReadSeekCloser{r, s}, size, nil
+}
+
+type countingReadSeekCloser struct {
+	blobstore.ReadSeekCloser
+	store *countingBlobStore
+}
+
+func (r *countingReadSeekCloser) Close() error {
+	r.store.open--
+	return r.ReadSeekCloser.Close()
+}
+
+func (s *StoreSuite) TestUploadExpiry(c *gc.C) {
+	s.PatchValue(&uploadExpiry, -time.Second)
+	store := s.newStore(c, false)
+	defer store.Close()
+	upload, err := store.NewUpload("bob")
+	c.Assert(err, gc.IsNil)
+
+	_, err = store.Upload(upload.Id)
+	c.Assert(err, gc.ErrorMatches, `upload ".*" has expired`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	content := "hello"
+	err = store.PutUploadChunk(upload, 0, strings.NewReader(content), int64(len(content)), hashOfReader(c, strings.NewReader(content)))
+	c.Assert(err, gc.ErrorMatches, `upload ".*" not found`)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+
+	// The blob holding the rejected chunk has been removed.
+	names, err := store.BlobStore.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestCollectBlobGarbageWithUploads(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	upload, err := store.NewUpload("bob")
+	c.Assert(err, gc.IsNil)
+	s.putUploadChunk(c, store, upload.Id, 0, "hello")
+	upload, err = store.Upload(upload.Id)
+	c.Assert(err, gc.IsNil)
+	blobName := upload.Chunks["0"].BlobName
+
+	// The chunks of an unexpired upload are not orphans.
+	result, err := store.CollectBlobGarbage(BlobGCParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &BlobGCResult{
+		Orphans: []string{},
+		Removed: []string{},
+	})
+
+	// Once the upload has expired, its chunks are collected
+	// and the upload itself is removed.
+	err = store.DB.Uploads().UpdateId(upload.Id, bson.M{"$set": bson.M{"expires": time.Now().Add(-time.Minute)}})
+	c.Assert(err, gc.IsNil)
+	result, err = store.CollectBlobGarbage(BlobGCParams{})
+	c.Assert(err, gc.IsNil)
+	c.Assert(result, jc.DeepEquals, &BlobGCResult{
+		Orphans: []string{blobName},
+		Removed: []string{blobName},
+	})
+	n, err := store.DB.Uploads().Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
@@ -0,0 +1,505 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+var (
+	// webhookPollInterval holds the time between successive
+	// checks for webhook deliveries to make.
+	webhookPollInterval = 5 * time.Second
+
+	// webhookTimeout holds the time allowed for
+	// a webhook delivery request to complete.
+	webhookTimeout = 30 * time.Second
+
+	// webhookRetryDelay holds the time before a failed webhook
+	// delivery is first retried. Each later retry waits for twice
+	// as long as the one before, up to maxWebhookRetryDelay.
+	webhookRetryDelay = 30 * time.Second
+)
+
+const (
+	// maxWebhookRetryDelay holds the longest time
+	// between retries of a webhook delivery.
+	maxWebhookRetryDelay = 6 * time.Hour
+
+	// maxWebhookAttempts holds the number of times a webhook
+	// delivery is attempted before it is marked as failed.
+	maxWebhookAttempts = 10
+
+	// webhookDeliveryRetention holds the length of time for which
+	// webhook deliveries are kept in the delivery history.
+	webhookDeliveryRetention = 30 * 24 * time.Hour
+
+	// webhookQueueBatchSize holds the number of events read from
+	// the change feed at a time when queueing webhook deliveries.
+	webhookQueueBatchSize = 100
+
+	// webhooksCursor holds the id of the document in the cursors
+	// collection that holds the sequence number of the last
+	// event queued for delivery to webhooks.
+	webhooksCursor = "webhooks"
+)
+
+// AddWebhook registers a new webhook on behalf of the given owner
+// according to the given request, and returns the stored webhook.
+// If the request is invalid, it returns an error with a
+// params.ErrBadRequest cause.
+func (s *Store) AddWebhook(owner string, req *params.WebhookRequest) (*mongodoc.Webhook, error) {
+	if req.User != "" && !validUser(req.User) {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid user name %q", req.User)
+	}
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid webhook URL %q", req.URL)
+	}
+	kinds := make([]string, len(req.Kinds))
+	for i, kind := range req.Kinds {
+		if !validEventKind(kind) {
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "invalid event kind %q", kind)
+		}
+		kinds[i] = string(kind)
+	}
+	secret := req.Secret
+	if secret == "" {
+		buf := make([]byte, 20)
+		if _, err := rand.Read(buf); err != nil {
+			return nil, errgo.Notef(err, "cannot generate webhook secret")
+		}
+		secret = hex.EncodeToString(buf)
+	}
+	hook := &mongodoc.Webhook{
+		Id:         bson.NewObjectId().Hex(),
+		User:       req.User,
+		URL:        req.URL,
+		Kinds:      kinds,
+		Secret:     secret,
+		Owner:      owner,
+		CreateTime: time.Now(),
+	}
+	if err := s.DB.Webhooks().Insert(hook); err != nil {
+		return nil, errgo.Notef(err, "cannot insert webhook")
+	}
+	return hook, nil
+}
+
+// validEventKind reports whether the given event kind is known.
+func validEventKind(kind params.EventKind) bool {
+	switch kind {
+	case params.EventUpload,
+		params.EventDelete,
+		params.EventRestore,
+		params.EventPublish,
+		params.EventPerm,
+		params.EventPromulgate,
+		params.EventExtraInfo,
+		params.EventMeta:
+		return true
+	}
+	return false
+}
+
+// Webhook returns the webhook with the given id.
+func (s *Store) Webhook(id string) (*mongodoc.Webhook, error) {
+	var hook mongodoc.Webhook
+	err := s.DB.Webhooks().FindId(id).One(&hook)
+	if err == mgo.ErrNotFound {
+		return nil, errgo.WithCausef(nil, params.ErrNotFound, "webhook %q not found", id)
+	}
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot get webhook %q", id)
+	}
+	return &hook, nil
+}
+
+// Webhooks returns the webhooks registered for the events of
+// the given user's entities, oldest first. If user is empty,
+// it returns the webhooks registered for all events.
+func (s *Store) Webhooks(user string) ([]*mongodoc.Webhook, error) {
+	var hooks []*mongodoc.Webhook
+	if err := s.DB.Webhooks().Find(bson.D{{"user", user}}).Sort("createtime", "_id").All(&hooks); err != nil {
+		return nil, errgo.Notef(err, "cannot get webhooks")
+	}
+	return hooks, nil
+}
+
+// RemoveWebhook removes the webhook with the given id. Its
+// delivery history is kept, but pending deliveries are not
+// attempted.
+func (s *Store) RemoveWebhook(id string) error {
+	err := s.DB.Webhooks().RemoveId(id)
+	if err == mgo.ErrNotFound {
+		return errgo.WithCausef(nil, params.ErrNotFound, "webhook %q not found", id)
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot remove webhook %q", id)
+	}
+	return nil
+}
+
+// WebhookDeliveries returns the deliveries to the webhook with the
+// given id, most recent first. If limit is greater than zero, at most
+// limit deliveries are returned.
+func (s *Store) WebhookDeliveries(id string, limit int) ([]*mongodoc.WebhookDelivery, error) {
+	query := s.DB.WebhookDeliveries().Find(bson.D{{"webhookid", id}}).Sort("-time", "-_id")
+	if limit > 0 {
+		query = query.Limit(limit)
+	}
+	var deliveries []*mongodoc.WebhookDelivery
+	if err := query.All(&deliveries); err != nil {
+		return nil, errgo.Notef(err, "cannot get deliveries of webhook %q", id)
+	}
+	return deliveries, nil
+}
+
+// deliverWebhooksForever repeatedly queues deliveries for the
+// events in the change feed and delivers them to webhooks.
+func (s *Store) deliverWebhooksForever() {
+	client := newWebhookClient()
+	for {
+		s.DB.Session.Refresh()
+		if err := s.queueWebhookDeliveries(); err != nil {
+			logger.Errorf("cannot queue webhook deliveries: %v", err)
+		}
+		if _, err := s.deliverWebhooks(client); err != nil {
+			logger.Errorf("cannot deliver webhooks: %v", err)
+		}
+		time.Sleep(webhookPollInterval)
+	}
+}
+
+// newWebhookClient returns the client used to deliver webhooks. As
+// webhook URLs are chosen by users, the client refuses to connect to
+// addresses in private, loopback and link-local networks, which may
+// hold services that are not meant to be reachable from outside, and
+// it does not follow redirects, which could lead it to them.
+func newWebhookClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookTimeout,
+	}
+	return &http.Client{
+		Timeout: webhookTimeout,
+		// No proxy is used, so that the
+		// address dialed is the one checked.
+		Transport: &http.Transport{
+			Dial: func(network, addr string) (net.Conn, error) {
+				return dialWebhook(dialer, network, addr)
+			},
+		},
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return errgo.Newf("redirect to %s not followed", req.URL)
+		},
+	}
+}
+
+// dialWebhook connects to the given address using the given dialer.
+// The host is resolved first and only its addresses that are not
+// forbidden by isForbiddenWebhookIP are dialed, so that the address
+// checked is the one connected to.
+func dialWebhook(dialer *net.Dialer, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	err = errgo.Newf("no addresses found for %q", host)
+	for _, ip := range ips {
+		if isForbiddenWebhookIP(ip) {
+			err = errgo.Newf("address %s of %q is not allowed for webhooks", ip, host)
+			continue
+		}
+		var conn net.Conn
+		conn, err = dialer.Dial(network, net.JoinHostPort(ip.String(), port))
+		if err == nil {
+			return conn, nil
+		}
+	}
+	return nil, errgo.Mask(err)
+}
+
+// isForbiddenWebhookIP is defined as a variable so
+// that it can be changed for testing.
+var isForbiddenWebhookIP = forbiddenWebhookIP
+
+// forbiddenWebhookNets holds the networks, other than the loopback,
+// link-local and unspecified addresses, to which webhooks are not
+// delivered.
+var forbiddenWebhookNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"172.16.0.0/12",
+	"192.168.0.0/16",
+	"fc00::/7",
+)
+
+// forbiddenWebhookIP reports whether webhooks
+// must not be delivered to the given address.
+func forbiddenWebhookIP(ip net.IP) bool {
+	if ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return true
+	}
+	for _, n := range forbiddenWebhookNets {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	nets := make([]*net.IPNet, len(cidrs))
+	for i, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			panic(err)
+		}
+		nets[i] = n
+	}
+	return nets
+}
+
+// queueWebhookDeliveries queues a delivery to each matching webhook
+// for every event in the change feed that has not yet been queued.
+//
+// Queueing is idempotent, so it is safe for more than one server
+// to queue deliveries at the same time.
+func (s *Store) queueWebhookDeliveries() error {
+	var cursor struct {
+		Seq int64
+	}
+	err := s.DB.Cursors().FindId(webhooksCursor).One(&cursor)
+	if err != nil && err != mgo.ErrNotFound {
+		return errgo.Notef(err, "cannot get webhooks cursor")
+	}
+	for {
+		events, err := s.Events(cursor.Seq, webhookQueueBatchSize)
+		if errgo.Cause(err) == params.ErrCursorExpired {
+			logger.Errorf("events following %d have expired before being delivered to webhooks", cursor.Seq)
+			events, err = s.Events(0, webhookQueueBatchSize)
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if len(events) == 0 {
+			return nil
+		}
+		for i := range events {
+			if err := s.queueEventDeliveries(&events[i]); err != nil {
+				return errgo.Mask(err)
+			}
+		}
+		cursor.Seq = events[len(events)-1].Seq
+		if _, err := s.DB.Cursors().UpsertId(webhooksCursor, bson.D{{"$max", bson.D{{"seq", cursor.Seq}}}}); err != nil {
+			return errgo.Notef(err, "cannot update webhooks cursor")
+		}
+	}
+}
+
+// queueEventDeliveries queues a delivery of the given event to
+// each webhook that matches it. Webhooks match the events for
+// their user's entities, or all events if they have no user,
+// and are only sent events recorded after they were registered.
+func (s *Store) queueEventDeliveries(e *mongodoc.Event) error {
+	users := []string{""}
+	if e.Id != nil && e.Id.User != "" {
+		users = append(users, e.Id.User)
+	}
+	var hooks []*mongodoc.Webhook
+	err := s.DB.Webhooks().Find(bson.D{
+		{"user", bson.D{{"$in", users}}},
+		{"createtime", bson.D{{"$lte", e.Time}}},
+	}).All(&hooks)
+	if err != nil {
+		return errgo.Notef(err, "cannot get webhooks")
+	}
+	now := time.Now()
+	for _, hook := range hooks {
+		if !wantsEvent(hook, e) {
+			continue
+		}
+		err := s.DB.WebhookDeliveries().Insert(&mongodoc.WebhookDelivery{
+			Id:          fmt.Sprintf("%s-%d", hook.Id, e.Seq),
+			WebhookId:   hook.Id,
+			Event:       *e,
+			Status:      string(params.WebhookPending),
+			Time:        now,
+			NextAttempt: now,
+		})
+		if err != nil && !mgo.IsDup(err) {
+			return errgo.Notef(err, "cannot queue delivery of event %d to webhook %q", e.Seq, hook.Id)
+		}
+	}
+	return nil
+}
+
+// wantsEvent reports whether the given webhook
+// accepts events of the kind of e.
+func wantsEvent(hook *mongodoc.Webhook, e *mongodoc.Event) bool {
+	if len(hook.Kinds) == 0 {
+		return true
+	}
+	for _, kind := range hook.Kinds {
+		if kind == e.Kind {
+			return true
+		}
+	}
+	return false
+}
+
+// deliverWebhooks attempts each pending webhook delivery that is due,
+// using the given client, and returns the number of attempts made.
+//
+// Each delivery is leased before it is attempted, so that it is not
+// attempted concurrently by another server. A delivery is attempted
+// at most once by each call.
+func (s *Store) deliverWebhooks(client *http.Client) (int, error) {
+	start := time.Now()
+	n := 0
+	for {
+		var d mongodoc.WebhookDelivery
+		// Deliveries already attempted since the start of the
+		// call are excluded, even if they are due to be retried.
+		_, err := s.DB.WebhookDeliveries().Find(bson.D{
+			{"status", string(params.WebhookPending)},
+			{"nextattempt", bson.D{{"$lte", start}}},
+			{"$or", []bson.D{
+				{{"lastattempt", bson.D{{"$exists", false}}}},
+				{{"lastattempt", bson.D{{"$lt", start}}}},
+			}},
+		}).Sort("nextattempt", "event._id").Apply(mgo.Change{
+			Update: bson.D{{"$set", bson.D{{"nextattempt", time.Now().Add(2 * webhookTimeout)}}}},
+		}, &d)
+		if err == mgo.ErrNotFound {
+			return n, nil
+		}
+		if err != nil {
+			return n, errgo.Notef(err, "cannot get pending webhook delivery")
+		}
+		if err := s.attemptDelivery(client, &d); err != nil {
+			return n, errgo.Mask(err)
+		}
+		n++
+	}
+}
+
+// attemptDelivery attempts to deliver the given delivery
+// and records the outcome.
+func (s *Store) attemptDelivery(client *http.Client, d *mongodoc.WebhookDelivery) error {
+	hook, err := s.Webhook(d.WebhookId)
+	if errgo.Cause(err) == params.ErrNotFound {
+		return s.updateDelivery(d.Id, bson.D{
+			{"status", string(params.WebhookFailed)},
+			{"error", "webhook has been removed"},
+		}, nil)
+	}
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	statusCode, err := postWebhook(client, hook, d)
+	now := time.Now()
+	attempts := d.Attempts + 1
+	set := bson.D{
+		{"attempts", attempts},
+		{"lastattempt", now},
+	}
+	var unset bson.D
+	if statusCode != 0 {
+		set = append(set, bson.DocElem{"statuscode", statusCode})
+	} else {
+		unset = append(unset, bson.DocElem{"statuscode", ""})
+	}
+	switch {
+	case err == nil:
+		set = append(set, bson.DocElem{"status", string(params.WebhookDelivered)})
+		unset = append(unset, bson.DocElem{"error", ""})
+	case attempts >= maxWebhookAttempts:
+		logger.Infof("delivery %s to webhook %q failed: %v", d.Id, hook.Id, err)
+		set = append(set, bson.DocElem{"status", string(params.WebhookFailed)}, bson.DocElem{"error", err.Error()})
+	default:
+		set = append(set, bson.DocElem{"nextattempt", now.Add(webhookBackoff(attempts))}, bson.DocElem{"error", err.Error()})
+	}
+	return s.updateDelivery(d.Id, set, unset)
+}
+
+// updateDelivery sets and unsets the given fields
+// of the delivery with the given id.
+func (s *Store) updateDelivery(id string, set, unset bson.D) error {
+	update := bson.D{{"$set", set}}
+	if len(unset) > 0 {
+		update = append(update, bson.DocElem{"$unset", unset})
+	}
+	if err := s.DB.WebhookDeliveries().UpdateId(id, update); err != nil {
+		return errgo.Notef(err, "cannot update webhook delivery %s", id)
+	}
+	return nil
+}
+
+// webhookBackoff returns the time to wait before retrying
+// a webhook delivery after the given number of attempts.
+func webhookBackoff(attempts int) time.Duration {
+	d := webhookRetryDelay
+	for i := 1; i < attempts; i++ {
+		d *= 2
+		if d >= maxWebhookRetryDelay {
+			return maxWebhookRetryDelay
+		}
+	}
+	return d
+}
+
+// postWebhook posts the event of the given delivery to the given
+// webhook, and returns the status code of the response, if any.
+func postWebhook(client *http.Client, hook *mongodoc.Webhook, d *mongodoc.WebhookDelivery) (int, error) {
+	body, err := json.Marshal(params.WebhookPayload{
+		WebhookId:  hook.Id,
+		DeliveryId: d.Id,
+		Event:      EventParams(&d.Event),
+	})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	req, err := http.NewRequest("POST", hook.URL, bytes.NewReader(body))
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(params.WebhookSignatureHeader, params.WebhookSignature(hook.Secret, body))
+	req.Header.Set(params.WebhookEventHeader, d.Event.Kind)
+	req.Header.Set(params.WebhookDeliveryHeader, d.Id)
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
+	defer resp.Body.Close()
+	// Read some of the body so that the connection can be reused.
+	io.Copy(ioutil.Discard, io.LimitReader(resp.Body, 64*1024))
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return resp.StatusCode, errgo.Newf("unexpected response status %q", resp.Status)
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,369 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package charmstore
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+var addWebhookErrorsTests = []struct {
+	about       string
+	req         params.WebhookRequest
+	expectError string
+}{{
+	about: "invalid user",
+	req: params.WebhookRequest{
+		User: "bad/user",
+		URL:  "http://example.com/hook",
+	},
+	expectError: `invalid user name "bad/user"`,
+}, {
+	about: "invalid URL scheme",
+	req: params.WebhookRequest{
+		URL: "ftp://example.com/hook",
+	},
+	expectError: `invalid webhook URL "ftp://example.com/hook"`,
+}, {
+	about: "relative URL",
+	req: params.WebhookRequest{
+		URL: "/hook",
+	},
+	expectError: `invalid webhook URL "/hook"`,
+}, {
+	about: "invalid event kind",
+	req: params.WebhookRequest{
+		URL:   "http://example.com/hook",
+		Kinds: []params.EventKind{"upload", "reboot"},
+	},
+	expectError: `invalid event kind "reboot"`,
+}}
+
+func (s *StoreSuite) TestAddWebhookErrors(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	for i, test := range addWebhookErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		_, err := store.AddWebhook("bob", &test.req)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+		c.Assert(errgo.Cause(err), gc.Equals, params.ErrBadRequest)
+	}
+}
+
+func (s *StoreSuite) TestAddWebhook(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	hook, err := store.AddWebhook("bob", &params.WebhookRequest{
+		User:  "bob",
+		URL:   "http://example.com/hook",
+		Kinds: []params.EventKind{params.EventUpload},
+	})
+	c.Assert(err, gc.IsNil)
+	c.Assert(hook.Secret, gc.Not(gc.Equals), "")
+	c.Assert(hook.Kinds, jc.DeepEquals, []string{"upload"})
+
+	got, err := store.Webhook(hook.Id)
+	c.Assert(err, gc.IsNil)
+	c.Assert(got.URL, gc.Equals, "http://example.com/hook")
+	c.Assert(got.Owner, gc.Equals, "bob")
+
+	hooks, err := store.Webhooks("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(hooks, gc.HasLen, 1)
+	c.Assert(hooks[0].Id, gc.Equals, hook.Id)
+	hooks, err = store.Webhooks("")
+	c.Assert(err, gc.IsNil)
+	c.Assert(hooks, gc.HasLen, 0)
+
+	err = store.RemoveWebhook(hook.Id)
+	c.Assert(err, gc.IsNil)
+	_, err = store.Webhook(hook.Id)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	err = store.RemoveWebhook(hook.Id)
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *StoreSuite) TestDeliverWebhooks(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	recv := newWebhookReceiver(c)
+	defer recv.Close()
+	userHook, err := store.AddWebhook("charmers", &params.WebhookRequest{
+		User:   "charmers",
+		URL:    recv.URL,
+		Kinds:  []params.EventKind{params.EventUpload},
+		Secret: "sekrit",
+	})
+	c.Assert(err, gc.IsNil)
+	globalHook, err := store.AddWebhook("", &params.WebhookRequest{
+		URL:    recv.URL,
+		Secret: "sekrit",
+	})
+	c.Assert(err, gc.IsNil)
+	otherHook, err := store.AddWebhook("bob", &params.WebhookRequest{
+		User: "bob",
+		URL:  recv.URL,
+	})
+	c.Assert(err, gc.IsNil)
+
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err = store.AddCharmWithArchive(id, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = store.SetPerms(&id.URL, "read", params.Everyone)
+	c.Assert(err, gc.IsNil)
+
+	err = store.queueWebhookDeliveries()
+	c.Assert(err, gc.IsNil)
+	// Queueing again does not queue any more deliveries.
+	err = store.queueWebhookDeliveries()
+	c.Assert(err, gc.IsNil)
+	n, err := store.deliverWebhooks(http.DefaultClient)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 3)
+
+	// The user's webhook receives only the upload event and the
+	// global webhook receives both events, in sequence order.
+	got := make(map[string][]params.EventKind)
+	for _, req := range recv.requests() {
+		c.Assert(req.header.Get(params.WebhookSignatureHeader), gc.Equals, params.WebhookSignature("sekrit", req.body))
+		var payload params.WebhookPayload
+		err := json.Unmarshal(req.body, &payload)
+		c.Assert(err, gc.IsNil)
+		c.Assert(req.header.Get(params.WebhookEventHeader), gc.Equals, string(payload.Event.Kind))
+		c.Assert(req.header.Get(params.WebhookDeliveryHeader), gc.Equals, payload.DeliveryId)
+		got[payload.WebhookId] = append(got[payload.WebhookId], payload.Event.Kind)
+	}
+	c.Assert(got, jc.DeepEquals, map[string][]params.EventKind{
+		userHook.Id:   {params.EventUpload},
+		globalHook.Id: {params.EventUpload, params.EventPerm},
+	})
+
+	deliveries, err := store.WebhookDeliveries(userHook.Id, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deliveries, gc.HasLen, 1)
+	c.Assert(deliveries[0].Status, gc.Equals, string(params.WebhookDelivered))
+	c.Assert(deliveries[0].Attempts, gc.Equals, 1)
+	c.Assert(deliveries[0].StatusCode, gc.Equals, http.StatusOK)
+	deliveries, err = store.WebhookDeliveries(otherHook.Id, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deliveries, gc.HasLen, 0)
+
+	// Nothing more is delivered.
+	n, err = store.deliverWebhooks(http.DefaultClient)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+func (s *StoreSuite) TestDeliverWebhooksRetry(c *gc.C) {
+	s.PatchValue(&webhookRetryDelay, time.Duration(0))
+	store := s.newStore(c, false)
+	defer store.Close()
+	recv := newWebhookReceiver(c)
+	defer recv.Close()
+	recv.setStatus(http.StatusInternalServerError)
+	hook, err := store.AddWebhook("", &params.WebhookRequest{
+		URL: recv.URL,
+	})
+	c.Assert(err, gc.IsNil)
+	s.addPermEvent(c, store)
+	err = store.queueWebhookDeliveries()
+	c.Assert(err, gc.IsNil)
+
+	// Each pass makes one attempt.
+	n, err := s.deliverWebhooksPass(store)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	deliveries, err := store.WebhookDeliveries(hook.Id, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deliveries, gc.HasLen, 1)
+	c.Assert(deliveries[0].Status, gc.Equals, string(params.WebhookPending))
+	c.Assert(deliveries[0].Attempts, gc.Equals, 1)
+	c.Assert(deliveries[0].StatusCode, gc.Equals, http.StatusInternalServerError)
+	c.Assert(deliveries[0].Error, gc.Equals, `unexpected response status "500 Internal Server Error"`)
+
+	// The delivery is marked as failed after the
+	// maximum number of attempts.
+	for i := 1; i < maxWebhookAttempts; i++ {
+		n, err := s.deliverWebhooksPass(store)
+		c.Assert(err, gc.IsNil)
+		c.Assert(n, gc.Equals, 1)
+	}
+	deliveries, err = store.WebhookDeliveries(hook.Id, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deliveries[0].Status, gc.Equals, string(params.WebhookFailed))
+	c.Assert(deliveries[0].Attempts, gc.Equals, maxWebhookAttempts)
+	c.Assert(recv.requests(), gc.HasLen, maxWebhookAttempts)
+	n, err = s.deliverWebhooksPass(store)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+
+	// A delivery that succeeds after a failure clears the error.
+	recv.setStatus(http.StatusOK)
+	s.addPermEvent(c, store)
+	err = store.queueWebhookDeliveries()
+	c.Assert(err, gc.IsNil)
+	n, err = store.deliverWebhooks(http.DefaultClient)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 1)
+	deliveries, err = store.WebhookDeliveries(hook.Id, 1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deliveries[0].Status, gc.Equals, string(params.WebhookDelivered))
+	c.Assert(deliveries[0].Error, gc.Equals, "")
+}
+
+func (s *StoreSuite) TestDeliverRemovedWebhook(c *gc.C) {
+	store := s.newStore(c, false)
+	defer store.Close()
+	recv := newWebhookReceiver(c)
+	defer recv.Close()
+	hook, err := store.AddWebhook("", &params.WebhookRequest{
+		URL: recv.URL,
+	})
+	c.Assert(err, gc.IsNil)
+	s.addPermEvent(c, store)
+	err = store.queueWebhookDeliveries()
+	c.Assert(err, gc.IsNil)
+	err = store.RemoveWebhook(hook.Id)
+	c.Assert(err, gc.IsNil)
+
+	_, err = store.deliverWebhooks(http.DefaultClient)
+	c.Assert(err, gc.IsNil)
+	c.Assert(recv.requests(), gc.HasLen, 0)
+	deliveries, err := store.WebhookDeliveries(hook.Id, 0)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deliveries[0].Status, gc.Equals, string(params.WebhookFailed))
+	c.Assert(deliveries[0].Error, gc.Equals, "webhook has been removed")
+}
+
+func (s *StoreSuite) TestWebhookBackoff(c *gc.C) {
+	c.Assert(webhookBackoff(1), gc.Equals, webhookRetryDelay)
+	c.Assert(webhookBackoff(2), gc.Equals, 2*webhookRetryDelay)
+	c.Assert(webhookBackoff(3), gc.Equals, 4*webhookRetryDelay)
+	c.Assert(webhookBackoff(100), gc.Equals, maxWebhookRetryDelay)
+}
+
+var forbiddenWebhookIPTests = []struct {
+	ip        string
+	forbidden bool
+}{
+	{"127.0.0.1", true},
+	{"::1", true},
+	{"10.1.2.3", true},
+	{"172.16.0.1", true},
+	{"192.168.1.1", true},
+	{"100.64.0.1", true},
+	{"169.254.169.254", true},
+	{"0.0.0.0", true},
+	{"fe80::1", true},
+	{"fd00::1", true},
+	{"8.8.8.8", false},
+	{"172.32.0.1", false},
+	{"2001:4860:4860::8888", false},
+}
+
+func (s *StoreSuite) TestForbiddenWebhookIP(c *gc.C) {
+	for i, test := range forbiddenWebhookIPTests {
+		c.Logf("test %d: %s", i, test.ip)
+		c.Assert(forbiddenWebhookIP(net.ParseIP(test.ip)), gc.Equals, test.forbidden)
+	}
+}
+
+func (s *StoreSuite) TestWebhookClientRefusesForbiddenAddresses(c *gc.C) {
+	recv := newWebhookReceiver(c)
+	defer recv.Close()
+	_, err := newWebhookClient().Post(recv.URL, "application/json", strings.NewReader("{}"))
+	c.Assert(err, gc.ErrorMatches, `.*address 127.0.0.1 of "127.0.0.1" is not allowed for webhooks`)
+	c.Assert(recv.requests(), gc.HasLen, 0)
+}
+
+func (s *StoreSuite) TestWebhookClientDoesNotFollowRedirects(c *gc.C) {
+	s.PatchValue(&isForbiddenWebhookIP, func(net.IP) bool {
+		return false
+	})
+	recv := newWebhookReceiver(c)
+	defer recv.Close()
+	redirector := httptest.NewServer(http.RedirectHandler(recv.URL, http.StatusFound))
+	defer redirector.Close()
+	_, err := newWebhookClient().Post(redirector.URL, "application/json", strings.NewReader("{}"))
+	c.Assert(err, gc.ErrorMatches, `.*redirect to .* not followed`)
+	c.Assert(recv.requests(), gc.HasLen, 0)
+}
+
+// deliverWebhooksPass calls store.deliverWebhooks after waiting long
+// enough for the attempts made by any previous call not to be
+// considered part of this one, as times are stored with millisecond
+// precision.
+func (s *StoreSuite) deliverWebhooksPass(store *Store) (int, error) {
+	time.Sleep(2 * time.Millisecond)
+	return store.deliverWebhooks(http.DefaultClient)
+}
+
+// addPermEvent adds a perm event to the change feed.
+func (s *StoreSuite) addPermEvent(c *gc.C, store *Store) {
+	err := store.AddEvent(&mongodoc.Event{
+		Kind:   string(params.EventPerm),
+		Id:     charm.MustParseReference("cs:~charmers/wordpress"),
+		Fields: []string{"read"},
+	})
+	c.Assert(err, gc.IsNil)
+}
+
+// webhookReceiver is an HTTP server that records
+// the webhook requests that it receives.
+type webhookReceiver struct {
+	*httptest.Server
+	mu       sync.Mutex
+	status   int
+	received []webhookRequest
+}
+
+type webhookRequest struct {
+	header http.Header
+	body   []byte
+}
+
+func newWebhookReceiver(c *gc.C) *webhookReceiver {
+	r := &webhookReceiver{
+		status: http.StatusOK,
+	}
+	r.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body, err := ioutil.ReadAll(req.Body)
+		c.Check(err, gc.IsNil)
+		r.mu.Lock()
+		defer r.mu.Unlock()
+		r.received = append(r.received, webhookRequest{
+			header: req.Header,
+			body:   body,
+		})
+		w.WriteHeader(r.status)
+	}))
+	return r
+}
+
+func (r *webhookReceiver) setStatus(status int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.status = status
+}
+
+func (r *webhookReceiver) requests() []webhookRequest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]webhookRequest(nil), r.received...)
+}
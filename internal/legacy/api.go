@@ -145,7 +145,7 @@ func (h *Handler) serveCharmInfo(_ http.Header, req *http.Request) (interface{},
 		}
 		var entity *mongodoc.Entity
 		if err == nil {
-			entity, err = store.FindBestEntity(curl)
+			entity, err = store.FindBestEntity(curl, params.StableChannel)
 			if errgo.Cause(err) == params.ErrNotFound {
 				// The old API actually returned "entry not found"
 				// on *any* error, but it seems reasonable to be
@@ -225,7 +225,7 @@ func (h *Handler) serveCharmEvent(_ http.Header, req *http.Request) (interface{}
 		}
 
 		// Retrieve the charm.
-		entity, err := store.FindBestEntity(id, "_id", "uploadtime", "extrainfo")
+		entity, err := store.FindBestEntity(id, params.StableChannel, "_id", "uploadtime", "extrainfo")
 		if err != nil {
 			if errgo.Cause(err) == params.ErrNotFound {
 				// The old API actually returned "entry not found"
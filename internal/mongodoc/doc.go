@@ -58,10 +58,44 @@ type Entity struct {
 
 	UploadTime time.Time
 
+	// Development holds whether the entity has been published
+	// in the development channel. Entities published in the
+	// stable channel are also published in the development channel.
+	Development bool `bson:",omitempty" json:",omitempty"`
+
+	// DevelopmentPublishTime holds the time when the entity
+	// was published in the development channel.
+	DevelopmentPublishTime time.Time `bson:",omitempty"`
+
+	// Stable holds whether the entity has been published
+	// in the stable channel.
+	Stable bool `bson:",omitempty" json:",omitempty"`
+
+	// StablePublishTime holds the time when the entity
+	// was published in the stable channel.
+	StablePublishTime time.Time `bson:",omitempty"`
+
+	// Deprecation holds information on the deprecation of the
+	// entity. It is nil if the entity has not been deprecated.
+	Deprecation *Deprecation `bson:",omitempty" json:",omitempty"`
+
+	// ReleaseNotes holds human-readable notes describing
+	// what has changed in this revision of the entity.
+	ReleaseNotes string `bson:",omitempty" json:",omitempty"`
+
 	// ExtraInfo holds arbitrary extra metadata associated with
 	// the entity. The byte slices hold JSON-encoded data.
 	ExtraInfo map[string][]byte `bson:",omitempty" json:",omitempty"`
 
+	// Resources holds the revision of each resource linked
+	// to the charm, keyed by resource name.
+	Resources map[string]int `bson:",omitempty" json:",omitempty"`
+
+	// Signatures holds the detached signatures of the entity's
+	// archive, each of which has been verified against a public
+	// key trusted by the signing user.
+	Signatures []Signature `bson:",omitempty" json:",omitempty"`
+
 	// TODO(rog) verify that all these types marshal to the expected
 	// JSON form.
 	CharmMeta    *charm.Meta
@@ -101,6 +135,14 @@ type Entity struct {
 	// every time we access one of these files.
 	Contents map[FileId]ZipFile `json:",omitempty" bson:",omitempty"`
 
+	// Appearance holds details of the appearance of the charm,
+	// derived from its icon. It is calculated when the charm is
+	// uploaded and is always nil for bundles. It is also nil for
+	// charms uploaded before it was introduced; their appearance
+	// is derived from the icon each time it is requested and is
+	// never stored.
+	Appearance *Appearance `json:",omitempty" bson:",omitempty"`
+
 	// PromulgatedURL holds the promulgated URL of the entity. If the entity
 	// is not promulgated this should be set to nil.
 	PromulgatedURL *charm.Reference `json:",omitempty" bson:"promulgated-url,omitempty"`
@@ -108,6 +150,11 @@ type Entity struct {
 	// PromulgatedRevision holds the revision number from the promulgated URL.
 	// If the entity is not promulgated this should be set to -1.
 	PromulgatedRevision int `bson:"promulgated-revision"`
+
+	// Modifications counts the updates made to the entity since it
+	// was added. It is used to tell clients whether the metadata of
+	// the entity has changed.
+	Modifications int `json:",omitempty" bson:",omitempty"`
 }
 
 // PreferredURL returns the preferred way to refer to this entity. If
@@ -148,6 +195,12 @@ type BaseEntity struct {
 	// Promulgated specifies whether the charm or bundle should be
 	// promulgated.
 	Promulgated IntBool
+
+	// Modifications counts the updates made to the base entity,
+	// including the uploads of new revisions, since it was added.
+	// It is used to tell clients whether the metadata of its
+	// entities has changed.
+	Modifications int `json:",omitempty" bson:",omitempty"`
 }
 
 // ACL holds lists of users and groups that are
@@ -235,6 +288,7 @@ const (
 	_ LogType = iota
 	IngestionType
 	LegacyStatisticsType
+	ScrubType
 )
 
 // Migration holds information about the database migration.
@@ -243,6 +297,330 @@ type Migration struct {
 	Executed []string
 }
 
+// Upload holds the in-database representation of a resumable
+// archive upload session. The archive is uploaded as a sequence
+// of numbered chunks, each of which is stored as a separate blob
+// until the upload is committed.
+type Upload struct {
+	// Id holds the unique id of the upload.
+	Id string `bson:"_id"`
+
+	// User holds the name of the user that created the upload.
+	// It is empty if the upload was created by an admin.
+	User string
+
+	// Created holds the time the upload was created.
+	Created time.Time
+
+	// Expires holds the time after which the upload
+	// can no longer be used.
+	Expires time.Time
+
+	// Chunks holds the chunks uploaded so far, keyed
+	// by the decimal representation of the chunk number.
+	Chunks map[string]UploadChunk
+}
+
+// ContentChallenge holds the in-database representation of a
+// pending content challenge, made when an archive is uploaded
+// without its content, so that the blob to be created when the
+// challenge is answered is chosen by the server alone.
+type ContentChallenge struct {
+	// Id holds the id of the challenge sent to the client.
+	Id string `bson:"_id"`
+
+	// BlobName holds the name of the blob to be created
+	// when the challenge is answered.
+	BlobName string
+
+	// RequestId holds the id of the challenge
+	// in the blob store.
+	RequestId string
+
+	// Hash and Size hold the hash and size of the
+	// content that the challenge is for.
+	Hash string
+	Size int64
+
+	// Expires holds the time after which the
+	// challenge can no longer be answered.
+	Expires time.Time
+}
+
+// UploadChunk holds information on a chunk of an upload.
+type UploadChunk struct {
+	// BlobName holds the name of the blob holding
+	// the chunk data.
+	BlobName string
+
+	// Size holds the size of the chunk.
+	Size int64
+
+	// Hash holds the SHA384 hash of the chunk data.
+	Hash string
+}
+
+// DeletedEntity holds the in-database representation of an
+// entity revision that has been deleted. Deleted entities are
+// kept, along with their archive blobs, until they expire, so
+// that they can be restored.
+type DeletedEntity struct {
+	Entity `bson:",inline"`
+
+	// DeleteTime holds the time the entity was deleted.
+	DeleteTime time.Time
+
+	// Expires holds the time after which the entity
+	// can no longer be restored.
+	Expires time.Time
+
+	// BaseEntity holds the base entity of the deleted
+	// entity if it was removed because the entity was
+	// the last remaining revision. It is nil otherwise.
+	BaseEntity *BaseEntity `bson:",omitempty"`
+}
+
+// Deprecation holds information on the deprecation of an
+// entity revision.
+type Deprecation struct {
+	// Yanked holds whether the revision has been yanked. Yanked
+	// revisions are never chosen when resolving a partially
+	// specified URL, but can still be retrieved by their full id.
+	Yanked bool
+
+	// Reason holds the reason why the revision was deprecated.
+	Reason string
+
+	// Replacement optionally holds the fully specified URL
+	// of the revision that should be used instead.
+	Replacement *charm.Reference `bson:",omitempty"`
+
+	// Time holds the time the revision was deprecated.
+	Time time.Time
+}
+
+// Resource holds the in-database representation of a revision
+// of a charm resource. Resources belong to a base entity and are
+// linked to individual charm revisions (see Entity.Resources).
+type Resource struct {
+	// BaseURL holds the base URL of the charm
+	// that the resource belongs to.
+	BaseURL *charm.Reference
+
+	// Name holds the name of the resource.
+	Name string
+
+	// Revision holds the revision of the resource.
+	Revision int
+
+	// BlobName holds the name that the resource blob
+	// is given in the blob store.
+	BlobName string
+
+	// BlobHash holds the SHA384 hash checksum of the
+	// blob, in hexadecimal format.
+	BlobHash string
+
+	// BlobHash256 holds the SHA256 hash checksum of
+	// the blob, in hexadecimal format.
+	BlobHash256 string
+
+	// Size holds the size of the resource blob.
+	Size int64
+
+	// UploadTime holds the time the resource
+	// revision was uploaded.
+	UploadTime time.Time
+}
+
+// Appearance holds details of the appearance of a charm
+// that are derived from its icon.
+type Appearance struct {
+	// Color holds the dominant color of the icon
+	// in "#rrggbb" form, or is empty if no color
+	// could be found in the icon.
+	Color string
+
+	// Palette holds the dominant color followed by up
+	// to four of the other most frequently used colors
+	// in the icon, most frequent first.
+	Palette []string `bson:",omitempty"`
+
+	// DefaultIcon records whether the charm has no
+	// icon of its own, in which case the appearance is
+	// that of the default icon.
+	DefaultIcon bool `bson:",omitempty"`
+}
+
+// Signature holds a detached signature of an entity's archive.
+type Signature struct {
+	// User holds the name of the user that made the signature.
+	User string
+
+	// KeyId holds the id of the public key that
+	// verifies the signature.
+	KeyId string
+
+	// Signature holds the signature of the
+	// SHA384 hash of the archive.
+	Signature []byte
+
+	// Time holds the time the signature was added.
+	Time time.Time
+}
+
+// PublicKey holds the in-database representation of a public key
+// trusted to verify the signatures made by a user.
+type PublicKey struct {
+	// User holds the name of the user that the key belongs to.
+	User string
+
+	// Id holds the id of the key: the hex-encoded SHA256
+	// hash of its PKIX encoding.
+	Id string
+
+	// Key holds the PEM-encoded PKIX public key.
+	Key []byte
+
+	// AddTime holds the time the key was added.
+	AddTime time.Time
+}
+
+// Redirect holds the in-database representation of a redirect left
+// behind when the ownership of a base entity is transferred to
+// another user. Any reference to the old base entity or to one of its
+// entities is resolved under the new base URL.
+type Redirect struct {
+	// URL holds the base URL that the entities were transferred
+	// from, e.g. cs:~alice/foo.
+	URL *charm.Reference `bson:"_id"`
+
+	// Target holds the base URL that the entities were transferred
+	// to, e.g. cs:~bob/foo.
+	Target *charm.Reference
+
+	// Time holds the time of the transfer.
+	Time time.Time
+}
+
+// Event holds the in-database representation of an event in the
+// change feed, which records every change made to the entities in
+// the charm store. Events are kept in a capped collection, so the
+// oldest events are discarded when it is full.
+type Event struct {
+	// Seq holds the sequence number of the event. Sequence
+	// numbers start at one and increase by one with each event.
+	Seq int64 `bson:"_id"`
+
+	// Time holds the time at which the event was recorded.
+	Time time.Time
+
+	// Kind holds the kind of the event, one of the
+	// params.EventKind values.
+	Kind string
+
+	// Id holds the id of the entity changed. For changes
+	// to a base entity, it holds the base entity URL.
+	Id *charm.Reference
+
+	// PromulgatedId holds the promulgated id of the
+	// entity, if it has one.
+	PromulgatedId *charm.Reference `bson:",omitempty"`
+
+	// Channel holds the channel the entity was published in,
+	// if any.
+	Channel string `bson:",omitempty"`
+
+	// Fields holds the names of the permissions or
+	// extra-info keys that were changed, if any.
+	Fields []string `bson:",omitempty"`
+}
+
+// Webhook holds the in-database representation of a webhook: an HTTP
+// endpoint that is notified of the events in the change feed.
+type Webhook struct {
+	// Id holds the id of the webhook.
+	Id string `bson:"_id"`
+
+	// User holds the user whose entities' events are delivered
+	// to the webhook. If it is empty, the events for all
+	// entities are delivered.
+	User string
+
+	// URL holds the URL that events are posted to.
+	URL string
+
+	// Kinds holds the kinds of event that are delivered.
+	// If it is empty, events of all kinds are delivered.
+	Kinds []string
+
+	// Secret holds the key used to sign the payloads
+	// delivered to the webhook.
+	Secret string
+
+	// Owner holds the name of the user that registered
+	// the webhook.
+	Owner string
+
+	// CreateTime holds the time the webhook was registered.
+	// Only events recorded after that time are delivered.
+	CreateTime time.Time
+}
+
+// WebhookDelivery holds the in-database representation of the
+// delivery of an event to a webhook.
+type WebhookDelivery struct {
+	// Id holds the id of the delivery, made from the webhook id
+	// and the event sequence number.
+	Id string `bson:"_id"`
+
+	// WebhookId holds the id of the webhook.
+	WebhookId string
+
+	// Event holds the event being delivered.
+	Event Event
+
+	// Status holds the status of the delivery, one
+	// of the params.WebhookDeliveryStatus values.
+	Status string
+
+	// Time holds the time the delivery was queued.
+	Time time.Time
+
+	// Attempts holds the number of delivery attempts made.
+	Attempts int
+
+	// NextAttempt holds the time of the next delivery attempt
+	// for pending deliveries.
+	NextAttempt time.Time
+
+	// LastAttempt holds the time of the last delivery attempt.
+	LastAttempt time.Time `bson:",omitempty"`
+
+	// StatusCode holds the HTTP status code of the response
+	// to the last delivery attempt, if any.
+	StatusCode int `bson:",omitempty"`
+
+	// Error holds the error from the last delivery attempt,
+	// if it failed.
+	Error string `bson:",omitempty"`
+}
+
+// Lease holds the in-database representation of a lease, which
+// gives one server the exclusive right to do some work, such as
+// scrubbing the archives, until it expires.
+type Lease struct {
+	// Name holds the name of the lease.
+	Name string `bson:"_id"`
+
+	// Holder identifies the server holding the lease.
+	Holder string
+
+	// Expires holds the time at which the lease expires
+	// unless it is renewed by its holder.
+	Expires time.Time
+}
+
 // IntBool is a bool that will be represented internally in the database as 1 for
 // true and -1 for false.
 type IntBool bool
@@ -0,0 +1,137 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+// The policy package implements the content policy applied to charm
+// and bundle archives when they are uploaded. A policy holds a set of
+// named rules, each of which checks an archive. All the rules are
+// checked, so that an archive rejected by the policy is reported with
+// every rule it violates.
+package policy
+
+import (
+	"archive/zip"
+	"fmt"
+	"sort"
+	"strings"
+
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// Archive holds an archive being checked against a policy.
+type Archive struct {
+	// Id holds the id the archive is being uploaded as.
+	Id *charm.Reference
+
+	// Size holds the size of the archive in bytes.
+	Size int64
+
+	// Files holds the files in the archive.
+	Files []*zip.File
+
+	// Charm holds the charm read from the archive.
+	// It is nil if the archive holds a bundle.
+	Charm charm.Charm
+
+	// Bundle holds the bundle read from the archive.
+	// It is nil if the archive holds a charm.
+	Bundle charm.Bundle
+}
+
+// Check checks an archive against a rule. It returns an
+// error describing the violation if the archive does not
+// comply with the rule.
+type Check func(a *Archive) error
+
+// rule holds a named check.
+type rule struct {
+	name  string
+	check Check
+}
+
+// Policy holds the rules applied to uploaded archives.
+// The zero value holds no rules and accepts all archives.
+type Policy struct {
+	rules []rule
+}
+
+// Register adds a rule with the given name to the policy.
+// The rules are checked in the order they were registered.
+func (p *Policy) Register(name string, check Check) {
+	p.rules = append(p.rules, rule{
+		name:  name,
+		check: check,
+	})
+}
+
+// Rules returns the names of the rules in the policy.
+func (p *Policy) Rules() []string {
+	if p == nil {
+		return nil
+	}
+	names := make([]string, len(p.rules))
+	for i, r := range p.rules {
+		names[i] = r.name
+	}
+	return names
+}
+
+// Check checks the given archive against all the rules in the
+// policy. If any rule is violated, the returned error is an *Error
+// holding all the violations. A nil policy accepts all archives.
+func (p *Policy) Check(a *Archive) error {
+	if p == nil {
+		return nil
+	}
+	var violations Error
+	for _, r := range p.rules {
+		if err := r.check(a); err != nil {
+			if violations == nil {
+				violations = make(Error)
+			}
+			violations[r.name] = err.Error()
+		}
+	}
+	if violations != nil {
+		return violations
+	}
+	return nil
+}
+
+// Error holds the violations of the rules of a policy,
+// keyed by rule name.
+type Error map[string]string
+
+// Error implements error.Error.
+func (e Error) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = fmt.Sprintf("%s: %s", name, e[name])
+	}
+	return "archive violates content policy: " + strings.Join(msgs, "; ")
+}
+
+// ErrorCode implements the error code interface
+// used by the router package.
+func (e Error) ErrorCode() params.ErrorCode {
+	return params.ErrPolicyViolation
+}
+
+// ErrorInfo returns the violation of each rule, so that
+// clients can find out about all of them.
+func (e Error) ErrorInfo() map[string]*params.Error {
+	info := make(map[string]*params.Error)
+	for name, msg := range e {
+		info[name] = &params.Error{
+			Message: msg,
+			Code:    params.ErrPolicyViolation,
+		}
+	}
+	return info
+}
@@ -0,0 +1,210 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package policy_test
+
+import (
+	"archive/zip"
+	"bytes"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/config"
+	"gopkg.in/juju/charmstore.v4/internal/policy"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type policySuite struct{}
+
+var _ = gc.Suite(&policySuite{})
+
+// newArchive returns an archive holding the given files, keyed by
+// name. If isCharm is true, the archive is treated as a charm.
+func newArchive(c *gc.C, isCharm bool, files map[string]string) *policy.Archive {
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+	for name, content := range files {
+		f, err := w.Create(name)
+		c.Assert(err, gc.IsNil)
+		_, err = f.Write([]byte(content))
+		c.Assert(err, gc.IsNil)
+	}
+	err := w.Close()
+	c.Assert(err, gc.IsNil)
+	r, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	c.Assert(err, gc.IsNil)
+	a := &policy.Archive{
+		Id:    charm.MustParseReference("~charmers/trusty/wordpress-0"),
+		Size:  int64(buf.Len()),
+		Files: r.File,
+	}
+	if isCharm {
+		a.Charm = new(charm.CharmDir)
+	} else {
+		a.Bundle = new(charm.BundleDir)
+	}
+	return a
+}
+
+const copyright = `Format: http://www.debian.org/doc/packaging-manuals/copyright-format/1.0/
+
+Files: *
+Copyright: 2015, Canonical Ltd.
+License: GPL-3
+
+Files: lib/*
+Copyright: 2014, Someone Else
+License: Apache-2.0
+`
+
+var checkTests = []struct {
+	about       string
+	check       policy.Check
+	isBundle    bool
+	files       map[string]string
+	expectError string
+}{{
+	about: "archive within maximum size",
+	check: policy.MaxArchiveSize(1024),
+	files: map[string]string{"metadata.yaml": "name: wordpress"},
+}, {
+	about:       "archive too large",
+	check:       policy.MaxArchiveSize(10),
+	files:       map[string]string{"metadata.yaml": "name: wordpress"},
+	expectError: `archive size [0-9]+ exceeds maximum 10`,
+}, {
+	about: "no forbidden files",
+	check: policy.ForbiddenFiles([]string{"*.exe", "*.dll"}),
+	files: map[string]string{"hooks/install": "", "bin/tool": ""},
+}, {
+	about: "forbidden files",
+	check: policy.ForbiddenFiles([]string{"*.exe", "*.dll"}),
+	files: map[string]string{
+		"hooks/install":  "",
+		"bin/tool.exe":   "",
+		"lib/native.dll": "",
+	},
+	expectError: `forbidden files found: (bin/tool.exe, lib/native.dll|lib/native.dll, bin/tool.exe)`,
+}, {
+	about: "readme found",
+	check: policy.RequireReadme,
+	files: map[string]string{"README.md": ""},
+}, {
+	about: "readme found in lower case",
+	check: policy.RequireReadme,
+	files: map[string]string{"readme": ""},
+}, {
+	about:       "readme not in root directory",
+	check:       policy.RequireReadme,
+	files:       map[string]string{"docs/README": ""},
+	expectError: `no README file found`,
+}, {
+	about: "allowed licences",
+	check: policy.AllowedLicences([]string{"GPL-3", "Apache-2.0"}),
+	files: map[string]string{"copyright": copyright},
+}, {
+	about:       "licence not allowed",
+	check:       policy.AllowedLicences([]string{"GPL-3"}),
+	files:       map[string]string{"copyright": copyright},
+	expectError: `licences not allowed: Apache-2.0`,
+}, {
+	about:       "no copyright file",
+	check:       policy.AllowedLicences([]string{"GPL-3"}),
+	files:       map[string]string{"metadata.yaml": ""},
+	expectError: `no licence declared`,
+}, {
+	about:       "no licence declared",
+	check:       policy.AllowedLicences([]string{"GPL-3"}),
+	files:       map[string]string{"copyright": "Copyright: 2015, Canonical Ltd.\n"},
+	expectError: `no licence declared`,
+}, {
+	about:    "licences of bundles not checked",
+	check:    policy.AllowedLicences([]string{"GPL-3"}),
+	isBundle: true,
+	files:    map[string]string{"bundle.yaml": ""},
+}, {
+	about: "required hooks found",
+	check: policy.RequiredHooks([]string{"install", "start"}),
+	files: map[string]string{"hooks/install": "", "hooks/start": "", "hooks/stop": ""},
+}, {
+	about:       "required hooks missing",
+	check:       policy.RequiredHooks([]string{"install", "start", "stop"}),
+	files:       map[string]string{"hooks/install": "", "hooks/subdir/start": ""},
+	expectError: `missing hooks: start, stop`,
+}, {
+	about:    "hooks of bundles not checked",
+	check:    policy.RequiredHooks([]string{"install"}),
+	isBundle: true,
+	files:    map[string]string{"bundle.yaml": ""},
+}}
+
+func (s *policySuite) TestChecks(c *gc.C) {
+	for i, test := range checkTests {
+		c.Logf("test %d: %s", i, test.about)
+		err := test.check(newArchive(c, !test.isBundle, test.files))
+		if test.expectError == "" {
+			c.Assert(err, gc.IsNil)
+		} else {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+		}
+	}
+}
+
+func (s *policySuite) TestCheckReportsAllViolations(c *gc.C) {
+	var p policy.Policy
+	p.Register("always", func(*policy.Archive) error {
+		return nil
+	})
+	p.Register("first", func(*policy.Archive) error {
+		return errgo.New("first failure")
+	})
+	p.Register("second", func(*policy.Archive) error {
+		return errgo.New("second failure")
+	})
+	c.Assert(p.Rules(), jc.DeepEquals, []string{"always", "first", "second"})
+
+	err := p.Check(newArchive(c, true, nil))
+	c.Assert(err, gc.ErrorMatches, `archive violates content policy: first: first failure; second: second failure`)
+	perr, ok := err.(policy.Error)
+	c.Assert(ok, jc.IsTrue)
+	c.Assert(perr.ErrorCode(), gc.Equals, params.ErrPolicyViolation)
+	c.Assert(perr.ErrorInfo(), jc.DeepEquals, map[string]*params.Error{
+		"first": {
+			Message: "first failure",
+			Code:    params.ErrPolicyViolation,
+		},
+		"second": {
+			Message: "second failure",
+			Code:    params.ErrPolicyViolation,
+		},
+	})
+}
+
+func (s *policySuite) TestNilPolicy(c *gc.C) {
+	var p *policy.Policy
+	c.Assert(p.Check(newArchive(c, true, nil)), gc.IsNil)
+	c.Assert(p.Rules(), gc.HasLen, 0)
+}
+
+func (s *policySuite) TestNewFromConfig(c *gc.C) {
+	p := policy.NewFromConfig(&config.Config{})
+	c.Assert(p.Rules(), gc.HasLen, 0)
+
+	p = policy.NewFromConfig(&config.Config{
+		PolicyMaxArchiveSize:  1024,
+		PolicyForbiddenFiles:  []string{"*.exe"},
+		PolicyRequireReadme:   true,
+		PolicyAllowedLicences: []string{"GPL-3"},
+		PolicyRequiredHooks:   []string{"install"},
+	})
+	c.Assert(p.Rules(), jc.DeepEquals, []string{
+		"max-archive-size",
+		"forbidden-files",
+		"require-readme",
+		"allowed-licences",
+		"required-hooks",
+	})
+}
@@ -0,0 +1,192 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package policy
+
+import (
+	"bufio"
+	"io"
+	"path"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/config"
+)
+
+// NewFromConfig returns the policy holding the
+// rules enabled by the given configuration.
+func NewFromConfig(conf *config.Config) *Policy {
+	p := new(Policy)
+	if conf.PolicyMaxArchiveSize > 0 {
+		p.Register("max-archive-size", MaxArchiveSize(conf.PolicyMaxArchiveSize))
+	}
+	if len(conf.PolicyForbiddenFiles) > 0 {
+		p.Register("forbidden-files", ForbiddenFiles(conf.PolicyForbiddenFiles))
+	}
+	if conf.PolicyRequireReadme {
+		p.Register("require-readme", RequireReadme)
+	}
+	if len(conf.PolicyAllowedLicences) > 0 {
+		p.Register("allowed-licences", AllowedLicences(conf.PolicyAllowedLicences))
+	}
+	if len(conf.PolicyRequiredHooks) > 0 {
+		p.Register("required-hooks", RequiredHooks(conf.PolicyRequiredHooks))
+	}
+	return p
+}
+
+// MaxArchiveSize returns a check that rejects archives
+// larger than the given number of bytes.
+func MaxArchiveSize(max int64) Check {
+	return func(a *Archive) error {
+		if a.Size > max {
+			return errgo.Newf("archive size %d exceeds maximum %d", a.Size, max)
+		}
+		return nil
+	}
+}
+
+// ForbiddenFiles returns a check that rejects archives holding
+// files with a base name matching any of the given patterns.
+// See path.Match for the pattern syntax.
+func ForbiddenFiles(patterns []string) Check {
+	return func(a *Archive) error {
+		var found []string
+		for _, f := range a.Files {
+			if f.FileInfo().IsDir() {
+				continue
+			}
+			base := path.Base(f.Name)
+			for _, pattern := range patterns {
+				if ok, _ := path.Match(pattern, base); ok {
+					found = append(found, f.Name)
+					break
+				}
+			}
+		}
+		if len(found) > 0 {
+			return errgo.Newf("forbidden files found: %s", strings.Join(found, ", "))
+		}
+		return nil
+	}
+}
+
+// RequireReadme rejects archives that do not hold
+// a README file in their root directory.
+func RequireReadme(a *Archive) error {
+	for _, f := range a.Files {
+		if strings.Contains(f.Name, "/") {
+			continue
+		}
+		if strings.HasPrefix(strings.ToLower(f.Name), "readme") {
+			return nil
+		}
+	}
+	return errgo.New("no README file found")
+}
+
+// copyrightFile holds the name of the file in which
+// charms declare their licences.
+const copyrightFile = "copyright"
+
+// maxCopyrightSize holds the maximum number of
+// bytes read from a copyright file.
+const maxCopyrightSize = 64 * 1024
+
+// AllowedLicences returns a check that rejects charms that declare
+// no licence or any licence other than the given ones. Licences are
+// declared in the License fields of the charm's copyright file (see
+// http://www.debian.org/doc/packaging-manuals/copyright-format/1.0/).
+// Bundles are not checked.
+func AllowedLicences(allowed []string) Check {
+	return func(a *Archive) error {
+		if a.Charm == nil {
+			return nil
+		}
+		licences, err := declaredLicences(a)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if len(licences) == 0 {
+			return errgo.New("no licence declared")
+		}
+		var disallowed []string
+		for _, licence := range licences {
+			if !contains(allowed, licence) {
+				disallowed = append(disallowed, licence)
+			}
+		}
+		if len(disallowed) > 0 {
+			return errgo.Newf("licences not allowed: %s", strings.Join(disallowed, ", "))
+		}
+		return nil
+	}
+}
+
+// declaredLicences returns the licences declared
+// in the copyright file of the given archive.
+func declaredLicences(a *Archive) ([]string, error) {
+	for _, f := range a.Files {
+		if f.Name != copyrightFile {
+			continue
+		}
+		r, err := f.Open()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot open copyright file")
+		}
+		defer r.Close()
+		var licences []string
+		scanner := bufio.NewScanner(io.LimitReader(r, maxCopyrightSize))
+		for scanner.Scan() {
+			line := scanner.Text()
+			if !strings.HasPrefix(line, "License:") {
+				continue
+			}
+			licence := strings.TrimSpace(strings.TrimPrefix(line, "License:"))
+			if licence != "" && !contains(licences, licence) {
+				licences = append(licences, licence)
+			}
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, errgo.Notef(err, "cannot read copyright file")
+		}
+		return licences, nil
+	}
+	return nil, nil
+}
+
+// RequiredHooks returns a check that rejects charms that do
+// not implement all the given hooks. Bundles are not checked.
+func RequiredHooks(hooks []string) Check {
+	return func(a *Archive) error {
+		if a.Charm == nil {
+			return nil
+		}
+		found := make(map[string]bool)
+		for _, f := range a.Files {
+			if strings.HasPrefix(f.Name, "hooks/") && !f.FileInfo().IsDir() {
+				found[strings.TrimPrefix(f.Name, "hooks/")] = true
+			}
+		}
+		var missing []string
+		for _, hook := range hooks {
+			if !found[hook] {
+				missing = append(missing, hook)
+			}
+		}
+		if len(missing) > 0 {
+			return errgo.Newf("missing hooks: %s", strings.Join(missing, ", "))
+		}
+		return nil
+	}
+}
+
+func contains(ss []string, s string) bool {
+	for _, t := range ss {
+		if t == s {
+			return true
+		}
+	}
+	return false
+}
@@ -34,14 +34,31 @@ func (u *FieldUpdater) UpdateSearch() {
 
 // A FieldUpdateFunc is used to update a metadata document for the
 // given id. For each field in fields, it should set that field to
-// its corresponding value in the metadata document.
-type FieldUpdateFunc func(id *ResolvedURL, fields map[string]interface{}) error
+// its corresponding value in the metadata document. The request is
+// the PUT request being served, so that the update can be made
+// conditional on its If-Match header.
+type FieldUpdateFunc func(id *ResolvedURL, fields map[string]interface{}, req *http.Request) error
 
 // A FieldUpdateSearchFunc is used to update a search document for the
 // given id. For each field in fields, it should set that field to
 // its corresponding value in the search document.
 type FieldUpdateSearchFunc func(id *ResolvedURL, fields map[string]interface{}) error
 
+// A FieldSnapshotFunc is used to retrieve the current values of the
+// given fields in the metadata document for the given id, so that an
+// update to them can be reverted. Fields that are not set should have
+// no entry in the returned map.
+type FieldSnapshotFunc func(id *ResolvedURL, fields []string) (map[string]interface{}, error)
+
+// A FieldRevertFunc is used to revert an update made by a
+// FieldUpdateFunc to the metadata document for the given id. The fields
+// passed to the FieldUpdateFunc are held in fields, and their values
+// before the update, as returned by a FieldSnapshotFunc, are held in
+// old. Fields that have no entry in old should be removed. It is
+// also responsible for updating any search documents affected by
+// the fields.
+type FieldRevertFunc func(id *ResolvedURL, fields, old map[string]interface{}) error
+
 // A FieldGetFunc returns some data from the given document. The
 // document will have been returned from an earlier call to the
 // associated QueryFunc.
@@ -82,6 +99,16 @@ type FieldIncludeHandlerParams struct {
 	// UpdateSearch is used to update the document in the search
 	// database for PUT requests.
 	UpdateSearch FieldUpdateSearchFunc
+
+	// Snapshot is used to retrieve the values of fields before they
+	// are updated, so that the update can be reverted if a PUT
+	// request fails. If either Snapshot or Revert is nil,
+	// updates cannot be reverted.
+	Snapshot FieldSnapshotFunc
+
+	// Revert is used to revert an update for PUT requests
+	// that fail after the update has been made.
+	Revert FieldRevertFunc
 }
 
 type fieldIncludeHandler struct {
@@ -102,48 +129,111 @@ func (h *fieldIncludeHandler) Key() interface{} {
 }
 
 func (h *fieldIncludeHandler) HandlePut(hs []BulkIncludeHandler, id *ResolvedURL, paths []string, values []*json.RawMessage, req *http.Request) []error {
-	updater := &FieldUpdater{
-		fields: make(map[string]interface{}),
+	put, errs := h.PreparePut(hs, id, paths, values, req)
+	if len(errs) > 0 {
+		return errs
 	}
-	var errs []error
-	errCount := 0
-	setError := func(i int, err error) {
-		if errs == nil {
-			errs = make([]error, len(hs))
+	if err := put.Apply(); err != nil {
+		if put.CanRevert() {
+			if err := put.Revert(); err != nil {
+				logger.Errorf("cannot roll back update to %q: %v", id, err)
+			}
 		}
-		if errs[i] == nil {
+		errs := make([]error, len(hs))
+		for i := range hs {
 			errs[i] = err
-			errCount++
 		}
+		return errs
 	}
+	return nil
+}
+
+// PreparePut implements PutPreparer.PreparePut.
+func (h *fieldIncludeHandler) PreparePut(hs []BulkIncludeHandler, id *ResolvedURL, paths []string, values []*json.RawMessage, req *http.Request) (PreparedPut, []error) {
+	updater := &FieldUpdater{
+		fields: make(map[string]interface{}),
+	}
+	var errs []error
 	for i, h := range hs {
 		h := h.(*fieldIncludeHandler)
+		var err error
 		if h.p.HandlePut == nil {
-			setError(i, errgo.New("PUT not supported"))
-			continue
+			err = errgo.New("PUT not supported")
+		} else if err = h.p.HandlePut(id, paths[i], values[i], updater, req); err != nil {
+			err = errgo.Mask(err, errgo.Any)
 		}
-		if err := h.p.HandlePut(id, paths[i], values[i], updater, req); err != nil {
-			setError(i, errgo.Mask(err, errgo.Any))
+		if err != nil {
+			if errs == nil {
+				errs = make([]error, len(hs))
+			}
+			errs[i] = err
 		}
 	}
-	if errCount == len(hs) {
-		// Every HandlePut request has drawn an error,
-		// no need to call Update.
-		return errs
+	if errs != nil {
+		// Nothing is updated unless every
+		// HandlePut request has succeeded.
+		return nil, errs
 	}
-	if err := h.p.Update(id, updater.fields); err != nil {
-		for i := range hs {
-			setError(i, err)
+	return &fieldPut{
+		p:       h.p,
+		id:      id,
+		updater: updater,
+		req:     req,
+	}, nil
+}
+
+// fieldPut implements PreparedPut for a fieldIncludeHandler.
+type fieldPut struct {
+	p       FieldIncludeHandlerParams
+	id      *ResolvedURL
+	updater *FieldUpdater
+	req     *http.Request
+
+	// old holds the values of the updated fields
+	// before the update, if snapshotted is true.
+	old         map[string]interface{}
+	snapshotted bool
+}
+
+// Apply implements PreparedPut.Apply.
+func (put *fieldPut) Apply() error {
+	if put.CanRevert() {
+		fields := make([]string, 0, len(put.updater.fields))
+		for field := range put.updater.fields {
+			fields = append(fields, field)
 		}
+		old, err := put.p.Snapshot(put.id, fields)
+		if err != nil {
+			return errgo.Notef(err, "cannot retrieve current values")
+		}
+		put.old, put.snapshotted = old, true
 	}
-	if updater.search {
-		if err := h.p.UpdateSearch(id, updater.fields); err != nil {
-			for i := range hs {
-				setError(i, err)
-			}
+	if err := put.p.Update(put.id, put.updater.fields, put.req); err != nil {
+		return err
+	}
+	if put.updater.search {
+		if err := put.p.UpdateSearch(put.id, put.updater.fields); err != nil {
+			return err
 		}
 	}
-	return errs
+	return nil
+}
+
+// CanRevert implements PreparedPut.CanRevert.
+func (put *fieldPut) CanRevert() bool {
+	return put.p.Snapshot != nil && put.p.Revert != nil
+}
+
+// Revert implements PreparedPut.Revert.
+func (put *fieldPut) Revert() error {
+	if !put.snapshotted {
+		// Nothing has been updated.
+		return nil
+	}
+	if err := put.p.Revert(put.id, put.updater.fields, put.old); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
 }
 
 func (h *fieldIncludeHandler) HandleGet(hs []BulkIncludeHandler, id *ResolvedURL, paths []string, flags url.Values, req *http.Request) ([]interface{}, error) {
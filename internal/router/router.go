@@ -14,6 +14,7 @@ import (
 	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/juju/utils/jsonhttp"
 	"github.com/juju/utils/parallel"
@@ -94,11 +95,41 @@ type BulkIncludeHandler interface {
 	HandlePut(hs []BulkIncludeHandler, id *ResolvedURL, paths []string, values []*json.RawMessage, req *http.Request) []error
 }
 
+// PutPreparer may be implemented by a BulkIncludeHandler to allow
+// metadata PUT requests to be made atomically. PutMetadata prepares
+// the writes for all the metadata in a request before any of it is
+// written, and reverts the writes already made if a later one fails,
+// so that either all the metadata is written or none of it is.
+type PutPreparer interface {
+	// PreparePut is like HandlePut except that nothing is
+	// written. If there are no errors, it returns the write to
+	// be made.
+	PreparePut(hs []BulkIncludeHandler, id *ResolvedURL, paths []string, values []*json.RawMessage, req *http.Request) (PreparedPut, []error)
+}
+
+// PreparedPut represents a metadata write returned by
+// PutPreparer.PreparePut.
+type PreparedPut interface {
+	// Apply makes the write.
+	Apply() error
+
+	// CanRevert reports whether Revert can undo the write.
+	CanRevert() bool
+
+	// Revert undoes any changes made by Apply. It is called
+	// when Apply or a later write in the same request fails.
+	Revert() error
+}
+
 // IdHandler handles a charm store request rooted at the given id.
 // The request path (req.URL.Path) holds the URL path after
 // the id has been stripped off.
 type IdHandler func(charmId *charm.Reference, w http.ResponseWriter, req *http.Request) error
 
+// UserHandler handles a charm store request rooted at the given user
+// name, of the form ~user/key.
+type UserHandler func(user string, w http.ResponseWriter, req *http.Request) error
+
 // Handlers specifies how HTTP requests will be routed
 // by the router. All errors returned by the handlers will
 // be processed by WriteError with their Cause left intact.
@@ -123,7 +154,8 @@ type Handlers struct {
 	// charm or bundle id other than the meta path. The map key
 	// holds the first element of the path, which may end in a
 	// trailing slash (/) to indicate that longer paths are allowed
-	// too.
+	// too. The handler with an empty key, if any, handles requests
+	// for the id itself.
 	Id map[string]IdHandler
 
 	// Meta holds metadata handlers for paths under the meta
@@ -131,15 +163,23 @@ type Handlers struct {
 	// which may end in a trailing slash (/) to indicate that longer
 	// paths are allowed too.
 	Meta map[string]BulkIncludeHandler
+
+	// User holds handlers for GET requests on paths of the form
+	// ~user/key. The map key holds the second element of the path.
+	// As such a path is also a base entity id, requests with other
+	// methods are handled by the Id handler with an empty key.
+	User map[string]UserHandler
 }
 
 // Router represents a charm store HTTP request router.
 type Router struct {
-	handlers   *Handlers
-	handler    http.Handler
-	resolveURL func(id *charm.Reference) (*ResolvedURL, error)
-	authorize  func(id *ResolvedURL, req *http.Request) error
-	exists     func(id *ResolvedURL, req *http.Request) (bool, error)
+	handlers    *Handlers
+	handler     http.Handler
+	resolveURL  func(id *charm.Reference, req *http.Request) (*ResolvedURL, error)
+	authorize   func(id *ResolvedURL, req *http.Request) error
+	exists      func(id *ResolvedURL, req *http.Request) (bool, error)
+	metaETag    func(id *ResolvedURL, includes []string, req *http.Request) (string, error)
+	redirectURL func(id *charm.Reference, req *http.Request) (*ResolvedURL, error)
 }
 
 // ResolvedURL represents a URL that has been resolved by resolveURL.
@@ -213,6 +253,8 @@ func (u *ResolvedURL) String() string {
 // The resolveURL function will be called to resolve ids in
 // router paths - it should fill in the Series and Revision
 // fields of its argument URL if they are not specified.
+// It is also passed the request, which may hold parameters
+// that affect the resolution.
 // The Cause of the resolveURL error will be left unchanged,
 // as for the handlers.
 //
@@ -224,17 +266,37 @@ func (u *ResolvedURL) String() string {
 // The exists function may be called to test whether an entity
 // exists when an API endpoint needs to know that
 // but has no appropriate handler to call.
+//
+// The metaETag function, if not nil, is called to get the entity tag
+// of the response to a GET request for the given metadata includes of
+// an entity, before the metadata is retrieved. Requests whose
+// If-None-Match header matches the tag are answered with a 304 (Not
+// Modified) status. It may return an empty tag if the response
+// should have none. It is also called to check the If-Match header
+// of metadata PUT requests; requests whose If-Match header does not
+// match the current tag fail with a params.ErrPreconditionFailed
+// error.
+//
+// The redirectURL function, if not nil, is called to find where
+// an id now refers to when resolving or serving a metadata request
+// for it fails with a params.ErrNotFound error. It should return an
+// error with a params.ErrNotFound cause if the id has not been
+// redirected, in which case the original error is returned.
 func New(
 	handlers *Handlers,
-	resolveURL func(id *charm.Reference) (*ResolvedURL, error),
+	resolveURL func(id *charm.Reference, req *http.Request) (*ResolvedURL, error),
 	authorize func(id *ResolvedURL, req *http.Request) error,
 	exists func(id *ResolvedURL, req *http.Request) (bool, error),
+	metaETag func(id *ResolvedURL, includes []string, req *http.Request) (string, error),
+	redirectURL func(id *charm.Reference, req *http.Request) (*ResolvedURL, error),
 ) *Router {
 	r := &Router{
-		handlers:   handlers,
-		resolveURL: resolveURL,
-		authorize:  authorize,
-		exists:     exists,
+		handlers:    handlers,
+		resolveURL:  resolveURL,
+		authorize:   authorize,
+		exists:      exists,
+		metaETag:    metaETag,
+		redirectURL: redirectURL,
 	}
 	mux := NewServeMux()
 	mux.Handle("/meta/", http.StripPrefix("/meta", HandleErrors(r.serveBulkMeta)))
@@ -297,8 +359,12 @@ func (r *Router) serveIds(w http.ResponseWriter, req *http.Request) error {
 		return errgo.WithCausef(err, params.ErrNotFound, "")
 	}
 	key, path := handlerKey(path)
-	if key == "" {
-		return errgo.WithCausef(nil, params.ErrNotFound, "")
+	if key == "" && req.Method == "GET" && url.User != "" && url.Series == "" && url.Revision == -1 {
+		if handler := r.handlers.User[url.Name]; handler != nil {
+			err := handler(url.User, w, req)
+			// Note: preserve error cause from handlers.
+			return errgo.Mask(err, errgo.Any)
+		}
 	}
 	handler := r.handlers.Id[key]
 	if handler != nil {
@@ -307,17 +373,45 @@ func (r *Router) serveIds(w http.ResponseWriter, req *http.Request) error {
 		// Note: preserve error cause from handlers.
 		return errgo.Mask(err, errgo.Any)
 	}
+	if key == "" {
+		return errgo.WithCausef(nil, params.ErrNotFound, "")
+	}
 	if key != "meta/" && key != "meta" {
 		return errgo.WithCausef(nil, params.ErrNotFound, params.ErrNotFound.Error())
 	}
 	// Always resolve the entity id for meta requests.
-	rurl, err := r.resolveURL(url)
-	if err != nil {
-		// Note: preserve error cause from resolveURL.
+	req.URL.Path = path
+	err = r.withResolvedURL(url, req, func(rurl *ResolvedURL) error {
+		return r.serveMeta(rurl, w, req)
+	})
+	// Note: preserve error causes from resolveURL and the meta handlers.
+	return errgo.Mask(err, errgo.Any)
+}
+
+// withResolvedURL resolves the given id and calls f with the result.
+// If either fails with a params.ErrNotFound error and the id has
+// been redirected, f is called with the target of the redirect
+// instead. The Cause of the error from resolveURL or f is left
+// unchanged.
+func (r *Router) withResolvedURL(url *charm.Reference, req *http.Request, f func(rurl *ResolvedURL) error) error {
+	rurl, err := r.resolveURL(url, req)
+	if err == nil {
+		err = f(rurl)
+	}
+	if errgo.Cause(err) != params.ErrNotFound || r.redirectURL == nil {
 		return errgo.Mask(err, errgo.Any)
 	}
-	req.URL.Path = path
-	return r.serveMeta(rurl, w, req)
+	// The id may have been moved elsewhere; this is only
+	// checked now so that ids that exist cost no more to serve.
+	target, rerr := r.redirectURL(url, req)
+	if errgo.Cause(rerr) == params.ErrNotFound {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if rerr != nil {
+		// Note: preserve error cause from redirectURL.
+		return errgo.Mask(rerr, errgo.Any)
+	}
+	return errgo.Mask(f(target), errgo.Any)
 }
 
 func idHandlerNeedsResolveURL(req *http.Request) bool {
@@ -345,7 +439,18 @@ func handlerKey(path string) (key, rest string) {
 func (r *Router) serveMeta(id *ResolvedURL, w http.ResponseWriter, req *http.Request) error {
 	switch req.Method {
 	case "GET", "HEAD":
-		resp, err := r.serveMetaGet(id, req)
+		if err := r.authorize(id, req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		etag, err := r.getMetaETag(id, req)
+		if err != nil {
+			// Note: preserve error cause from metaETag.
+			return errgo.Mask(err, errgo.Any)
+		}
+		if CheckNotModified(w, req, etag, time.Time{}) {
+			return nil
+		}
+		resp, err := r.getMeta(id, req)
 		if err != nil {
 			// Note: preserve error causes from meta handlers.
 			return errgo.Mask(err, errgo.Any)
@@ -360,12 +465,48 @@ func (r *Router) serveMeta(id *ResolvedURL, w http.ResponseWriter, req *http.Req
 	return params.ErrMethodNotAllowed
 }
 
+// getMetaETag returns the entity tag of the response to the
+// given meta GET request for the given entity, or the empty
+// string if it has none.
+func (r *Router) getMetaETag(id *ResolvedURL, req *http.Request) (string, error) {
+	if r.metaETag == nil {
+		return "", nil
+	}
+	var includes []string
+	switch key, _ := handlerKey(req.URL.Path); key {
+	case "":
+		// GET id/meta returns the metadata names,
+		// which do not depend on the entity.
+		return "", nil
+	case "any":
+		includes = req.Form["include"]
+	default:
+		includes = []string{strings.TrimPrefix(req.URL.Path, "/")}
+	}
+	etag, err := r.metaETag(id, includes, req)
+	if err != nil {
+		// Note: preserve error cause from metaETag.
+		return "", errgo.Mask(err, errgo.Any)
+	}
+	return etag, nil
+}
+
 func (r *Router) serveMetaGet(id *ResolvedURL, req *http.Request) (interface{}, error) {
 	// TODO: consider whether we might want the capability to
 	// have different permissions for different meta endpoints.
 	if err := r.authorize(id, req); err != nil {
 		return nil, errgo.Mask(err, errgo.Any)
 	}
+	resp, err := r.getMeta(id, req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Any)
+	}
+	return resp, nil
+}
+
+// getMeta is like serveMetaGet except that
+// it does not authorize the request.
+func (r *Router) getMeta(id *ResolvedURL, req *http.Request) (interface{}, error) {
 	key, path := handlerKey(req.URL.Path)
 	if key == "" {
 		// GET id/meta
@@ -434,6 +575,9 @@ func (r *Router) serveMetaPut(id *ResolvedURL, req *http.Request) error {
 	if err := r.authorize(id, req); err != nil {
 		return errgo.Mask(err, errgo.Any)
 	}
+	if err := r.checkIfMatch(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
 	var body json.RawMessage
 	if err := unmarshalJSONBody(req, &body); err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
@@ -441,6 +585,34 @@ func (r *Router) serveMetaPut(id *ResolvedURL, req *http.Request) error {
 	return r.serveMetaPutBody(id, req, &body)
 }
 
+// checkIfMatch checks the If-Match header of the given metadata PUT
+// request, if there is one, against the current entity tag of the
+// metadata of the given entity. It returns an error with a
+// params.ErrPreconditionFailed cause if they do not match.
+//
+// Note that the check is not atomic with the write that follows it.
+// The FieldUpdateFunc that makes the write is given the request so
+// that it can make the write itself conditional on the If-Match
+// header, guarding against simultaneous writes too.
+func (r *Router) checkIfMatch(id *ResolvedURL, req *http.Request) error {
+	ifMatch := strings.Join(req.Header["If-Match"], ",")
+	if ifMatch == "" {
+		return nil
+	}
+	etag, err := r.getMetaETag(id, req)
+	if err != nil {
+		// Note: preserve error cause from metaETag.
+		return errgo.Mask(err, errgo.Any)
+	}
+	// Metadata entity tags are weak, so we use the weak comparison
+	// function rather than the strong one specified for If-Match
+	// by RFC 7232.
+	if !ETagMatches(ifMatch, etag, false) {
+		return errgo.WithCausef(nil, params.ErrPreconditionFailed, "metadata of %s has been modified", id)
+	}
+	return nil
+}
+
 // serveMetaPutBody serves a PUT request to the metadata for the given id.
 // The metadata to be put is in body.
 // This method is used both for individual metadata PUTs and
@@ -555,17 +727,12 @@ func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, error) {
 		if err != nil {
 			return nil, errgo.WithCausef(err, params.ErrBadRequest, "")
 		}
-		rurl, err := r.resolveURL(url)
-		if err != nil {
-			if errgo.Cause(err) == params.ErrNotFound {
-				// URLs not found will be omitted from the result.
-				// https://github.com/juju/charmstore/blob/v4/docs/API.md#bulk-requests-and-missing-metadata
-				continue
-			}
-			// Note: preserve error cause from resolveURL.
-			return nil, errgo.Mask(err, errgo.Any)
-		}
-		meta, err := r.serveMetaGet(rurl, req)
+		var meta interface{}
+		err = r.withResolvedURL(url, req, func(rurl *ResolvedURL) error {
+			var err error
+			meta, err = r.serveMetaGet(rurl, req)
+			return errgo.Mask(err, errgo.Any)
+		})
 		if cause := errgo.Cause(err); cause == params.ErrNotFound || cause == params.ErrMetadataNotFound || (ignoreAuth && isAuthorizationError(cause)) {
 			// The relevant data does not exist, or it is not public and client
 			// asked not to authorize.
@@ -573,7 +740,8 @@ func (r *Router) serveBulkMetaGet(req *http.Request) (interface{}, error) {
 			continue
 		}
 		if err != nil {
-			return nil, errgo.Mask(err)
+			// Note: preserve error cause from resolveURL.
+			return nil, errgo.Mask(err, errgo.Any)
 		}
 		result[id] = meta
 	}
@@ -635,18 +803,27 @@ func (r *Router) serveBulkMetaPutOne(req *http.Request, id string, val *json.Raw
 	if err != nil {
 		return errgo.Mask(err)
 	}
-	rurl, err := r.resolveURL(url)
-	if err != nil {
-		// Note: preserve error cause from resolveURL.
-		return errgo.Mask(err, errgo.Any)
-	}
-	if err := r.authorize(rurl, req); err != nil {
-		return errgo.Mask(err, errgo.Any)
-	}
-	if err := r.serveMetaPutBody(rurl, req, val); err != nil {
-		return errgo.Mask(err, errgo.Any)
-	}
-	return nil
+	err = r.withResolvedURL(url, req, func(rurl *ResolvedURL) error {
+		if err := r.authorize(rurl, req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if err := r.checkIfMatch(rurl, req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if err := r.serveMetaPutBody(rurl, req, val); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		return nil
+	})
+	// Note: preserve error causes from resolveURL and the handlers.
+	return errgo.Mask(err, errgo.Any)
+}
+
+// IsMetadataName reports whether the given metadata include,
+// as accepted by GetMetadata, is recognized.
+func (r *Router) IsMetadataName(include string) bool {
+	key, _ := handlerKey(include)
+	return r.handlers.Meta[key] != nil
 }
 
 // maxMetadataConcurrency specifies the maximum number
@@ -730,28 +907,62 @@ func (r *Router) GetMetadata(id *ResolvedURL, includes []string, req *http.Reque
 // the name of a metadata endpoint; its associated value
 // holds the value to be written.
 func (r *Router) PutMetadata(id *ResolvedURL, data map[string]*json.RawMessage, req *http.Request) error {
+	m, err := r.PrepareMetadata(id, data, req)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if err := m.Apply(); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	return nil
+}
+
+// PreparedMetadata holds the metadata writes
+// prepared by Router.PrepareMetadata.
+type PreparedMetadata struct {
+	id            *ResolvedURL
+	req           *http.Request
+	prepared      []preparedGroup
+	unprepared    [][]BulkIncludeHandler
+	pathsByGroup  map[interface{}][]string
+	valuesByGroup map[interface{}][]*json.RawMessage
+}
+
+// PrepareMetadata is like PutMetadata except that nothing is written.
+// It checks the metadata as far as possible and returns the writes to
+// be made. The entity with the given id need not exist yet, so that
+// metadata can be checked before the entity is added.
+func (r *Router) PrepareMetadata(id *ResolvedURL, data map[string]*json.RawMessage, req *http.Request) (*PreparedMetadata, error) {
 	groups := make(map[interface{}][]BulkIncludeHandler)
-	valuesByGroup := make(map[interface{}][]*json.RawMessage)
-	pathsByGroup := make(map[interface{}][]string)
+	m := &PreparedMetadata{
+		id:            id,
+		req:           req,
+		valuesByGroup: make(map[interface{}][]*json.RawMessage),
+		pathsByGroup:  make(map[interface{}][]string),
+	}
 	for path, body := range data {
 		// Get the key that lets us choose the meta handler.
 		metaKey, _ := handlerKey(path)
 		handler := r.handlers.Meta[metaKey]
 		if handler == nil {
-			return errgo.Newf("unrecognized metadata name %q", path)
+			return nil, errgo.WithCausef(nil, params.ErrBadRequest, "unrecognized metadata name %q", path)
 		}
 
 		// Get the key that lets us group this handler into the
 		// correct bulk group.
 		key := handler.Key()
 		groups[key] = append(groups[key], handler)
-		valuesByGroup[key] = append(valuesByGroup[key], body)
+		m.valuesByGroup[key] = append(m.valuesByGroup[key], body)
 
 		// Paths contains all the path elements after
 		// the handler key has been stripped off.
-		pathsByGroup[key] = append(pathsByGroup[key], path)
+		m.pathsByGroup[key] = append(m.pathsByGroup[key], path)
 	}
-	var multiErr multiError
+	// Prepare all the writes before making any of them, so that
+	// no metadata is written if any of it is invalid. Handlers that
+	// cannot prepare their writes are left until last.
+	multiErr := make(multiError)
+	var unrevertable []preparedGroup
 	for _, g := range groups {
 		// We know that we must have at least one element in the
 		// slice here. We could use any member of the slice to
@@ -759,36 +970,84 @@ func (r *Router) PutMetadata(id *ResolvedURL, data map[string]*json.RawMessage,
 		// g[0]. Note that g[0].Key() is equal to g[i].Key() for
 		// every i in the slice.
 		key := g[0].Key()
-
-		paths := pathsByGroup[key]
-		// The paths passed to the handler contain all the path elements
-		// after the handler key has been stripped off.
-		strippedPaths := make([]string, len(paths))
-		for i, path := range paths {
-			_, strippedPaths[i] = handlerKey(path)
+		preparer, ok := g[0].(PutPreparer)
+		if !ok {
+			m.unprepared = append(m.unprepared, g)
+			continue
+		}
+		paths := m.pathsByGroup[key]
+		put, errs := preparer.PreparePut(g, id, strippedPaths(paths), m.valuesByGroup[key], req)
+		if err := multiErr.addErrors(paths, errs); err != nil {
+			return nil, errgo.Mask(err)
 		}
-
-		errs := g[0].HandlePut(g, id, strippedPaths, valuesByGroup[key], req)
 		if len(errs) > 0 {
-			if multiErr == nil {
-				multiErr = make(multiError)
-			}
-			if len(errs) != len(paths) {
-				return fmt.Errorf("unexpected error count; expected %d, got %q", len(paths), errs)
-			}
-			for i, err := range errs {
-				if err != nil {
-					multiErr[paths[i]] = err
-				}
+			continue
+		}
+		if put.CanRevert() {
+			m.prepared = append(m.prepared, preparedGroup{put, paths})
+		} else {
+			unrevertable = append(unrevertable, preparedGroup{put, paths})
+		}
+	}
+	if len(multiErr) != 0 {
+		return nil, multiErr
+	}
+	// Make the writes that can be reverted first, so that
+	// as few writes as possible are left in place if a
+	// later one fails.
+	m.prepared = append(m.prepared, unrevertable...)
+	return m, nil
+}
+
+// Apply writes the prepared metadata. If any of it cannot be
+// written, the writes already made are reverted where possible.
+func (m *PreparedMetadata) Apply() error {
+	multiErr := make(multiError)
+	var applied []preparedGroup
+	for _, p := range m.prepared {
+		// Note that a failed write is reverted too, because
+		// it may have been partly made.
+		applied = append(applied, p)
+		if err := p.put.Apply(); err != nil {
+			for _, path := range p.paths {
+				multiErr[path] = err
 			}
+			multiErr.revert(applied)
+			return multiErr
+		}
+	}
+	for _, g := range m.unprepared {
+		key := g[0].Key()
+		paths := m.pathsByGroup[key]
+		errs := g[0].HandlePut(g, m.id, strippedPaths(paths), m.valuesByGroup[key], m.req)
+		if err := multiErr.addErrors(paths, errs); err != nil {
+			return errgo.Mask(err)
 		}
 	}
 	if len(multiErr) != 0 {
+		multiErr.revert(applied)
 		return multiErr
 	}
 	return nil
 }
 
+// preparedGroup holds a write prepared for a group of metadata
+// handlers, and the metadata paths that it writes.
+type preparedGroup struct {
+	put   PreparedPut
+	paths []string
+}
+
+// strippedPaths returns the given metadata paths with
+// their handler keys stripped off.
+func strippedPaths(paths []string) []string {
+	stripped := make([]string, len(paths))
+	for i, path := range paths {
+		_, stripped[i] = handlerKey(path)
+	}
+	return stripped
+}
+
 // splitPath returns the first path element
 // after path[i:] and the start of the next
 // element.
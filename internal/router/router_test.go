@@ -42,7 +42,7 @@ var routerGetTests = []struct {
 	expectStatus     int
 	expectBody       interface{}
 	expectQueryCount int32
-	resolveURL       func(*charm.Reference) (*ResolvedURL, error)
+	resolveURL       func(*charm.Reference, *http.Request) (*ResolvedURL, error)
 	authorize        func(*ResolvedURL, *http.Request) error
 	exists           func(*ResolvedURL, *http.Request) (bool, error)
 }{{
@@ -146,6 +146,80 @@ var routerGetTests = []struct {
 		Method:   "GET",
 		CharmURL: "cs:precise/wordpress",
 	},
+}, {
+	about: "id handler with empty key",
+	handlers: Handlers{
+		Id: map[string]IdHandler{
+			"": testIdHandler,
+		},
+	},
+	urlStr:       "/~bob/wordpress",
+	expectStatus: http.StatusOK,
+	expectBody: idHandlerTestResp{
+		Method:   "GET",
+		CharmURL: "cs:~bob/wordpress",
+	},
+}, {
+	about: "user handler",
+	handlers: Handlers{
+		Id: map[string]IdHandler{
+			"": testIdHandler,
+		},
+		User: map[string]UserHandler{
+			"foo": testUserHandler,
+		},
+	},
+	urlStr:       "/~bob/foo",
+	expectStatus: http.StatusOK,
+	expectBody: userHandlerTestResp{
+		Method: "GET",
+		User:   "bob",
+	},
+}, {
+	about: "user handler does not match id with series",
+	handlers: Handlers{
+		Id: map[string]IdHandler{
+			"": testIdHandler,
+		},
+		User: map[string]UserHandler{
+			"foo": testUserHandler,
+		},
+	},
+	urlStr:       "/~bob/trusty/foo",
+	expectStatus: http.StatusOK,
+	expectBody: idHandlerTestResp{
+		Method:   "GET",
+		CharmURL: "cs:~bob/trusty/foo",
+	},
+}, {
+	about: "user handler does not match id with extra path",
+	handlers: Handlers{
+		Id: map[string]IdHandler{
+			"bar": testIdHandler,
+		},
+		User: map[string]UserHandler{
+			"foo": testUserHandler,
+		},
+	},
+	urlStr:       "/~bob/foo/bar",
+	expectStatus: http.StatusOK,
+	expectBody: idHandlerTestResp{
+		Method:   "GET",
+		CharmURL: "cs:~bob/foo",
+	},
+}, {
+	about: "id with no handlers",
+	handlers: Handlers{
+		Id: map[string]IdHandler{
+			"foo": testIdHandler,
+		},
+	},
+	urlStr:       "/~bob/wordpress",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
 }, {
 	about: "id handler with extra path",
 	handlers: Handlers{
@@ -452,6 +526,19 @@ var routerGetTests = []struct {
 		Code:    "arble",
 		Message: "a message",
 	},
+}, {
+	about:  "meta handler returning content challenge error",
+	urlStr: "/precise/wordpress-42/meta/foo",
+	handlers: Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": errorMetaHandler(errgo.WithCausef(nil, params.ErrContentChallenge, "a message")),
+		},
+	},
+	expectStatus: http.StatusConflict,
+	expectBody: params.Error{
+		Code:    params.ErrContentChallenge,
+		Message: "a message",
+	},
 }, {
 	about:  "unauthorized meta handler",
 	urlStr: "/precise/wordpress-42/meta/foo",
@@ -796,7 +883,7 @@ var routerGetTests = []struct {
 }, {
 	about:  "bulk meta handler with unresolvable id",
 	urlStr: "/meta/foo?id=unresolved&id=~foo/precise/wordpress-23",
-	resolveURL: func(url *charm.Reference) (*ResolvedURL, error) {
+	resolveURL: func(url *charm.Reference, req *http.Request) (*ResolvedURL, error) {
 		if url.Name == "unresolved" {
 			return nil, params.ErrNotFound
 		}
@@ -816,7 +903,7 @@ var routerGetTests = []struct {
 }, {
 	about:  "bulk meta handler with id resolution error",
 	urlStr: "/meta/foo?id=resolveerror&id=precise/wordpress-23",
-	resolveURL: func(url *charm.Reference) (*ResolvedURL, error) {
+	resolveURL: func(url *charm.Reference, req *http.Request) (*ResolvedURL, error) {
 		if url.Name == "resolveerror" {
 			return nil, errgo.Newf("an error")
 		}
@@ -885,8 +972,8 @@ var routerGetTests = []struct {
 // resolveTo returns a URL resolver that resolves
 // unspecified series and revision to the given series
 // and revision.
-func resolveTo(series string, revision int) func(*charm.Reference) (*ResolvedURL, error) {
-	return func(url *charm.Reference) (*ResolvedURL, error) {
+func resolveTo(series string, revision int) func(*charm.Reference, *http.Request) (*ResolvedURL, error) {
+	return func(url *charm.Reference, req *http.Request) (*ResolvedURL, error) {
 		var rurl ResolvedURL
 		rurl.URL = *url
 		if url.Series == "" {
@@ -903,13 +990,13 @@ func resolveTo(series string, revision int) func(*charm.Reference) (*ResolvedURL
 	}
 }
 
-func resolveURLError(err error) func(*charm.Reference) (*ResolvedURL, error) {
-	return func(*charm.Reference) (*ResolvedURL, error) {
+func resolveURLError(err error) func(*charm.Reference, *http.Request) (*ResolvedURL, error) {
+	return func(*charm.Reference, *http.Request) (*ResolvedURL, error) {
 		return nil, err
 	}
 }
 
-func alwaysResolveURL(u *charm.Reference) (*ResolvedURL, error) {
+func alwaysResolveURL(u *charm.Reference, req *http.Request) (*ResolvedURL, error) {
 	u1 := *u
 	if u1.Series == "" {
 		u1.Series = "precise"
@@ -940,7 +1027,7 @@ func (s *RouterSuite) TestRouterGet(c *gc.C) {
 		if test.exists != nil {
 			exists = test.exists
 		}
-		router := New(&test.handlers, resolve, authorize, exists)
+		router := New(&test.handlers, resolve, authorize, exists, nil, nil)
 		// Note that fieldSelectHandler increments queryCount each time
 		// a query is made.
 		queryCount = 0
@@ -988,7 +1075,7 @@ func (s *RouterSuite) TestCORSHeaders(c *gc.C) {
 		Global: map[string]http.Handler{
 			"foo": http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}),
 		},
-	}, alwaysResolveURL, alwaysAuthorize, alwaysExists)
+	}, alwaysResolveURL, alwaysAuthorize, alwaysExists, nil, nil)
 	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
 		Handler: h,
 		URL:     "/foo",
@@ -1025,7 +1112,7 @@ func (s *RouterSuite) TestHTTPRequestPassedThroughToMeta(c *gc.C) {
 		donePut = true
 		return nil
 	}
-	update := func(id *ResolvedURL, fields map[string]interface{}) error {
+	update := func(id *ResolvedURL, fields map[string]interface{}, req *http.Request) error {
 		return nil
 	}
 	h := New(&Handlers{
@@ -1039,7 +1126,7 @@ func (s *RouterSuite) TestHTTPRequestPassedThroughToMeta(c *gc.C) {
 				Update:    update,
 			}),
 		},
-	}, alwaysResolveURL, alwaysAuthorize, alwaysExists)
+	}, alwaysResolveURL, alwaysAuthorize, alwaysExists, nil, nil)
 	resp := httptest.NewRecorder()
 	h.ServeHTTP(resp, testReq)
 	c.Assert(resp.Code, gc.Equals, http.StatusOK, gc.Commentf("response body: %s", resp.Body))
@@ -1056,7 +1143,7 @@ func (s *RouterSuite) TestHTTPRequestPassedThroughToMeta(c *gc.C) {
 }
 
 func (s *RouterSuite) TestOptionsHTTPMethod(c *gc.C) {
-	h := New(&Handlers{}, alwaysResolveURL, alwaysAuthorize, alwaysExists)
+	h := New(&Handlers{}, alwaysResolveURL, alwaysAuthorize, alwaysExists, nil, nil)
 	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
 		Handler: h,
 		Method:  "OPTIONS",
@@ -1069,6 +1156,258 @@ func (s *RouterSuite) TestOptionsHTTPMethod(c *gc.C) {
 	c.Assert(header.Get("Allow"), gc.Equals, "DELETE,GET,HEAD,PUT,POST")
 }
 
+func (s *RouterSuite) TestMetaETag(c *gc.C) {
+	getCount := 0
+	handler := SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+		getCount++
+		return "value", nil
+	})
+	var etagIncludes [][]string
+	metaETag := func(id *ResolvedURL, includes []string, req *http.Request) (string, error) {
+		etagIncludes = append(etagIncludes, includes)
+		if id.URL.Name == "notag" {
+			return "", nil
+		}
+		return `W/"` + id.URL.String() + `"`, nil
+	}
+	h := New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo":  handler,
+			"bar/": handler,
+		},
+	}, alwaysResolveURL, alwaysAuthorize, alwaysExists, metaETag, nil)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		URL:     "/precise/wordpress-42/meta/foo",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	etag := rec.Header().Get("ETag")
+	c.Assert(etag, gc.Equals, `W/"cs:~charmers/precise/wordpress-42"`)
+	c.Assert(getCount, gc.Equals, 1)
+
+	// A request with a matching tag gets a 304 response
+	// without the metadata being retrieved.
+	for _, path := range []string{
+		"/precise/wordpress-42/meta/foo",
+		"/precise/wordpress-42/meta/bar/baz",
+		"/precise/wordpress-42/meta/any?include=foo&include=bar/baz",
+	} {
+		rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: h,
+			URL:     path,
+			Header:  http.Header{"If-None-Match": {etag}},
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusNotModified, gc.Commentf("path %s", path))
+		c.Assert(rec.Body.Len(), gc.Equals, 0)
+		c.Assert(rec.Header().Get("ETag"), gc.Equals, etag)
+	}
+	c.Assert(getCount, gc.Equals, 1)
+	c.Assert(etagIncludes, jc.DeepEquals, [][]string{
+		{"foo"},
+		{"foo"},
+		{"bar/baz"},
+		{"foo", "bar/baz"},
+	})
+
+	// A request with a different tag gets the metadata.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		URL:     "/precise/wordpress-41/meta/foo",
+		Header:  http.Header{"If-None-Match": {etag}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("ETag"), gc.Equals, `W/"cs:~charmers/precise/wordpress-41"`)
+	c.Assert(getCount, gc.Equals, 2)
+
+	// A response may have no tag.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: h,
+		URL:     "/precise/notag-1/meta/foo",
+		Header:  http.Header{"If-None-Match": {"*"}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("ETag"), gc.Equals, "")
+	c.Assert(getCount, gc.Equals, 3)
+}
+
+func (s *RouterSuite) TestMetaPutIfMatch(c *gc.C) {
+	var puts, updateIfMatch []string
+	concurrentWrite := false
+	handlePut := func(id *ResolvedURL, path string, val *json.RawMessage, updater *FieldUpdater, req *http.Request) error {
+		puts = append(puts, id.URL.String())
+		return nil
+	}
+	handler := FieldIncludeHandler(FieldIncludeHandlerParams{
+		Key: 0,
+		Query: func(id *ResolvedURL, selector map[string]int, req *http.Request) (interface{}, error) {
+			return 0, nil
+		},
+		Fields: []string{"foo"},
+		HandleGet: func(doc interface{}, id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+			return 0, nil
+		},
+		HandlePut: handlePut,
+		Update: func(id *ResolvedURL, fields map[string]interface{}, req *http.Request) error {
+			updateIfMatch = append(updateIfMatch, req.Header.Get("If-Match"))
+			if concurrentWrite {
+				return errgo.WithCausef(nil, params.ErrPreconditionFailed, "%s has been modified", id)
+			}
+			return nil
+		},
+	})
+	metaETag := func(id *ResolvedURL, includes []string, req *http.Request) (string, error) {
+		return `W/"` + id.URL.String() + `"`, nil
+	}
+	h := New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": handler,
+		},
+	}, alwaysResolveURL, alwaysAuthorize, alwaysExists, metaETag, nil)
+	doPut := func(path, body, ifMatch string) *httptest.ResponseRecorder {
+		header := http.Header{"Content-Type": {"application/json"}}
+		if ifMatch != "" {
+			header.Set("If-Match", ifMatch)
+		}
+		return httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: h,
+			Method:  "PUT",
+			URL:     path,
+			Header:  header,
+			Body:    strings.NewReader(body),
+		})
+	}
+
+	// Without If-Match, the PUT is unconditional.
+	rec := doPut("/precise/wordpress-42/meta/foo", `"x"`, "")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+
+	// A matching tag allows the PUT.
+	rec = doPut("/precise/wordpress-42/meta/foo", `"x"`, `W/"cs:~charmers/precise/wordpress-42"`)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	rec = doPut("/precise/wordpress-42/meta/any", `{"Meta": {"foo": "x"}}`, "*")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(puts, jc.DeepEquals, []string{
+		"cs:~charmers/precise/wordpress-42",
+		"cs:~charmers/precise/wordpress-42",
+		"cs:~charmers/precise/wordpress-42",
+	})
+	puts = nil
+
+	// The update is given the If-Match header, so that
+	// it can make the write conditional.
+	c.Assert(updateIfMatch, jc.DeepEquals, []string{"", `W/"cs:~charmers/precise/wordpress-42"`, "*"})
+
+	// A precondition failure from the update itself, as when
+	// the entity has been modified since the tag was checked,
+	// causes the PUT to fail.
+	concurrentWrite = true
+	rec = doPut("/precise/wordpress-42/meta/foo", `"x"`, `W/"cs:~charmers/precise/wordpress-42"`)
+	c.Assert(rec.Code, gc.Equals, http.StatusPreconditionFailed, gc.Commentf("body: %s", rec.Body))
+	concurrentWrite = false
+	puts = nil
+
+	// A mismatched tag causes the PUT to fail.
+	rec = doPut("/precise/wordpress-42/meta/foo", `"x"`, `W/"cs:~charmers/precise/wordpress-41"`)
+	c.Assert(rec.Code, gc.Equals, http.StatusPreconditionFailed)
+	var perr params.Error
+	err := json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(perr, jc.DeepEquals, params.Error{
+		Code:    params.ErrPreconditionFailed,
+		Message: "metadata of cs:precise/wordpress-42 has been modified",
+	})
+	c.Assert(puts, gc.HasLen, 0)
+
+	// In a bulk PUT, the tag of each entity must be listed.
+	rec = doPut("/meta/foo", `{"precise/wordpress-41": "x", "precise/wordpress-42": "x"}`, `W/"cs:~charmers/precise/wordpress-42"`)
+	c.Assert(rec.Code, gc.Equals, http.StatusInternalServerError)
+	perr = params.Error{}
+	err = json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(perr, jc.DeepEquals, params.Error{
+		Code:    params.ErrMultipleErrors,
+		Message: "multiple (1) errors",
+		Info: map[string]*params.Error{
+			"precise/wordpress-41": {
+				Code:    params.ErrPreconditionFailed,
+				Message: "metadata of cs:precise/wordpress-41 has been modified",
+			},
+		},
+	})
+	c.Assert(puts, jc.DeepEquals, []string{"cs:~charmers/precise/wordpress-42"})
+}
+
+func (s *RouterSuite) TestRedirectURL(c *gc.C) {
+	handler := SingleIncludeHandler(func(id *ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+		return id.URL.String(), nil
+	})
+	// Entities owned by alice do not exist.
+	authorize := func(id *ResolvedURL, req *http.Request) error {
+		if id.URL.User == "alice" {
+			return errgo.WithCausef(nil, params.ErrNotFound, "%s not found", id)
+		}
+		return nil
+	}
+	// Only alice's wordpress has been redirected, to bob.
+	var redirected []string
+	redirectURL := func(id *charm.Reference, req *http.Request) (*ResolvedURL, error) {
+		redirected = append(redirected, id.String())
+		if id.User != "alice" || id.Name != "wordpress" {
+			return nil, errgo.WithCausef(nil, params.ErrNotFound, "no redirect")
+		}
+		target := *id
+		target.User = "bob"
+		return &ResolvedURL{URL: target, PromulgatedRevision: -1}, nil
+	}
+	h := New(&Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo": handler,
+		},
+	}, alwaysResolveURL, authorize, alwaysExists, nil, redirectURL)
+
+	// Ids that exist are served without looking for a redirect.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    h,
+		URL:        "/~charmers/precise/wordpress-42/meta/foo",
+		ExpectBody: "cs:~charmers/precise/wordpress-42",
+	})
+	c.Assert(redirected, gc.HasLen, 0)
+
+	// Ids that do not exist are served from the target of their redirect.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    h,
+		URL:        "/~alice/precise/wordpress-42/meta/foo",
+		ExpectBody: "cs:~bob/precise/wordpress-42",
+	})
+	c.Assert(redirected, jc.DeepEquals, []string{"cs:~alice/precise/wordpress-42"})
+	redirected = nil
+
+	// Ids that do not exist and have no redirect are not found.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      h,
+		URL:          "/~alice/precise/mysql-1/meta/foo",
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: "cs:~alice/precise/mysql-1 not found",
+		},
+	})
+	c.Assert(redirected, jc.DeepEquals, []string{"cs:~alice/precise/mysql-1"})
+	redirected = nil
+
+	// Bulk requests are redirected in the same way.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: h,
+		URL:     "/meta/foo?id=~charmers/precise/wordpress-42&id=~alice/precise/wordpress-42&id=~alice/precise/mysql-1",
+		ExpectBody: map[string]string{
+			"~charmers/precise/wordpress-42": "cs:~charmers/precise/wordpress-42",
+			"~alice/precise/wordpress-42":    "cs:~bob/precise/wordpress-42",
+		},
+	})
+	c.Assert(redirected, jc.DeepEquals, []string{"cs:~alice/precise/wordpress-42", "cs:~alice/precise/mysql-1"})
+}
+
 var routerPutTests = []struct {
 	about               string
 	handlers            Handlers
@@ -1077,7 +1416,7 @@ var routerPutTests = []struct {
 	expectCode          int
 	expectBody          interface{}
 	expectRecordedCalls []interface{}
-	resolveURL          func(*charm.Reference) (*ResolvedURL, error)
+	resolveURL          func(*charm.Reference, *http.Request) (*ResolvedURL, error)
 }{{
 	about: "global handler",
 	handlers: Handlers{
@@ -1422,7 +1761,7 @@ var routerPutTests = []struct {
 					}
 					return nil
 				},
-				Update: func(id *ResolvedURL, fields map[string]interface{}) error {
+				Update: func(id *ResolvedURL, fields map[string]interface{}, req *http.Request) error {
 					return params.ErrBadRequest
 				},
 			}),
@@ -1446,20 +1785,11 @@ var routerPutTests = []struct {
 	expectCode: http.StatusInternalServerError,
 	expectBody: params.Error{
 		Code:    params.ErrMultipleErrors,
-		Message: "multiple (4) errors",
+		Message: "multiple (2) errors",
 		Info: map[string]*params.Error{
-			// All endpoints that share the same bulk key should
-			// get the same error, as the update pertains to all of them,
-			// but endpoints for which the HandlePut failed will
-			// not be included in that.
-			"foo/one": {
-				Code:    params.ErrBadRequest,
-				Message: "bad request",
-			},
-			"foo/two": {
-				Code:    params.ErrBadRequest,
-				Message: "bad request",
-			},
+			// Nothing is updated when any HandlePut fails,
+			// so only the endpoints for which the HandlePut
+			// failed have errors.
 			"foo/bad": {
 				Message: "foo/bad error",
 			},
@@ -1468,6 +1798,71 @@ var routerPutTests = []struct {
 			},
 		},
 	},
+}, {
+	about: "meta/any put with update error reverts other updates",
+	handlers: Handlers{
+		Meta: map[string]BulkIncludeHandler{
+			"foo/": FieldIncludeHandler(FieldIncludeHandlerParams{
+				Key: 0,
+				HandlePut: func(id *ResolvedURL, path string, val *json.RawMessage, updater *FieldUpdater, req *http.Request) error {
+					updater.UpdateField("foo"+path, string(*val))
+					return nil
+				},
+				Update: func(id *ResolvedURL, fields map[string]interface{}, req *http.Request) error {
+					RecordCall(fieldUpdateCall{"update", fields})
+					return nil
+				},
+				Snapshot: func(id *ResolvedURL, fields []string) (map[string]interface{}, error) {
+					return map[string]interface{}{
+						"foo/one": "old",
+					}, nil
+				},
+				Revert: func(id *ResolvedURL, fields, old map[string]interface{}) error {
+					RecordCall(fieldUpdateCall{"revert", old})
+					return nil
+				},
+			}),
+			// The bar handler cannot be reverted, so it
+			// is always updated after the foo handler.
+			"bar": FieldIncludeHandler(FieldIncludeHandlerParams{
+				Key: 1,
+				HandlePut: func(id *ResolvedURL, path string, val *json.RawMessage, updater *FieldUpdater, req *http.Request) error {
+					return nil
+				},
+				Update: func(id *ResolvedURL, fields map[string]interface{}, req *http.Request) error {
+					return errgo.WithCausef(nil, params.ErrBadRequest, "bar update error")
+				},
+			}),
+		},
+	},
+	urlStr: "/precise/wordpress-23/meta/any",
+	body: params.MetaAnyResponse{
+		Meta: map[string]interface{}{
+			"foo/one": "one",
+			"foo/two": "two",
+			"bar":     "bar",
+		},
+	},
+	expectCode: http.StatusInternalServerError,
+	expectBody: params.Error{
+		Code:    params.ErrMultipleErrors,
+		Message: "multiple (1) errors",
+		Info: map[string]*params.Error{
+			"bar": {
+				Code:    params.ErrBadRequest,
+				Message: "bar update error",
+			},
+		},
+	},
+	expectRecordedCalls: []interface{}{
+		fieldUpdateCall{"revert", map[string]interface{}{
+			"foo/one": "old",
+		}},
+		fieldUpdateCall{"update", map[string]interface{}{
+			"foo/one": `"one"`,
+			"foo/two": `"two"`,
+		}},
+	},
 }, {
 	about: "bulk meta/any put with several errors",
 	handlers: Handlers{
@@ -1488,7 +1883,7 @@ var routerPutTests = []struct {
 			}),
 		},
 	},
-	resolveURL: func(id *charm.Reference) (*ResolvedURL, error) {
+	resolveURL: func(id *charm.Reference, req *http.Request) (*ResolvedURL, error) {
 		if id.Name == "bad" {
 			return nil, params.ErrBadRequest
 		}
@@ -1584,10 +1979,17 @@ var routerPutTests = []struct {
 	},
 }}
 
-func nopUpdate(id *ResolvedURL, fields map[string]interface{}) error {
+func nopUpdate(id *ResolvedURL, fields map[string]interface{}, req *http.Request) error {
 	return nil
 }
 
+// fieldUpdateCall records a call to a FieldUpdateFunc
+// or a FieldRevertFunc.
+type fieldUpdateCall struct {
+	Op     string
+	Fields map[string]interface{}
+}
+
 func (s *RouterSuite) TestRouterPut(c *gc.C) {
 	for i, test := range routerPutTests {
 		c.Logf("test %d: %s", i, test.about)
@@ -1598,7 +2000,7 @@ func (s *RouterSuite) TestRouterPut(c *gc.C) {
 		}
 		bodyVal, err := json.Marshal(test.body)
 		c.Assert(err, gc.IsNil)
-		router := New(&test.handlers, resolve, alwaysAuthorize, alwaysExists)
+		router := New(&test.handlers, resolve, alwaysAuthorize, alwaysExists, nil, nil)
 		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
 			Handler: router,
 			URL:     test.urlStr,
@@ -1667,7 +2069,7 @@ func (s *RouterSuite) TestRouterPutWithInvalidContent(c *gc.C) {
 				"foo": testMetaHandler(0),
 			},
 		}
-		router := New(handlers, alwaysResolveURL, alwaysAuthorize, alwaysExists)
+		router := New(handlers, alwaysResolveURL, alwaysAuthorize, alwaysExists, nil, nil)
 		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
 			Handler: router,
 			URL:     test.urlStr,
@@ -1749,7 +2151,7 @@ func (s *RouterSuite) TestGetMetadata(c *gc.C) {
 				"item2": fieldSelectHandler("handler2", 0, "item2"),
 				"test":  testMetaHandler(0),
 			},
-		}, alwaysResolveURL, alwaysAuthorize, alwaysExists)
+		}, alwaysResolveURL, alwaysAuthorize, alwaysExists, nil, nil)
 		result, err := router.GetMetadata(test.id, test.includes, nil)
 		if test.expectError != "" {
 			c.Assert(err, gc.ErrorMatches, test.expectError)
@@ -2098,6 +2500,19 @@ func testIdHandler(charmId *charm.Reference, w http.ResponseWriter, req *http.Re
 	return nil
 }
 
+type userHandlerTestResp struct {
+	Method string
+	User   string
+}
+
+func testUserHandler(user string, w http.ResponseWriter, req *http.Request) error {
+	jsonhttp.WriteJSON(w, http.StatusOK, userHandlerTestResp{
+		Method: req.Method,
+		User:   user,
+	})
+	return nil
+}
+
 type metaHandlerTestResp struct {
 	CharmURL string
 	Path     string
@@ -2329,7 +2744,7 @@ func fieldSelectHandler(handlerId string, key interface{}, fields ...string) Bul
 		return nil
 	}
 
-	update := func(id *ResolvedURL, fields map[string]interface{}) error {
+	update := func(id *ResolvedURL, fields map[string]interface{}, req *http.Request) error {
 		// We make information on how update and handlePut have
 		// been called by calling SetCallRecord with the above
 		// parameters. The fields will have been created by
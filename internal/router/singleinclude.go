@@ -50,3 +50,8 @@ func (h SingleIncludeHandler) HandlePut(hs []BulkIncludeHandler, id *ResolvedURL
 	}
 	return errs
 }
+
+// PreparePut implements PutPreparer.PreparePut.
+func (h SingleIncludeHandler) PreparePut(hs []BulkIncludeHandler, id *ResolvedURL, paths []string, values []*json.RawMessage, req *http.Request) (PreparedPut, []error) {
+	return nil, h.HandlePut(hs, id, paths, values, req)
+}
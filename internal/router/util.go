@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"net/http"
 	"strings"
+	"time"
 
 	"github.com/juju/loggo"
 	"github.com/juju/utils/jsonhttp"
@@ -36,17 +37,23 @@ func errorToResp1(err error) (int, interface{}) {
 	if err, ok := errgo.Cause(err).(*httpbakery.Error); ok {
 		return httpbakery.ErrorToResponse(err)
 	}
-	errorBody := errorResponseBody(err)
+	errorBody := ErrorResponseBody(err)
 	status := http.StatusInternalServerError
 	switch errorBody.Code {
 	case params.ErrNotFound, params.ErrMetadataNotFound:
 		status = http.StatusNotFound
 	case params.ErrBadRequest:
 		status = http.StatusBadRequest
-	case params.ErrForbidden:
+	case params.ErrForbidden, params.ErrPolicyViolation, params.ErrQuotaExceeded:
 		status = http.StatusForbidden
 	case params.ErrUnauthorized:
 		status = http.StatusUnauthorized
+	case params.ErrContentChallenge:
+		status = http.StatusConflict
+	case params.ErrCursorExpired:
+		status = http.StatusGone
+	case params.ErrPreconditionFailed:
+		status = http.StatusPreconditionFailed
 	case params.ErrMethodNotAllowed:
 		// TODO(rog) from RFC 2616, section 4.7: An Allow header
 		// field MUST be present in a 405 (Method Not Allowed)
@@ -57,9 +64,9 @@ func errorToResp1(err error) (int, interface{}) {
 	return status, errorBody
 }
 
-// errorResponse returns an appropriate error
-// response for the provided error.
-func errorResponseBody(err error) *params.Error {
+// ErrorResponseBody returns an appropriate error
+// response body for the provided error.
+func ErrorResponseBody(err error) *params.Error {
 
 	errResp := &params.Error{
 		Message: err.Error(),
@@ -96,11 +103,51 @@ func (err multiError) ErrorCode() params.ErrorCode {
 func (err multiError) ErrorInfo() map[string]*params.Error {
 	m := make(map[string]*params.Error)
 	for key, err := range err {
-		m[key] = errorResponseBody(err)
+		m[key] = ErrorResponseBody(err)
 	}
 	return m
 }
 
+// addErrors adds the errors returned by a metadata
+// handler for the given paths, if any.
+func (err multiError) addErrors(paths []string, errs []error) error {
+	if len(errs) == 0 {
+		return nil
+	}
+	if len(errs) != len(paths) {
+		return fmt.Errorf("unexpected error count; expected %d, got %q", len(paths), errs)
+	}
+	for i, e := range errs {
+		if e != nil {
+			err[paths[i]] = e
+		}
+	}
+	return nil
+}
+
+// revert reverts the given metadata writes, most recent first.
+// Metadata that may have been left written is reported in err.
+func (err multiError) revert(applied []preparedGroup) {
+	for i := len(applied) - 1; i >= 0; i-- {
+		p := applied[i]
+		var revertErr error
+		if !p.put.CanRevert() {
+			revertErr = errgo.New("cannot roll back update")
+		} else if e := p.put.Revert(); e != nil {
+			logger.Errorf("cannot roll back update to %v: %v", p.paths, e)
+			revertErr = errgo.Notef(e, "cannot roll back update")
+		}
+		if revertErr == nil {
+			continue
+		}
+		for _, path := range p.paths {
+			if err[path] == nil {
+				err[path] = revertErr
+			}
+		}
+	}
+}
+
 // NotFoundHandler is like http.NotFoundHandler except it
 // returns a JSON error response.
 func NotFoundHandler() http.Handler {
@@ -132,6 +179,88 @@ func (mux *ServeMux) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	h.ServeHTTP(w, req)
 }
 
+// CheckNotModified sets the ETag and Last-Modified headers of the
+// response from the given entity tag and modification time, when they
+// are not empty, and checks them against the If-None-Match and
+// If-Modified-Since headers of a GET or HEAD request. If the request
+// headers show that the client already holds the current representation
+// of the resource, it writes a 304 (Not Modified) response and returns
+// true, in which case the caller should write nothing more.
+//
+// Any other headers that should be included in a 304 response, such as
+// Cache-Control, should be set before calling CheckNotModified.
+func CheckNotModified(w http.ResponseWriter, req *http.Request, etag string, modTime time.Time) bool {
+	header := w.Header()
+	if etag != "" {
+		header.Set("ETag", etag)
+	}
+	if !modTime.IsZero() {
+		header.Set("Last-Modified", modTime.UTC().Format(http.TimeFormat))
+	}
+	if req.Method != "GET" && req.Method != "HEAD" {
+		return false
+	}
+	if !notModified(req, etag, modTime) {
+		return false
+	}
+	header.Del("Content-Type")
+	header.Del("Content-Length")
+	w.WriteHeader(http.StatusNotModified)
+	return true
+}
+
+// notModified reports whether the conditional headers of the given
+// request show that the client holds the representation with the given
+// entity tag and modification time.
+func notModified(req *http.Request, etag string, modTime time.Time) bool {
+	if inm := req.Header.Get("If-None-Match"); inm != "" {
+		// If-None-Match takes precedence over If-Modified-Since.
+		// See RFC 7232, section 6.
+		return etag != "" && ETagMatches(inm, etag, false)
+	}
+	ims := req.Header.Get("If-Modified-Since")
+	if ims == "" || modTime.IsZero() {
+		return false
+	}
+	t, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	// HTTP dates have a resolution of one second.
+	return !modTime.Truncate(time.Second).After(t)
+}
+
+// ETagMatches reports whether the given If-None-Match or If-Match
+// header value matches the given entity tag. If strong is true, the
+// strong comparison function of RFC 7232 is used, and weak tags never
+// match; otherwise the weak comparison function is used, and the weak
+// indicators of the tags are ignored.
+//
+// The header value is taken to be a comma-separated list of entity
+// tags, or "*", which matches any tag. Entity tags containing commas
+// are not supported.
+func ETagMatches(header, etag string, strong bool) bool {
+	if strings.TrimSpace(header) == "*" {
+		return true
+	}
+	if strong && strings.HasPrefix(etag, "W/") {
+		return false
+	}
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if strong {
+			if tag == etag {
+				return true
+			}
+			continue
+		}
+		if strings.TrimPrefix(tag, "W/") == strings.TrimPrefix(etag, "W/") {
+			return true
+		}
+	}
+	return false
+}
+
 // RelativeURLPath returns a relative URL path that is lexically equivalent to
 // targpath when interpreted by url.URL.ResolveReference.
 // On succes, the returned path will always be relative to basePath, even if basePath
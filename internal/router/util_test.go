@@ -4,7 +4,10 @@
 package router_test
 
 import (
+	"net/http"
+	"net/http/httptest"
 	"net/url"
+	"time"
 
 	gc "gopkg.in/check.v1"
 
@@ -122,3 +125,151 @@ func (*utilSuite) TestRelativeURL(c *gc.C) {
 		}
 	}
 }
+
+var checkNotModifiedTests = []struct {
+	about          string
+	method         string
+	header         http.Header
+	etag           string
+	modTime        time.Time
+	expectModified bool
+}{{
+	about:          "no conditional headers",
+	etag:           `"abc"`,
+	modTime:        time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+	expectModified: true,
+}, {
+	about:  "matching etag",
+	header: http.Header{"If-None-Match": {`"abc"`}},
+	etag:   `"abc"`,
+}, {
+	about:  "matching etag in list",
+	header: http.Header{"If-None-Match": {`"xyz", "abc"`}},
+	etag:   `"abc"`,
+}, {
+	about:  "weak comparison",
+	header: http.Header{"If-None-Match": {`"abc"`}},
+	etag:   `W/"abc"`,
+}, {
+	about:  "wildcard",
+	header: http.Header{"If-None-Match": {"*"}},
+	etag:   `"abc"`,
+}, {
+	about:          "mismatched etag",
+	header:         http.Header{"If-None-Match": {`"xyz"`}},
+	etag:           `"abc"`,
+	expectModified: true,
+}, {
+	about:          "no etag",
+	header:         http.Header{"If-None-Match": {`"abc"`}},
+	expectModified: true,
+}, {
+	about: "If-None-Match takes precedence over If-Modified-Since",
+	header: http.Header{
+		"If-None-Match":     {`"xyz"`},
+		"If-Modified-Since": {"Fri, 02 Jan 2015 03:04:05 GMT"},
+	},
+	etag:           `"abc"`,
+	modTime:        time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+	expectModified: true,
+}, {
+	about:   "not modified since",
+	header:  http.Header{"If-Modified-Since": {"Fri, 02 Jan 2015 03:04:05 GMT"}},
+	modTime: time.Date(2015, 1, 2, 3, 4, 5, 500e6, time.UTC),
+}, {
+	about:          "modified since",
+	header:         http.Header{"If-Modified-Since": {"Fri, 02 Jan 2015 03:04:04 GMT"}},
+	modTime:        time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+	expectModified: true,
+}, {
+	about:          "invalid If-Modified-Since",
+	header:         http.Header{"If-Modified-Since": {"yesterday"}},
+	modTime:        time.Date(2015, 1, 2, 3, 4, 5, 0, time.UTC),
+	expectModified: true,
+}, {
+	about:          "not a GET request",
+	method:         "POST",
+	header:         http.Header{"If-None-Match": {`"abc"`}},
+	etag:           `"abc"`,
+	expectModified: true,
+}, {
+	about:  "HEAD request",
+	method: "HEAD",
+	header: http.Header{"If-None-Match": {`"abc"`}},
+	etag:   `"abc"`,
+}}
+
+func (*utilSuite) TestCheckNotModified(c *gc.C) {
+	for i, test := range checkNotModifiedTests {
+		c.Logf("test %d: %s", i, test.about)
+		method := test.method
+		if method == "" {
+			method = "GET"
+		}
+		req, err := http.NewRequest(method, "/foo", nil)
+		c.Assert(err, gc.IsNil)
+		req.Header = test.header
+		if req.Header == nil {
+			req.Header = make(http.Header)
+		}
+		rec := httptest.NewRecorder()
+		rec.Header().Set("Content-Type", "application/json")
+		notModified := router.CheckNotModified(rec, req, test.etag, test.modTime)
+		c.Assert(notModified, gc.Equals, !test.expectModified)
+		c.Assert(rec.Header().Get("ETag"), gc.Equals, test.etag)
+		if test.modTime.IsZero() {
+			c.Assert(rec.Header().Get("Last-Modified"), gc.Equals, "")
+		} else {
+			c.Assert(rec.Header().Get("Last-Modified"), gc.Equals, test.modTime.Format(http.TimeFormat))
+		}
+		if notModified {
+			c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+			c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "")
+		} else {
+			c.Assert(rec.Header().Get("Content-Type"), gc.Equals, "application/json")
+		}
+	}
+}
+
+var etagMatchesTests = []struct {
+	header string
+	etag   string
+	strong bool
+	expect bool
+}{{
+	header: `"abc"`,
+	etag:   `"abc"`,
+	expect: true,
+}, {
+	header: `"abc"`,
+	etag:   `"abc"`,
+	strong: true,
+	expect: true,
+}, {
+	header: `W/"abc"`,
+	etag:   `"abc"`,
+	expect: true,
+}, {
+	header: `W/"abc"`,
+	etag:   `W/"abc"`,
+	strong: true,
+}, {
+	header: `"xyz",W/"abc"`,
+	etag:   `W/"abc"`,
+	expect: true,
+}, {
+	header: "*",
+	etag:   `W/"abc"`,
+	strong: true,
+	expect: true,
+}, {
+	header: `"xyz"`,
+	etag:   `"abc"`,
+}}
+
+func (*utilSuite) TestETagMatches(c *gc.C) {
+	for i, test := range etagMatchesTests {
+		c.Logf("test %d: %q %q strong=%v", i, test.header, test.etag, test.strong)
+		c.Assert(router.ETagMatches(test.header, test.etag, test.strong), gc.Equals, test.expect)
+	}
+}
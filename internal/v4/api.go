@@ -6,6 +6,7 @@ package v4
 import (
 	"archive/zip"
 	"encoding/json"
+	"fmt"
 	"io/ioutil"
 	"net/http"
 	"net/url"
@@ -49,29 +50,46 @@ func New(pool *charmstore.Pool, config charmstore.ServerParams) *Handler {
 
 	h.Router = router.New(&router.Handlers{
 		Global: map[string]http.Handler{
+			"changes/events":       router.HandleJSON(h.serveChangesEvents),
 			"changes/published":    router.HandleJSON(h.serveChangesPublished),
+			"changes/stream":       router.HandleErrors(h.serveChangesStream),
 			"debug":                http.HandlerFunc(h.serveDebug),
 			"debug/pprof/":         newPprofHandler(h),
 			"debug/status":         router.HandleJSON(h.serveDebugStatus),
+			"gc":                   router.HandleJSON(h.serveBlobGC),
+			"keys/":                router.HandleErrors(h.serveKeys),
 			"log":                  router.HandleErrors(h.serveLog),
 			"search":               router.HandleJSON(h.serveSearch),
 			"search/interesting":   http.HandlerFunc(h.serveSearchInteresting),
 			"stats/":               router.NotFoundHandler(),
 			"stats/counter/":       router.HandleJSON(h.serveStatsCounter),
+			"upload":               router.HandleJSON(h.serveUpload),
+			"upload/":              router.HandleErrors(h.serveUploadId),
+			"webhooks":             router.HandleErrors(h.serveWebhooks),
+			"webhooks/":            router.HandleErrors(h.serveWebhook),
 			"macaroon":             router.HandleJSON(h.serveMacaroon),
 			"delegatable-macaroon": router.HandleJSON(h.serveDelegatableMacaroon),
 		},
 		Id: map[string]router.IdHandler{
+			"":            h.serveBaseEntity,
 			"archive":     h.serveArchive,
 			"archive/":    h.resolveId(h.authId(h.serveArchiveFile)),
 			"diagram.svg": h.resolveId(h.authId(h.serveDiagram)),
+			"diff":        h.resolveId(h.authId(h.serveDiff)),
 			"expand-id":   h.resolveId(h.authId(h.serveExpandId)),
 			"icon.svg":    h.resolveId(h.authId(h.serveIcon)),
 			"readme":      h.resolveId(h.authId(h.serveReadMe)),
 			"resources":   h.resolveId(h.authId(h.serveResources)),
+			"resources/":  h.resolveId(h.authId(h.serveResource)),
+			"signatures":  h.resolveId(h.serveSignatures),
 			"promulgate":  h.resolveId(h.serveAdminPromulgate),
+			"publish":     h.servePublish,
+			"purge":       h.servePurge,
+			"restore":     h.serveRestore,
+			"transfer":    h.serveTransfer,
 		},
 		Meta: map[string]router.BulkIncludeHandler{
+			"appearance":           h.entityHandler(h.metaAppearance, appearanceFields...),
 			"archive-size":         h.entityHandler(h.metaArchiveSize, "size"),
 			"archive-upload-time":  h.entityHandler(h.metaArchiveUploadTime, "uploadtime"),
 			"bundle-machine-count": h.entityHandler(h.metaBundleMachineCount, "bundlemachinecount"),
@@ -82,6 +100,12 @@ func New(pool *charmstore.Pool, config charmstore.ServerParams) *Handler {
 			"charm-config":         h.entityHandler(h.metaCharmConfig, "charmconfig"),
 			"charm-metadata":       h.entityHandler(h.metaCharmMetadata, "charmmeta"),
 			"charm-related":        h.entityHandler(h.metaCharmRelated, "charmprovidedinterfaces", "charmrequiredinterfaces"),
+			"color":                h.entityHandler(h.metaColor, appearanceFields...),
+			"deprecation": h.puttableEntityHandler(
+				h.metaDeprecation,
+				h.putMetaDeprecation,
+				"deprecation",
+			),
 			"extra-info": h.puttableEntityHandler(
 				h.metaExtraInfo,
 				h.putMetaExtraInfo,
@@ -103,14 +127,16 @@ func New(pool *charmstore.Pool, config charmstore.ServerParams) *Handler {
 			"perm":          h.puttableBaseEntityHandler(h.metaPerm, h.putMetaPerm, "acls"),
 			"perm/":         h.puttableBaseEntityHandler(h.metaPermWithKey, h.putMetaPermWithKey, "acls"),
 			"promulgated":   h.baseEntityHandler(h.metaPromulgated, "promulgated"),
+			"release-notes": h.puttableEntityHandler(h.metaReleaseNotes, h.putMetaReleaseNotes, "releasenotes"),
 			"revision-info": router.SingleIncludeHandler(h.metaRevisionInfo),
+			"signatures":    h.entityHandler(h.metaSignatures, "signatures"),
 			"stats":         h.entityHandler(h.metaStats),
 			"tags":          h.entityHandler(h.metaTags, "charmmeta", "bundledata"),
-
-			// endpoints not yet implemented:
-			// "color": router.SingleIncludeHandler(h.metaColor),
 		},
-	}, h.resolveURL, h.AuthorizeEntity, h.entityExists)
+		User: map[string]router.UserHandler{
+			"quota": h.serveQuota,
+		},
+	}, h.resolveURL, h.AuthorizeEntity, h.entityExists, h.metaETag, h.redirectURL)
 	return h
 }
 
@@ -132,7 +158,12 @@ func (h *Handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 
 // ResolveURL resolves the series and revision of the given URL if either is
 // unspecified by filling them out with information retrieved from the store.
-func ResolveURL(store *charmstore.Store, url *charm.Reference) (*router.ResolvedURL, error) {
+// Only entities published in the given channel are considered when
+// resolving the URL. URLs that are not fully specified and are owned by
+// a user that has transferred the charm or bundle to another user are
+// resolved under the new owner; fully specified URLs are redirected by
+// h.redirectURL only when they are not found.
+func ResolveURL(store *charmstore.Store, url *charm.Reference, channel params.Channel) (*router.ResolvedURL, error) {
 	if url.Series != "" && url.Revision != -1 && url.User != "" {
 		// URL is fully specified; no need for a database lookup.
 		return &router.ResolvedURL{
@@ -140,12 +171,22 @@ func ResolveURL(store *charmstore.Store, url *charm.Reference) (*router.Resolved
 			PromulgatedRevision: -1,
 		}, nil
 	}
-	entity, err := store.FindBestEntity(url, "_id", "promulgated-revision")
+	entity, err := store.FindBestEntity(url, channel, "_id", "promulgated-revision")
 	if err != nil && errgo.Cause(err) != params.ErrNotFound {
-		return nil, errgo.Mask(err)
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
 	}
 	if errgo.Cause(err) == params.ErrNotFound {
-		return nil, noMatchingURLError(url)
+		if url.User == "" {
+			return nil, noMatchingURLError(url)
+		}
+		target, err := store.Redirect(url)
+		if errgo.Cause(err) == params.ErrNotFound {
+			return nil, noMatchingURLError(url)
+		}
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		return ResolveURL(store, target, channel)
 	}
 	if url.User == "" {
 		return &router.ResolvedURL{
@@ -163,10 +204,37 @@ func noMatchingURLError(url *charm.Reference) error {
 	return errgo.WithCausef(nil, params.ErrNotFound, "no matching charm or bundle for %q", url)
 }
 
-func (h *Handler) resolveURL(url *charm.Reference) (*router.ResolvedURL, error) {
+func (h *Handler) resolveURL(url *charm.Reference, req *http.Request) (*router.ResolvedURL, error) {
+	channel, err := requestChannel(req)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	return ResolveURL(store, url, channel)
+}
+
+// redirectURL returns the id that the given fully specified id, which
+// was not found, refers to after its owner has transferred the charm
+// or bundle to another user. It returns an error with a
+// params.ErrNotFound cause if there is no such redirect. It is only
+// called for ids that were not found, so that fully specified ids that
+// exist need no extra database lookup.
+func (h *Handler) redirectURL(url *charm.Reference, req *http.Request) (*router.ResolvedURL, error) {
+	if url.User == "" || !isFullySpecified(url) {
+		// Other ids are redirected by ResolveURL.
+		return nil, noMatchingURLError(url)
+	}
 	store := h.pool.Store()
 	defer store.Close()
-	return ResolveURL(store, url)
+	target, err := store.Redirect(url)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return &router.ResolvedURL{
+		URL:                 *target,
+		PromulgatedRevision: -1,
+	}, nil
 }
 
 type entityHandlerFunc func(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error)
@@ -194,6 +262,8 @@ func (h *Handler) puttableEntityHandler(get entityHandlerFunc, handlePut router.
 		HandlePut:    handlePut,
 		Update:       h.updateEntity,
 		UpdateSearch: h.updateSearch,
+		Snapshot:     h.entityFields,
+		Revert:       h.revertEntity,
 	})
 }
 
@@ -218,32 +288,119 @@ func (h *Handler) puttableBaseEntityHandler(get baseEntityHandlerFunc, handlePut
 		HandlePut:    handlePut,
 		Update:       h.updateBaseEntity,
 		UpdateSearch: h.updateSearchBase,
+		Snapshot:     h.baseEntityFields,
+		Revert:       h.revertBaseEntity,
 	})
 }
 
-func (h *Handler) updateBaseEntity(id *router.ResolvedURL, fields map[string]interface{}) error {
+func (h *Handler) updateBaseEntity(id *router.ResolvedURL, fields map[string]interface{}, req *http.Request) error {
 	store := h.pool.Store()
 	defer store.Close()
-	if err := store.UpdateBaseEntity(id, bson.D{{"$set", fields}}); err != nil {
+	update := bson.D{{"$set", fields}}
+	var err error
+	if _, baseMods, ok := ifMatchModifications(id, req); ok {
+		err = store.UpdateBaseEntityIfUnmodified(id, baseMods, update)
+	} else {
+		err = store.UpdateBaseEntity(id, update)
+	}
+	if err != nil {
+		return errgo.NoteMask(err, fmt.Sprintf("cannot update base entity %q", id), errgo.Is(params.ErrPreconditionFailed))
+	}
+	if err := store.AddBaseUpdateEvents(id, fields); err != nil {
 		return errgo.Notef(err, "cannot update base entity %q", id)
 	}
 	return nil
 }
 
-func (h *Handler) updateEntity(id *router.ResolvedURL, fields map[string]interface{}) error {
+func (h *Handler) updateEntity(id *router.ResolvedURL, fields map[string]interface{}, req *http.Request) error {
 	store := h.pool.Store()
 	defer store.Close()
-	err := store.UpdateEntity(id, bson.D{{"$set", fields}})
+	update := bson.D{{"$set", fields}}
+	var err error
+	if entityMods, _, ok := ifMatchModifications(id, req); ok {
+		err = store.UpdateEntityIfUnmodified(id, entityMods, update)
+	} else {
+		err = store.UpdateEntity(id, update)
+	}
 	if err != nil {
-		return errgo.Notef(err, "cannot update %q", &id.URL)
+		return errgo.NoteMask(err, fmt.Sprintf("cannot update %q", &id.URL), errgo.Is(params.ErrPreconditionFailed))
 	}
 	err = store.UpdateSearchFields(id, fields)
 	if err != nil {
 		return errgo.Notef(err, "cannot update %q", &id.URL)
 	}
+	if err := store.AddUpdateEvents(id, fields); err != nil {
+		return errgo.Notef(err, "cannot update %q", &id.URL)
+	}
+	return nil
+}
+
+func (h *Handler) entityFields(id *router.ResolvedURL, fields []string) (map[string]interface{}, error) {
+	store := h.pool.Store()
+	defer store.Close()
+	return store.EntityFields(id, fields)
+}
+
+func (h *Handler) baseEntityFields(id *router.ResolvedURL, fields []string) (map[string]interface{}, error) {
+	store := h.pool.Store()
+	defer store.Close()
+	return store.BaseEntityFields(id, fields)
+}
+
+func (h *Handler) revertEntity(id *router.ResolvedURL, fields, old map[string]interface{}) error {
+	store := h.pool.Store()
+	defer store.Close()
+	if err := store.UpdateEntity(id, revertUpdate(fields, old)); err != nil {
+		return errgo.Notef(err, "cannot revert %q", &id.URL)
+	}
+	if err := store.UpdateSearchFields(id, fields); err != nil {
+		return errgo.Notef(err, "cannot revert %q", &id.URL)
+	}
+	if err := store.AddUpdateEvents(id, fields); err != nil {
+		return errgo.Notef(err, "cannot revert %q", &id.URL)
+	}
+	return nil
+}
+
+func (h *Handler) revertBaseEntity(id *router.ResolvedURL, fields, old map[string]interface{}) error {
+	store := h.pool.Store()
+	defer store.Close()
+	if err := store.UpdateBaseEntity(id, revertUpdate(fields, old)); err != nil {
+		return errgo.Notef(err, "cannot revert base entity %q", id)
+	}
+	if _, ok := fields["public"]; ok {
+		// The read permissions are held in the search records.
+		if err := h.updateSearchBase(id, fields); err != nil {
+			return errgo.Notef(err, "cannot revert base entity %q", id)
+		}
+	}
+	if err := store.AddBaseUpdateEvents(id, fields); err != nil {
+		return errgo.Notef(err, "cannot revert base entity %q", id)
+	}
 	return nil
 }
 
+// revertUpdate returns an update that sets each of the given fields
+// back to its value in old, removing any fields that have no value.
+func revertUpdate(fields, old map[string]interface{}) bson.D {
+	set, unset := make(bson.M), make(bson.M)
+	for field := range fields {
+		if val, ok := old[field]; ok {
+			set[field] = val
+		} else {
+			unset[field] = ""
+		}
+	}
+	var update bson.D
+	if len(set) > 0 {
+		update = append(update, bson.DocElem{"$set", set})
+	}
+	if len(unset) > 0 {
+		update = append(update, bson.DocElem{"$unset", unset})
+	}
+	return update
+}
+
 func (h *Handler) updateSearch(id *router.ResolvedURL, fields map[string]interface{}) error {
 	store := h.pool.Store()
 	defer store.Close()
@@ -276,6 +433,85 @@ func (h *Handler) entityExists(id *router.ResolvedURL, req *http.Request) (bool,
 	return true, nil
 }
 
+// volatileMetadata holds the names of the metadata endpoints whose
+// results can change without any change to the entity or its base
+// entity. Responses that include them have no entity tag. The
+// signatures are included because whether they are trusted depends
+// on the public keys of their users. The revision info is included
+// because it holds the deprecations of other revisions, which may
+// belong to other base entities when the id is promulgated.
+var volatileMetadata = map[string]bool{
+	"bundles-containing": true,
+	"charm-related":      true,
+	"revision-info":      true,
+	"signatures":         true,
+	"stats":              true,
+}
+
+// metaETag returns the entity tag of a response holding the given
+// metadata includes of the entity with the given id. It implements the
+// metaETag function passed to router.New.
+func (h *Handler) metaETag(id *router.ResolvedURL, includes []string, req *http.Request) (string, error) {
+	for _, include := range includes {
+		if volatileMetadata[strings.SplitN(include, "/", 2)[0]] {
+			return "", nil
+		}
+	}
+	etag, err := h.entityETag(id)
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return etag, nil
+}
+
+// entityETag returns a weak entity tag that changes whenever
+// the entity with the given id or its base entity is modified.
+func (h *Handler) entityETag(id *router.ResolvedURL) (string, error) {
+	store := h.pool.Store()
+	defer store.Close()
+	entity, err := store.FindEntity(id, "modifications")
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	baseEntity, err := store.FindBaseEntity(&id.URL, "modifications")
+	if err != nil {
+		return "", errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return fmt.Sprintf(`W/"%s-%d-%d"`, &id.URL, entity.Modifications, baseEntity.Modifications), nil
+}
+
+// ifMatchModifications returns the modification counters of the entity
+// with the given id and of its base entity held in the entity tag for
+// the entity in the If-Match header of the given request (see
+// entityETag). If the header lists several tags for the entity, the
+// first is used. It returns false if the header holds no such tag, in
+// which case metadata updates are unconditional.
+//
+// The router checks the header against the current tag before the
+// update is made; the counters are used to make the update itself
+// conditional, so that it cannot overwrite a simultaneous write.
+func ifMatchModifications(id *router.ResolvedURL, req *http.Request) (entityMods, baseMods int, ok bool) {
+	prefix := fmt.Sprintf(`"%s-`, &id.URL)
+	for _, header := range req.Header["If-Match"] {
+		for _, tag := range strings.Split(header, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if !strings.HasPrefix(tag, prefix) || !strings.HasSuffix(tag, `"`) {
+				continue
+			}
+			counters := strings.Split(strings.TrimSuffix(strings.TrimPrefix(tag, prefix), `"`), "-")
+			if len(counters) != 2 {
+				continue
+			}
+			entityMods, err1 := strconv.Atoi(counters[0])
+			baseMods, err2 := strconv.Atoi(counters[1])
+			if err1 == nil && err2 == nil {
+				return entityMods, baseMods, true
+			}
+		}
+	}
+	return 0, 0, false
+}
+
 func (h *Handler) baseEntityQuery(id *router.ResolvedURL, selector map[string]int, req *http.Request) (interface{}, error) {
 	fields := make([]string, 0, len(selector))
 	for k, v := range selector {
@@ -334,24 +570,16 @@ func (h *Handler) serveDebug(w http.ResponseWriter, req *http.Request) {
 	router.WriteError(w, errNotImplemented)
 }
 
-// POST id/resources/name.stream
-// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idresourcesnamestream
-//
-// GET  id/resources/name.stream[-revision]/arch/filename
-// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idresourcesnamestream-revisionarchfilename
-//
-// PUT id/resources/[~user/]series/name.stream-revision/arch?sha256=hash
-// https://github.com/juju/charmstore/blob/v4/docs/API.md#put-idresourcesuserseriesnamestream-revisionarchsha256hash
-func (h *Handler) serveResources(id *router.ResolvedURL, _ bool, w http.ResponseWriter, req *http.Request) error {
-	return errNotImplemented
-}
-
 // GET id/expand-id
 // https://docs.google.com/a/canonical.com/document/d/1TgRA7jW_mmXoKH3JiwBbtPvQu7WiM6XMrz1wSrhTMXw/edit#bookmark=id.4xdnvxphb2si
 func (h *Handler) serveExpandId(id *router.ResolvedURL, _ bool, w http.ResponseWriter, req *http.Request) error {
 	baseURL := id.PreferredURL()
 	baseURL.Revision = -1
 	baseURL.Series = ""
+	channel, err := requestChannel(req)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
 	store := h.pool.Store()
 	defer store.Close()
 
@@ -360,15 +588,20 @@ func (h *Handler) serveExpandId(id *router.ResolvedURL, _ bool, w http.ResponseW
 	// specified without a user, which will cause EntitiesQuery
 	// to return entities that match appropriately.
 
-	// Retrieve all the entities with the same base URL.
-	q := store.EntitiesQuery(baseURL).Select(bson.D{{"_id", 1}, {"promulgated-url", 1}})
+	// Retrieve all the entities with the same base URL
+	// that are published in the channel.
+	q, err := store.ChannelEntitiesQuery(baseURL, channel)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	q = q.Select(bson.D{{"_id", 1}, {"promulgated-url", 1}})
 	if id.PromulgatedRevision != -1 {
 		q = q.Sort("-series", "-promulgated-revision")
 	} else {
 		q = q.Sort("-series", "-revision")
 	}
 	var docs []*mongodoc.Entity
-	err := q.All(&docs)
+	err = q.All(&docs)
 	if err != nil && errgo.Cause(err) != mgo.ErrNotFound {
 		return errgo.Mask(err)
 	}
@@ -471,11 +704,6 @@ func (h *Handler) metaCharmConfig(entity *mongodoc.Entity, id *router.ResolvedUR
 	return entity.CharmConfig, nil
 }
 
-// GET id/meta/color
-func (h *Handler) metaColor(id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
-	return nil, errNotImplemented
-}
-
 // GET id/meta/archive-size
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetaarchive-size
 func (h *Handler) metaArchiveSize(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
@@ -573,7 +801,7 @@ func (h *Handler) metaRevisionInfo(id *router.ResolvedURL, path string, flags ur
 		q = q.Sort("-revision")
 	}
 	var docs []*mongodoc.Entity
-	if err := q.Select(bson.D{{"_id", 1}, {"promulgated-url", 1}}).All(&docs); err != nil {
+	if err := q.Select(bson.D{{"_id", 1}, {"promulgated-url", 1}, {"deprecation", 1}}).All(&docs); err != nil {
 		return "", errgo.Notef(err, "cannot get ids")
 	}
 
@@ -582,10 +810,16 @@ func (h *Handler) metaRevisionInfo(id *router.ResolvedURL, path string, flags ur
 	}
 	var response params.RevisionInfoResponse
 	for _, doc := range docs {
+		url := doc.URL
 		if id.PromulgatedRevision != -1 {
-			response.Revisions = append(response.Revisions, doc.PromulgatedURL)
-		} else {
-			response.Revisions = append(response.Revisions, doc.URL)
+			url = doc.PromulgatedURL
+		}
+		response.Revisions = append(response.Revisions, url)
+		if doc.Deprecation != nil {
+			if response.Deprecations == nil {
+				response.Deprecations = make(map[string]*params.Deprecation)
+			}
+			response.Deprecations[url.String()] = deprecationParams(doc.Deprecation)
 		}
 	}
 
@@ -790,13 +1024,30 @@ type PublishedResponse struct {
 	Published time.Time
 }
 
-// GET changes/published[?limit=$count][&from=$fromdate][&to=$todate]
+// GET changes/published[?limit=$count][&from=$fromdate][&to=$todate][&channel=$channel]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-changespublished
 func (h *Handler) serveChangesPublished(_ http.Header, r *http.Request) (interface{}, error) {
 	start, stop, err := parseDateRange(r.Form)
 	if err != nil {
 		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
 	}
+	channel, err := requestChannel(r)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	// Entities are reported by the time they were published
+	// in the channel. In the unpublished channel, all entities
+	// are reported by the time they were uploaded.
+	var findQuery bson.D
+	timeField := "uploadtime"
+	switch channel {
+	case params.DevelopmentChannel:
+		findQuery = bson.D{{"development", true}}
+		timeField = "developmentpublishtime"
+	case params.StableChannel:
+		findQuery = bson.D{{"stable", true}}
+		timeField = "stablepublishtime"
+	}
 	limit := -1
 	if limitStr := r.Form.Get("limit"); limitStr != "" {
 		limit, err = strconv.Atoi(limitStr)
@@ -818,16 +1069,15 @@ func (h *Handler) serveChangesPublished(_ http.Header, r *http.Request) (interfa
 			Value: stop,
 		})
 	}
-	var findQuery bson.D
 	if len(tquery) > 0 {
-		findQuery = bson.D{{"uploadtime", tquery}}
+		findQuery = append(findQuery, bson.DocElem{timeField, tquery})
 	}
 	store := h.pool.Store()
 	defer store.Close()
 	query := store.DB.Entities().
 		Find(findQuery).
-		Sort("-uploadtime").
-		Select(bson.D{{"_id", 1}, {"uploadtime", 1}})
+		Sort("-" + timeField).
+		Select(bson.D{{"_id", 1}, {timeField, 1}, {"releasenotes", 1}})
 	if limit != -1 {
 		query = query.Limit(limit)
 	}
@@ -835,9 +1085,17 @@ func (h *Handler) serveChangesPublished(_ http.Header, r *http.Request) (interfa
 	results := []params.Published{}
 	var entity mongodoc.Entity
 	for iter := query.Iter(); iter.Next(&entity); {
+		publishTime := entity.UploadTime
+		switch channel {
+		case params.DevelopmentChannel:
+			publishTime = entity.DevelopmentPublishTime
+		case params.StableChannel:
+			publishTime = entity.StablePublishTime
+		}
 		results = append(results, params.Published{
-			Id:          entity.URL,
-			PublishTime: entity.UploadTime.UTC(),
+			Id:           entity.URL,
+			PublishTime:  publishTime.UTC(),
+			ReleaseNotes: entity.ReleaseNotes,
 		})
 	}
 	return results, nil
@@ -924,12 +1182,26 @@ func isFullySpecified(id *charm.Reference) bool {
 
 // resolveId returns an id handler that resolves any non-fully-specified
 // entity ids using h.resolveURL before calling f with the resolved id.
+// If f fails with a params.ErrNotFound error and the id has been
+// redirected by h.redirectURL, f is called again with the target of
+// the redirect.
 func (h *Handler) resolveId(f resolvedIdHandler) router.IdHandler {
 	return func(id *charm.Reference, w http.ResponseWriter, req *http.Request) error {
-		rid, err := h.resolveURL(id)
+		rid, err := h.resolveURL(id, req)
 		if err != nil {
-			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+		}
+		err = f(rid, isFullySpecified(id), w, req)
+		if errgo.Cause(err) != params.ErrNotFound {
+			return errgo.Mask(err, errgo.Any)
+		}
+		target, rerr := h.redirectURL(id, req)
+		if errgo.Cause(rerr) == params.ErrNotFound {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if rerr != nil {
+			return errgo.Mask(rerr)
 		}
-		return f(rid, isFullySpecified(id), w, req)
+		return f(target, true, w, req)
 	}
 }
@@ -11,6 +11,7 @@ import (
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/http/httptest"
 	"reflect"
 	"sort"
 	"strconv"
@@ -127,6 +128,40 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data.(*charm.Meta).Summary, gc.Equals, "Blog engine")
 	},
+}, {
+	name:      "color",
+	exclusive: charmOnly,
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		// None of the test charms have icons, so they all
+		// take the color of the default icon.
+		if url.URL.Series == "bundle" {
+			return nil, nil
+		}
+		return &params.ColorResponse{
+			Color: "#dd4814",
+		}, nil
+	},
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data.(*params.ColorResponse).Color, gc.Equals, "#dd4814")
+	},
+}, {
+	name:      "appearance",
+	exclusive: charmOnly,
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		if url.URL.Series == "bundle" {
+			return nil, nil
+		}
+		return &params.AppearanceResponse{
+			Color:       "#dd4814",
+			Palette:     []string{"#dd4814", "#ffffff", "#505050", "#646464", "#b8b8b8"},
+			DefaultIcon: true,
+		}, nil
+	},
+	checkURL: newResolvedURL("~charmers/precise/wordpress-23", 23),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data.(*params.AppearanceResponse).DefaultIcon, jc.IsTrue)
+	},
 }, {
 	name:      "bundle-metadata",
 	exclusive: bundleOnly,
@@ -240,13 +275,13 @@ var metaEndpoints = []metaEndpoint{{
 			ref = id.PreferredURL()
 		}
 		return params.RevisionInfoResponse{
-			[]*charm.Reference{ref},
+			Revisions: []*charm.Reference{ref},
 		}, nil
 	},
 	checkURL: newResolvedURL("~charmers/precise/wordpress-99", 99),
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data, gc.DeepEquals, params.RevisionInfoResponse{
-			[]*charm.Reference{
+			Revisions: []*charm.Reference{
 				charm.MustParseReference("cs:precise/wordpress-99"),
 			}})
 	},
@@ -292,6 +327,53 @@ var metaEndpoints = []metaEndpoint{{
 	assertCheckData: func(c *gc.C, data interface{}) {
 		c.Assert(data, gc.FitsTypeOf, (*params.StatsResponse)(nil))
 	},
+}, {
+	name: "deprecation",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindEntity(url, "deprecation")
+		if err != nil {
+			return nil, err
+		}
+		if e.Deprecation == nil {
+			return nil, nil
+		}
+		return &params.Deprecation{
+			Yanked:      e.Deprecation.Yanked,
+			Reason:      e.Deprecation.Reason,
+			Replacement: e.Deprecation.Replacement,
+			Time:        e.Deprecation.Time.UTC(),
+		}, nil
+	},
+	checkURL: newResolvedURL("~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data.(*params.Deprecation).Reason, gc.Equals, "superseded")
+	},
+}, {
+	name: "signatures",
+	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
+		e, err := store.FindEntity(url, "signatures")
+		if err != nil {
+			return nil, err
+		}
+		if len(e.Signatures) == 0 {
+			return nil, nil
+		}
+		sigs := make([]params.Signature, len(e.Signatures))
+		for i, sig := range e.Signatures {
+			sigs[i] = params.Signature{
+				User:      sig.User,
+				KeyId:     sig.KeyId,
+				Signature: sig.Signature,
+				Time:      sig.Time.UTC(),
+				Trusted:   true,
+			}
+		}
+		return sigs, nil
+	},
+	checkURL: newResolvedURL("~bob/utopic/wordpress-2", -1),
+	assertCheckData: func(c *gc.C, data interface{}) {
+		c.Assert(data.([]params.Signature)[0].User, gc.Equals, "bob")
+	},
 }, {
 	name: "extra-info",
 	get: func(store *charmstore.Store, url *router.ResolvedURL) (interface{}, error) {
@@ -503,6 +585,12 @@ func (s *APISuite) addTestEntities(c *gc.C) []*router.ResolvedURL {
 		key := e.URL.Path() + "/meta/extra-info/key"
 		s.assertPut(c, key, "value "+e.URL.String())
 	}
+	// Deprecate one of the entities.
+	s.assertPut(c, "~bob/utopic/wordpress-2/meta/deprecation", params.Deprecation{
+		Reason: "superseded",
+	})
+	// Sign one of the entities.
+	s.addSignature(c, newResolvedURL("~bob/utopic/wordpress-2", -1), "bob")
 	return testEntities
 }
 
@@ -805,6 +893,45 @@ func (s *APISuite) TestExtraInfoBadPutRequests(c *gc.C) {
 	}
 }
 
+func (s *APISuite) TestMetaAnyPutWithErrorWritesNothing(c *gc.C) {
+	id := "precise/wordpress-23"
+	s.addPublicCharm(c, "wordpress", newResolvedURL("~charmers/"+id, 23))
+	s.assertPut(c, id+"/meta/extra-info/foo", "fooval")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/meta/any"),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Username: testUsername,
+		Password: testPassword,
+		Body: strings.NewReader(mustMarshalJSON(params.MetaAnyResponse{
+			Meta: map[string]interface{}{
+				"extra-info/foo":  "fooval2",
+				"extra-info/$bad": "badval",
+				"perm/read":       []string{"bob"},
+			},
+		})),
+		ExpectStatus: http.StatusInternalServerError,
+		ExpectBody: params.Error{
+			Code:    params.ErrMultipleErrors,
+			Message: "multiple (1) errors",
+			Info: map[string]*params.Error{
+				"extra-info/$bad": {
+					Code:    params.ErrBadRequest,
+					Message: "bad key for extra-info",
+				},
+			},
+		},
+	})
+	// None of the metadata has been written.
+	s.assertGet(c, id+"/meta/extra-info", map[string]string{
+		"foo": "fooval",
+	})
+	s.assertGet(c, id+"/meta/perm/read", []string{params.Everyone, "charmers"})
+}
+
 func (s *APISuite) TestExtraInfoPutUnauthorized(c *gc.C) {
 	s.addPublicCharm(c, "wordpress", newResolvedURL("cs:~charmers/precise/wordpress-23", 23))
 	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
@@ -822,6 +949,197 @@ func (s *APISuite) TestExtraInfoPutUnauthorized(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestMetaETag(c *gc.C) {
+	id := "precise/wordpress-23"
+	s.addPublicCharm(c, "wordpress", newResolvedURL("~charmers/"+id, 23))
+	getETag := func(path string) string {
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL(path),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+		return rec.Header().Get("ETag")
+	}
+	etag := getETag(id + "/meta/extra-info")
+	c.Assert(etag, gc.Matches, `W/"cs:~charmers/precise/wordpress-23-[0-9]+-[0-9]+"`)
+	c.Assert(getETag(id+"/meta/any?include=extra-info&include=archive-size"), gc.Equals, etag)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/meta/extra-info"),
+		Header:  http.Header{"If-None-Match": {etag}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+	c.Assert(rec.Body.Len(), gc.Equals, 0)
+
+	// Changing the entity changes its tag.
+	s.assertPut(c, id+"/meta/extra-info/foo", "fooval")
+	etag1 := getETag(id + "/meta/extra-info")
+	c.Assert(etag1, gc.Not(gc.Equals), etag)
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/meta/extra-info"),
+		Header:  http.Header{"If-None-Match": {etag}},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+
+	// So does changing its base entity.
+	s.assertPut(c, id+"/meta/perm/write", []string{"charmers", "bob"})
+	etag2 := getETag(id + "/meta/extra-info")
+	c.Assert(etag2, gc.Not(gc.Equals), etag1)
+
+	// Responses holding volatile metadata have no tag.
+	c.Assert(getETag(id+"/meta/stats"), gc.Equals, "")
+	c.Assert(getETag(id+"/meta/signatures"), gc.Equals, "")
+	c.Assert(getETag(id+"/meta/revision-info"), gc.Equals, "")
+	c.Assert(getETag(id+"/meta/any?include=extra-info&include=bundles-containing"), gc.Equals, "")
+}
+
+func (s *APISuite) TestRevisionInfoAfterDeprecation(c *gc.C) {
+	s.addPublicCharm(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-1", -1))
+	s.addPublicCharm(c, "wordpress", newResolvedURL("~charmers/precise/wordpress-2", -1))
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-2/meta/any?include=extra-info"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	etag := rec.Header().Get("ETag")
+	c.Assert(etag, gc.Not(gc.Equals), "")
+
+	// Yanking one revision changes the revision info of the
+	// other, so a conditional request for it is never answered
+	// with a 304 status, even with the tag of the revision.
+	s.assertPut(c, "~charmers/precise/wordpress-1/meta/deprecation", params.Deprecation{
+		Yanked: true,
+		Reason: "broken",
+	})
+	for _, path := range []string{"meta/revision-info", "meta/any?include=extra-info&include=revision-info"} {
+		rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("~charmers/precise/wordpress-2/" + path),
+			Header:  http.Header{"If-None-Match": {etag}},
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("path %s", path))
+		c.Assert(rec.Header().Get("ETag"), gc.Equals, "")
+		c.Assert(rec.Body.String(), jc.Contains, `"broken"`)
+	}
+}
+
+func (s *APISuite) TestMetaPutIfMatch(c *gc.C) {
+	id := "precise/wordpress-23"
+	s.addPublicCharm(c, "wordpress", newResolvedURL("~charmers/"+id, 23))
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/meta/extra-info"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	etag := rec.Header().Get("ETag")
+	c.Assert(etag, gc.Not(gc.Equals), "")
+
+	putExtraInfo := func(val string) *httptest.ResponseRecorder {
+		return httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL(id + "/meta/extra-info/foo"),
+			Method:  "PUT",
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+				"If-Match":     {etag},
+			},
+			Username: testUsername,
+			Password: testPassword,
+			Body:     strings.NewReader(mustMarshalJSON(val)),
+		})
+	}
+	// The first write succeeds.
+	rec = putExtraInfo("first")
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+
+	// A second write based on the same tag fails, because
+	// the first write has changed the tag.
+	rec = putExtraInfo("second")
+	c.Assert(rec.Code, gc.Equals, http.StatusPreconditionFailed, gc.Commentf("body: %s", rec.Body.String()))
+	var perr params.Error
+	err := json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(perr.Code, gc.Equals, params.ErrPreconditionFailed)
+	s.assertGet(c, id+"/meta/extra-info/foo", "first")
+
+	// Writes to the permissions are checked against
+	// the same tag.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/meta/perm/read"),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+			"If-Match":     {etag},
+		},
+		Username:     testUsername,
+		Password:     testPassword,
+		Body:         strings.NewReader(mustMarshalJSON([]string{"bob"})),
+		ExpectStatus: http.StatusPreconditionFailed,
+		ExpectBody: params.Error{
+			Code:    params.ErrPreconditionFailed,
+			Message: "metadata of cs:precise/wordpress-23 has been modified",
+		},
+	})
+	s.assertGet(c, id+"/meta/perm/read", []string{params.Everyone, "charmers"})
+}
+
+var ifMatchModificationsTests = []struct {
+	about            string
+	ifMatch          []string
+	expectEntityMods int
+	expectBaseMods   int
+	expectOK         bool
+}{{
+	about: "no header",
+}, {
+	about:   "any tag",
+	ifMatch: []string{"*"},
+}, {
+	about:            "weak tag",
+	ifMatch:          []string{`W/"cs:~charmers/precise/wordpress-23-3-7"`},
+	expectEntityMods: 3,
+	expectBaseMods:   7,
+	expectOK:         true,
+}, {
+	about:            "strong tag",
+	ifMatch:          []string{`"cs:~charmers/precise/wordpress-23-0-12"`},
+	expectEntityMods: 0,
+	expectBaseMods:   12,
+	expectOK:         true,
+}, {
+	about:            "tag among others",
+	ifMatch:          []string{`W/"cs:~charmers/precise/mysql-1-1-1", W/"cs:~charmers/precise/wordpress-23-4-5"`, `W/"cs:~charmers/precise/wordpress-23-6-7"`},
+	expectEntityMods: 4,
+	expectBaseMods:   5,
+	expectOK:         true,
+}, {
+	about:   "other revision",
+	ifMatch: []string{`W/"cs:~charmers/precise/wordpress-2-3-7"`},
+}, {
+	about:   "bad counters",
+	ifMatch: []string{`W/"cs:~charmers/precise/wordpress-23-3"`, `W/"cs:~charmers/precise/wordpress-23-x-7"`},
+}}
+
+func (s *APISuite) TestIfMatchModifications(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-23", 23)
+	for i, test := range ifMatchModificationsTests {
+		c.Logf("test %d: %s", i, test.about)
+		req := &http.Request{
+			Header: http.Header{},
+		}
+		if test.ifMatch != nil {
+			req.Header["If-Match"] = test.ifMatch
+		}
+		entityMods, baseMods, ok := v4.IfMatchModifications(id, req)
+		c.Assert(ok, gc.Equals, test.expectOK)
+		c.Assert(entityMods, gc.Equals, test.expectEntityMods)
+		c.Assert(baseMods, gc.Equals, test.expectBaseMods)
+	}
+}
+
 func isNull(v interface{}) bool {
 	data, err := json.Marshal(v)
 	if err != nil {
@@ -1195,7 +1513,7 @@ func (s *APISuite) TestResolveURL(c *gc.C) {
 	for i, test := range resolveURLTests {
 		c.Logf("test %d: %s", i, test.url)
 		url := charm.MustParseReference(test.url)
-		rurl, err := v4.ResolveURL(s.store, url)
+		rurl, err := v4.ResolveURL(s.store, url, params.StableChannel)
 		if test.notFound {
 			c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
 			c.Assert(err, gc.ErrorMatches, `no matching charm or bundle for ".*"`)
@@ -1293,7 +1611,7 @@ var serveMetaRevisionInfoTests = []struct {
 	about: "fully qualified url",
 	url:   "trusty/wordpress-42",
 	expect: params.RevisionInfoResponse{
-		[]*charm.Reference{
+		Revisions: []*charm.Reference{
 			charm.MustParseReference("cs:trusty/wordpress-43"),
 			charm.MustParseReference("cs:trusty/wordpress-42"),
 			charm.MustParseReference("cs:trusty/wordpress-41"),
@@ -1303,7 +1621,7 @@ var serveMetaRevisionInfoTests = []struct {
 	about: "partial url uses a default series",
 	url:   "wordpress",
 	expect: params.RevisionInfoResponse{
-		[]*charm.Reference{
+		Revisions: []*charm.Reference{
 			charm.MustParseReference("cs:trusty/wordpress-43"),
 			charm.MustParseReference("cs:trusty/wordpress-42"),
 			charm.MustParseReference("cs:trusty/wordpress-41"),
@@ -1313,7 +1631,7 @@ var serveMetaRevisionInfoTests = []struct {
 	about: "non-promulgated URL gives non-promulgated revisions (~charmers)",
 	url:   "~charmers/trusty/cinder",
 	expect: params.RevisionInfoResponse{
-		[]*charm.Reference{
+		Revisions: []*charm.Reference{
 			charm.MustParseReference("cs:~charmers/trusty/cinder-6"),
 			charm.MustParseReference("cs:~charmers/trusty/cinder-5"),
 			charm.MustParseReference("cs:~charmers/trusty/cinder-4"),
@@ -1326,7 +1644,7 @@ var serveMetaRevisionInfoTests = []struct {
 	about: "non-promulgated URL gives non-promulgated revisions (~openstack-charmers)",
 	url:   "~openstack-charmers/trusty/cinder",
 	expect: params.RevisionInfoResponse{
-		[]*charm.Reference{
+		Revisions: []*charm.Reference{
 			charm.MustParseReference("cs:~openstack-charmers/trusty/cinder-1"),
 			charm.MustParseReference("cs:~openstack-charmers/trusty/cinder-0"),
 		}},
@@ -1334,7 +1652,7 @@ var serveMetaRevisionInfoTests = []struct {
 	about: "promulgated URL gives promulgated revisions",
 	url:   "trusty/cinder",
 	expect: params.RevisionInfoResponse{
-		[]*charm.Reference{
+		Revisions: []*charm.Reference{
 			charm.MustParseReference("cs:trusty/cinder-5"),
 			charm.MustParseReference("cs:trusty/cinder-4"),
 			charm.MustParseReference("cs:trusty/cinder-3"),
@@ -1883,7 +2201,11 @@ func (s *APISuite) publishCharmsAtKnownTimes(c *gc.C, charms []publishSpec) {
 	for _, ch := range publishedCharms {
 		id, _ := s.addPublicCharm(c, "wordpress", ch.id)
 		t := ch.published().PublishTime
-		err := s.store.UpdateEntity(id, bson.D{{"$set", bson.D{{"uploadtime", t}}}})
+		err := s.store.UpdateEntity(id, bson.D{{"$set", bson.D{
+			{"uploadtime", t},
+			{"developmentpublishtime", t},
+			{"stablepublishtime", t},
+		}}})
 		c.Assert(err, gc.IsNil)
 	}
 }
@@ -0,0 +1,345 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"archive/zip"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// maxPaletteSize holds the maximum number of
+// colors in the palette of a charm's appearance.
+const maxPaletteSize = 5
+
+// GET id/meta/color
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetacolor
+func (h *Handler) metaColor(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	appearance, err := h.entityAppearance(entity, id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if appearance == nil {
+		return nil, nil
+	}
+	return &params.ColorResponse{
+		Color: appearance.Color,
+	}, nil
+}
+
+// GET id/meta/appearance
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetaappearance
+func (h *Handler) metaAppearance(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	appearance, err := h.entityAppearance(entity, id)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if appearance == nil {
+		return nil, nil
+	}
+	return &params.AppearanceResponse{
+		Color:       appearance.Color,
+		Palette:     appearance.Palette,
+		DefaultIcon: appearance.DefaultIcon,
+	}, nil
+}
+
+// appearanceFields holds the entity fields
+// required by entityAppearance.
+var appearanceFields = []string{"_id", "appearance", "blobname", "contents"}
+
+// entityAppearance returns the appearance of the given entity, which
+// must hold at least the fields in appearanceFields. The appearance is
+// normally calculated when the charm is uploaded; for charms uploaded
+// before that, it is derived from the charm's icon, but not saved, so
+// that GET requests never modify the entity.
+// It returns nil for bundles, which have no icon.
+func (h *Handler) entityAppearance(entity *mongodoc.Entity, id *router.ResolvedURL) (*mongodoc.Appearance, error) {
+	if id.URL.Series == "bundle" {
+		return nil, nil
+	}
+	if entity.Appearance != nil {
+		return entity.Appearance, nil
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	r, err := store.OpenCachedBlobFile(entity, mongodoc.FileIcon, isIconFile)
+	if err != nil {
+		if errgo.Cause(err) != params.ErrNotFound {
+			return nil, errgo.Notef(err, "cannot open icon")
+		}
+		return iconOrDefaultAppearance(nil, id)
+	}
+	defer r.Close()
+	return iconOrDefaultAppearance(r, id)
+}
+
+// archiveAppearance returns the appearance of the charm with the given
+// id held in the archive with the given contents and size. It is called
+// when the charm is uploaded.
+func archiveAppearance(id *router.ResolvedURL, r io.ReaderAt, size int64) (*mongodoc.Appearance, error) {
+	zipReader, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot read archive")
+	}
+	for _, f := range zipReader.File {
+		if !isIconFile(f) {
+			continue
+		}
+		icon, err := f.Open()
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot open icon")
+		}
+		defer icon.Close()
+		return iconOrDefaultAppearance(icon, id)
+	}
+	return iconOrDefaultAppearance(nil, id)
+}
+
+// isIconFile reports whether the given archive
+// file holds the icon of a charm.
+func isIconFile(f *zip.File) bool {
+	return path.Clean(f.Name) == "icon.svg"
+}
+
+// iconOrDefaultAppearance returns the appearance of the icon of the
+// charm with the given id read from r. If r is nil or the icon cannot
+// be processed, the charm will be shown with the default icon, so it
+// returns the appearance of the default icon.
+func iconOrDefaultAppearance(r io.Reader, id *router.ResolvedURL) (*mongodoc.Appearance, error) {
+	if r != nil {
+		appearance, err := iconAppearance(r)
+		if err == nil {
+			return appearance, nil
+		}
+		logger.Errorf("cannot process icon.svg from %s: %v", id, err)
+	}
+	appearance, err := iconAppearance(strings.NewReader(defaultIcon))
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot process default icon")
+	}
+	appearance.DefaultIcon = true
+	return appearance, nil
+}
+
+// iconAppearance returns the appearance of the SVG icon read from r.
+// The colors are taken from the fill, stroke and stop-color
+// attributes and style properties of all the visible elements
+// in the icon.
+// The dominant color is the most frequently used color that is
+// neither too dark, too light nor too grey to be distinctive;
+// if there is no such color, the most frequently used color is
+// chosen instead.
+func iconAppearance(r io.Reader) (*mongodoc.Appearance, error) {
+	dec := xml.NewDecoder(r)
+	dec.DefaultSpace = svgNamespace
+	counts := make(map[string]int)
+	found := false
+	hidden := 0
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errgo.Notef(err, "cannot parse icon")
+		}
+		if hidden > 0 {
+			// Colors inside clip paths and masks are never shown.
+			switch tok.(type) {
+			case xml.StartElement:
+				hidden++
+			case xml.EndElement:
+				hidden--
+			}
+			continue
+		}
+		elem, ok := tok.(xml.StartElement)
+		if !ok || elem.Name.Space != svgNamespace {
+			continue
+		}
+		switch elem.Name.Local {
+		case "svg":
+			found = true
+		case "clipPath", "mask":
+			hidden = 1
+			continue
+		}
+		for _, attr := range elem.Attr {
+			if attr.Name.Space != "" {
+				continue
+			}
+			if attr.Name.Local == "style" {
+				for _, decl := range strings.Split(attr.Value, ";") {
+					if i := strings.Index(decl, ":"); i != -1 {
+						countColor(counts, strings.TrimSpace(decl[:i]), decl[i+1:])
+					}
+				}
+				continue
+			}
+			countColor(counts, attr.Name.Local, attr.Value)
+		}
+	}
+	if !found {
+		return nil, errgo.New("no <svg> element found")
+	}
+	colors := make([]string, 0, len(counts))
+	for color := range counts {
+		colors = append(colors, color)
+	}
+	sort.Sort(colorsByCount{colors, counts})
+	appearance := &mongodoc.Appearance{}
+	if len(colors) == 0 {
+		return appearance, nil
+	}
+	// Move the dominant color to the front of the palette.
+	for i, color := range colors {
+		if isDistinctive(color) {
+			copy(colors[1:i+1], colors[0:i])
+			colors[0] = color
+			break
+		}
+	}
+	appearance.Color = colors[0]
+	if len(colors) > maxPaletteSize {
+		colors = colors[0:maxPaletteSize]
+	}
+	appearance.Palette = colors
+	return appearance, nil
+}
+
+// countColor increments the count of the color
+// specified by the given SVG property, if any.
+func countColor(counts map[string]int, property, value string) {
+	switch property {
+	case "fill", "stroke", "stop-color":
+	default:
+		return
+	}
+	if color, ok := parseColor(value); ok {
+		counts[color]++
+	}
+}
+
+// namedColors holds the basic CSS color keywords.
+var namedColors = map[string]string{
+	"aqua":    "#00ffff",
+	"black":   "#000000",
+	"blue":    "#0000ff",
+	"fuchsia": "#ff00ff",
+	"gray":    "#808080",
+	"green":   "#008000",
+	"grey":    "#808080",
+	"lime":    "#00ff00",
+	"maroon":  "#800000",
+	"navy":    "#000080",
+	"olive":   "#808000",
+	"orange":  "#ffa500",
+	"purple":  "#800080",
+	"red":     "#ff0000",
+	"silver":  "#c0c0c0",
+	"teal":    "#008080",
+	"white":   "#ffffff",
+	"yellow":  "#ffff00",
+}
+
+// parseColor parses an SVG color value and returns it in "#rrggbb"
+// form. It reports whether the value holds a color; values such as
+// "none" or references to gradients do not.
+func parseColor(value string) (string, bool) {
+	value = strings.ToLower(strings.TrimSpace(value))
+	if color, ok := namedColors[value]; ok {
+		return color, true
+	}
+	if strings.HasPrefix(value, "#") {
+		hex := value[1:]
+		if len(hex) == 3 {
+			hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+		}
+		if len(hex) != 6 {
+			return "", false
+		}
+		if _, err := strconv.ParseUint(hex, 16, 32); err != nil {
+			return "", false
+		}
+		return "#" + hex, true
+	}
+	if strings.HasPrefix(value, "rgb(") && strings.HasSuffix(value, ")") {
+		parts := strings.Split(value[len("rgb("):len(value)-1], ",")
+		if len(parts) != 3 {
+			return "", false
+		}
+		var rgb [3]uint64
+		for i, part := range parts {
+			n, err := strconv.ParseUint(strings.TrimSpace(part), 10, 8)
+			if err != nil {
+				return "", false
+			}
+			rgb[i] = n
+		}
+		return fmt.Sprintf("#%02x%02x%02x", rgb[0], rgb[1], rgb[2]), true
+	}
+	return "", false
+}
+
+// isDistinctive reports whether the given color, in "#rrggbb"
+// form, is saturated enough and neither too dark nor too light
+// to identify a charm.
+func isDistinctive(color string) bool {
+	rgb, err := strconv.ParseUint(color[1:], 16, 32)
+	if err != nil {
+		return false
+	}
+	r, g, b := int(rgb>>16), int(rgb>>8&0xff), int(rgb&0xff)
+	max, min := r, r
+	for _, c := range []int{g, b} {
+		if c > max {
+			max = c
+		}
+		if c < min {
+			min = c
+		}
+	}
+	if max < 0x30 || min > 0xe0 {
+		return false
+	}
+	// The saturation must be at least 20%.
+	return (max-min)*5 >= max
+}
+
+// colorsByCount sorts colors by decreasing count,
+// and then by name so that the order is stable.
+type colorsByCount struct {
+	colors []string
+	counts map[string]int
+}
+
+func (s colorsByCount) Len() int {
+	return len(s.colors)
+}
+
+func (s colorsByCount) Swap(i, j int) {
+	s.colors[i], s.colors[j] = s.colors[j], s.colors[i]
+}
+
+func (s colorsByCount) Less(i, j int) bool {
+	ci, cj := s.counts[s.colors[i]], s.counts[s.colors[j]]
+	if ci != cj {
+		return ci > cj
+	}
+	return s.colors[i] < s.colors[j]
+}
@@ -0,0 +1,124 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/v4"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+var iconAppearanceTests = []struct {
+	about            string
+	icon             string
+	expectAppearance *mongodoc.Appearance
+	expectError      string
+}{{
+	about: "fill attributes",
+	icon:  `<svg xmlns="http://www.w3.org/2000/svg"><rect fill="#0080ff"/><rect fill="#0080FF"/><rect fill="#f00"/></svg>`,
+	expectAppearance: &mongodoc.Appearance{
+		Color:   "#0080ff",
+		Palette: []string{"#0080ff", "#ff0000"},
+	},
+}, {
+	about: "style properties",
+	icon:  `<svg xmlns="http://www.w3.org/2000/svg"><rect style="fill: rgb(0, 128, 255); stroke:none"/><stop style="stop-color:teal"/><stop style="stop-color:teal"/></svg>`,
+	expectAppearance: &mongodoc.Appearance{
+		Color:   "#008080",
+		Palette: []string{"#008080", "#0080ff"},
+	},
+}, {
+	about: "neutral colors are not dominant",
+	icon:  `<svg xmlns="http://www.w3.org/2000/svg"><rect fill="white"/><rect fill="white"/><rect stroke="#333"/><rect stroke="#333"/><rect fill="#dd4814"/></svg>`,
+	expectAppearance: &mongodoc.Appearance{
+		Color:   "#dd4814",
+		Palette: []string{"#dd4814", "#333333", "#ffffff"},
+	},
+}, {
+	about: "only neutral colors",
+	icon:  `<svg xmlns="http://www.w3.org/2000/svg"><rect fill="white"/><rect fill="#333"/><rect fill="#333"/></svg>`,
+	expectAppearance: &mongodoc.Appearance{
+		Color:   "#333333",
+		Palette: []string{"#333333", "#ffffff"},
+	},
+}, {
+	about: "clip paths and masks are ignored",
+	icon:  `<svg xmlns="http://www.w3.org/2000/svg"><clipPath><rect fill="#00ffff"/><rect fill="#00ffff"/></clipPath><mask><rect fill="#ff00ff"/></mask><rect fill="#0080ff"/></svg>`,
+	expectAppearance: &mongodoc.Appearance{
+		Color:   "#0080ff",
+		Palette: []string{"#0080ff"},
+	},
+}, {
+	about: "palette is limited",
+	icon:  `<svg xmlns="http://www.w3.org/2000/svg"><g fill="#111"/><g fill="#222"/><g fill="#333"/><g fill="#444"/><g fill="#555"/><g fill="#666"/><g fill="#0080ff"/></svg>`,
+	expectAppearance: &mongodoc.Appearance{
+		Color:   "#0080ff",
+		Palette: []string{"#0080ff", "#111111", "#222222", "#333333", "#444444"},
+	},
+}, {
+	about:            "values that are not colors are ignored",
+	icon:             `<svg xmlns="http://www.w3.org/2000/svg"><rect fill="none"/><rect fill="url(#gradient)"/><rect fill="#12"/><rect fill="rgb(1,2)"/></svg>`,
+	expectAppearance: &mongodoc.Appearance{},
+}, {
+	about:       "no svg element",
+	icon:        `<foo/>`,
+	expectError: `no <svg> element found`,
+}, {
+	about:       "not XML",
+	icon:        `<svg`,
+	expectError: `cannot parse icon: .*`,
+}}
+
+func (s *APISuite) TestIconAppearance(c *gc.C) {
+	for i, test := range iconAppearanceTests {
+		c.Logf("test %d: %s", i, test.about)
+		appearance, err := v4.IconAppearance(strings.NewReader(test.icon))
+		if test.expectError != "" {
+			c.Assert(err, gc.ErrorMatches, test.expectError)
+			continue
+		}
+		c.Assert(err, gc.IsNil)
+		c.Assert(appearance, jc.DeepEquals, test.expectAppearance)
+	}
+}
+
+func (s *APISuite) TestMetaAppearance(c *gc.C) {
+	icon := `<svg xmlns="http://www.w3.org/2000/svg"><rect fill="#0080ff"/><rect fill="white"/><rect fill="white"/></svg>`
+	url := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(url, charmWithExtraFile(c, "wordpress", "icon.svg", icon))
+	c.Assert(err, gc.IsNil)
+	err = s.store.SetPerms(&url.URL, "read", params.Everyone, url.URL.User)
+	c.Assert(err, gc.IsNil)
+
+	s.assertGet(c, "~charmers/precise/wordpress-0/meta/color", params.ColorResponse{
+		Color: "#0080ff",
+	})
+	s.assertGet(c, "~charmers/precise/wordpress-0/meta/appearance", params.AppearanceResponse{
+		Color:   "#0080ff",
+		Palette: []string{"#0080ff", "#ffffff"},
+	})
+
+	// The entity was not added through the API, so it has no
+	// saved appearance, and getting the appearance does not
+	// modify it.
+	entity, err := s.store.FindEntity(url, "appearance", "modifications")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Appearance, gc.IsNil)
+	c.Assert(entity.Modifications, gc.Equals, 0)
+
+	// A non-XML icon is shown as the default icon.
+	url = newResolvedURL("~charmers/precise/wordpress-1", -1)
+	err = s.store.AddCharmWithArchive(url, charmWithExtraFile(c, "wordpress", "icon.svg", "bad icon"))
+	c.Assert(err, gc.IsNil)
+	s.assertGet(c, "~charmers/precise/wordpress-1/meta/appearance", params.AppearanceResponse{
+		Color:       "#dd4814",
+		Palette:     []string{"#dd4814", "#ffffff", "#505050", "#646464", "#b8b8b8"},
+		DefaultIcon: true,
+	})
+}
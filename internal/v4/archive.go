@@ -6,11 +6,14 @@ package v4
 import (
 	"archive/zip"
 	"crypto/sha256"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"mime"
 	"net/http"
+	"os"
 	"path"
 	"path/filepath"
 	"sort"
@@ -24,8 +27,10 @@ import (
 	"gopkg.in/mgo.v2"
 	"gopkg.in/mgo.v2/bson"
 
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
 	"gopkg.in/juju/charmstore.v4/internal/charmstore"
 	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/policy"
 	"gopkg.in/juju/charmstore.v4/internal/router"
 	"gopkg.in/juju/charmstore.v4/params"
 )
@@ -33,13 +38,16 @@ import (
 // GET id/archive
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idarchive
 //
-// POST id/archive?hash=sha384hash
+// POST id/archive?hash=sha384hash[&upload=upload-id]
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idarchive
+//
+// POST id/archive?dry-run=1[&hash=sha384hash][&upload=upload-id]
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idarchive
 //
 // DELETE id/archive
 // https://github.com/juju/charmstore/blob/v4/docs/API.md#delete-idarchive
 //
-// PUT id/archive?hash=sha384hash
+// PUT id/archive?hash=sha384hash[&upload=upload-id]
 // This is like POST except that it puts the archive to a known revision
 // rather than choosing a new one. As this feature is to support legacy
 // ingestion methods, and will be removed in the future, it has no entry
@@ -55,6 +63,13 @@ func (h *Handler) serveArchive(id *charm.Reference, w http.ResponseWriter, req *
 			return errgo.Mask(err, errgo.Any)
 		}
 		if req.Method == "POST" {
+			dryRun, err := router.ParseBool(req.Form.Get("dry-run"))
+			if err != nil {
+				return badRequestf(err, "invalid dry-run value")
+			}
+			if dryRun {
+				return h.serveValidateArchive(id, w, req)
+			}
 			return h.servePostArchive(id, w, req)
 		}
 		return h.servePutArchive(id, w, req)
@@ -92,15 +107,25 @@ func (h *Handler) authorizeUpload(id *charm.Reference, req *http.Request) error
 func (h *Handler) serveGetArchive(id *router.ResolvedURL, fullySpecified bool, w http.ResponseWriter, req *http.Request) error {
 	store := h.pool.Store()
 	defer store.Close()
-	r, size, hash, err := store.OpenBlob(id)
+	entity, err := store.FindEntity(id, "deprecation", "blobhash", "uploadtime")
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-	defer r.Close()
 	header := w.Header()
 	setArchiveCacheControl(w.Header(), fullySpecified)
-	header.Set(params.ContentHashHeader, hash)
+	header.Set(params.ContentHashHeader, entity.BlobHash)
 	header.Set(params.EntityIdHeader, id.String())
+	// Yanked revisions can still be downloaded by deployments
+	// that are pinned to them, but they are warned.
+	setDeprecationWarning(header, id, entity.Deprecation)
+	if router.CheckNotModified(w, req, archiveETag(entity), entity.UploadTime) {
+		return nil
+	}
+	r, size, _, err := store.OpenBlob(id)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	defer r.Close()
 
 	if StatsEnabled(req) {
 		store.IncrementDownloadCountsAsync(id)
@@ -114,20 +139,91 @@ func (h *Handler) serveGetArchive(id *router.ResolvedURL, fullySpecified bool, w
 func (h *Handler) serveDeleteArchive(id *router.ResolvedURL, fullySpecified bool, w http.ResponseWriter, req *http.Request) error {
 	store := h.pool.Store()
 	defer store.Close()
-	// Retrieve the entity blob name from the database.
-	blobName, _, err := store.BlobNameAndHash(id)
+	// The entity is kept for a while so that it can be restored;
+	// its archive blob is removed when it is purged or expires.
+	if err := store.DeleteEntity(id); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	store.IncCounterAsync(charmstore.EntityStatsKey(&id.URL, params.StatsArchiveDelete))
+	return nil
+}
+
+// POST id/restore
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idrestore
+func (h *Handler) serveRestore(id *charm.Reference, w http.ResponseWriter, req *http.Request) error {
+	if err := h.authorizeDeleted(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	if _, err := store.RestoreEntity(id); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrDuplicateUpload))
+	}
+	return nil
+}
+
+// POST id/purge
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idpurge
+func (h *Handler) servePurge(id *charm.Reference, w http.ResponseWriter, req *http.Request) error {
+	if err := h.authorizeDeleted(id, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	if err := store.PurgeEntity(id); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
+// DELETE id
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#delete-id
+func (h *Handler) serveBaseEntity(id *charm.Reference, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "DELETE" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	if id.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	if id.Series != "" || id.Revision != -1 {
+		return badRequestf(nil, "base entity id %q must not specify a series or revision", id)
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	baseEntity, err := store.FindBaseEntity(id, "acls")
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
 	}
-	// Remove the entity.
-	if err := store.DB.Entities().RemoveId(&id.URL); err != nil {
-		return errgo.Notef(err, "cannot remove %s", id)
+	if err := h.authorizeWithPerms(req, baseEntity.ACLs.Read, baseEntity.ACLs.Write, nil); err != nil {
+		return errgo.Mask(err, errgo.Any)
 	}
-	// Remove the reference to the archive from the blob store.
-	if err := store.BlobStore.Remove(blobName); err != nil {
-		return errgo.Notef(err, "cannot remove blob %s", blobName)
+	result, err := store.RemoveBaseEntity(id)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot remove base entity", errgo.Is(params.ErrNotFound))
+	}
+	return jsonhttp.WriteJSON(w, http.StatusOK, params.BaseEntityDeleteResponse{
+		Entities:      result.Entities,
+		Blobs:         result.Blobs,
+		SearchRecords: result.SearchRecords,
+		Counters:      result.Counters,
+		Errors:        result.Errors,
+	})
+}
+
+// authorizeDeleted checks that the given request to act on the
+// deleted entity with the given id has been made by an admin.
+// Deleted entities cannot be resolved, so the id must be fully
+// specified.
+func (h *Handler) authorizeDeleted(id *charm.Reference, req *http.Request) error {
+	if _, err := h.authorize(req, nil, true, nil); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	if !isFullySpecified(id) {
+		return badRequestf(nil, "entity id %q is not fully specified", id)
 	}
-	store.IncCounterAsync(charmstore.EntityStatsKey(&id.URL, params.StatsArchiveDelete))
 	return nil
 }
 
@@ -137,6 +233,11 @@ func (h *Handler) updateStatsArchiveUpload(id *charm.Reference, err *error) {
 	// Upload stats don't include revision: it is assumed that each
 	// entity revision is only uploaded once.
 	id.Revision = -1
+	if *err != nil && isContentError(errgo.Cause(*err)) {
+		// The client has not yet tried to upload
+		// the archive content.
+		return
+	}
 	kind := params.StatsArchiveUpload
 	if *err != nil {
 		kind = params.StatsArchiveFailedUpload
@@ -160,8 +261,18 @@ func (h *Handler) servePostArchive(id *charm.Reference, w http.ResponseWriter, r
 	if hash == "" {
 		return badRequestf(nil, "hash parameter not specified")
 	}
-	if req.ContentLength == -1 {
-		return badRequestf(nil, "Content-Length not specified")
+	info, err := uploadInfoFromRequest(req)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	body, size, upload, err := h.uploadBody(store, req, &info)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if body != nil {
+		defer body.Close()
 	}
 
 	oldId, oldHash, err := h.latestRevisionInfo(id)
@@ -170,11 +281,23 @@ func (h *Handler) servePostArchive(id *charm.Reference, w http.ResponseWriter, r
 	}
 	if oldHash == hash {
 		// The hash matches the hash of the latest revision, so
-		// no need to upload anything.
+		// no need to upload anything, but the rest of the upload
+		// is applied to the latest revision instead.
+		oldRid := &router.ResolvedURL{
+			URL:                 *oldId,
+			PromulgatedRevision: -1,
+		}
+		if err := h.applyUploadInfo(oldRid, info, req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		removeCommittedUpload(store, upload)
 		return jsonhttp.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
 			Id: oldId,
 		})
 	}
+	if err := h.checkQuota(store, id.User, size, upload); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrQuotaExceeded))
+	}
 	rid := &router.ResolvedURL{
 		URL: *id,
 	}
@@ -184,20 +307,99 @@ func (h *Handler) servePostArchive(id *charm.Reference, w http.ResponseWriter, r
 	} else {
 		rid.URL.Revision = oldId.Revision + 1
 	}
+	// Revisions of deleted entities are not reused so that
+	// the deleted entities can still be restored.
+	deletedRev, err := store.MaxDeletedRevision(id)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if deletedRev >= rid.URL.Revision {
+		rid.URL.Revision = deletedRev + 1
+	}
 	rid.PromulgatedRevision, err = h.getNewPromulgatedRevision(id)
 	if err != nil {
 		return errgo.Mask(err)
 	}
 
-	if err := h.addBlobAndEntity(rid, req.Body, hash, req.ContentLength); err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
+	if err := h.addArchiveWithMetadata(rid, body, hash, size, info, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
 	}
+	removeCommittedUpload(store, upload)
 	return jsonhttp.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
 		Id:            &rid.URL,
 		PromulgatedId: rid.PromulgatedURL(),
 	})
 }
 
+// serveValidateArchive checks the archive in the request as if it were
+// being uploaded, without adding anything to the store, and responds
+// with all the problems found.
+func (h *Handler) serveValidateArchive(id *charm.Reference, w http.ResponseWriter, req *http.Request) error {
+	if id.Series == "" {
+		return badRequestf(nil, "series not specified")
+	}
+	if id.Revision != -1 {
+		return badRequestf(nil, "revision specified, but should not be specified")
+	}
+	if id.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	body, size, upload, err := h.archiveBody(store, req)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if body == nil {
+		return badRequestf(nil, "archive content not provided")
+	}
+	defer body.Close()
+	// The upload is of no further use once it has been validated.
+	defer removeCommittedUpload(store, upload)
+
+	// The archive must be read at random, so keep
+	// a copy of it while it is being checked.
+	f, err := ioutil.TempFile("", "charmstore-archive")
+	if err != nil {
+		return errgo.Notef(err, "cannot create temporary file")
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	hash384 := blobstore.NewHash()
+	n, err := io.Copy(io.MultiWriter(f, hash384), io.LimitReader(body, size+1))
+	if err != nil {
+		return errgo.Notef(err, "cannot read archive")
+	}
+	if n != size {
+		return badRequestf(nil, "archive size mismatch (got %d bytes, expected %d)", n, size)
+	}
+	if hash := req.Form.Get("hash"); hash != "" && fmt.Sprintf("%x", hash384.Sum(nil)) != hash {
+		return badRequestf(nil, "archive does not match hash")
+	}
+
+	var problems []error
+	if err := h.checkQuota(store, id.User, size, nil); err != nil {
+		if errgo.Cause(err) != params.ErrQuotaExceeded {
+			return errgo.Mask(err)
+		}
+		problems = append(problems, err)
+	}
+	rid := &router.ResolvedURL{
+		URL:                 *id,
+		PromulgatedRevision: -1,
+	}
+	_, _, archiveProblems, err := h.checkArchive(rid, f, size)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	problems = append(problems, archiveProblems...)
+	var resp params.ArchiveValidateResponse
+	for _, problem := range problems {
+		resp.Problems = append(resp.Problems, router.ErrorResponseBody(problem))
+	}
+	return jsonhttp.WriteJSON(w, http.StatusOK, &resp)
+}
+
 func (h *Handler) servePutArchive(id *charm.Reference, w http.ResponseWriter, req *http.Request) (err error) {
 	defer h.updateStatsArchiveUpload(id, &err)
 	if id.Series == "" {
@@ -213,8 +415,21 @@ func (h *Handler) servePutArchive(id *charm.Reference, w http.ResponseWriter, re
 	if hash == "" {
 		return badRequestf(nil, "hash parameter not specified")
 	}
-	if req.ContentLength == -1 {
-		return badRequestf(nil, "Content-Length not specified")
+	info, err := uploadInfoFromRequest(req)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	body, size, upload, err := h.uploadBody(store, req, &info)
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if body != nil {
+		defer body.Close()
+	}
+	if err := h.checkQuota(store, id.User, size, upload); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrQuotaExceeded))
 	}
 	rid := &router.ResolvedURL{
 		URL:                 *id,
@@ -245,9 +460,10 @@ func (h *Handler) servePutArchive(id *charm.Reference, w http.ResponseWriter, re
 		}
 		rid.PromulgatedRevision = pid.Revision
 	}
-	if err := h.addBlobAndEntity(rid, req.Body, hash, req.ContentLength); err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
+	if err := h.addArchiveWithMetadata(rid, body, hash, size, info, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
 	}
+	removeCommittedUpload(store, upload)
 	return jsonhttp.WriteJSON(w, http.StatusOK, &params.ArchiveUploadResponse{
 		Id:            id,
 		PromulgatedId: rid.PromulgatedURL(),
@@ -255,11 +471,258 @@ func (h *Handler) servePutArchive(id *charm.Reference, w http.ResponseWriter, re
 	return nil
 }
 
+// uploadInfo holds information about an uploaded
+// entity that is not held in its archive.
+type uploadInfo struct {
+	// releaseNotes holds the release notes of the entity.
+	releaseNotes string
+
+	// signatureUser and signature optionally hold a detached
+	// signature of the archive and the user that made it.
+	signatureUser string
+	signature     []byte
+
+	// meta holds metadata to be put to the entity once it
+	// has been added, keyed by metadata endpoint name.
+	meta map[string]*json.RawMessage
+}
+
+// uploadInfoFromRequest returns the information about the
+// entity uploaded in the given request.
+func uploadInfoFromRequest(req *http.Request) (uploadInfo, error) {
+	notes := req.Form.Get("release-notes")
+	if err := checkReleaseNotes(notes); err != nil {
+		return uploadInfo{}, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	info := uploadInfo{
+		releaseNotes:  notes,
+		signatureUser: req.Form.Get("signature-user"),
+	}
+	if sig := req.Form.Get("signature"); sig != "" {
+		var err error
+		info.signature, err = base64.StdEncoding.DecodeString(sig)
+		if err != nil {
+			return uploadInfo{}, badRequestf(err, "invalid signature")
+		}
+		if info.signatureUser == "" {
+			return uploadInfo{}, badRequestf(nil, "signature-user not specified")
+		}
+	}
+	return info, nil
+}
+
+// applyUploadInfo applies the upload information in info to the
+// existing entity with the given id. It is used when an uploaded
+// archive is the same as the archive of that entity, so that no part
+// of the upload is ignored.
+func (h *Handler) applyUploadInfo(id *router.ResolvedURL, info uploadInfo, req *http.Request) error {
+	meta := make(map[string]*json.RawMessage)
+	if info.releaseNotes != "" {
+		data, err := json.Marshal(info.releaseNotes)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		notes := json.RawMessage(data)
+		meta["release-notes"] = &notes
+	}
+	// As for a new revision, any release notes
+	// in the metadata take precedence.
+	for name, val := range info.meta {
+		meta[name] = val
+	}
+	var prepared *router.PreparedMetadata
+	if len(meta) > 0 {
+		var err error
+		prepared, err = h.Router.PrepareMetadata(id, meta, req)
+		if err != nil {
+			return errgo.NoteMask(err, "cannot put metadata", errgo.Any)
+		}
+	}
+	if info.signature != nil {
+		store := h.pool.Store()
+		defer store.Close()
+		if _, err := store.AddSignature(id, info.signatureUser, info.signature); err != nil {
+			return errgo.NoteMask(err, "cannot verify signature", errgo.Is(params.ErrBadRequest))
+		}
+	}
+	if prepared != nil {
+		if err := prepared.Apply(); err != nil {
+			return errgo.NoteMask(err, "cannot put metadata", errgo.Any)
+		}
+	}
+	return nil
+}
+
+// addArchive adds the archive with the given hash and size to the
+// store, associating it with the given id and upload information.
+// If body is nil, the content is not sent by the client; instead,
+// the content must already be held by the blob store and the client
+// must prove that it also holds the content by answering a content
+// challenge.
+func (h *Handler) addArchive(id *router.ResolvedURL, body io.Reader, hash string, size int64, info uploadInfo, req *http.Request) error {
+	if body != nil {
+		return h.addBlobAndEntity(id, body, hash, size, info)
+	}
+	var proof *blobstore.ContentChallengeResponse
+	if requestId := req.Form.Get("challenge-id"); requestId != "" {
+		proof = &blobstore.ContentChallengeResponse{
+			RequestId: requestId,
+			Hash:      req.Form.Get("challenge-hash"),
+		}
+	}
+	return h.addEntityWithProof(id, hash, size, info, proof)
+}
+
+// addEntityWithProof adds an entity record for the archive with the
+// given hash and size without reading the archive content from the
+// client. If the proof is nil, the blob store is asked for a content
+// challenge, which is returned as a contentChallengeError; otherwise
+// the proof is used to answer a challenge previously returned.
+//
+// If the blob store does not already hold the content, a
+// contentRequiredError is returned.
+func (h *Handler) addEntityWithProof(id *router.ResolvedURL, hash string, size int64, info uploadInfo, proof *blobstore.ContentChallengeResponse) (err error) {
+	store := h.pool.Store()
+	defer store.Close()
+	name := bson.NewObjectId().Hex()
+	if proof != nil {
+		// The name of the blob is chosen when the challenge
+		// is made and kept with it, so that a client cannot
+		// choose the blob that its answer applies to.
+		chal, err := store.TakeContentChallenge(proof.RequestId)
+		if errgo.Cause(err) == params.ErrNotFound {
+			return badRequestf(nil, "invalid challenge-id %q", proof.RequestId)
+		}
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		if chal.Hash != hash || chal.Size != size {
+			return badRequestf(nil, "challenge-id %q does not match the archive", proof.RequestId)
+		}
+		name = chal.BlobName
+		proof = &blobstore.ContentChallengeResponse{
+			RequestId: chal.RequestId,
+			Hash:      proof.Hash,
+		}
+	}
+	var body noContentReader
+	chal, err := store.BlobStore.Put(&body, name, size, hash, proof)
+	if body.read {
+		// The blob store does not hold the content (or no longer
+		// holds the content that was challenged), so the client
+		// must send it.
+		return contentRequiredError{}
+	}
+	if err != nil {
+		return errgo.Notef(err, "cannot put archive blob")
+	}
+	if chal != nil {
+		chalId, err := store.AddContentChallenge(name, chal.RequestId, hash, size)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		return contentChallengeError{&params.ContentChallenge{
+			RequestId:   chalId,
+			RangeStart:  chal.RangeStart,
+			RangeLength: chal.RangeLength,
+		}}
+	}
+	// The blob has just been created by the Put above, under a
+	// name that only this call knows, so it can safely be removed
+	// if the entity cannot be added.
+	defer func() {
+		if err != nil {
+			if err := store.BlobStore.Remove(name); err != nil {
+				logger.Errorf("cannot remove blob %q after failed upload: %v", name, err)
+			}
+		}
+	}()
+	r, _, err := store.BlobStore.Open(name)
+	if err != nil {
+		return errgo.Notef(err, "cannot open newly created blob")
+	}
+	defer r.Close()
+	// Check the content of the blob, calculating the SHA256 hash
+	// at the same time, so that we can be sure that the
+	// entity refers to the content that the client claims.
+	hash384 := blobstore.NewHash()
+	hash256 := sha256.New()
+	n, err := io.Copy(io.MultiWriter(hash384, hash256), r)
+	if err != nil {
+		return errgo.Notef(err, "cannot read archive blob")
+	}
+	if n != size || fmt.Sprintf("%x", hash384.Sum(nil)) != hash {
+		return errgo.New("archive blob does not match hash")
+	}
+	if _, err := r.Seek(0, 0); err != nil {
+		return errgo.Notef(err, "cannot seek archive blob")
+	}
+	sum256 := fmt.Sprintf("%x", hash256.Sum(nil))
+	if err := h.addEntity(id, r, name, hash, sum256, size, info); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrBadRequest), isProblemError)
+	}
+	return nil
+}
+
+// noContentReader is used as the content when an archive is
+// uploaded without content. It records any attempt to read it.
+type noContentReader struct {
+	read bool
+}
+
+// Read implements io.Reader.
+func (r *noContentReader) Read([]byte) (int, error) {
+	r.read = true
+	return 0, errgo.New("archive content not provided")
+}
+
+// contentChallengeError is returned when the client must
+// prove that it holds the content of an archive.
+type contentChallengeError struct {
+	*params.ContentChallenge
+}
+
+// Error implements error.Error.
+func (contentChallengeError) Error() string {
+	return "proof of content ownership required"
+}
+
+// ErrorCode implements router.errorCoder.
+func (contentChallengeError) ErrorCode() params.ErrorCode {
+	return params.ErrContentChallenge
+}
+
+// contentRequiredError is returned when an archive is
+// uploaded without content but the blob store does not
+// already hold the content.
+type contentRequiredError struct{}
+
+// Error implements error.Error.
+func (contentRequiredError) Error() string {
+	return "archive content not found"
+}
+
+// ErrorCode implements router.errorCoder.
+func (contentRequiredError) ErrorCode() params.ErrorCode {
+	return params.ErrNotFound
+}
+
+// isContentError reports whether the given error is
+// returned when an archive uploaded without content
+// cannot be added until the client responds.
+func isContentError(err error) bool {
+	switch err.(type) {
+	case contentChallengeError, contentRequiredError:
+		return true
+	}
+	return false
+}
+
 // addBlobAndEntity streams the contents of the given body
 // to the blob store and adds an entity record for it.
 // The hash and contentLength parameters hold
 // the content hash and the content length respectively.
-func (h *Handler) addBlobAndEntity(id *router.ResolvedURL, body io.Reader, hash string, contentLength int64) (err error) {
+func (h *Handler) addBlobAndEntity(id *router.ResolvedURL, body io.Reader, hash string, contentLength int64, info uploadInfo) (err error) {
 	name := bson.NewObjectId().Hex()
 
 	// Calculate the SHA256 hash while uploading the blob in the blob store.
@@ -281,84 +744,191 @@ func (h *Handler) addBlobAndEntity(id *router.ResolvedURL, body io.Reader, hash
 	defer r.Close()
 	defer func() {
 		if err != nil {
-			store.BlobStore.Remove(name)
-			// TODO(rog) log if remove fails.
+			if err := store.BlobStore.Remove(name); err != nil {
+				// The blob will be reclaimed by the blob
+				// garbage collector.
+				logger.Errorf("cannot remove blob %q after failed upload: %v", name, err)
+			}
 		}
 	}()
 
 	// Add the entity entry to the charm store.
 	sum256 := fmt.Sprintf("%x", hash256.Sum(nil))
-	if err := h.addEntity(id, r, name, hash, sum256, contentLength); err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
+	if err := h.addEntity(id, r, name, hash, sum256, contentLength, info); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrBadRequest), isProblemError)
 	}
 	return nil
 }
 
 // addEntity adds the entity represented by the contents
-// of the given reader, associating it with the given id.
-func (h *Handler) addEntity(id *router.ResolvedURL, r io.ReadSeeker, blobName, hash, hash256 string, contentLength int64) error {
+// of the given reader, associating it with the given id
+// and upload information.
+func (h *Handler) addEntity(id *router.ResolvedURL, r io.ReadSeeker, blobName, hash, hash256 string, contentLength int64, info uploadInfo) error {
 	store := h.pool.Store()
 	defer store.Close()
-	readerAt := charmstore.ReaderAtSeeker(r)
 	p := charmstore.AddParams{
-		URL:         id,
-		BlobName:    blobName,
-		BlobHash:    hash,
-		BlobHash256: hash256,
-		BlobSize:    contentLength,
+		URL:          id,
+		BlobName:     blobName,
+		BlobHash:     hash,
+		BlobHash256:  hash256,
+		BlobSize:     contentLength,
+		ReleaseNotes: info.releaseNotes,
 	}
+	if info.signature != nil {
+		sig, err := store.VerifySignature(info.signatureUser, hash, info.signature)
+		if err != nil {
+			return errgo.NoteMask(err, "cannot verify signature", errgo.Is(params.ErrBadRequest))
+		}
+		p.Signatures = []mongodoc.Signature{*sig}
+	}
+	ch, b, problems, err := h.checkArchive(id, charmstore.ReaderAtSeeker(r), contentLength)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	switch len(problems) {
+	case 0:
+	case 1:
+		return errgo.Mask(problems[0], isPolicyError)
+	default:
+		return archiveProblemsError(problems)
+	}
+	if b != nil {
+		if err := store.AddBundle(b, p); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
+		}
+		return nil
+	}
+	p.Appearance, err = archiveAppearance(id, charmstore.ReaderAtSeeker(r), contentLength)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if err := store.AddCharm(ch, p); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
+	}
+	return nil
+}
+
+// checkArchive reads the charm or bundle held in the archive with the
+// given contents and size, and checks whether it can be added to the
+// store with the given id. It returns either the charm or the bundle,
+// and all the problems found with the archive. An error is returned
+// only if the checks could not be made.
+func (h *Handler) checkArchive(id *router.ResolvedURL, r io.ReaderAt, size int64) (ch *charm.CharmArchive, b *charm.BundleArchive, problems []error, err error) {
 	if id.URL.Series == "bundle" {
-		b, err := charm.ReadBundleArchiveFromReader(readerAt, contentLength)
+		b, err = charm.ReadBundleArchiveFromReader(r, size)
 		if err != nil {
-			return errgo.Notef(err, "cannot read bundle archive")
+			return nil, nil, []error{errgo.Notef(err, "cannot read bundle archive")}, nil
 		}
 		bundleData := b.Data()
 		charms, err := h.bundleCharms(bundleData.RequiredCharms())
 		if err != nil {
-			return errgo.Notef(err, "cannot retrieve bundle charms")
+			return nil, nil, nil, errgo.Notef(err, "cannot retrieve bundle charms")
 		}
 		if err := bundleData.VerifyWithCharms(verifyConstraints, charms); err != nil {
 			// TODO frankban: use multiError (defined in internal/router).
-			return errgo.Notef(verificationError(err), "bundle verification failed")
+			problems = append(problems, errgo.Notef(verificationError(err), "bundle verification failed"))
 		}
-		if err := store.AddBundle(b, p); err != nil {
-			return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
+		if err := h.checkPolicy(id, r, size, nil, b); err != nil {
+			problems = append(problems, err)
 		}
+		return nil, b, problems, nil
+	}
+	ch, err = charm.ReadCharmArchiveFromReader(r, size)
+	if err != nil {
+		return nil, nil, []error{errgo.Notef(err, "cannot read charm archive")}, nil
+	}
+	problems = append(problems, charmProblems(ch)...)
+	if err := h.checkPolicy(id, r, size, ch, nil); err != nil {
+		problems = append(problems, err)
+	}
+	return ch, nil, problems, nil
+}
+
+// checkPolicy checks the archive with the given contents and size,
+// holding either the charm ch or the bundle b, against the content
+// policy of the charm store.
+func (h *Handler) checkPolicy(id *router.ResolvedURL, r io.ReaderAt, size int64, ch charm.Charm, b charm.Bundle) error {
+	if h.config.Policy == nil {
 		return nil
 	}
-	ch, err := charm.ReadCharmArchiveFromReader(readerAt, contentLength)
+	zipReader, err := zip.NewReader(r, size)
 	if err != nil {
-		return errgo.Notef(err, "cannot read charm archive")
+		return errgo.Notef(err, "cannot read archive")
 	}
-	if err := checkCharmIsValid(ch); err != nil {
-		return errgo.Mask(err)
+	return h.config.Policy.Check(&policy.Archive{
+		Id:     &id.URL,
+		Size:   size,
+		Files:  zipReader.File,
+		Charm:  ch,
+		Bundle: b,
+	})
+}
+
+// isPolicyError reports whether the given error is returned
+// when an archive violates the content policy.
+func isPolicyError(err error) bool {
+	_, ok := err.(policy.Error)
+	return ok
+}
+
+// archiveProblemsError is returned when an uploaded
+// archive has more than one problem.
+type archiveProblemsError []error
+
+// Error implements error.Error.
+func (err archiveProblemsError) Error() string {
+	messages := make([]string, len(err))
+	for i, problem := range err {
+		messages[i] = problem.Error()
 	}
-	if err := store.AddCharm(ch, p); err != nil {
-		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload))
+	return fmt.Sprintf("multiple (%d) problems with archive: %s", len(err), strings.Join(messages, "; "))
+}
+
+// ErrorCode implements router.errorCoder.
+func (archiveProblemsError) ErrorCode() params.ErrorCode {
+	return params.ErrMultipleErrors
+}
+
+// ErrorInfo implements router.errorInfoer by returning
+// each problem keyed by its position in the list.
+func (err archiveProblemsError) ErrorInfo() map[string]*params.Error {
+	info := make(map[string]*params.Error)
+	for i, problem := range err {
+		info[strconv.Itoa(i)] = router.ErrorResponseBody(problem)
 	}
-	return nil
+	return info
+}
+
+// isProblemError reports whether the given error is
+// returned when an archive cannot be added because
+// of problems found with its content.
+func isProblemError(err error) bool {
+	_, ok := err.(archiveProblemsError)
+	return ok || isPolicyError(err)
 }
 
-func checkCharmIsValid(ch charm.Charm) error {
+// charmProblems returns all the problems
+// found with the metadata of the given charm.
+func charmProblems(ch charm.Charm) []error {
+	var problems []error
 	m := ch.Meta()
 	for _, rels := range []map[string]charm.Relation{m.Provides, m.Requires, m.Peers} {
-		if err := checkRelationsAreValid(rels); err != nil {
-			return errgo.Mask(err)
-		}
+		problems = append(problems, relationProblems(rels)...)
 	}
-	return nil
+	return problems
 }
 
-func checkRelationsAreValid(rels map[string]charm.Relation) error {
+func relationProblems(rels map[string]charm.Relation) []error {
+	var problems []error
 	for _, rel := range rels {
 		if rel.Name == "relation-name" {
-			return errgo.Newf("relation %s has almost certainly not been changed from the template", rel.Name)
+			problems = append(problems, errgo.Newf("relation %s has almost certainly not been changed from the template", rel.Name))
 		}
 		if rel.Interface == "interface-name" {
-			return errgo.Newf("interface %s in relation %s has almost certainly not been changed from the template", rel.Interface, rel.Name)
+			problems = append(problems, errgo.Newf("interface %s in relation %s has almost certainly not been changed from the template", rel.Interface, rel.Name))
 		}
 	}
-	return nil
+	return problems
 }
 
 func (h *Handler) latestRevisionInfo(id *charm.Reference) (*charm.Reference, string, error) {
@@ -390,6 +960,10 @@ func verifyConstraints(s string) error {
 func (h *Handler) serveArchiveFile(id *router.ResolvedURL, fullySpecified bool, w http.ResponseWriter, req *http.Request) error {
 	store := h.pool.Store()
 	defer store.Close()
+	entity, err := store.FindEntity(id, "blobhash", "uploadtime")
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
 	r, size, _, err := store.OpenBlob(id)
 	if err != nil {
 		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
@@ -411,6 +985,10 @@ func (h *Handler) serveArchiveFile(id *router.ResolvedURL, fullySpecified bool,
 		if fileInfo.IsDir() {
 			return errgo.WithCausef(nil, params.ErrForbidden, "directory listing not allowed")
 		}
+		setArchiveCacheControl(w.Header(), fullySpecified)
+		if router.CheckNotModified(w, req, archiveETag(entity), entity.UploadTime) {
+			return nil
+		}
 		content, err := file.Open()
 		if err != nil {
 			return errgo.Notef(err, "unable to read file %q", filePath)
@@ -422,7 +1000,6 @@ func (h *Handler) serveArchiveFile(id *router.ResolvedURL, fullySpecified bool,
 			w.Header().Set("Content-Type", ctype)
 		}
 		w.Header().Set("Content-Length", strconv.FormatInt(fileInfo.Size(), 10))
-		setArchiveCacheControl(w.Header(), fullySpecified)
 		w.WriteHeader(http.StatusOK)
 		io.Copy(w, content)
 		return nil
@@ -445,7 +1022,7 @@ func (h *Handler) bundleCharms(ids []string) (map[string]charm.Charm, error) {
 			// be returned to the user along with other bundle errors.
 			continue
 		}
-		e, err := store.FindBestEntity(url)
+		e, err := store.FindBestEntity(url, params.UnpublishedChannel)
 		if err != nil {
 			if errgo.Cause(err) == params.ErrNotFound {
 				// Ignore this error too, for the same reasons
@@ -546,6 +1123,13 @@ func setArchiveCacheControl(h http.Header, idFullySpecified bool) {
 	h.Set("Cache-Control", "public, max-age="+strconv.Itoa(seconds))
 }
 
+// archiveETag returns the strong entity tag of the archive of the
+// given entity and of the files within it. Archives are immutable,
+// so the tag is derived from the archive's hash.
+func archiveETag(entity *mongodoc.Entity) string {
+	return `"` + entity.BlobHash + `"`
+}
+
 // getNewPromulgatedRevision returns the promulgated revision
 // to give to a newly uploaded charm with the given id.
 // It returns -1 if the charm is not promulgated.
@@ -564,13 +1148,24 @@ func (h *Handler) getNewPromulgatedRevision(id *charm.Reference) (int, error) {
 		Name:     id.Name,
 		Revision: -1,
 	})
+	deletedRev, err := store.MaxDeletedRevision(&charm.Reference{
+		Series:   id.Series,
+		Name:     id.Name,
+		Revision: -1,
+	})
+	if err != nil {
+		return 0, errgo.Mask(err)
+	}
 	var entity mongodoc.Entity
 	err = query.Sort("-promulgated-revision").Select(bson.D{{"promulgated-revision", 1}}).One(&entity)
 	if err == mgo.ErrNotFound {
-		return 0, nil
+		return deletedRev + 1, nil
 	}
 	if err != nil {
 		return 0, errgo.Mask(err)
 	}
+	if deletedRev > entity.PromulgatedRevision {
+		return deletedRev + 1, nil
+	}
 	return entity.PromulgatedRevision + 1, nil
 }
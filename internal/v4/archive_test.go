@@ -15,6 +15,7 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
@@ -80,6 +81,80 @@ func (s *ArchiveSuite) TestGet(c *gc.C) {
 	assertCacheControl(c, rec.Header(), true)
 }
 
+func (s *ArchiveSuite) TestGetNotModified(c *gc.C) {
+	patchArchiveCacheAges(s)
+	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	wordpress := s.assertUploadCharm(c, "POST", id, "wordpress")
+	err := s.store.SetPerms(&id.URL, "read", params.Everyone, id.URL.User)
+	c.Assert(err, gc.IsNil)
+	archiveBytes, err := ioutil.ReadFile(wordpress.Path)
+	c.Assert(err, gc.IsNil)
+	etag := `"` + hashOfBytes(archiveBytes) + `"`
+
+	for _, path := range []string{"archive", "archive/metadata.yaml"} {
+		c.Logf("path %s", path)
+		url := storeURL("~charmers/precise/wordpress-0/" + path)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     url,
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		c.Assert(rec.Header().Get("ETag"), gc.Equals, etag)
+		lastModified := rec.Header().Get("Last-Modified")
+		_, err := http.ParseTime(lastModified)
+		c.Assert(err, gc.IsNil)
+
+		// A request with a matching tag gets an empty 304 response,
+		// which still carries the cache control headers.
+		rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     url,
+			Header:  http.Header{"If-None-Match": {etag}},
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+		c.Assert(rec.Body.Len(), gc.Equals, 0)
+		c.Assert(rec.Header().Get("ETag"), gc.Equals, etag)
+		assertCacheControl(c, rec.Header(), true)
+
+		// So does a request that is not modified since
+		// the upload time.
+		rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     url,
+			Header:  http.Header{"If-Modified-Since": {lastModified}},
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusNotModified)
+
+		// A request with a different tag gets the content.
+		rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     url,
+			Header:  http.Header{"If-None-Match": {`"other"`}},
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK)
+		c.Assert(rec.Body.Len(), gc.Not(gc.Equals), 0)
+	}
+}
+
+func (s *ArchiveSuite) TestUploadSavesAppearance(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	ch := charmWithExtraFile(c, "wordpress", "icon.svg", `<svg xmlns="http://www.w3.org/2000/svg"><rect fill="#0080ff"/></svg>`)
+	archivePath := filepath.Join(c.MkDir(), "wordpress.zip")
+	f, err := os.Create(archivePath)
+	c.Assert(err, gc.IsNil)
+	err = ch.ArchiveTo(f)
+	f.Close()
+	c.Assert(err, gc.IsNil)
+	s.assertUpload(c, "POST", id, archivePath)
+
+	entity, err := s.store.FindEntity(id, "appearance")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Appearance, jc.DeepEquals, &mongodoc.Appearance{
+		Color:   "#0080ff",
+		Palette: []string{"#0080ff"},
+	})
+}
+
 func (s *ArchiveSuite) TestGetWithPartialId(c *gc.C) {
 	id := newResolvedURL("cs:~charmers/utopic/wordpress-42", -1)
 	err := s.store.AddCharmWithArchive(
@@ -480,6 +555,188 @@ func (s *ArchiveSuite) TestPostHashMismatch(c *gc.C) {
 	})
 }
 
+func (s *ArchiveSuite) TestPostWithContentChallenge(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	wordpress := s.assertUploadCharm(c, "POST", id, "wordpress")
+	archiveBytes, err := ioutil.ReadFile(wordpress.Path)
+	c.Assert(err, gc.IsNil)
+	hash := hashOfBytes(archiveBytes)
+	path := fmt.Sprintf("~bob/precise/wordpress/archive?hash=%s&size=%d", hash, len(archiveBytes))
+
+	// Uploading known content without a body returns a challenge.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL(path),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusConflict, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var perr params.Error
+	err = json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(perr.Code, gc.Equals, params.ErrContentChallenge)
+	c.Assert(perr.Message, gc.Equals, "proof of content ownership required")
+	chal, err := params.ContentChallengeFromError(&perr)
+	c.Assert(err, gc.IsNil)
+
+	// Answering the challenge adds the entity.
+	proof := hashOfBytes(archiveBytes[chal.RangeStart : chal.RangeStart+chal.RangeLength])
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL(path + "&challenge-id=" + chal.RequestId + "&challenge-hash=" + proof),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseReference("cs:~bob/precise/wordpress-0"),
+		},
+	})
+	entity0, err := s.store.FindEntity(id)
+	c.Assert(err, gc.IsNil)
+	entity1, err := s.store.FindEntity(newResolvedURL("~bob/precise/wordpress-0", -1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity1.BlobHash, gc.Equals, entity0.BlobHash)
+	c.Assert(entity1.BlobHash256, gc.Equals, entity0.BlobHash256)
+	c.Assert(entity1.Size, gc.Equals, entity0.Size)
+	c.Assert(entity1.BlobName, gc.Not(gc.Equals), entity0.BlobName)
+
+	// A challenge can be answered only once.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(path + "&challenge-id=" + chal.RequestId + "&challenge-hash=" + proof),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: fmt.Sprintf("invalid challenge-id %q", chal.RequestId),
+		},
+	})
+
+	// The archive can be downloaded from the new entity.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("~bob/precise/wordpress-0/archive"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Body.Bytes(), gc.DeepEquals, archiveBytes)
+}
+
+func (s *ArchiveSuite) TestPostWithContentChallengeForOtherContent(c *gc.C) {
+	id0 := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	wordpress := s.assertUploadCharm(c, "POST", id0, "wordpress")
+	archiveBytes, err := ioutil.ReadFile(wordpress.Path)
+	c.Assert(err, gc.IsNil)
+	hash := hashOfBytes(archiveBytes)
+	id1 := newResolvedURL("~charmers/precise/mysql-0", -1)
+	s.assertUploadCharm(c, "POST", id1, "mysql")
+	entity1, err := s.store.FindEntity(id1)
+	c.Assert(err, gc.IsNil)
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL(fmt.Sprintf("~bob/precise/wordpress/archive?hash=%s&size=%d", hash, len(archiveBytes))),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusConflict, gc.Commentf("body: %s", rec.Body.Bytes()))
+	var perr params.Error
+	err = json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.IsNil)
+	chal, err := params.ContentChallengeFromError(&perr)
+	c.Assert(err, gc.IsNil)
+
+	// The challenge cannot be used for other content, and using
+	// it does not touch the blobs of other entities.
+	proof := hashOfBytes(archiveBytes[chal.RangeStart : chal.RangeStart+chal.RangeLength])
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(fmt.Sprintf("~bob/precise/mysql/archive?hash=%s&size=%d&challenge-id=%s&challenge-hash=%s", entity1.BlobHash, entity1.Size, chal.RequestId, proof)),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: fmt.Sprintf("challenge-id %q does not match the archive", chal.RequestId),
+		},
+	})
+	r, _, err := s.store.BlobStore.Open(entity1.BlobName)
+	c.Assert(err, gc.IsNil)
+	r.Close()
+}
+
+func (s *ArchiveSuite) TestPostWithContentChallengeUnknownContent(c *gc.C) {
+	content := []byte("some content")
+	path := fmt.Sprintf("~charmers/precise/wordpress/archive?hash=%s&size=%d", hashOfBytes(content), len(content))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL(path),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: "archive content not found",
+		},
+	})
+}
+
+var contentChallengeErrorTests = []struct {
+	about         string
+	path          string
+	body          string
+	expectStatus  int
+	expectMessage string
+}{{
+	about:         "invalid size",
+	path:          "~charmers/precise/wordpress/archive?hash=x&size=-1",
+	expectStatus:  http.StatusBadRequest,
+	expectMessage: `invalid size value "-1"`,
+}, {
+	about:         "size with upload",
+	path:          "~charmers/precise/wordpress/archive?hash=x&size=10&upload=foo",
+	expectStatus:  http.StatusBadRequest,
+	expectMessage: "size and upload parameters both specified",
+}, {
+	about:         "size with body",
+	path:          "~charmers/precise/wordpress/archive?hash=x&size=10",
+	body:          "some content",
+	expectStatus:  http.StatusBadRequest,
+	expectMessage: "request body provided with size parameter",
+}, {
+	about:         "invalid challenge id",
+	path:          "~charmers/precise/wordpress/archive?hash=x&size=10&challenge-id=foo&challenge-hash=x",
+	expectStatus:  http.StatusBadRequest,
+	expectMessage: `invalid challenge-id "foo"`,
+}}
+
+func (s *ArchiveSuite) TestContentChallengeErrors(c *gc.C) {
+	for i, test := range contentChallengeErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:       s.srv,
+			URL:           storeURL(test.path),
+			Method:        "POST",
+			Body:          strings.NewReader(test.body),
+			ContentLength: int64(len(test.body)),
+			Username:      testUsername,
+			Password:      testPassword,
+			ExpectStatus:  test.expectStatus,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectMessage,
+			},
+		})
+	}
+}
+
 func invalidZip() io.ReadSeeker {
 	return strings.NewReader("invalid zip content")
 }
@@ -585,6 +842,50 @@ func (s *ArchiveSuite) TestPostInvalidCharmMetadata(c *gc.C) {
 	}
 }
 
+func (s *ArchiveSuite) TestPostCharmWithMultipleProblems(c *gc.C) {
+	ch := charmtesting.NewCharm(c, charmtesting.CharmSpec{
+		Meta: `
+name: foo
+summary: bar
+description: d
+provides:
+    relation-name:
+        interface: interface-name
+`,
+	})
+	r := bytes.NewReader(ch.ArchiveBytes())
+	hash, size := hashOf(r)
+	_, err := r.Seek(0, 0)
+	c.Assert(err, gc.IsNil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL("~charmers/trusty/wordpress/archive?hash=" + hash),
+		Method:        "POST",
+		ContentLength: size,
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:         r,
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusInternalServerError,
+		ExpectBody: params.Error{
+			Code: params.ErrMultipleErrors,
+			Message: "multiple (2) problems with archive: " +
+				"relation relation-name has almost certainly not been changed from the template; " +
+				"interface interface-name in relation relation-name has almost certainly not been changed from the template",
+			Info: map[string]*params.Error{
+				"0": {
+					Message: "relation relation-name has almost certainly not been changed from the template",
+				},
+				"1": {
+					Message: "interface interface-name in relation relation-name has almost certainly not been changed from the template",
+				},
+			},
+		},
+	})
+}
+
 func (s *ArchiveSuite) TestPostInvalidBundleData(c *gc.C) {
 	path := storetesting.Charms.BundleArchivePath(c.MkDir(), "bad")
 	f, err := os.Open(path)
@@ -599,6 +900,127 @@ func (s *ArchiveSuite) TestPostInvalidBundleData(c *gc.C) {
 	s.assertCannotUpload(c, "~charmers/bundle/wordpress", f, expectErr)
 }
 
+func (s *ArchiveSuite) TestPostDryRun(c *gc.C) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	f, err := os.Open(ch.Path)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	s.assertDryRun(c, "~charmers/precise/wordpress", f, nil)
+
+	// Nothing has been added to the store.
+	_, err = s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(err, gc.ErrorMatches, `entity not found`)
+	count, err := s.store.DB.Entities().Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(count, gc.Equals, 0)
+}
+
+func (s *ArchiveSuite) TestPostDryRunInvalidCharmMetadata(c *gc.C) {
+	ch := charmtesting.NewCharm(c, charmtesting.CharmSpec{
+		Meta: `
+name: foo
+summary: bar
+description: d
+provides:
+    relation-name:
+        interface: baz
+requires:
+    baz:
+        interface: interface-name
+`,
+	})
+	s.assertDryRun(c, "~charmers/trusty/foo", bytes.NewReader(ch.ArchiveBytes()), []*params.Error{{
+		Message: "relation relation-name has almost certainly not been changed from the template",
+	}, {
+		Message: "interface interface-name in relation baz has almost certainly not been changed from the template",
+	}})
+}
+
+func (s *ArchiveSuite) TestPostDryRunInvalidBundleData(c *gc.C) {
+	path := storetesting.Charms.BundleArchivePath(c.MkDir(), "bad")
+	f, err := os.Open(path)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	s.assertDryRun(c, "~charmers/bundle/wordpress", f, []*params.Error{{
+		Message: `bundle verification failed: [` +
+			`"relation [\"foo:db\" \"mysql:server\"] refers to service \"foo\" not defined in this bundle",` +
+			`"service \"mysql\" refers to non-existent charm \"mysql\"",` +
+			`"service \"wordpress\" refers to non-existent charm \"wordpress\""]`,
+	}})
+}
+
+func (s *ArchiveSuite) TestPostDryRunInvalidZip(c *gc.C) {
+	s.assertDryRun(c, "~charmers/precise/wordpress", invalidZip(), []*params.Error{{
+		Message: "cannot read charm archive: zip: not a valid zip file",
+	}})
+}
+
+func (s *ArchiveSuite) TestPostDryRunErrors(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/wordpress/archive?dry-run=maybe"),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: `invalid dry-run value: unexpected bool value "maybe" (must be "0" or "1")`,
+			Code:    params.ErrBadRequest,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/wordpress/archive?dry-run=1&size=100"),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: "archive content not provided",
+			Code:    params.ErrBadRequest,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL("~charmers/precise/wordpress/archive?dry-run=1&hash=bad"),
+		Method:        "POST",
+		ContentLength: int64(len("content")),
+		Body:          strings.NewReader("content"),
+		Username:      testUsername,
+		Password:      testPassword,
+		ExpectStatus:  http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Message: "archive does not match hash",
+			Code:    params.ErrBadRequest,
+		},
+	})
+}
+
+// assertDryRun checks that a dry-run upload of the given content
+// to the given id responds with the given problems.
+func (s *ArchiveSuite) assertDryRun(c *gc.C, id string, content io.ReadSeeker, expectProblems []*params.Error) {
+	hash, size := hashOf(content)
+	_, err := content.Seek(0, 0)
+	c.Assert(err, gc.IsNil)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL(fmt.Sprintf("%s/archive?dry-run=1&hash=%s", id, hash)),
+		Method:        "POST",
+		ContentLength: size,
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:         content,
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: params.ArchiveValidateResponse{
+			Problems: expectProblems,
+		},
+	})
+}
+
 func (s *ArchiveSuite) TestPostCounters(c *gc.C) {
 	if !storetesting.MongoJSEnabled() {
 		c.Skip("MongoDB JavaScript not available")
@@ -1045,9 +1467,316 @@ func (s *ArchiveSuite) TestDelete(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(count, gc.Equals, 0)
 
+	// The entity can no longer be resolved.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/mysql/meta/id"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Message: `no matching charm or bundle for "cs:~charmers/mysql"`,
+			Code:    params.ErrNotFound,
+		},
+	})
+
+	// The blob is kept so that the entity can be restored.
+	r, _, err := s.store.BlobStore.Open(entity.BlobName)
+	c.Assert(err, gc.IsNil)
+	r.Close()
+}
+
+func (s *ArchiveSuite) TestRestore(c *gc.C) {
+	id := newResolvedURL("~charmers/utopic/mysql-42", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.Charms.CharmArchive(c.MkDir(), "mysql"))
+	c.Assert(err, gc.IsNil)
+	s.assertDelete(c, "~charmers/utopic/mysql-42")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/utopic/mysql-42/restore"),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~charmers/mysql/meta/id-revision"),
+		ExpectBody: params.IdRevisionResponse{Revision: 42},
+	})
+
+	// The entity is no longer deleted.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/utopic/mysql-42/restore"),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Message: `deleted entity cs:~charmers/utopic/mysql-42 not found`,
+			Code:    params.ErrNotFound,
+		},
+	})
+}
+
+func (s *ArchiveSuite) TestPurge(c *gc.C) {
+	id := newResolvedURL("~charmers/utopic/mysql-42", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.Charms.CharmArchive(c.MkDir(), "mysql"))
+	c.Assert(err, gc.IsNil)
+	blobName, _, err := s.store.BlobNameAndHash(id)
+	c.Assert(err, gc.IsNil)
+	s.assertDelete(c, "~charmers/utopic/mysql-42")
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/utopic/mysql-42/purge"),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+	})
+
 	// The blob has been deleted.
-	_, _, err = s.store.BlobStore.Open(entity.BlobName)
+	_, _, err = s.store.BlobStore.Open(blobName)
 	c.Assert(err, gc.ErrorMatches, "resource.*not found")
+
+	// The entity can no longer be restored.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/utopic/mysql-42/restore"),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Message: `deleted entity cs:~charmers/utopic/mysql-42 not found`,
+			Code:    params.ErrNotFound,
+		},
+	})
+}
+
+var deletedEntityErrorTests = []struct {
+	about        string
+	method       string
+	path         string
+	username     string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "not an admin",
+	method:       "POST",
+	path:         "~charmers/utopic/mysql-42/restore",
+	username:     "bad",
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Message: "invalid user name or password",
+		Code:    params.ErrUnauthorized,
+	},
+}, {
+	about:        "bad method",
+	method:       "GET",
+	path:         "~charmers/utopic/mysql-42/purge",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Message: "GET method not allowed",
+		Code:    params.ErrMethodNotAllowed,
+	},
+}, {
+	about:        "id not fully specified",
+	method:       "POST",
+	path:         "~charmers/mysql/restore",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: `entity id "cs:~charmers/mysql" is not fully specified`,
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "entity not deleted",
+	method:       "POST",
+	path:         "~charmers/utopic/mysql-1/purge",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Message: `deleted entity cs:~charmers/utopic/mysql-1 not found`,
+		Code:    params.ErrNotFound,
+	},
+}}
+
+func (s *ArchiveSuite) TestDeletedEntityErrors(c *gc.C) {
+	for i, test := range deletedEntityErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		username := testUsername
+		if test.username != "" {
+			username = test.username
+		}
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       test.method,
+			Username:     username,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *ArchiveSuite) TestPostDoesNotReuseDeletedRevision(c *gc.C) {
+	id := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	s.assertUploadCharm(c, "POST", id, "wordpress")
+	s.assertDelete(c, "~charmers/precise/wordpress-0")
+
+	// The next upload is given a new revision so that
+	// the deleted entity can still be restored.
+	s.assertUploadCharm(c, "POST", newResolvedURL("~charmers/precise/wordpress-1", -1), "mysql")
+}
+
+func (s *ArchiveSuite) assertDelete(c *gc.C, id string) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL(id + "/archive"),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+	})
+}
+
+func (s *ArchiveSuite) TestDeleteBaseEntity(c *gc.C) {
+	for _, id := range []string{"~charmers/trusty/mysql-42", "~charmers/utopic/mysql-42", "~charmers/utopic/mysql-47", "~bob/utopic/mysql-0"} {
+		err := s.store.AddCharmWithArchive(
+			newResolvedURL(id, -1),
+			storetesting.Charms.CharmArchive(c.MkDir(), "mysql"))
+		c.Assert(err, gc.IsNil)
+	}
+	err := s.store.DeleteEntity(newResolvedURL("~charmers/utopic/mysql-47", -1))
+	c.Assert(err, gc.IsNil)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/mysql"),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.BaseEntityDeleteResponse{
+			Entities: []*charm.Reference{
+				charm.MustParseReference("cs:~charmers/trusty/mysql-42"),
+				charm.MustParseReference("cs:~charmers/utopic/mysql-42"),
+				charm.MustParseReference("cs:~charmers/utopic/mysql-47"),
+			},
+			Blobs: 3,
+		},
+	})
+
+	// The entities can no longer be resolved or restored.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/mysql/meta/id"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Message: `no matching charm or bundle for "cs:~charmers/mysql"`,
+			Code:    params.ErrNotFound,
+		},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/utopic/mysql-47/restore"),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Message: `deleted entity cs:~charmers/utopic/mysql-47 not found`,
+			Code:    params.ErrNotFound,
+		},
+	})
+
+	// Other users' charms are unaffected.
+	_, err = s.store.FindEntity(newResolvedURL("~bob/utopic/mysql-0", -1))
+	c.Assert(err, gc.IsNil)
+}
+
+var baseEntityDeleteErrorTests = []struct {
+	about        string
+	method       string
+	path         string
+	username     string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "bad credentials",
+	method:       "DELETE",
+	path:         "~charmers/mysql",
+	username:     "bad",
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Message: "invalid user name or password",
+		Code:    params.ErrUnauthorized,
+	},
+}, {
+	about:        "bad method",
+	method:       "GET",
+	path:         "~charmers/mysql",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Message: "GET method not allowed",
+		Code:    params.ErrMethodNotAllowed,
+	},
+}, {
+	about:        "no user",
+	method:       "DELETE",
+	path:         "mysql",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: "user not specified",
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "series specified",
+	method:       "DELETE",
+	path:         "~charmers/utopic/mysql",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: `base entity id "cs:~charmers/utopic/mysql" must not specify a series or revision`,
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "revision specified",
+	method:       "DELETE",
+	path:         "~charmers/mysql-42",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: `base entity id "cs:~charmers/mysql-42" must not specify a series or revision`,
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "not found",
+	method:       "DELETE",
+	path:         "~charmers/wordpress",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Message: "base entity not found",
+		Code:    params.ErrNotFound,
+	},
+}}
+
+func (s *ArchiveSuite) TestDeleteBaseEntityErrors(c *gc.C) {
+	err := s.store.AddCharmWithArchive(
+		newResolvedURL("~charmers/utopic/mysql-42", -1),
+		storetesting.Charms.CharmArchive(c.MkDir(), "mysql"))
+	c.Assert(err, gc.IsNil)
+	for i, test := range baseEntityDeleteErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		username := testUsername
+		if test.username != "" {
+			username = test.username
+		}
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       test.method,
+			Username:     username,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
 }
 
 func (s *ArchiveSuite) TestDeleteSpecificCharm(c *gc.C) {
@@ -1097,7 +1826,7 @@ func (s *ArchiveSuite) TestDeleteNotFound(c *gc.C) {
 	})
 }
 
-func (s *ArchiveSuite) TestDeleteError(c *gc.C) {
+func (s *ArchiveSuite) TestPurgeError(c *gc.C) {
 	// Add a charm to the database (not including the archive).
 	id := "~charmers/utopic/mysql-42"
 	url := newResolvedURL(id, -1)
@@ -1109,12 +1838,13 @@ func (s *ArchiveSuite) TestDeleteError(c *gc.C) {
 			BlobSize: fakeBlobSize,
 		})
 	c.Assert(err, gc.IsNil)
+	s.assertDelete(c, id)
 
-	// Try to delete the charm using the API.
+	// Try to purge the charm using the API.
 	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
 		Handler:      s.srv,
-		URL:          storeURL(id + "/archive"),
-		Method:       "DELETE",
+		URL:          storeURL(id + "/purge"),
+		Method:       "POST",
 		Username:     testUsername,
 		Password:     testPassword,
 		ExpectStatus: http.StatusInternalServerError,
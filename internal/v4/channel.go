@@ -0,0 +1,57 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// PUT id/publish
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#put-idpublish
+func (h *Handler) servePublish(id *charm.Reference, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "PUT" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s not allowed", req.Method)
+	}
+	if !isFullySpecified(id) {
+		return badRequestf(nil, "entity id %q is not fully specified", id)
+	}
+	rid, err := h.resolveURL(id, req)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	if err := h.AuthorizeEntity(rid, req); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var publish params.PublishRequest
+	if err := json.NewDecoder(req.Body).Decode(&publish); err != nil {
+		return badRequestf(err, "cannot unmarshal publish request")
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	if err := store.Publish(rid, publish.Channel); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	return nil
+}
+
+// requestChannel returns the channel specified by the channel
+// parameter of the given request, or the stable channel if
+// the parameter is not specified.
+func requestChannel(req *http.Request) (params.Channel, error) {
+	channel := params.Channel(req.Form.Get("channel"))
+	if channel == "" {
+		return params.StableChannel, nil
+	}
+	if !charmstore.ValidChannel(channel) {
+		return "", badRequestf(nil, "invalid channel %q", channel)
+	}
+	return channel, nil
+}
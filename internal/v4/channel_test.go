@@ -0,0 +1,346 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type ChannelSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&ChannelSuite{})
+
+// addUnpublishedCharm adds the wordpress charm to the store with the
+// given id without publishing it, and makes it readable by everyone.
+func (s *ChannelSuite) addUnpublishedCharm(c *gc.C, id string) *router.ResolvedURL {
+	url := newResolvedURL(id, -1)
+	err := s.store.AddCharm(storetesting.Charms.CharmDir("wordpress"), charmstore.AddParams{
+		URL:      url,
+		BlobName: "no-such-name",
+		BlobHash: fakeBlobHash,
+		BlobSize: fakeBlobSize,
+	})
+	c.Assert(err, gc.IsNil)
+	err = s.store.SetPerms(&url.URL, "read", params.Everyone, url.URL.User)
+	c.Assert(err, gc.IsNil)
+	return url
+}
+
+// publish publishes the entity with the given id
+// in the given channel through the API.
+func (s *ChannelSuite) publish(c *gc.C, id string, channel params.Channel) {
+	body, err := json.Marshal(params.PublishRequest{
+		Channel: channel,
+	})
+	c.Assert(err, gc.IsNil)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/publish"),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Username: testUsername,
+		Password: testPassword,
+		Body:     bytes.NewReader(body),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+}
+
+// assertResolvesTo checks that the given id resolves to the
+// given revision when the given query is used.
+func (s *ChannelSuite) assertResolvesTo(c *gc.C, id, query string, revision int) {
+	c.Logf("resolving %s%s", id, query)
+	if revision == -1 {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(id + "/meta/id-revision" + query),
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody: params.Error{
+				Code:    params.ErrNotFound,
+				Message: `no matching charm or bundle for "cs:` + id + `"`,
+			},
+		})
+		return
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL(id + "/meta/id-revision" + query),
+		ExpectBody: params.IdRevisionResponse{revision},
+	})
+}
+
+func (s *ChannelSuite) TestPublish(c *gc.C) {
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-0")
+
+	// An unpublished charm can only be resolved in the
+	// unpublished channel or by its full id.
+	s.assertResolvesTo(c, "~charmers/wordpress", "", -1)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=development", -1)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=unpublished", 0)
+	s.assertResolvesTo(c, "~charmers/precise/wordpress-0", "", 0)
+
+	s.publish(c, "~charmers/precise/wordpress-0", params.DevelopmentChannel)
+	s.assertResolvesTo(c, "~charmers/wordpress", "", -1)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=stable", -1)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=development", 0)
+
+	s.publish(c, "~charmers/precise/wordpress-0", params.StableChannel)
+	s.assertResolvesTo(c, "~charmers/wordpress", "", 0)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=stable", 0)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=development", 0)
+
+	// A new revision does not replace the published one
+	// until it is published itself.
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-1")
+	s.assertResolvesTo(c, "~charmers/wordpress", "", 0)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=development", 0)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=unpublished", 1)
+
+	s.publish(c, "~charmers/precise/wordpress-1", params.DevelopmentChannel)
+	s.assertResolvesTo(c, "~charmers/wordpress", "", 0)
+	s.assertResolvesTo(c, "~charmers/wordpress", "?channel=development", 1)
+}
+
+func (s *ChannelSuite) TestPublishSetsPublishTime(c *gc.C) {
+	url := s.addUnpublishedCharm(c, "~charmers/precise/wordpress-0")
+	before := time.Now()
+	s.publish(c, "~charmers/precise/wordpress-0", params.StableChannel)
+	after := time.Now()
+	entity, err := s.store.FindEntity(url)
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Development, gc.Equals, true)
+	c.Assert(entity.Stable, gc.Equals, true)
+	c.Assert(entity.StablePublishTime, jc.TimeBetween(before, after))
+}
+
+var publishErrorsTests = []struct {
+	about        string
+	method       string
+	id           string
+	body         string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "get not allowed",
+	method:       "GET",
+	id:           "~charmers/precise/wordpress-0",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET not allowed",
+	},
+}, {
+	about:        "partial id",
+	method:       "PUT",
+	id:           "~charmers/wordpress",
+	body:         `{"Channel": "stable"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `entity id "cs:~charmers/wordpress" is not fully specified`,
+	},
+}, {
+	about:        "invalid body",
+	method:       "PUT",
+	id:           "~charmers/precise/wordpress-0",
+	body:         `{`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot unmarshal publish request: unexpected EOF",
+	},
+}, {
+	about:        "unpublished channel",
+	method:       "PUT",
+	id:           "~charmers/precise/wordpress-0",
+	body:         `{"Channel": "unpublished"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot publish in "unpublished" channel`,
+	},
+}, {
+	about:        "invalid channel",
+	method:       "PUT",
+	id:           "~charmers/precise/wordpress-0",
+	body:         `{"Channel": "bad-wolf"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot publish in "bad-wolf" channel`,
+	},
+}}
+
+func (s *ChannelSuite) TestPublishErrors(c *gc.C) {
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-0")
+	for i, test := range publishErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:  s.srv,
+			URL:      storeURL(test.id + "/publish"),
+			Method:   test.method,
+			Username: testUsername,
+			Password: testPassword,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+			},
+			Body:         strings.NewReader(test.body),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *ChannelSuite) TestPublishNotFound(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/no-such-0/publish"),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Body: strings.NewReader(`{"Channel": "stable"}`),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusNotFound, gc.Commentf("body: %s", rec.Body.String()))
+	var perr params.Error
+	err := json.Unmarshal(rec.Body.Bytes(), &perr)
+	c.Assert(err, gc.IsNil)
+	c.Assert(perr.Code, gc.Equals, params.ErrNotFound)
+}
+
+func (s *ChannelSuite) TestPublishUnauthorized(c *gc.C) {
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-0")
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/publish"),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Body: strings.NewReader(`{"Channel": "stable"}`),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusProxyAuthRequired, gc.Commentf("body: %s", rec.Body.String()))
+	entity, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Stable, gc.Equals, false)
+}
+
+func (s *ChannelSuite) TestInvalidChannel(c *gc.C) {
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-0")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/wordpress/meta/id-revision?channel=bad-wolf"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid channel "bad-wolf"`,
+		},
+	})
+}
+
+func (s *ChannelSuite) TestExpandIdChannel(c *gc.C) {
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-0")
+	s.addUnpublishedCharm(c, "~charmers/trusty/wordpress-1")
+	s.addUnpublishedCharm(c, "~charmers/utopic/wordpress-2")
+	s.publish(c, "~charmers/precise/wordpress-0", params.StableChannel)
+	s.publish(c, "~charmers/trusty/wordpress-1", params.DevelopmentChannel)
+
+	tests := []struct {
+		query  string
+		expect []params.ExpandedId
+	}{{
+		query: "",
+		expect: []params.ExpandedId{
+			{Id: "cs:~charmers/precise/wordpress-0"},
+		},
+	}, {
+		query: "?channel=development",
+		expect: []params.ExpandedId{
+			{Id: "cs:~charmers/trusty/wordpress-1"},
+			{Id: "cs:~charmers/precise/wordpress-0"},
+		},
+	}, {
+		query: "?channel=unpublished",
+		expect: []params.ExpandedId{
+			{Id: "cs:~charmers/utopic/wordpress-2"},
+			{Id: "cs:~charmers/trusty/wordpress-1"},
+			{Id: "cs:~charmers/precise/wordpress-0"},
+		},
+	}}
+	for i, test := range tests {
+		c.Logf("test %d: %q", i, test.query)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:    s.srv,
+			URL:        storeURL("~charmers/precise/wordpress-0/expand-id" + test.query),
+			ExpectBody: test.expect,
+		})
+	}
+}
+
+func (s *ChannelSuite) TestChangesPublishedChannel(c *gc.C) {
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-0")
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-1")
+	s.addUnpublishedCharm(c, "~charmers/precise/wordpress-2")
+	s.publish(c, "~charmers/precise/wordpress-0", params.StableChannel)
+	s.publish(c, "~charmers/precise/wordpress-1", params.DevelopmentChannel)
+
+	ids := func(query string) []string {
+		var published []params.Published
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL("changes/published" + query),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+		err := json.Unmarshal(rec.Body.Bytes(), &published)
+		c.Assert(err, gc.IsNil)
+		// Entities may have been published within the same
+		// millisecond, so the order is not checked.
+		var ids []string
+		for _, p := range published {
+			ids = append(ids, p.Id.String())
+		}
+		sort.Strings(ids)
+		return ids
+	}
+	c.Assert(ids(""), jc.DeepEquals, []string{
+		"cs:~charmers/precise/wordpress-0",
+	})
+	c.Assert(ids("?channel=development"), jc.DeepEquals, []string{
+		"cs:~charmers/precise/wordpress-0",
+		"cs:~charmers/precise/wordpress-1",
+	})
+	c.Assert(ids("?channel=unpublished"), jc.DeepEquals, []string{
+		"cs:~charmers/precise/wordpress-0",
+		"cs:~charmers/precise/wordpress-1",
+		"cs:~charmers/precise/wordpress-2",
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("changes/published?channel=bad-wolf"),
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `invalid channel "bad-wolf"`,
+		},
+	})
+}
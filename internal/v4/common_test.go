@@ -16,6 +16,7 @@ import (
 	"gopkg.in/macaroon-bakery.v0/httpbakery"
 
 	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/policy"
 	"gopkg.in/juju/charmstore.v4/internal/storetesting"
 	"gopkg.in/juju/charmstore.v4/internal/v4"
 )
@@ -72,6 +73,15 @@ type commonSuite struct {
 	// enableES holds whether the charmstore server will be
 	// started with Elastic Search enabled.
 	enableES bool
+
+	// policy holds the content policy that the charmstore
+	// server will be started with.
+	policy *policy.Policy
+
+	// quotaMaxEntities and quotaMaxBytes hold the user
+	// quotas that the charmstore server will be started with.
+	quotaMaxEntities int
+	quotaMaxBytes    int64
 }
 
 func (s *commonSuite) SetUpSuite(c *gc.C) {
@@ -115,8 +125,11 @@ func (s *commonSuite) TearDownTest(c *gc.C) {
 // startServer creates a new charmstore server.
 func (s *commonSuite) startServer(c *gc.C) {
 	config := charmstore.ServerParams{
-		AuthUsername: testUsername,
-		AuthPassword: testPassword,
+		AuthUsername:     testUsername,
+		AuthPassword:     testPassword,
+		Policy:           s.policy,
+		QuotaMaxEntities: s.quotaMaxEntities,
+		QuotaMaxBytes:    s.quotaMaxBytes,
 	}
 	if s.enableIdentity {
 		s.discharge = func(_, _ string) ([]checkers.Caveat, error) {
@@ -153,7 +166,7 @@ func (s *commonSuite) startServer(c *gc.C) {
 	}
 	s.noMacaroonSrvParams = config
 
-	pool, err := charmstore.NewPool(db, si, &bakery.NewServiceParams{})
+	pool, err := charmstore.NewPool(db, si, &bakery.NewServiceParams{}, nil)
 	c.Assert(err, gc.IsNil)
 	s.store = pool.Store()
 }
@@ -101,6 +101,7 @@ func (s *APISuite) TestServeDiagram(c *gc.C) {
 		BlobName: "blobName",
 		BlobHash: fakeBlobHash,
 		BlobSize: fakeBlobSize,
+		Channel:  params.StableChannel,
 	})
 	c.Assert(err, gc.IsNil)
 	err = s.store.SetPerms(&url.URL, "read", params.Everyone, url.URL.User)
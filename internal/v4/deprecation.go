@@ -0,0 +1,92 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// GET id/meta/deprecation
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetadeprecation
+func (h *Handler) metaDeprecation(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.Deprecation == nil {
+		return nil, nil
+	}
+	return deprecationParams(entity.Deprecation), nil
+}
+
+// PUT id/meta/deprecation
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#put-idmetadeprecation
+func (h *Handler) putMetaDeprecation(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	var d *params.Deprecation
+	if err := json.Unmarshal(*val, &d); err != nil {
+		return badRequestf(err, "cannot unmarshal deprecation")
+	}
+	if d == nil {
+		// A null value removes any existing deprecation.
+		updater.UpdateField("deprecation", nil)
+		return nil
+	}
+	if d.Reason == "" {
+		return badRequestf(nil, "deprecation reason not specified")
+	}
+	if d.Replacement != nil {
+		if !isFullySpecified(d.Replacement) {
+			return badRequestf(nil, "replacement %q is not fully specified", d.Replacement)
+		}
+		store := h.pool.Store()
+		defer store.Close()
+		rid, err := ResolveURL(store, d.Replacement, params.UnpublishedChannel)
+		if err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		if _, err := store.FindEntity(rid, "_id"); err != nil {
+			return errgo.NoteMask(err, "cannot find replacement", errgo.Is(params.ErrNotFound))
+		}
+		if rid.URL == id.URL {
+			return badRequestf(nil, "revision cannot be its own replacement")
+		}
+	}
+	updater.UpdateField("deprecation", &mongodoc.Deprecation{
+		Yanked:      d.Yanked,
+		Reason:      d.Reason,
+		Replacement: d.Replacement,
+		Time:        time.Now(),
+	})
+	return nil
+}
+
+// deprecationParams returns the external representation
+// of the given deprecation.
+func deprecationParams(d *mongodoc.Deprecation) *params.Deprecation {
+	return &params.Deprecation{
+		Yanked:      d.Yanked,
+		Reason:      d.Reason,
+		Replacement: d.Replacement,
+		Time:        d.Time.UTC(),
+	}
+}
+
+// setDeprecationWarning sets a Warning header on the given response
+// header if the entity with the given id has been yanked.
+func setDeprecationWarning(header http.Header, id *router.ResolvedURL, d *mongodoc.Deprecation) {
+	if d == nil || !d.Yanked {
+		return
+	}
+	msg := fmt.Sprintf("%s has been yanked: %s", id, d.Reason)
+	if d.Replacement != nil {
+		msg += fmt.Sprintf(" (use %s instead)", d.Replacement)
+	}
+	header.Set("Warning", fmt.Sprintf("299 - %q", msg))
+}
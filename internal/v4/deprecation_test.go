@@ -0,0 +1,247 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type DeprecationSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&DeprecationSuite{})
+
+func (s *DeprecationSuite) SetUpTest(c *gc.C) {
+	s.commonSuite.SetUpTest(c)
+	for _, id := range []string{
+		"~charmers/precise/wordpress-0",
+		"~charmers/precise/wordpress-1",
+	} {
+		url := newResolvedURL(id, -1)
+		err := s.store.AddCharmWithArchive(url, storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"))
+		c.Assert(err, gc.IsNil)
+		err = s.store.SetPerms(&url.URL, "read", params.Everyone, url.URL.User)
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+// putDeprecation sets the deprecation of the entity
+// with the given id through the API.
+func (s *DeprecationSuite) putDeprecation(c *gc.C, id string, d *params.Deprecation) {
+	body, err := json.Marshal(d)
+	c.Assert(err, gc.IsNil)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/meta/deprecation"),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Username: testUsername,
+		Password: testPassword,
+		Body:     bytes.NewReader(body),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+}
+
+func (s *DeprecationSuite) assertResolvesTo(c *gc.C, id string, revision int) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL(id + "/meta/id-revision"),
+		ExpectBody: params.IdRevisionResponse{revision},
+	})
+}
+
+func (s *DeprecationSuite) TestGetDeprecation(c *gc.C) {
+	// A revision that has not been deprecated has no deprecation metadata.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/wordpress-1/meta/deprecation"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrMetadataNotFound,
+			Message: params.ErrMetadataNotFound.Error(),
+		},
+	})
+
+	before := time.Now()
+	s.putDeprecation(c, "~charmers/precise/wordpress-1", &params.Deprecation{
+		Yanked:      true,
+		Reason:      "security bug",
+		Replacement: charm.MustParseReference("~charmers/precise/wordpress-0"),
+	})
+	after := time.Now()
+
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-1/meta/deprecation"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var d params.Deprecation
+	err := json.Unmarshal(rec.Body.Bytes(), &d)
+	c.Assert(err, gc.IsNil)
+	c.Assert(d.Time, jc.TimeBetween(before.Add(-time.Millisecond), after))
+	d.Time = time.Time{}
+	c.Assert(d, jc.DeepEquals, params.Deprecation{
+		Yanked:      true,
+		Reason:      "security bug",
+		Replacement: charm.MustParseReference("~charmers/precise/wordpress-0"),
+	})
+}
+
+func (s *DeprecationSuite) TestYankedRevisionNotResolved(c *gc.C) {
+	s.assertResolvesTo(c, "~charmers/wordpress", 1)
+
+	// A deprecated revision is still resolved.
+	s.putDeprecation(c, "~charmers/precise/wordpress-1", &params.Deprecation{
+		Reason: "please upgrade",
+	})
+	s.assertResolvesTo(c, "~charmers/wordpress", 1)
+
+	// A yanked revision is not.
+	s.putDeprecation(c, "~charmers/precise/wordpress-1", &params.Deprecation{
+		Yanked: true,
+		Reason: "security bug",
+	})
+	s.assertResolvesTo(c, "~charmers/wordpress", 0)
+	s.assertResolvesTo(c, "~charmers/precise/wordpress", 0)
+
+	// It can still be referred to by its full id.
+	s.assertResolvesTo(c, "~charmers/precise/wordpress-1", 1)
+
+	// Removing the deprecation makes it resolvable again.
+	s.putDeprecation(c, "~charmers/precise/wordpress-1", nil)
+	s.assertResolvesTo(c, "~charmers/wordpress", 1)
+}
+
+func (s *DeprecationSuite) TestGetYankedArchive(c *gc.C) {
+	s.putDeprecation(c, "~charmers/precise/wordpress-1", &params.Deprecation{
+		Yanked:      true,
+		Reason:      "security bug",
+		Replacement: charm.MustParseReference("~charmers/precise/wordpress-0"),
+	})
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-1/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Warning"), gc.Equals, `299 - "cs:~charmers/precise/wordpress-1 has been yanked: security bug (use cs:~charmers/precise/wordpress-0 instead)"`)
+
+	// Revisions that have not been yanked have no warning.
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK)
+	c.Assert(rec.Header().Get("Warning"), gc.Equals, "")
+}
+
+func (s *DeprecationSuite) TestRevisionInfo(c *gc.C) {
+	s.putDeprecation(c, "~charmers/precise/wordpress-0", &params.Deprecation{
+		Yanked: true,
+		Reason: "security bug",
+	})
+	entity, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1), "deprecation")
+	c.Assert(err, gc.IsNil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-1/meta/revision-info"),
+		ExpectBody: params.RevisionInfoResponse{
+			Revisions: []*charm.Reference{
+				charm.MustParseReference("cs:~charmers/precise/wordpress-1"),
+				charm.MustParseReference("cs:~charmers/precise/wordpress-0"),
+			},
+			Deprecations: map[string]*params.Deprecation{
+				"cs:~charmers/precise/wordpress-0": {
+					Yanked: true,
+					Reason: "security bug",
+					Time:   entity.Deprecation.Time.UTC(),
+				},
+			},
+		},
+	})
+}
+
+var putDeprecationErrorsTests = []struct {
+	about        string
+	body         string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "no reason",
+	body:         `{"Yanked": true}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "deprecation reason not specified",
+	},
+}, {
+	about:        "invalid body",
+	body:         `{"Reason": 42}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot unmarshal deprecation: json: cannot unmarshal number into Go value of type string",
+	},
+}, {
+	about:        "partial replacement",
+	body:         `{"Reason": "bug", "Replacement": "~charmers/wordpress"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `replacement "cs:~charmers/wordpress" is not fully specified`,
+	},
+}, {
+	about:        "replacement not found",
+	body:         `{"Reason": "bug", "Replacement": "~charmers/precise/wordpress-42"}`,
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "cannot find replacement: entity not found",
+	},
+}, {
+	about:        "self replacement",
+	body:         `{"Reason": "bug", "Replacement": "~charmers/precise/wordpress-1"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "revision cannot be its own replacement",
+	},
+}}
+
+func (s *DeprecationSuite) TestPutDeprecationErrors(c *gc.C) {
+	for i, test := range putDeprecationErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:  s.srv,
+			URL:      storeURL("~charmers/precise/wordpress-1/meta/deprecation"),
+			Method:   "PUT",
+			Username: testUsername,
+			Password: testPassword,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+			},
+			Body:         strings.NewReader(test.body),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+	// The entity has not been deprecated.
+	entity, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-1", -1), "deprecation")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Deprecation, gc.IsNil)
+}
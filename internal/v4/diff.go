@@ -0,0 +1,461 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/juju/utils/jsonhttp"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+const (
+	// maxDiffFileSize holds the maximum size of a file
+	// for which a text diff is included in a diff response.
+	maxDiffFileSize = 64 * 1024
+
+	// maxDiffLines holds the maximum product of the line
+	// counts of the two versions of a file for which a text
+	// diff is calculated, bounding the time and memory used.
+	maxDiffLines = 1000 * 1000
+
+	// diffContext holds the number of unchanged lines
+	// shown around each change in a text diff.
+	diffContext = 3
+)
+
+// diffFields holds the entity fields required by serveDiff.
+var diffFields = []string{"_id", "blobname", "charmmeta", "charmconfig", "charmactions"}
+
+// GET id/diff?against=revision
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-iddiff
+func (h *Handler) serveDiff(id *router.ResolvedURL, fullySpecified bool, w http.ResponseWriter, req *http.Request) error {
+	against := req.Form.Get("against")
+	if against == "" {
+		return badRequestf(nil, "against parameter not specified")
+	}
+	rev, err := strconv.Atoi(against)
+	if err != nil || rev < 0 {
+		return badRequestf(nil, "invalid against revision %q", against)
+	}
+	// When the id was requested by its promulgated URL, the
+	// revision to compare against is a promulgated revision too.
+	oldURL := id.PreferredURL()
+	oldURL.Revision = rev
+	store := h.pool.Store()
+	defer store.Close()
+	newEntity, err := store.FindEntity(id, diffFields...)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	oldEntity, err := store.FindEntity(&router.ResolvedURL{
+		URL:                 *oldURL,
+		PromulgatedRevision: -1,
+	}, diffFields...)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	oldId := &router.ResolvedURL{
+		URL:                 *oldEntity.URL,
+		PromulgatedRevision: -1,
+	}
+	if oldId.URL.User != id.URL.User {
+		// The promulgated revision was published by another
+		// user, so the client must be allowed to read it too.
+		if err := h.AuthorizeEntity(oldId, req); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+	}
+	oldFiles, closeOld, err := openArchiveFiles(store, oldEntity)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer closeOld()
+	newFiles, closeNew, err := openArchiveFiles(store, newEntity)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer closeNew()
+
+	resp := params.DiffResponse{
+		Id:      &id.URL,
+		Against: &oldId.URL,
+	}
+	for name, newFile := range newFiles {
+		oldFile, ok := oldFiles[name]
+		if !ok {
+			resp.Added = append(resp.Added, name)
+			continue
+		}
+		if oldFile.CRC32 == newFile.CRC32 && oldFile.UncompressedSize64 == newFile.UncompressedSize64 {
+			continue
+		}
+		fileDiff := params.FileDiff{
+			Name:    name,
+			OldSize: int64(oldFile.UncompressedSize64),
+			NewSize: int64(newFile.UncompressedSize64),
+		}
+		fileDiff.Diff, err = fileTextDiff(oldFile, newFile)
+		if err != nil {
+			return errgo.Notef(err, "cannot compare %q", name)
+		}
+		resp.Changed = append(resp.Changed, fileDiff)
+	}
+	for name := range oldFiles {
+		if _, ok := newFiles[name]; !ok {
+			resp.Removed = append(resp.Removed, name)
+		}
+	}
+	sort.Strings(resp.Added)
+	sort.Strings(resp.Removed)
+	sort.Sort(fileDiffsByName(resp.Changed))
+	if id.URL.Series != "bundle" {
+		resp.Config = configDiff(oldEntity.CharmConfig, newEntity.CharmConfig)
+		resp.Relations = relationsDiff(oldEntity.CharmMeta, newEntity.CharmMeta)
+		resp.Actions = actionsDiff(oldEntity.CharmActions, newEntity.CharmActions)
+	}
+	return jsonhttp.WriteJSON(w, http.StatusOK, &resp)
+}
+
+// openArchiveFiles opens the archive of the given entity and returns
+// its files, keyed by name. Directories are omitted. The returned
+// function must be called to close the archive when done.
+func openArchiveFiles(store *charmstore.Store, entity *mongodoc.Entity) (map[string]*zip.File, func(), error) {
+	r, size, err := store.BlobStore.Open(entity.BlobName)
+	if err != nil {
+		return nil, nil, errgo.Notef(err, "cannot open archive data for %s", entity.URL)
+	}
+	zipReader, err := zip.NewReader(charmstore.ReaderAtSeeker(r), size)
+	if err != nil {
+		r.Close()
+		return nil, nil, errgo.Notef(err, "cannot read archive data for %s", entity.URL)
+	}
+	files := make(map[string]*zip.File)
+	for _, file := range zipReader.File {
+		if file.FileInfo().IsDir() {
+			continue
+		}
+		files[file.Name] = file
+	}
+	return files, func() { r.Close() }, nil
+}
+
+// fileTextDiff returns a unified diff between the given versions of
+// a file. It returns the empty string if either version is too
+// large or does not hold text.
+func fileTextDiff(oldFile, newFile *zip.File) (string, error) {
+	if oldFile.UncompressedSize64 > maxDiffFileSize || newFile.UncompressedSize64 > maxDiffFileSize {
+		return "", nil
+	}
+	oldLines, err := readTextLines(oldFile)
+	if err != nil || oldLines == nil {
+		return "", errgo.Mask(err)
+	}
+	newLines, err := readTextLines(newFile)
+	if err != nil || newLines == nil {
+		return "", errgo.Mask(err)
+	}
+	if len(oldLines)*len(newLines) > maxDiffLines {
+		return "", nil
+	}
+	return unifiedDiff(oldFile.Name, newFile.Name, oldLines, newLines), nil
+}
+
+// readTextLines returns the lines in the given file, without their
+// line terminators. It returns nil if the file does not hold text.
+func readTextLines(file *zip.File) ([]string, error) {
+	r, err := file.Open()
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	defer r.Close()
+	data, err := ioutil.ReadAll(io.LimitReader(r, maxDiffFileSize))
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) != -1 {
+		return nil, nil
+	}
+	text := strings.TrimSuffix(string(data), "\n")
+	if text == "" {
+		return []string{}, nil
+	}
+	return strings.Split(text, "\n"), nil
+}
+
+// diffLine holds a line of a unified diff. Its kind
+// is one of ' ', '-' and '+'.
+type diffLine struct {
+	kind byte
+	text string
+}
+
+// diffLines returns the edits that turn the lines in a into the lines
+// in b, calculated from the longest common subsequence of the two.
+func diffLines(a, b []string) []diffLine {
+	// lcs[i][j] holds the length of the longest
+	// common subsequence of a[i:] and b[j:].
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			switch {
+			case a[i] == b[j]:
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			case lcs[i+1][j] >= lcs[i][j+1]:
+				lcs[i][j] = lcs[i+1][j]
+			default:
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+	var lines []diffLine
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && a[i] == b[j]:
+			lines = append(lines, diffLine{' ', a[i]})
+			i++
+			j++
+		case i < len(a) && (j == len(b) || lcs[i+1][j] >= lcs[i][j+1]):
+			lines = append(lines, diffLine{'-', a[i]})
+			i++
+		default:
+			lines = append(lines, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	return lines
+}
+
+// unifiedDiff returns a unified diff between the lines in a, read from
+// the file named oldName, and the lines in b, read from the file named
+// newName. It returns the empty string if there are no differences.
+func unifiedDiff(oldName, newName string, a, b []string) string {
+	lines := diffLines(a, b)
+	// oldPos[k] and newPos[k] hold the number of lines
+	// of a and b respectively before lines[k].
+	oldPos := make([]int, len(lines)+1)
+	newPos := make([]int, len(lines)+1)
+	for k, line := range lines {
+		oldPos[k+1], newPos[k+1] = oldPos[k], newPos[k]
+		if line.kind != '+' {
+			oldPos[k+1]++
+		}
+		if line.kind != '-' {
+			newPos[k+1]++
+		}
+	}
+	var buf bytes.Buffer
+	for start := 0; start < len(lines); {
+		first := start
+		for first < len(lines) && lines[first].kind == ' ' {
+			first++
+		}
+		if first == len(lines) {
+			break
+		}
+		// Changes separated by few enough unchanged
+		// lines are shown in the same hunk.
+		end := first
+		for k := first; k < len(lines); k++ {
+			if lines[k].kind != ' ' {
+				end = k + 1
+			} else if k-end >= 2*diffContext {
+				break
+			}
+		}
+		lo := first - diffContext
+		if lo < start {
+			lo = start
+		}
+		hi := end + diffContext
+		if hi > len(lines) {
+			hi = len(lines)
+		}
+		if buf.Len() == 0 {
+			fmt.Fprintf(&buf, "--- %s\n+++ %s\n", oldName, newName)
+		}
+		fmt.Fprintf(&buf, "@@ -%s +%s @@\n", hunkRange(oldPos[lo], oldPos[hi]), hunkRange(newPos[lo], newPos[hi]))
+		for _, line := range lines[lo:hi] {
+			buf.WriteByte(line.kind)
+			buf.WriteString(line.text)
+			buf.WriteByte('\n')
+		}
+		start = hi
+	}
+	return buf.String()
+}
+
+// hunkRange returns the range of lines from start to end, counting
+// from zero, in the format used by the header of a unified diff hunk.
+func hunkRange(start, end int) string {
+	if start == end {
+		// An empty range refers to the line before it.
+		return fmt.Sprintf("%d,0", start)
+	}
+	return fmt.Sprintf("%d,%d", start+1, end-start)
+}
+
+// configDiff returns the differences between the given configurations,
+// or nil if there are none.
+func configDiff(oldConfig, newConfig *charm.Config) *params.ConfigDiff {
+	var oldOptions, newOptions map[string]charm.Option
+	if oldConfig != nil {
+		oldOptions = oldConfig.Options
+	}
+	if newConfig != nil {
+		newOptions = newConfig.Options
+	}
+	var diff params.ConfigDiff
+	for name, newOption := range newOptions {
+		oldOption, ok := oldOptions[name]
+		switch {
+		case !ok:
+			if diff.Added == nil {
+				diff.Added = make(map[string]charm.Option)
+			}
+			diff.Added[name] = newOption
+		case !reflect.DeepEqual(oldOption, newOption):
+			if diff.Changed == nil {
+				diff.Changed = make(map[string]params.OptionChange)
+			}
+			diff.Changed[name] = params.OptionChange{
+				Old: oldOption,
+				New: newOption,
+			}
+		}
+	}
+	for name, oldOption := range oldOptions {
+		if _, ok := newOptions[name]; !ok {
+			if diff.Removed == nil {
+				diff.Removed = make(map[string]charm.Option)
+			}
+			diff.Removed[name] = oldOption
+		}
+	}
+	if diff.Added == nil && diff.Removed == nil && diff.Changed == nil {
+		return nil
+	}
+	return &diff
+}
+
+// relationsDiff returns the differences between the relations
+// in the given charm metadata, or nil if there are none.
+func relationsDiff(oldMeta, newMeta *charm.Meta) *params.RelationsDiff {
+	oldRelations, newRelations := metaRelations(oldMeta), metaRelations(newMeta)
+	var diff params.RelationsDiff
+	for name, newRelation := range newRelations {
+		oldRelation, ok := oldRelations[name]
+		switch {
+		case !ok:
+			if diff.Added == nil {
+				diff.Added = make(map[string]charm.Relation)
+			}
+			diff.Added[name] = newRelation
+		case oldRelation != newRelation:
+			if diff.Changed == nil {
+				diff.Changed = make(map[string]params.RelationChange)
+			}
+			diff.Changed[name] = params.RelationChange{
+				Old: oldRelation,
+				New: newRelation,
+			}
+		}
+	}
+	for name, oldRelation := range oldRelations {
+		if _, ok := newRelations[name]; !ok {
+			if diff.Removed == nil {
+				diff.Removed = make(map[string]charm.Relation)
+			}
+			diff.Removed[name] = oldRelation
+		}
+	}
+	if diff.Added == nil && diff.Removed == nil && diff.Changed == nil {
+		return nil
+	}
+	return &diff
+}
+
+// metaRelations returns all the relations in the given
+// charm metadata, keyed by relation name.
+func metaRelations(m *charm.Meta) map[string]charm.Relation {
+	relations := make(map[string]charm.Relation)
+	if m == nil {
+		return relations
+	}
+	for _, rels := range []map[string]charm.Relation{m.Provides, m.Requires, m.Peers} {
+		for name, rel := range rels {
+			relations[name] = rel
+		}
+	}
+	return relations
+}
+
+// actionsDiff returns the differences between the given
+// actions, or nil if there are none.
+func actionsDiff(oldActions, newActions *charm.Actions) *params.ActionsDiff {
+	var oldSpecs, newSpecs map[string]charm.ActionSpec
+	if oldActions != nil {
+		oldSpecs = oldActions.ActionSpecs
+	}
+	if newActions != nil {
+		newSpecs = newActions.ActionSpecs
+	}
+	var diff params.ActionsDiff
+	for name, newSpec := range newSpecs {
+		oldSpec, ok := oldSpecs[name]
+		switch {
+		case !ok:
+			if diff.Added == nil {
+				diff.Added = make(map[string]charm.ActionSpec)
+			}
+			diff.Added[name] = newSpec
+		case !reflect.DeepEqual(oldSpec, newSpec):
+			if diff.Changed == nil {
+				diff.Changed = make(map[string]params.ActionChange)
+			}
+			diff.Changed[name] = params.ActionChange{
+				Old: oldSpec,
+				New: newSpec,
+			}
+		}
+	}
+	for name, oldSpec := range oldSpecs {
+		if _, ok := newSpecs[name]; !ok {
+			if diff.Removed == nil {
+				diff.Removed = make(map[string]charm.ActionSpec)
+			}
+			diff.Removed[name] = oldSpec
+		}
+	}
+	if diff.Added == nil && diff.Removed == nil && diff.Changed == nil {
+		return nil
+	}
+	return &diff
+}
+
+type fileDiffsByName []params.FileDiff
+
+func (s fileDiffsByName) Len() int           { return len(s) }
+func (s fileDiffsByName) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s fileDiffsByName) Less(i, j int) bool { return s[i].Name < s[j].Name }
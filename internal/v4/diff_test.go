@@ -0,0 +1,263 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/internal/v4"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type DiffSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&DiffSuite{})
+
+// diffNewConfig holds the configuration of the
+// second revision of the dummy charm.
+const diffNewConfig = `options:
+  title: {default: New Title, description: A descriptive title used for the service., type: string}
+  username: {default: admin001, description: The name of the initial account (given admin permissions)., type: string}
+  skill-level: {description: A number indicating skill., type: int}
+  color: {default: red, description: The color of the service., type: string}
+`
+
+func (s *DiffSuite) SetUpTest(c *gc.C) {
+	s.commonSuite.SetUpTest(c)
+	err := s.store.AddCharmWithArchive(
+		newResolvedURL("~charmers/precise/dummy-0", -1),
+		storetesting.Charms.CharmDir("dummy"),
+	)
+	c.Assert(err, gc.IsNil)
+
+	// The second revision changes the configuration,
+	// adds a README and removes the C source.
+	ch := storetesting.Charms.ClonedDir(c.MkDir(), "dummy")
+	err = ioutil.WriteFile(filepath.Join(ch.Path, "config.yaml"), []byte(diffNewConfig), 0666)
+	c.Assert(err, gc.IsNil)
+	err = ioutil.WriteFile(filepath.Join(ch.Path, "README.md"), []byte("A dummy charm.\n"), 0666)
+	c.Assert(err, gc.IsNil)
+	err = os.Remove(filepath.Join(ch.Path, "src", "hello.c"))
+	c.Assert(err, gc.IsNil)
+	ch, err = charm.ReadCharmDir(ch.Path)
+	c.Assert(err, gc.IsNil)
+	err = s.store.AddCharmWithArchive(newResolvedURL("~charmers/precise/dummy-1", -1), ch)
+	c.Assert(err, gc.IsNil)
+	err = s.store.SetPerms(charm.MustParseReference("~charmers/precise/dummy-0"), "read", params.Everyone, "charmers")
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *DiffSuite) TestDiff(c *gc.C) {
+	oldConfig, err := ioutil.ReadFile(filepath.Join(storetesting.Charms.CharmDir("dummy").Path, "config.yaml"))
+	c.Assert(err, gc.IsNil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/dummy/diff?against=0"),
+		ExpectBody: params.DiffResponse{
+			Id:      charm.MustParseReference("cs:~charmers/precise/dummy-1"),
+			Against: charm.MustParseReference("cs:~charmers/precise/dummy-0"),
+			Added:   []string{"README.md"},
+			Removed: []string{"src/hello.c"},
+			Changed: []params.FileDiff{{
+				Name:    "config.yaml",
+				OldSize: int64(len(oldConfig)),
+				NewSize: int64(len(diffNewConfig)),
+				Diff: `--- config.yaml
++++ config.yaml
+@@ -1,5 +1,5 @@
+ options:
+-  title: {default: My Title, description: A descriptive title used for the service., type: string}
+-  outlook: {description: No default outlook., type: string}
++  title: {default: New Title, description: A descriptive title used for the service., type: string}
+   username: {default: admin001, description: The name of the initial account (given admin permissions)., type: string}
+   skill-level: {description: A number indicating skill., type: int}
++  color: {default: red, description: The color of the service., type: string}
+`,
+			}},
+			Config: &params.ConfigDiff{
+				Added: map[string]charm.Option{
+					"color": {
+						Type:        "string",
+						Description: "The color of the service.",
+						Default:     "red",
+					},
+				},
+				Removed: map[string]charm.Option{
+					"outlook": {
+						Type:        "string",
+						Description: "No default outlook.",
+					},
+				},
+				Changed: map[string]params.OptionChange{
+					"title": {
+						Old: charm.Option{
+							Type:        "string",
+							Description: "A descriptive title used for the service.",
+							Default:     "My Title",
+						},
+						New: charm.Option{
+							Type:        "string",
+							Description: "A descriptive title used for the service.",
+							Default:     "New Title",
+						},
+					},
+				},
+			},
+		},
+	})
+}
+
+func (s *DiffSuite) TestDiffSameRevision(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/dummy-0/diff?against=0"),
+		ExpectBody: params.DiffResponse{
+			Id:      charm.MustParseReference("cs:~charmers/precise/dummy-0"),
+			Against: charm.MustParseReference("cs:~charmers/precise/dummy-0"),
+		},
+	})
+}
+
+func (s *DiffSuite) TestDiffPromulgated(c *gc.C) {
+	for _, rid := range []*router.ResolvedURL{
+		newResolvedURL("~bob/precise/dummy-7", 0),
+		newResolvedURL("~bob/precise/dummy-8", 1),
+	} {
+		err := s.store.AddCharmWithArchive(rid, storetesting.Charms.CharmDir("dummy"))
+		c.Assert(err, gc.IsNil)
+	}
+	err := s.store.SetPerms(charm.MustParseReference("~bob/precise/dummy"), "read", params.Everyone, "bob")
+	c.Assert(err, gc.IsNil)
+
+	// The against revision is resolved as a promulgated
+	// revision when the id is a promulgated URL.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("precise/dummy-1/diff?against=0"),
+		ExpectBody: params.DiffResponse{
+			Id:      charm.MustParseReference("cs:~bob/precise/dummy-8"),
+			Against: charm.MustParseReference("cs:~bob/precise/dummy-7"),
+		},
+	})
+}
+
+var diffErrorsTests = []struct {
+	about        string
+	url          string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "against not specified",
+	url:          "~charmers/precise/dummy/diff",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: "against parameter not specified",
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "invalid against revision",
+	url:          "~charmers/precise/dummy/diff?against=foo",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: `invalid against revision "foo"`,
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "against revision not found",
+	url:          "~charmers/precise/dummy/diff?against=42",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Message: "entity not found",
+		Code:    params.ErrNotFound,
+	},
+}}
+
+func (s *DiffSuite) TestDiffErrors(c *gc.C) {
+	for i, test := range diffErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.url),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+var unifiedDiffTests = []struct {
+	about  string
+	a, b   string
+	expect string
+}{{
+	about: "no differences",
+	a:     "1 2 3",
+	b:     "1 2 3",
+}, {
+	about: "added to empty",
+	b:     "x",
+	expect: `--- a
++++ b
+@@ -0,0 +1,1 @@
++x
+`,
+}, {
+	about: "distant changes in separate hunks",
+	a:     "1 2 3 4 5 6 7 8 9 10 11 12",
+	b:     "1 two 3 4 5 6 7 8 9 10 eleven 12",
+	expect: `--- a
++++ b
+@@ -1,5 +1,5 @@
+ 1
+-2
++two
+ 3
+ 4
+ 5
+@@ -8,5 +8,5 @@
+ 8
+ 9
+ 10
+-11
++eleven
+ 12
+`,
+}, {
+	about: "close changes in the same hunk",
+	a:     "1 2 3 4 5 6 7 8",
+	b:     "1 two 3 4 5 6 seven 8",
+	expect: `--- a
++++ b
+@@ -1,8 +1,8 @@
+ 1
+-2
++two
+ 3
+ 4
+ 5
+ 6
+-7
++seven
+ 8
+`,
+}}
+
+func (s *DiffSuite) TestUnifiedDiff(c *gc.C) {
+	for i, test := range unifiedDiffTests {
+		c.Logf("test %d: %s", i, test.about)
+		diff := v4.UnifiedDiff("a", "b", strings.Fields(test.a), strings.Fields(test.b))
+		c.Assert(diff, gc.Equals, test.expect)
+	}
+}
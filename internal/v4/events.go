@@ -0,0 +1,319 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+const (
+	// defaultEventsLimit holds the number of events returned
+	// by changes/events when no limit is specified.
+	defaultEventsLimit = 100
+
+	// maxEventsLimit holds the maximum number of events
+	// returned by a single changes/events request.
+	maxEventsLimit = 1000
+
+	// streamBatchSize holds the number of events read from
+	// the change feed at a time by changes/stream.
+	streamBatchSize = 100
+)
+
+var (
+	// streamPollInterval holds the time between successive
+	// checks for new events by changes/stream.
+	streamPollInterval = time.Second
+
+	// streamKeepAliveInterval holds the longest time that
+	// changes/stream waits without sending anything to the
+	// client. When it has no events to send, it sends a
+	// comment instead, so that intermediate proxies keep
+	// the connection open and closed connections are noticed.
+	streamKeepAliveInterval = 30 * time.Second
+)
+
+// streamEventKinds holds the kinds of event sent by changes/stream.
+var streamEventKinds = map[params.EventKind]bool{
+	params.EventUpload:    true,
+	params.EventPublish:   true,
+	params.EventExtraInfo: true,
+	params.EventMeta:      true,
+}
+
+// GET changes/events[?after=$seq][&limit=$count]
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-changesevents
+func (h *Handler) serveChangesEvents(_ http.Header, req *http.Request) (interface{}, error) {
+	var after int64
+	if s := req.Form.Get("after"); s != "" {
+		var err error
+		after, err = strconv.ParseInt(s, 10, 64)
+		if err != nil || after < 0 {
+			return nil, badRequestf(nil, "invalid 'after' value")
+		}
+	}
+	limit := defaultEventsLimit
+	if s := req.Form.Get("limit"); s != "" {
+		var err error
+		limit, err = strconv.Atoi(s)
+		if err != nil || limit <= 0 {
+			return nil, badRequestf(nil, "invalid 'limit' value")
+		}
+		if limit > maxEventsLimit {
+			limit = maxEventsLimit
+		}
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	events, err := store.Events(after, limit)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrCursorExpired))
+	}
+	resp := params.EventsResponse{
+		Events: make([]params.Event, len(events)),
+		Cursor: after,
+	}
+	for i := range events {
+		resp.Events[i] = charmstore.EventParams(&events[i])
+		resp.Cursor = events[i].Seq
+	}
+	return resp, nil
+}
+
+// GET changes/stream[?after=$seq][&include=$meta...]
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-changesstream
+func (h *Handler) serveChangesStream(w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "GET" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return errgo.New("response writer does not support streaming")
+	}
+	var includes []string
+	for _, include := range req.Form["include"] {
+		if include == "" {
+			continue
+		}
+		if !h.Router.IsMetadataName(include) {
+			return badRequestf(nil, "unrecognized metadata name %q", include)
+		}
+		includes = append(includes, include)
+	}
+	// A client that reconnects after losing its connection sends
+	// the id of the last event it received in the Last-Event-ID
+	// header, which takes precedence over the after parameter.
+	afterStr := req.Header.Get("Last-Event-ID")
+	if afterStr == "" {
+		afterStr = req.Form.Get("after")
+	}
+	var after int64
+	if afterStr != "" {
+		var err error
+		after, err = strconv.ParseInt(afterStr, 10, 64)
+		if err != nil || after < 0 {
+			return badRequestf(nil, "invalid 'after' value")
+		}
+	} else {
+		// Only stream the events that happen from now on.
+		store := h.pool.Store()
+		var err error
+		after, err = store.LastEventSeq()
+		store.Close()
+		if err != nil {
+			return errgo.Mask(err)
+		}
+	}
+	// Get the first events before sending the response header
+	// so that an expired cursor can be reported as an error.
+	events, err := h.streamEvents(after)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrCursorExpired))
+	}
+	var closed <-chan bool
+	if notifier, ok := w.(http.CloseNotifier); ok {
+		closed = notifier.CloseNotify()
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	lastWrite := time.Now()
+	for {
+		sent := false
+		reads := h.newStreamReadChecker(req)
+		for i := range events {
+			e := &events[i]
+			after = e.Seq
+			se := h.streamEvent(e, includes, reads, req)
+			if se == nil {
+				continue
+			}
+			if err := writeStreamEvent(w, se); err != nil {
+				logger.Infof("cannot write stream event: %v", err)
+				return nil
+			}
+			sent = true
+		}
+		if !sent && time.Since(lastWrite) >= streamKeepAliveInterval {
+			if _, err := fmt.Fprint(w, ": keep-alive\n\n"); err != nil {
+				return nil
+			}
+			sent = true
+		}
+		if sent {
+			flusher.Flush()
+			lastWrite = time.Now()
+		}
+		if len(events) < streamBatchSize {
+			select {
+			case <-closed:
+				return nil
+			case <-time.After(streamPollInterval):
+			}
+		}
+		events, err = h.streamEvents(after)
+		if err != nil {
+			// The response header has already been sent, so
+			// end the stream. If the cursor has expired, the
+			// client will be told when it reconnects.
+			logger.Infof("cannot get events following %d: %v", after, err)
+			return nil
+		}
+	}
+}
+
+// streamEvents returns the next batch of events
+// following the given sequence number.
+func (h *Handler) streamEvents(after int64) ([]mongodoc.Event, error) {
+	store := h.pool.Store()
+	defer store.Close()
+	events, err := store.Events(after, streamBatchSize)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrCursorExpired))
+	}
+	return events, nil
+}
+
+// streamEvent returns the data to send to the client of changes/stream
+// for the given event, including the given metadata of its entity. It
+// returns nil if the event should not be sent, because it is not of a
+// kind that is streamed, it does not refer to a single entity, or the
+// client is not authorized to read the entity.
+func (h *Handler) streamEvent(e *mongodoc.Event, includes []string, reads *streamReadChecker, req *http.Request) *params.StreamEvent {
+	if !streamEventKinds[params.EventKind(e.Kind)] || e.Id == nil || e.Id.Revision == -1 {
+		return nil
+	}
+	id := &router.ResolvedURL{
+		URL:                 *e.Id,
+		PromulgatedRevision: -1,
+	}
+	if e.PromulgatedId != nil {
+		id.PromulgatedRevision = e.PromulgatedId.Revision
+	}
+	if !reads.canRead(id) {
+		return nil
+	}
+	se := &params.StreamEvent{
+		Event: charmstore.EventParams(e),
+	}
+	if len(includes) > 0 {
+		meta, err := h.Router.GetMetadata(id, includes, req)
+		if err != nil {
+			// The entity may have been removed since the
+			// event was recorded.
+			logger.Infof("cannot retrieve metadata for %v: %v", id, err)
+			return nil
+		}
+		se.Meta = meta
+	}
+	return se
+}
+
+// streamReadChecker checks whether the client of changes/stream can
+// read the entities of a batch of events. Unlike AuthorizeEntity, it
+// checks the read ACLs only against the credentials already in the
+// request, so that no macaroon is minted for each event that the
+// client cannot read, and it caches the result for each base entity.
+type streamReadChecker struct {
+	h *Handler
+
+	// auth holds the credentials found in the request,
+	// and authErr any error found when checking them.
+	auth    authorization
+	authErr error
+
+	// canReadBase holds whether the client can read
+	// each base entity, keyed by user and name.
+	canReadBase map[string]bool
+}
+
+// newStreamReadChecker returns a streamReadChecker for
+// a batch of events streamed in response to req.
+func (h *Handler) newStreamReadChecker(req *http.Request) *streamReadChecker {
+	auth, err := h.checkRequest(req, nil)
+	return &streamReadChecker{
+		h:           h,
+		auth:        auth,
+		authErr:     err,
+		canReadBase: make(map[string]bool),
+	}
+}
+
+// canRead reports whether the client can read the entity with the
+// given id.
+func (c *streamReadChecker) canRead(id *router.ResolvedURL) bool {
+	key := id.URL.User + "/" + id.URL.Name
+	if ok, found := c.canReadBase[key]; found {
+		return ok
+	}
+	ok := c.checkRead(id)
+	c.canReadBase[key] = ok
+	return ok
+}
+
+func (c *streamReadChecker) checkRead(id *router.ResolvedURL) bool {
+	store := c.h.pool.Store()
+	defer store.Close()
+	baseEntity, err := store.FindBaseEntity(&id.URL, "acls")
+	if err != nil {
+		if errgo.Cause(err) != params.ErrNotFound {
+			logger.Errorf("cannot retrieve permissions of %v: %v", id, err)
+		}
+		return false
+	}
+	for _, name := range baseEntity.ACLs.Read {
+		if name == params.Everyone {
+			return true
+		}
+	}
+	if c.authErr != nil {
+		return false
+	}
+	return c.h.checkACLMembership(c.auth, baseEntity.ACLs.Read) == nil
+}
+
+// writeStreamEvent writes the given event to w in the
+// Server-Sent Events format.
+func writeStreamEvent(w http.ResponseWriter, se *params.StreamEvent) error {
+	data, err := json.Marshal(se)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if _, err := fmt.Fprintf(w, "id: %d\nevent: %s\ndata: %s\n\n", se.Seq, se.Kind, data); err != nil {
+		return errgo.Mask(err)
+	}
+	return nil
+}
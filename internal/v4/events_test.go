@@ -0,0 +1,412 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/internal/v4"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type EventsSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&EventsSuite{})
+
+func (s *EventsSuite) TestChangesEvents(c *gc.C) {
+	rid := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(rid, storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = s.store.SetPerms(&rid.URL, "read", params.Everyone, rid.URL.User)
+	c.Assert(err, gc.IsNil)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/meta/extra-info/vcs-revision"),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Username: testUsername,
+		Password: testPassword,
+		Body:     bytes.NewReader([]byte(`"1234"`)),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+
+	resp := s.getEvents(c, "")
+	c.Assert(resp.Cursor, gc.Equals, int64(3))
+	for i := range resp.Events {
+		c.Assert(resp.Events[i].Time.IsZero(), gc.Equals, false)
+		resp.Events[i].Time = time.Time{}
+	}
+	c.Assert(resp.Events, jc.DeepEquals, []params.Event{{
+		Seq:     1,
+		Kind:    params.EventUpload,
+		Id:      &rid.URL,
+		Channel: params.StableChannel,
+	}, {
+		Seq:    2,
+		Kind:   params.EventPerm,
+		Id:     charm.MustParseReference("cs:~charmers/wordpress"),
+		Fields: []string{"read"},
+	}, {
+		Seq:    3,
+		Kind:   params.EventExtraInfo,
+		Id:     &rid.URL,
+		Fields: []string{"vcs-revision"},
+	}})
+
+	// The feed can be resumed from the cursor.
+	resp = s.getEvents(c, "?after=1&limit=1")
+	c.Assert(resp.Cursor, gc.Equals, int64(2))
+	c.Assert(resp.Events, gc.HasLen, 1)
+	c.Assert(resp.Events[0].Seq, gc.Equals, int64(2))
+
+	resp = s.getEvents(c, "?after=3")
+	c.Assert(resp.Cursor, gc.Equals, int64(3))
+	c.Assert(resp.Events, gc.HasLen, 0)
+}
+
+func (s *EventsSuite) TestChangesEventsCursorExpired(c *gc.C) {
+	// Simulate the earlier events having been discarded.
+	err := s.store.DB.Events().Insert(&mongodoc.Event{
+		Seq:  5,
+		Kind: string(params.EventMeta),
+		Id:   charm.MustParseReference("cs:~charmers/wordpress"),
+	})
+	c.Assert(err, gc.IsNil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("changes/events?after=2"),
+		ExpectStatus: http.StatusGone,
+		ExpectBody: params.Error{
+			Code:    params.ErrCursorExpired,
+			Message: "events following 2 have expired",
+		},
+	})
+}
+
+var changesEventsErrorsTests = []struct {
+	about       string
+	url         string
+	expectError string
+}{{
+	about:       "invalid after",
+	url:         "?after=foo",
+	expectError: "invalid 'after' value",
+}, {
+	about:       "negative after",
+	url:         "?after=-1",
+	expectError: "invalid 'after' value",
+}, {
+	about:       "invalid limit",
+	url:         "?limit=0",
+	expectError: "invalid 'limit' value",
+}}
+
+func (s *EventsSuite) TestChangesEventsErrors(c *gc.C) {
+	for i, test := range changesEventsErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL("changes/events" + test.url),
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Code:    params.ErrBadRequest,
+				Message: test.expectError,
+			},
+		})
+	}
+}
+
+// getEvents gets the change feed events with the given query.
+func (s *EventsSuite) getEvents(c *gc.C, query string) params.EventsResponse {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("changes/events" + query),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var resp params.EventsResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.IsNil)
+	return resp
+}
+
+func (s *EventsSuite) TestChangesStream(c *gc.C) {
+	s.PatchValue(v4.StreamPollInterval, 10*time.Millisecond)
+	srv := httptest.NewServer(s.srv)
+	defer srv.Close()
+
+	// Events recorded before the stream is opened are not sent.
+	s.addCharm(c, "~charmers/precise/wordpress-0", true)
+
+	stream := openStream(c, srv.URL+storeURL("changes/stream?include=archive-size&include=id-name"), nil)
+	defer stream.Close()
+	s.addCharm(c, "~charmers/precise/private-0", false)
+	rid := s.addCharm(c, "~charmers/precise/mysql-0", true)
+
+	// The private charm is not sent to an unauthenticated client,
+	// nor are the perm events.
+	e := stream.next(c)
+	c.Assert(e.id, gc.Equals, "4")
+	c.Assert(e.event, gc.Equals, "upload")
+	var se params.StreamEvent
+	err := json.Unmarshal([]byte(e.data), &se)
+	c.Assert(err, gc.IsNil)
+	c.Assert(se.Seq, gc.Equals, int64(4))
+	c.Assert(se.Kind, gc.Equals, params.EventUpload)
+	c.Assert(se.Id, jc.DeepEquals, &rid.URL)
+	c.Assert(se.Meta, gc.HasLen, 2)
+	c.Assert(se.Meta["id-name"], jc.DeepEquals, map[string]interface{}{"Name": "mysql"})
+	c.Assert(se.Meta["archive-size"], gc.NotNil)
+
+	// Metadata changes are sent.
+	err = s.store.AddUpdateEvents(rid, map[string]interface{}{"extrainfo.foo": "bar"})
+	c.Assert(err, gc.IsNil)
+	e = stream.next(c)
+	c.Assert(e.id, gc.Equals, "6")
+	c.Assert(e.event, gc.Equals, "extra-info")
+
+	// A reconnecting client resumes from the last event it received.
+	stream1 := openStream(c, srv.URL+storeURL("changes/stream"), http.Header{
+		"Last-Event-ID": {"3"},
+	})
+	defer stream1.Close()
+	e = stream1.next(c)
+	c.Assert(e.id, gc.Equals, "4")
+	e = stream1.next(c)
+	c.Assert(e.id, gc.Equals, "6")
+}
+
+func (s *EventsSuite) TestChangesStreamAdmin(c *gc.C) {
+	s.PatchValue(v4.StreamPollInterval, 10*time.Millisecond)
+	srv := httptest.NewServer(s.srv)
+	defer srv.Close()
+	s.addCharm(c, "~charmers/precise/private-0", false)
+
+	// Admins are sent events for all entities.
+	req, err := http.NewRequest("GET", srv.URL+storeURL("changes/stream?after=0"), nil)
+	c.Assert(err, gc.IsNil)
+	req.SetBasicAuth(testUsername, testPassword)
+	stream := doStream(c, req)
+	defer stream.Close()
+	e := stream.next(c)
+	c.Assert(e.id, gc.Equals, "1")
+	c.Assert(e.event, gc.Equals, "upload")
+}
+
+func (s *EventsSuite) TestChangesStreamKeepAlive(c *gc.C) {
+	s.PatchValue(v4.StreamPollInterval, 10*time.Millisecond)
+	s.PatchValue(v4.StreamKeepAliveInterval, time.Duration(0))
+	srv := httptest.NewServer(s.srv)
+	defer srv.Close()
+	stream := openStream(c, srv.URL+storeURL("changes/stream"), nil)
+	defer stream.Close()
+	line := stream.readLine(c)
+	c.Assert(line, gc.Equals, ": keep-alive")
+}
+
+type EventsIdentitySuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&EventsIdentitySuite{})
+
+func (s *EventsIdentitySuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *EventsIdentitySuite) TestChangesStreamMintsNoMacaroons(c *gc.C) {
+	s.PatchValue(v4.StreamPollInterval, 10*time.Millisecond)
+	srv := httptest.NewServer(s.srv)
+	defer srv.Close()
+	for _, id := range []string{
+		"~charmers/precise/private-0",
+		"~charmers/trusty/private-1",
+		"~charmers/precise/other-0",
+	} {
+		rid := newResolvedURL(id, -1)
+		err := s.store.AddCharmWithArchive(rid, storetesting.Charms.CharmDir("wordpress"))
+		c.Assert(err, gc.IsNil)
+	}
+	rid := newResolvedURL("~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(rid, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = s.store.SetPerms(&rid.URL, "read", params.Everyone)
+	c.Assert(err, gc.IsNil)
+
+	// The events of the private charms are skipped
+	// without a discharge being required for each.
+	stream := openStream(c, srv.URL+storeURL("changes/stream?after=0"), nil)
+	defer stream.Close()
+	e := stream.next(c)
+	c.Assert(e.id, gc.Equals, "4")
+	c.Assert(e.event, gc.Equals, "upload")
+	n, err := s.store.DB.Macaroons().Count()
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 0)
+}
+
+var changesStreamErrorsTests = []struct {
+	about        string
+	url          string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "invalid after",
+	url:          "?after=foo",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "invalid 'after' value",
+	},
+}, {
+	about:        "unknown include",
+	url:          "?include=no-such-meta",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `unrecognized metadata name "no-such-meta"`,
+	},
+}, {
+	about:        "expired cursor",
+	url:          "?after=2",
+	expectStatus: http.StatusGone,
+	expectBody: params.Error{
+		Code:    params.ErrCursorExpired,
+		Message: "events following 2 have expired",
+	},
+}}
+
+func (s *EventsSuite) TestChangesStreamErrors(c *gc.C) {
+	// Simulate the earlier events having been discarded.
+	err := s.store.DB.Events().Insert(&mongodoc.Event{
+		Seq:  5,
+		Kind: string(params.EventMeta),
+		Id:   charm.MustParseReference("cs:~charmers/wordpress"),
+	})
+	c.Assert(err, gc.IsNil)
+	for i, test := range changesStreamErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL("changes/stream" + test.url),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+// addCharm adds the wordpress charm to the store with the given id,
+// readable by everyone if public is true.
+func (s *EventsSuite) addCharm(c *gc.C, id string, public bool) *router.ResolvedURL {
+	rid := newResolvedURL(id, -1)
+	err := s.store.AddCharmWithArchive(rid, storetesting.Charms.CharmDir("wordpress"))
+	c.Assert(err, gc.IsNil)
+	if public {
+		err = s.store.SetPerms(&rid.URL, "read", params.Everyone, rid.URL.User)
+		c.Assert(err, gc.IsNil)
+	}
+	return rid
+}
+
+// eventStream reads Server-Sent Events from a response body.
+type eventStream struct {
+	resp  *http.Response
+	lines chan string
+}
+
+// streamEvent holds a Server-Sent Event.
+type streamEvent struct {
+	id    string
+	event string
+	data  string
+}
+
+func openStream(c *gc.C, url string, header http.Header) *eventStream {
+	req, err := http.NewRequest("GET", url, nil)
+	c.Assert(err, gc.IsNil)
+	for k, v := range header {
+		req.Header[k] = v
+	}
+	return doStream(c, req)
+}
+
+func doStream(c *gc.C, req *http.Request) *eventStream {
+	resp, err := http.DefaultClient.Do(req)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.StatusCode, gc.Equals, http.StatusOK)
+	c.Assert(resp.Header.Get("Content-Type"), gc.Equals, "text/event-stream")
+	stream := &eventStream{
+		resp:  resp,
+		lines: make(chan string),
+	}
+	go func() {
+		defer close(stream.lines)
+		r := bufio.NewReader(resp.Body)
+		for {
+			line, err := r.ReadString('\n')
+			if err != nil {
+				return
+			}
+			stream.lines <- strings.TrimSuffix(line, "\n")
+		}
+	}()
+	return stream
+}
+
+func (s *eventStream) Close() {
+	s.resp.Body.Close()
+	for range s.lines {
+	}
+}
+
+// readLine returns the next line from the stream.
+func (s *eventStream) readLine(c *gc.C) string {
+	select {
+	case line, ok := <-s.lines:
+		c.Assert(ok, gc.Equals, true, gc.Commentf("stream closed unexpectedly"))
+		return line
+	case <-time.After(5 * time.Second):
+		c.Fatalf("timed out waiting for stream event")
+	}
+	panic("unreachable")
+}
+
+// next returns the next event from the stream,
+// skipping any comments.
+func (s *eventStream) next(c *gc.C) streamEvent {
+	var e streamEvent
+	for {
+		line := s.readLine(c)
+		switch {
+		case line == "":
+			if e.id != "" {
+				return e
+			}
+		case strings.HasPrefix(line, "id: "):
+			e.id = strings.TrimPrefix(line, "id: ")
+		case strings.HasPrefix(line, "event: "):
+			e.event = strings.TrimPrefix(line, "event: ")
+		case strings.HasPrefix(line, "data: "):
+			e.data = strings.TrimPrefix(line, "data: ")
+		}
+	}
+}
@@ -12,9 +12,14 @@ var (
 	ParamsLogLevels                = paramsLogLevels
 	ParamsLogTypes                 = paramsLogTypes
 	ProcessIcon                    = processIcon
+	IconAppearance                 = iconAppearance
 	ErrProbablyNotXML              = errProbablyNotXML
 	UsernameAttr                   = usernameAttr
 	GetNewPromulgatedRevision      = (*Handler).getNewPromulgatedRevision
 	DelegatableMacaroonExpiry      = delegatableMacaroonExpiry
 	GroupsForUser                  = (*Handler).groupsForUser
+	IfMatchModifications           = ifMatchModifications
+	UnifiedDiff                    = unifiedDiff
+	StreamPollInterval             = &streamPollInterval
+	StreamKeepAliveInterval        = &streamKeepAliveInterval
 )
@@ -0,0 +1,52 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"net/http"
+	"time"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// POST gc[?dry-run=0|1][&grace-period=duration]
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-gc
+func (h *Handler) serveBlobGC(_ http.Header, req *http.Request) (interface{}, error) {
+	if _, err := h.authorize(req, nil, true, nil); err != nil {
+		return nil, err
+	}
+	if req.Method != "POST" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	dryRun, err := router.ParseBool(req.Form.Get("dry-run"))
+	if err != nil {
+		return nil, badRequestf(err, "invalid dry-run value")
+	}
+	gracePeriod := charmstore.DefaultBlobGCGracePeriod
+	if s := req.Form.Get("grace-period"); s != "" {
+		gracePeriod, err = time.ParseDuration(s)
+		if err != nil || gracePeriod < 0 {
+			return nil, badRequestf(nil, "invalid grace-period value %q", s)
+		}
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	result, err := store.CollectBlobGarbage(charmstore.BlobGCParams{
+		DryRun:      dryRun,
+		GracePeriod: gracePeriod,
+	})
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot collect orphaned blobs")
+	}
+	return params.BlobGCResponse{
+		DryRun:  dryRun,
+		Orphans: result.Orphans,
+		Removed: result.Removed,
+		Errors:  result.Errors,
+	}, nil
+}
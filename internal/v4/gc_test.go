@@ -0,0 +1,139 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bytes"
+	"net/http"
+	"time"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/mgo.v2/bson"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type GCSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&GCSuite{})
+
+func (s *GCSuite) putBlob(c *gc.C, name, content string) {
+	err := s.store.BlobStore.PutUnchallenged(bytes.NewReader([]byte(content)), name, int64(len(content)), hashOfBytes([]byte(content)))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *GCSuite) TestGC(c *gc.C) {
+	id := newResolvedURL("cs:~charmers/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(id, storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"))
+	c.Assert(err, gc.IsNil)
+	orphan := bson.NewObjectIdWithTime(time.Now().Add(-48 * time.Hour)).Hex()
+	s.putBlob(c, orphan, "orphan")
+	recent := bson.NewObjectIdWithTime(time.Now().Add(-2 * time.Hour)).Hex()
+	s.putBlob(c, recent, "recent")
+
+	// The default grace period excludes the recent blob.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("gc?dry-run=1"),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: params.BlobGCResponse{
+			DryRun:  true,
+			Orphans: []string{orphan},
+			Removed: []string{},
+		},
+	})
+	_, _, err = s.store.BlobStore.Open(orphan)
+	c.Assert(err, gc.IsNil)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("gc?grace-period=1h"),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: params.BlobGCResponse{
+			Orphans: []string{orphan, recent},
+			Removed: []string{orphan, recent},
+		},
+	})
+	_, _, err = s.store.BlobStore.Open(orphan)
+	c.Assert(err, gc.ErrorMatches, `resource at path "[^"]+" not found`)
+	_, _, err = s.store.BlobStore.Open(recent)
+	c.Assert(err, gc.ErrorMatches, `resource at path "[^"]+" not found`)
+
+	// The entity archive is still available.
+	_, _, _, err = s.store.OpenBlob(id)
+	c.Assert(err, gc.IsNil)
+}
+
+var gcErrorTests = []struct {
+	about        string
+	method       string
+	url          string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "bad method",
+	method:       "GET",
+	url:          "gc",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET method not allowed",
+	},
+}, {
+	about:        "bad dry-run value",
+	method:       "POST",
+	url:          "gc?dry-run=yes",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid dry-run value: unexpected bool value "yes" (must be "0" or "1")`,
+	},
+}, {
+	about:        "bad grace period",
+	method:       "POST",
+	url:          "gc?grace-period=forever",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid grace-period value "forever"`,
+	},
+}}
+
+func (s *GCSuite) TestGCErrors(c *gc.C) {
+	for i, test := range gcErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.url),
+			Method:       test.method,
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *GCSuite) TestGCUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("gc"),
+		Method:       "POST",
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Message: "authentication failed: missing HTTP auth header",
+			Code:    params.ErrUnauthorized,
+		},
+	})
+}
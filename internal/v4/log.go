@@ -182,11 +182,13 @@ var (
 	mongodocLogTypes = map[mongodoc.LogType]params.LogType{
 		mongodoc.IngestionType:        params.IngestionType,
 		mongodoc.LegacyStatisticsType: params.LegacyStatisticsType,
+		mongodoc.ScrubType:            params.ScrubType,
 	}
 	// paramsLogTypes maps API params log types to internal mongodoc ones.
 	paramsLogTypes = map[params.LogType]mongodoc.LogType{
 		params.IngestionType:        mongodoc.IngestionType,
 		params.LegacyStatisticsType: mongodoc.LegacyStatisticsType,
+		params.ScrubType:            mongodoc.ScrubType,
 	}
 )
 
@@ -0,0 +1,157 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"os"
+
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// maxUploadMetadataSize holds the maximum size of the
+// metadata part of a multipart archive upload.
+const maxUploadMetadataSize = 1024 * 1024
+
+// isMultipartUpload reports whether the body of the given
+// archive upload request is multipart/form-data.
+func isMultipartUpload(req *http.Request) bool {
+	mediaType, _, err := mime.ParseMediaType(req.Header.Get("Content-Type"))
+	return err == nil && mediaType == "multipart/form-data"
+}
+
+// uploadBody returns the archive content of the given upload request
+// in the same way as archiveBody. If the request body is
+// multipart/form-data, the archive is read from its "archive" part and
+// the metadata in its "metadata" part, if any, is stored in info.
+func (h *Handler) uploadBody(store *charmstore.Store, req *http.Request, info *uploadInfo) (io.ReadCloser, int64, *mongodoc.Upload, error) {
+	if !isMultipartUpload(req) {
+		return h.archiveBody(store, req)
+	}
+	if req.Form.Get("upload") != "" || req.Form.Get("size") != "" {
+		return nil, 0, nil, badRequestf(nil, "upload and size parameters cannot be used with a multipart body")
+	}
+	body, size, meta, err := readMultipartUpload(req)
+	if err != nil {
+		return nil, 0, nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	info.meta = meta
+	return body, size, nil, nil
+}
+
+// readMultipartUpload reads the archive and metadata parts of the given
+// multipart/form-data upload request. The archive is copied to a
+// temporary file, which is removed when the returned body is closed.
+func readMultipartUpload(req *http.Request) (body io.ReadCloser, size int64, meta map[string]*json.RawMessage, err error) {
+	mr, err := req.MultipartReader()
+	if err != nil {
+		return nil, 0, nil, badRequestf(err, "cannot read multipart body")
+	}
+	var f *os.File
+	defer func() {
+		if err != nil && f != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+	gotMeta := false
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, 0, nil, badRequestf(err, "cannot read multipart body")
+		}
+		switch name := part.FormName(); name {
+		case "archive":
+			if f != nil {
+				return nil, 0, nil, badRequestf(nil, "duplicate archive part in multipart body")
+			}
+			f, err = ioutil.TempFile("", "charmstore-archive")
+			if err != nil {
+				return nil, 0, nil, errgo.Notef(err, "cannot create temporary file")
+			}
+			size, err = io.Copy(f, part)
+			if err != nil {
+				return nil, 0, nil, badRequestf(err, "cannot read archive part")
+			}
+		case "metadata":
+			if gotMeta {
+				return nil, 0, nil, badRequestf(nil, "duplicate metadata part in multipart body")
+			}
+			gotMeta = true
+			var metaBody struct {
+				Meta map[string]*json.RawMessage
+			}
+			if err := json.NewDecoder(io.LimitReader(part, maxUploadMetadataSize)).Decode(&metaBody); err != nil {
+				return nil, 0, nil, badRequestf(err, "cannot unmarshal metadata part")
+			}
+			meta = metaBody.Meta
+		default:
+			return nil, 0, nil, badRequestf(nil, "unexpected part %q in multipart body", name)
+		}
+	}
+	if f == nil {
+		return nil, 0, nil, badRequestf(nil, "archive part not found in multipart body")
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, 0, nil, errgo.Notef(err, "cannot seek temporary file")
+	}
+	return tempFile{f}, size, meta, nil
+}
+
+// tempFile is a temporary file that
+// is removed when it is closed.
+type tempFile struct {
+	*os.File
+}
+
+// Close implements io.Closer.Close.
+func (f tempFile) Close() error {
+	f.File.Close()
+	return os.Remove(f.Name())
+}
+
+// addArchiveWithMetadata adds the archive as addArchive does and then
+// writes the metadata in info to the new entity. The metadata is
+// checked before the archive is added, but it can only be written once
+// the entity exists, by which time the upload has been recorded in the
+// change feed (and so delivered to webhooks) and the modification
+// counts have been incremented. If any of the metadata then cannot be
+// written, the metadata already written is reverted and the new entity
+// is removed again, which records a compensating delete event.
+func (h *Handler) addArchiveWithMetadata(id *router.ResolvedURL, body io.Reader, hash string, size int64, info uploadInfo, req *http.Request) error {
+	if len(info.meta) == 0 {
+		return h.addArchive(id, body, hash, size, info, req)
+	}
+	meta, err := h.Router.PrepareMetadata(id, info.meta, req)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot put metadata", errgo.Any)
+	}
+	if err := h.addArchive(id, body, hash, size, info, req); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrDuplicateUpload), errgo.Is(params.ErrBadRequest), isContentError, isProblemError)
+	}
+	if err := meta.Apply(); err != nil {
+		store := h.pool.Store()
+		defer store.Close()
+		// RemoveEntity adds a delete event for the entity,
+		// so that clients of the change feed that have seen
+		// the upload know that the revision has gone.
+		if err := store.RemoveEntity(id); err != nil {
+			logger.Errorf("cannot remove %s after failed metadata update: %v", id, err)
+		}
+		return errgo.NoteMask(err, "cannot put metadata", errgo.Any)
+	}
+	return nil
+}
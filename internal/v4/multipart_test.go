@@ -0,0 +1,247 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type MultipartSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&MultipartSuite{})
+
+func (s *MultipartSuite) TestUploadWithMetadata(c *gc.C) {
+	rec := s.uploadMultipart(c, "~charmers/precise/wordpress", map[string]interface{}{
+		"extra-info": map[string]interface{}{
+			"vcs-revision": "1234",
+		},
+		"release-notes": "Fixed the db relation.",
+		"perm/read":     []string{params.Everyone, "charmers"},
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var resp params.ArchiveUploadResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.Id, jc.DeepEquals, charm.MustParseReference("cs:~charmers/precise/wordpress-0"))
+
+	entity, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.ReleaseNotes, gc.Equals, "Fixed the db relation.")
+	c.Assert(entity.ExtraInfo, jc.DeepEquals, map[string][]byte{
+		"vcs-revision": []byte(`"1234"`),
+	})
+	baseEntity, err := s.store.FindBaseEntity(&entity.URL.URL)
+	c.Assert(err, gc.IsNil)
+	c.Assert(baseEntity.ACLs.Read, jc.DeepEquals, []string{params.Everyone, "charmers"})
+}
+
+func (s *MultipartSuite) TestUploadWithoutMetadata(c *gc.C) {
+	rec := s.uploadMultipart(c, "~charmers/precise/wordpress", nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	_, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *MultipartSuite) TestUploadWithInvalidMetadataAddsNothing(c *gc.C) {
+	err := s.store.AddCharmWithArchive(
+		newResolvedURL("~charmers/precise/wordpress-0", -1),
+		storetesting.Charms.CharmDir("mysql"),
+	)
+	c.Assert(err, gc.IsNil)
+	before, err := s.store.FindBaseEntity(charm.MustParseReference("~charmers/wordpress"))
+	c.Assert(err, gc.IsNil)
+
+	rec := s.uploadMultipart(c, "~charmers/precise/wordpress", map[string]interface{}{
+		"perm/read":     []string{params.Everyone},
+		"release-notes": strings.Repeat("x", 64*1024+1),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusInternalServerError, gc.Commentf("body: %s", rec.Body.String()))
+	var errResp params.Error
+	err = json.Unmarshal(rec.Body.Bytes(), &errResp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(errResp.Code, gc.Equals, params.ErrMultipleErrors)
+	c.Assert(errResp.Info["release-notes"], gc.NotNil)
+
+	// The metadata is checked before the archive is added, so
+	// no revision has been added and the base entity is unchanged.
+	_, err = s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-1", -1))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	after, err := s.store.FindBaseEntity(charm.MustParseReference("~charmers/wordpress"))
+	c.Assert(err, gc.IsNil)
+	c.Assert(after, jc.DeepEquals, before)
+}
+
+func (s *MultipartSuite) TestUploadWithUnknownMetadataAddsNothing(c *gc.C) {
+	rec := s.uploadMultipart(c, "~charmers/precise/wordpress", map[string]interface{}{
+		"no-such": "value",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest, gc.Commentf("body: %s", rec.Body.String()))
+	_, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	_, err = s.store.FindBaseEntity(charm.MustParseReference("~charmers/wordpress"))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *MultipartSuite) TestUploadSameArchiveAppliesMetadata(c *gc.C) {
+	rec := s.uploadMultipart(c, "~charmers/precise/wordpress", nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+
+	// Uploading the same archive again does not add a revision,
+	// but the metadata is written to the latest revision.
+	rec = s.uploadMultipart(c, "~charmers/precise/wordpress", map[string]interface{}{
+		"extra-info": map[string]interface{}{
+			"vcs-revision": "1234",
+		},
+		"release-notes": "Fixed the db relation.",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var resp params.ArchiveUploadResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.Id, jc.DeepEquals, charm.MustParseReference("cs:~charmers/precise/wordpress-0"))
+
+	entity, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.ReleaseNotes, gc.Equals, "Fixed the db relation.")
+	c.Assert(entity.ExtraInfo, jc.DeepEquals, map[string][]byte{
+		"vcs-revision": []byte(`"1234"`),
+	})
+	_, err = s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-1", -1))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
+
+func (s *MultipartSuite) TestUploadSameArchiveWithInvalidMetadata(c *gc.C) {
+	rec := s.uploadMultipart(c, "~charmers/precise/wordpress", nil)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+
+	rec = s.uploadMultipart(c, "~charmers/precise/wordpress", map[string]interface{}{
+		"no-such": "value",
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest, gc.Commentf("body: %s", rec.Body.String()))
+}
+
+var multipartErrorsTests = []struct {
+	about       string
+	parts       []string
+	url         string
+	expectError string
+}{{
+	about:       "no archive part",
+	parts:       []string{"metadata"},
+	expectError: "archive part not found in multipart body",
+}, {
+	about:       "duplicate archive part",
+	parts:       []string{"archive", "archive"},
+	expectError: "duplicate archive part in multipart body",
+}, {
+	about:       "unexpected part",
+	parts:       []string{"archive", "other"},
+	expectError: `unexpected part "other" in multipart body`,
+}, {
+	about:       "upload parameter specified",
+	parts:       []string{"archive"},
+	url:         "&upload=1234",
+	expectError: "upload and size parameters cannot be used with a multipart body",
+}}
+
+func (s *MultipartSuite) TestUploadErrors(c *gc.C) {
+	archive := s.archiveBytes(c)
+	for i, test := range multipartErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		var buf bytes.Buffer
+		w := multipart.NewWriter(&buf)
+		for _, name := range test.parts {
+			part, err := w.CreateFormFile(name, name)
+			c.Assert(err, gc.IsNil)
+			if name == "metadata" {
+				_, err = part.Write([]byte(`{"Meta": {}}`))
+			} else {
+				_, err = part.Write(archive)
+			}
+			c.Assert(err, gc.IsNil)
+		}
+		err := w.Close()
+		c.Assert(err, gc.IsNil)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			URL:     storeURL("~charmers/precise/wordpress/archive?hash=" + hashOfBytes(archive) + test.url),
+			Method:  "POST",
+			Header: http.Header{
+				"Content-Type": {w.FormDataContentType()},
+			},
+			Body:         &buf,
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: http.StatusBadRequest,
+			ExpectBody: params.Error{
+				Message: test.expectError,
+				Code:    params.ErrBadRequest,
+			},
+		})
+	}
+}
+
+// archiveBytes returns the contents of the
+// archive of the wordpress charm.
+func (s *MultipartSuite) archiveBytes(c *gc.C) []byte {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	f, err := os.Open(ch.Path)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, f)
+	c.Assert(err, gc.IsNil)
+	return buf.Bytes()
+}
+
+// uploadMultipart uploads the wordpress charm to the given id in a
+// multipart body along with the given metadata, if any.
+func (s *MultipartSuite) uploadMultipart(c *gc.C, id string, meta map[string]interface{}) *httptest.ResponseRecorder {
+	archive := s.archiveBytes(c)
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	if meta != nil {
+		part, err := w.CreateFormField("metadata")
+		c.Assert(err, gc.IsNil)
+		err = json.NewEncoder(part).Encode(map[string]interface{}{
+			"Meta": meta,
+		})
+		c.Assert(err, gc.IsNil)
+	}
+	part, err := w.CreateFormFile("archive", "wordpress.zip")
+	c.Assert(err, gc.IsNil)
+	_, err = part.Write(archive)
+	c.Assert(err, gc.IsNil)
+	err = w.Close()
+	c.Assert(err, gc.IsNil)
+	return httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/archive?hash=" + hashOfBytes(archive)),
+		Method:  "POST",
+		Header: http.Header{
+			"Content-Type": {w.FormDataContentType()},
+		},
+		Body:     &buf,
+		Username: testUsername,
+		Password: testPassword,
+	})
+}
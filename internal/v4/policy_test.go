@@ -0,0 +1,155 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"fmt"
+	"net/http"
+	"os"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/config"
+	"gopkg.in/juju/charmstore.v4/internal/policy"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type PolicySuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&PolicySuite{})
+
+func (s *PolicySuite) SetUpSuite(c *gc.C) {
+	s.policy = policy.NewFromConfig(&config.Config{
+		PolicyForbiddenFiles: []string{"*.c"},
+		PolicyRequiredHooks:  []string{"install", "start"},
+		PolicyRequireReadme:  true,
+	})
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *PolicySuite) TestUploadViolatingPolicy(c *gc.C) {
+	id := charm.MustParseReference("~charmers/precise/dummy-0")
+	s.assertUploadCharm(c, "PUT", id, "dummy", http.StatusForbidden, params.Error{
+		Message: "archive violates content policy: forbidden-files: forbidden files found: src/hello.c; require-readme: no README file found; required-hooks: missing hooks: start",
+		Code:    params.ErrPolicyViolation,
+		Info: map[string]*params.Error{
+			"forbidden-files": {
+				Message: "forbidden files found: src/hello.c",
+				Code:    params.ErrPolicyViolation,
+			},
+			"require-readme": {
+				Message: "no README file found",
+				Code:    params.ErrPolicyViolation,
+			},
+			"required-hooks": {
+				Message: "missing hooks: start",
+				Code:    params.ErrPolicyViolation,
+			},
+		},
+	})
+
+	// The charm has not been added.
+	_, err := s.store.FindEntity(newResolvedURL("~charmers/precise/dummy-0", -1))
+	c.Assert(err, gc.ErrorMatches, `entity not found`)
+}
+
+func (s *PolicySuite) TestDryRunViolatingPolicy(c *gc.C) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "dummy")
+	f, err := os.Open(ch.Path)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	hash, size := hashOf(f)
+	_, err = f.Seek(0, 0)
+	c.Assert(err, gc.IsNil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL("~charmers/precise/dummy/archive?dry-run=1&hash=" + hash),
+		Method:        "POST",
+		ContentLength: size,
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:         f,
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusOK,
+		ExpectBody: params.ArchiveValidateResponse{
+			Problems: []*params.Error{{
+				Message: "archive violates content policy: forbidden-files: forbidden files found: src/hello.c; require-readme: no README file found; required-hooks: missing hooks: start",
+				Code:    params.ErrPolicyViolation,
+				Info: map[string]*params.Error{
+					"forbidden-files": {
+						Message: "forbidden files found: src/hello.c",
+						Code:    params.ErrPolicyViolation,
+					},
+					"require-readme": {
+						Message: "no README file found",
+						Code:    params.ErrPolicyViolation,
+					},
+					"required-hooks": {
+						Message: "missing hooks: start",
+						Code:    params.ErrPolicyViolation,
+					},
+				},
+			}},
+		},
+	})
+
+	// The charm has not been added.
+	_, err = s.store.FindEntity(newResolvedURL("~charmers/precise/dummy-0", -1))
+	c.Assert(err, gc.ErrorMatches, `entity not found`)
+}
+
+func (s *PolicySuite) TestUploadBundle(c *gc.C) {
+	// The bundle has a README and the hooks
+	// rule applies to charms only.
+	err := s.store.AddCharmWithArchive(
+		newResolvedURL("~charmers/utopic/wordpress-42", 42),
+		storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"),
+	)
+	c.Assert(err, gc.IsNil)
+	err = s.store.AddCharmWithArchive(
+		newResolvedURL("~charmers/utopic/mysql-42", 42),
+		storetesting.Charms.CharmArchive(c.MkDir(), "mysql"),
+	)
+	c.Assert(err, gc.IsNil)
+	id := charm.MustParseReference("~charmers/bundle/wordpress-simple-0")
+	path := storetesting.Charms.BundleArchivePath(c.MkDir(), "wordpress-simple")
+	s.assertUpload(c, "PUT", id, path, http.StatusOK, params.ArchiveUploadResponse{
+		Id: id,
+	})
+}
+
+func (s *PolicySuite) assertUploadCharm(c *gc.C, method string, id *charm.Reference, charmName string, expectStatus int, expectBody interface{}) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), charmName)
+	s.assertUpload(c, method, id, ch.Path, expectStatus, expectBody)
+}
+
+func (s *PolicySuite) assertUpload(c *gc.C, method string, id *charm.Reference, fileName string, expectStatus int, expectBody interface{}) {
+	f, err := os.Open(fileName)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	hash, size := hashOf(f)
+	_, err = f.Seek(0, 0)
+	c.Assert(err, gc.IsNil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL(fmt.Sprintf("%s/archive?hash=%s", id.Path(), hash)),
+		Method:        method,
+		ContentLength: size,
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:         f,
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: expectStatus,
+		ExpectBody:   expectBody,
+	})
+}
@@ -0,0 +1,86 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"net/http"
+
+	"github.com/juju/utils/jsonhttp"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// GET ~user/quota
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-userquota
+func (h *Handler) serveQuota(user string, w http.ResponseWriter, req *http.Request) error {
+	// Only the user can see their usage.
+	if _, err := h.authorize(req, []string{user}, true, nil); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	entities, bytes, err := store.UserUsage(user)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return jsonhttp.WriteJSON(w, http.StatusOK, params.QuotaResponse{
+		Entities:    entities,
+		Bytes:       bytes,
+		MaxEntities: h.config.QuotaMaxEntities,
+		MaxBytes:    h.config.QuotaMaxBytes,
+	})
+}
+
+// checkQuota checks that the given user can upload a new
+// archive of the given size without exceeding their quota.
+// If the archive is read from an upload, the upload is given
+// so that its chunks, which already count towards the quota
+// of the user that created it, are not counted twice.
+func (h *Handler) checkQuota(store *charmstore.Store, user string, size int64, upload *mongodoc.Upload) error {
+	maxEntities, maxBytes := h.config.QuotaMaxEntities, h.config.QuotaMaxBytes
+	if maxEntities == 0 && maxBytes == 0 {
+		return nil
+	}
+	entities, bytes, err := store.UserUsage(user)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	if maxEntities > 0 && entities >= maxEntities {
+		return errgo.WithCausef(nil, params.ErrQuotaExceeded, "user %q has reached the quota of %d entities", user, maxEntities)
+	}
+	if upload != nil && upload.User == user {
+		bytes -= charmstore.UploadSize(upload)
+	}
+	return h.checkByteQuota(user, "archive", size, bytes)
+}
+
+// checkBlobQuota checks that the given user can store a blob of the
+// given size, such as an upload chunk or a resource, without exceeding
+// their quota of bytes. The what parameter describes the blob. If the
+// blob replaces another blob of the user, the size of that blob is
+// given in replaced.
+func (h *Handler) checkBlobQuota(store *charmstore.Store, user, what string, size, replaced int64) error {
+	if h.config.QuotaMaxBytes == 0 {
+		return nil
+	}
+	_, bytes, err := store.UserUsage(user)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	return h.checkByteQuota(user, what, size, bytes-replaced)
+}
+
+// checkByteQuota checks that adding a blob of the given size to
+// the given number of bytes used by the user does not exceed
+// their quota of bytes.
+func (h *Handler) checkByteQuota(user, what string, size, bytes int64) error {
+	maxBytes := h.config.QuotaMaxBytes
+	if maxBytes > 0 && bytes+size > maxBytes {
+		return errgo.WithCausef(nil, params.ErrQuotaExceeded, "%s of %d bytes would exceed the quota of %d bytes of user %q (%d bytes used)", what, size, maxBytes, user, bytes)
+	}
+	return nil
+}
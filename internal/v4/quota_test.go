@@ -0,0 +1,263 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type QuotaSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&QuotaSuite{})
+
+// setQuota restarts the server with the given quotas.
+func (s *QuotaSuite) setQuota(c *gc.C, maxEntities int, maxBytes int64) {
+	s.quotaMaxEntities = maxEntities
+	s.quotaMaxBytes = maxBytes
+	s.store.Close()
+	s.startServer(c)
+}
+
+func (s *QuotaSuite) TearDownTest(c *gc.C) {
+	s.quotaMaxEntities = 0
+	s.quotaMaxBytes = 0
+	s.commonSuite.TearDownTest(c)
+}
+
+// archiveData returns the contents of the archive
+// of the testing charm with the given name.
+func archiveData(c *gc.C, charmName string) []byte {
+	data, err := ioutil.ReadFile(storetesting.Charms.CharmArchive(c.MkDir(), charmName).Path)
+	c.Assert(err, gc.IsNil)
+	return data
+}
+
+// postArchive uploads the given archive data
+// as a new revision of the given charm id.
+func (s *QuotaSuite) postArchive(c *gc.C, id string, data []byte, expectStatus int, expectBody interface{}) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL(fmt.Sprintf("%s/archive?hash=%s", id, hashOfBytes(data))),
+		Method:        "POST",
+		ContentLength: int64(len(data)),
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		Body:         bytes.NewReader(data),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: expectStatus,
+		ExpectBody:   expectBody,
+	})
+}
+
+func (s *QuotaSuite) TestEntityQuota(c *gc.C) {
+	s.setQuota(c, 2, 0)
+	wordpress := archiveData(c, "wordpress")
+	mysql := archiveData(c, "mysql")
+	s.postArchive(c, "~bob/trusty/wordpress", wordpress, http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseReference("~bob/trusty/wordpress-0"),
+	})
+	s.postArchive(c, "~bob/trusty/mysql", mysql, http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseReference("~bob/trusty/mysql-0"),
+	})
+
+	// Uploading the latest revision again does not add an entity.
+	s.postArchive(c, "~bob/trusty/mysql", mysql, http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseReference("~bob/trusty/mysql-0"),
+	})
+
+	s.postArchive(c, "~bob/trusty/mysql", wordpress, http.StatusForbidden, params.Error{
+		Message: `user "bob" has reached the quota of 2 entities`,
+		Code:    params.ErrQuotaExceeded,
+	})
+
+	// Other users are not affected.
+	s.postArchive(c, "~alice/trusty/mysql", mysql, http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseReference("~alice/trusty/mysql-0"),
+	})
+}
+
+func (s *QuotaSuite) TestByteQuota(c *gc.C) {
+	wordpress := archiveData(c, "wordpress")
+	mysql := archiveData(c, "mysql")
+	s.setQuota(c, 0, int64(len(wordpress)+len(mysql)-1))
+	s.postArchive(c, "~bob/trusty/wordpress", wordpress, http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseReference("~bob/trusty/wordpress-0"),
+	})
+	s.postArchive(c, "~bob/trusty/mysql", mysql, http.StatusForbidden, params.Error{
+		Message: fmt.Sprintf(`archive of %d bytes would exceed the quota of %d bytes of user "bob" (%d bytes used)`, len(mysql), len(wordpress)+len(mysql)-1, len(wordpress)),
+		Code:    params.ErrQuotaExceeded,
+	})
+}
+
+// putChunk uploads the given data as chunk n of
+// the upload with the given id.
+func (s *QuotaSuite) putChunk(c *gc.C, id string, n int, data []byte, expectStatus int, expectBody interface{}) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL(fmt.Sprintf("upload/%s/%d?hash=%s", id, n, hashOfBytes(data))),
+		Method:        "PUT",
+		ContentLength: int64(len(data)),
+		Body:          bytes.NewReader(data),
+		Username:      testUsername,
+		Password:      testPassword,
+		ExpectStatus:  expectStatus,
+		ExpectBody:    expectBody,
+	})
+}
+
+func (s *QuotaSuite) TestUploadChunkQuota(c *gc.C) {
+	s.setQuota(c, 0, 100)
+	upload, err := s.store.NewUpload("bob")
+	c.Assert(err, gc.IsNil)
+	s.putChunk(c, upload.Id, 0, bytes.Repeat([]byte("a"), 60), http.StatusOK, nil)
+	s.putChunk(c, upload.Id, 1, bytes.Repeat([]byte("b"), 60), http.StatusForbidden, params.Error{
+		Message: `chunk of 60 bytes would exceed the quota of 100 bytes of user "bob" (60 bytes used)`,
+		Code:    params.ErrQuotaExceeded,
+	})
+
+	// A chunk that replaces another is checked
+	// without the chunk it replaces.
+	s.putChunk(c, upload.Id, 0, bytes.Repeat([]byte("c"), 90), http.StatusOK, nil)
+	entities, used, err := s.store.UserUsage("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entities, gc.Equals, 0)
+	c.Assert(used, gc.Equals, int64(90))
+
+	// Uploads created by admins do not count.
+	upload, err = s.store.NewUpload("")
+	c.Assert(err, gc.IsNil)
+	s.putChunk(c, upload.Id, 0, bytes.Repeat([]byte("d"), 200), http.StatusOK, nil)
+}
+
+func (s *QuotaSuite) TestArchiveFromUploadQuota(c *gc.C) {
+	wordpress := archiveData(c, "wordpress")
+	s.setQuota(c, 0, int64(len(wordpress)))
+	upload, err := s.store.NewUpload("bob")
+	c.Assert(err, gc.IsNil)
+	half := len(wordpress) / 2
+	s.putChunk(c, upload.Id, 0, wordpress[:half], http.StatusOK, nil)
+	s.putChunk(c, upload.Id, 1, wordpress[half:], http.StatusOK, nil)
+
+	// The chunks of the upload are not counted
+	// again when the archive is added from them.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL(fmt.Sprintf("~bob/trusty/wordpress/archive?hash=%s&upload=%s", hashOfBytes(wordpress), upload.Id)),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseReference("~bob/trusty/wordpress-0"),
+		},
+	})
+	_, used, err := s.store.UserUsage("bob")
+	c.Assert(err, gc.IsNil)
+	c.Assert(used, gc.Equals, int64(len(wordpress)))
+}
+
+func (s *QuotaSuite) TestResourceQuota(c *gc.C) {
+	wordpress := archiveData(c, "wordpress")
+	s.setQuota(c, 0, int64(len(wordpress)+10))
+	s.postArchive(c, "~bob/trusty/wordpress", wordpress, http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseReference("~bob/trusty/wordpress-0"),
+	})
+	postResource := func(content string, expectStatus int, expectBody interface{}) {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:       s.srv,
+			URL:           storeURL("~bob/trusty/wordpress-0/resources/data?hash=" + hashOfString(content)),
+			Method:        "POST",
+			ContentLength: int64(len(content)),
+			Header: http.Header{
+				"Content-Type": {"application/octet-stream"},
+			},
+			Body:         strings.NewReader(content),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: expectStatus,
+			ExpectBody:   expectBody,
+		})
+	}
+	postResource("0123456789", http.StatusOK, params.ResourceUploadResponse{
+		Revision: 0,
+	})
+	postResource("x", http.StatusForbidden, params.Error{
+		Message: fmt.Sprintf(`resource of 1 bytes would exceed the quota of %d bytes of user "bob" (%d bytes used)`, len(wordpress)+10, len(wordpress)+10),
+		Code:    params.ErrQuotaExceeded,
+	})
+}
+
+func (s *QuotaSuite) TestServeQuota(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~bob/quota"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: params.QuotaResponse{},
+	})
+
+	s.setQuota(c, 10, 1000000)
+	wordpress := archiveData(c, "wordpress")
+	mysql := archiveData(c, "mysql")
+	s.postArchive(c, "~bob/trusty/wordpress", wordpress, http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseReference("~bob/trusty/wordpress-0"),
+	})
+	s.postArchive(c, "~bob/trusty/wordpress", mysql, http.StatusOK, params.ArchiveUploadResponse{
+		Id: charm.MustParseReference("~bob/trusty/wordpress-1"),
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~bob/quota"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.QuotaResponse{
+			Entities:    2,
+			Bytes:       int64(len(wordpress) + len(mysql)),
+			MaxEntities: 10,
+			MaxBytes:    1000000,
+		},
+	})
+
+	// Deleted entities do not count.
+	err := s.store.DeleteEntity(newResolvedURL("~bob/trusty/wordpress-1", -1))
+	c.Assert(err, gc.IsNil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~bob/quota"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.QuotaResponse{
+			Entities:    1,
+			Bytes:       int64(len(wordpress)),
+			MaxEntities: 10,
+			MaxBytes:    1000000,
+		},
+	})
+}
+
+func (s *QuotaSuite) TestServeQuotaUnauthorized(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~bob/quota"),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: "authentication failed: missing HTTP auth header",
+		},
+	})
+}
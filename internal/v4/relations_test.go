@@ -377,6 +377,7 @@ func (s *RelationsSuite) addCharms(c *gc.C, charms map[string]charm.Charm) {
 			BlobName: "blobName",
 			BlobHash: fakeBlobHash,
 			BlobSize: fakeBlobSize,
+			Channel:  params.StableChannel,
 		})
 		c.Assert(err, gc.IsNil, gc.Commentf("id %q", id))
 		err = s.store.SetPerms(&url.URL, "read", params.Everyone, url.URL.User)
@@ -717,6 +718,7 @@ func (s *RelationsSuite) TestMetaBundlesContaining(c *gc.C) {
 			BlobName: "blobName",
 			BlobHash: fakeBlobHash,
 			BlobSize: fakeBlobSize,
+			Channel:  params.StableChannel,
 		})
 		c.Assert(err, gc.IsNil)
 	}
@@ -746,6 +748,7 @@ func (s *RelationsSuite) TestMetaBundlesContaining(c *gc.C) {
 			BlobName: "blobName",
 			BlobHash: fakeBlobHash,
 			BlobSize: fakeBlobSize,
+			Channel:  params.StableChannel,
 		})
 		c.Assert(err, gc.IsNil)
 		err = s.store.SetPerms(&rurl.URL, "read", params.Everyone, rurl.URL.User)
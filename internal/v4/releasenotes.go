@@ -0,0 +1,50 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+)
+
+// maxReleaseNotesSize holds the maximum size
+// of the release notes of an entity.
+const maxReleaseNotesSize = 64 * 1024
+
+// GET id/meta/release-notes
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetarelease-notes
+func (h *Handler) metaReleaseNotes(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if entity.ReleaseNotes == "" {
+		return nil, nil
+	}
+	return entity.ReleaseNotes, nil
+}
+
+// PUT id/meta/release-notes
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#put-idmetarelease-notes
+func (h *Handler) putMetaReleaseNotes(id *router.ResolvedURL, path string, val *json.RawMessage, updater *router.FieldUpdater, req *http.Request) error {
+	var notes string
+	if err := json.Unmarshal(*val, &notes); err != nil {
+		return badRequestf(err, "cannot unmarshal release notes")
+	}
+	if err := checkReleaseNotes(notes); err != nil {
+		return err
+	}
+	// Empty release notes remove any existing ones.
+	updater.UpdateField("releasenotes", notes)
+	return nil
+}
+
+// checkReleaseNotes checks that the given
+// release notes can be stored.
+func checkReleaseNotes(notes string) error {
+	if len(notes) > maxReleaseNotesSize {
+		return badRequestf(nil, "release notes too long (%d bytes, maximum %d)", len(notes), maxReleaseNotesSize)
+	}
+	return nil
+}
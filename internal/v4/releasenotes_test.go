@@ -0,0 +1,156 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type ReleaseNotesSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&ReleaseNotesSuite{})
+
+func (s *ReleaseNotesSuite) TestUploadWithReleaseNotes(c *gc.C) {
+	s.uploadWithReleaseNotes(c, "~charmers/precise/wordpress-0", "Fixed the db relation.", http.StatusOK)
+	s.assertReleaseNotes(c, "~charmers/precise/wordpress-0", "Fixed the db relation.")
+}
+
+func (s *ReleaseNotesSuite) TestUploadWithReleaseNotesTooLong(c *gc.C) {
+	s.uploadWithReleaseNotes(c, "~charmers/precise/wordpress-0", strings.Repeat("x", 64*1024+1), http.StatusBadRequest)
+	_, err := s.store.FindEntity(newResolvedURL("~charmers/precise/wordpress-0", -1))
+	c.Assert(err, gc.ErrorMatches, `entity not found`)
+}
+
+func (s *ReleaseNotesSuite) TestPutReleaseNotes(c *gc.C) {
+	s.addCharm(c, "~charmers/precise/wordpress-0")
+	s.assertReleaseNotes(c, "~charmers/precise/wordpress-0", "")
+
+	s.putReleaseNotes(c, "~charmers/precise/wordpress-0", "Fixed the db relation.", http.StatusOK)
+	s.assertReleaseNotes(c, "~charmers/precise/wordpress-0", "Fixed the db relation.")
+
+	// Putting empty release notes removes them.
+	s.putReleaseNotes(c, "~charmers/precise/wordpress-0", "", http.StatusOK)
+	s.assertReleaseNotes(c, "~charmers/precise/wordpress-0", "")
+}
+
+func (s *ReleaseNotesSuite) TestPutReleaseNotesTooLong(c *gc.C) {
+	s.addCharm(c, "~charmers/precise/wordpress-0")
+	s.putReleaseNotes(c, "~charmers/precise/wordpress-0", strings.Repeat("x", 64*1024+1), http.StatusBadRequest)
+	s.assertReleaseNotes(c, "~charmers/precise/wordpress-0", "")
+}
+
+func (s *ReleaseNotesSuite) TestChangesPublished(c *gc.C) {
+	s.addCharm(c, "~charmers/precise/wordpress-0")
+	s.addCharm(c, "~charmers/precise/wordpress-1")
+	s.putReleaseNotes(c, "~charmers/precise/wordpress-1", "Fixed the db relation.", http.StatusOK)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("changes/published"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var published []params.Published
+	err := json.Unmarshal(rec.Body.Bytes(), &published)
+	c.Assert(err, gc.IsNil)
+	notes := make(map[string]string)
+	for _, p := range published {
+		notes[p.Id.String()] = p.ReleaseNotes
+	}
+	c.Assert(notes, gc.DeepEquals, map[string]string{
+		"cs:~charmers/precise/wordpress-0": "",
+		"cs:~charmers/precise/wordpress-1": "Fixed the db relation.",
+	})
+}
+
+func (s *ReleaseNotesSuite) addCharm(c *gc.C, id string) {
+	rid := newResolvedURL(id, -1)
+	err := s.store.AddCharmWithArchive(rid, storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = s.store.SetPerms(&rid.URL, "read", params.Everyone, rid.URL.User)
+	c.Assert(err, gc.IsNil)
+}
+
+// uploadWithReleaseNotes uploads the wordpress charm to the given
+// id with the given release notes and checks the response status.
+func (s *ReleaseNotesSuite) uploadWithReleaseNotes(c *gc.C, id, notes string, expectStatus int) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	f, err := os.Open(ch.Path)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	hash, size := hashOf(f)
+	_, err = f.Seek(0, 0)
+	c.Assert(err, gc.IsNil)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(fmt.Sprintf("%s/archive?hash=%s&release-notes=%s", charm.MustParseReference(id).Path(), hash, url.QueryEscape(notes))),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		ContentLength: size,
+		Body:          f,
+		Username:      testUsername,
+		Password:      testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, expectStatus, gc.Commentf("body: %s", rec.Body.String()))
+}
+
+// putReleaseNotes sets the release notes of the entity
+// with the given id through the API.
+func (s *ReleaseNotesSuite) putReleaseNotes(c *gc.C, id, notes string, expectStatus int) {
+	body, err := json.Marshal(notes)
+	c.Assert(err, gc.IsNil)
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL(id + "/meta/release-notes"),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Username: testUsername,
+		Password: testPassword,
+		Body:     bytes.NewReader(body),
+	})
+	c.Assert(rec.Code, gc.Equals, expectStatus, gc.Commentf("body: %s", rec.Body.String()))
+}
+
+// assertReleaseNotes checks that the entity with the given id
+// has the given release notes.
+func (s *ReleaseNotesSuite) assertReleaseNotes(c *gc.C, id, notes string) {
+	if notes == "" {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(id + "/meta/release-notes"),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: http.StatusNotFound,
+			ExpectBody: params.Error{
+				Code:    params.ErrMetadataNotFound,
+				Message: params.ErrMetadataNotFound.Error(),
+			},
+		})
+		return
+	}
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL(id + "/meta/release-notes"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: notes,
+	})
+}
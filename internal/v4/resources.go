@@ -0,0 +1,174 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/juju/utils/jsonhttp"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// GET id/resources
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idresources
+func (h *Handler) serveResources(id *router.ResolvedURL, _ bool, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "GET" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	resources, err := store.EntityResources(id)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	result := make([]params.Resource, len(resources))
+	for i, res := range resources {
+		result[i] = resourceParams(res)
+	}
+	return jsonhttp.WriteJSON(w, http.StatusOK, result)
+}
+
+// serveResource serves the resource named by the remaining
+// request path.
+func (h *Handler) serveResource(id *router.ResolvedURL, fullySpecified bool, w http.ResponseWriter, req *http.Request) error {
+	name, revision, err := parseResourcePath(req.URL.Path)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	switch req.Method {
+	case "GET", "HEAD":
+		return h.serveGetResource(id, fullySpecified, name, revision, w, req)
+	case "POST", "PUT":
+		if !fullySpecified {
+			return badRequestf(nil, "entity id %q is not fully specified", id)
+		}
+		if revision != -1 {
+			return badRequestf(nil, "resource revision specified, but should not be specified")
+		}
+		if req.Method == "POST" {
+			return h.servePostResource(id, name, w, req)
+		}
+		return h.servePutResource(id, name, w, req)
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+}
+
+// GET id/resources/name[/revision]
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idresourcesnamerevision
+func (h *Handler) serveGetResource(id *router.ResolvedURL, fullySpecified bool, name string, revision int, w http.ResponseWriter, req *http.Request) error {
+	store := h.pool.Store()
+	defer store.Close()
+	entity, err := store.FindEntity(id, "baseurl", "resources")
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	// The linked revision of a resource may change, so only
+	// specific revisions of specific charms can be cached for long.
+	cacheable := fullySpecified && revision != -1
+	if revision == -1 {
+		rev, ok := entity.Resources[name]
+		if !ok {
+			return errgo.WithCausef(nil, params.ErrNotFound, "resource %q not found", name)
+		}
+		revision = rev
+	}
+	res, err := store.FindResource(entity.BaseURL, name, revision)
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	r, err := store.OpenResource(res)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	defer r.Close()
+	header := w.Header()
+	setArchiveCacheControl(header, cacheable)
+	header.Set(params.ContentHashHeader, res.BlobHash)
+	header.Set(params.ContentHash256Header, res.BlobHash256)
+	header.Set(params.ResourceRevisionHeader, strconv.Itoa(res.Revision))
+	serveContent(w, req, res.Size, r)
+	return nil
+}
+
+// POST id/resources/name?hash=sha384hash
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idresourcesname
+func (h *Handler) servePostResource(id *router.ResolvedURL, name string, w http.ResponseWriter, req *http.Request) error {
+	hash := req.Form.Get("hash")
+	if hash == "" {
+		return badRequestf(nil, "hash parameter not specified")
+	}
+	if req.ContentLength == -1 {
+		return badRequestf(nil, "Content-Length not specified")
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	if err := h.checkBlobQuota(store, id.URL.User, "resource", req.ContentLength, 0); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrQuotaExceeded))
+	}
+	res, err := store.AddResource(id, name, req.Body, hash, req.ContentLength)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot add resource", errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	return jsonhttp.WriteJSON(w, http.StatusOK, &params.ResourceUploadResponse{
+		Revision: res.Revision,
+	})
+}
+
+// PUT id/resources/name
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#put-idresourcesname
+func (h *Handler) servePutResource(id *router.ResolvedURL, name string, w http.ResponseWriter, req *http.Request) error {
+	var link params.ResourceRequest
+	if err := json.NewDecoder(req.Body).Decode(&link); err != nil {
+		return badRequestf(err, "cannot unmarshal resource request")
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	if err := store.LinkResource(id, name, link.Revision); err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	return nil
+}
+
+// parseResourcePath parses a resource path of the
+// form name[/revision]. If no revision is specified,
+// the returned revision is -1.
+func parseResourcePath(path string) (name string, revision int, err error) {
+	parts := strings.Split(strings.TrimPrefix(path, "/"), "/")
+	if len(parts) > 2 {
+		return "", 0, badRequestf(nil, "invalid resource path %q", path)
+	}
+	name = parts[0]
+	if !charmstore.ValidResourceName(name) {
+		return "", 0, badRequestf(nil, "invalid resource name %q", name)
+	}
+	if len(parts) == 1 {
+		return name, -1, nil
+	}
+	revision, err = strconv.Atoi(parts[1])
+	if err != nil || revision < 0 {
+		return "", 0, badRequestf(nil, "invalid resource revision %q", parts[1])
+	}
+	return name, revision, nil
+}
+
+// resourceParams returns the external representation
+// of the given resource.
+func resourceParams(res *mongodoc.Resource) params.Resource {
+	return params.Resource{
+		Name:       res.Name,
+		Revision:   res.Revision,
+		Size:       res.Size,
+		Hash:       res.BlobHash,
+		Hash256:    res.BlobHash256,
+		UploadTime: res.UploadTime.UTC(),
+	}
+}
@@ -0,0 +1,307 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type ResourcesSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&ResourcesSuite{})
+
+func (s *ResourcesSuite) SetUpTest(c *gc.C) {
+	s.commonSuite.SetUpTest(c)
+	for _, id := range []string{
+		"~charmers/precise/wordpress-0",
+		"~charmers/trusty/wordpress-1",
+		"~charmers/bundle/wordpress-simple-0",
+	} {
+		url := newResolvedURL(id, -1)
+		var err error
+		if url.URL.Series == "bundle" {
+			err = s.store.AddBundleWithArchive(url, storetesting.Charms.BundleDir("wordpress-simple"))
+		} else {
+			err = s.store.AddCharmWithArchive(url, storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"))
+		}
+		c.Assert(err, gc.IsNil)
+		err = s.store.SetPerms(&url.URL, "read", params.Everyone, url.URL.User)
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+// assertUploadResource uploads the given content as a new revision of
+// the named resource of the charm with the given id and checks that it
+// is given the expected revision.
+func (s *ResourcesSuite) assertUploadResource(c *gc.C, id, name, content string, expectRevision int) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:       s.srv,
+		URL:           storeURL(fmt.Sprintf("%s/resources/%s?hash=%s", id, name, hashOfString(content))),
+		Method:        "POST",
+		ContentLength: int64(len(content)),
+		Header: http.Header{
+			"Content-Type": {"application/octet-stream"},
+		},
+		Body:     strings.NewReader(content),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ResourceUploadResponse{
+			Revision: expectRevision,
+		},
+	})
+}
+
+func (s *ResourcesSuite) TestUploadAndGetResource(c *gc.C) {
+	s.assertUploadResource(c, "~charmers/precise/wordpress-0", "data", "first", 0)
+	s.assertUploadResource(c, "~charmers/trusty/wordpress-1", "data", "second", 1)
+	s.assertUploadResource(c, "~charmers/trusty/wordpress-1", "config", "third", 0)
+
+	// Each charm gets the revision uploaded for it.
+	for i, test := range []struct {
+		path           string
+		expectContent  string
+		expectRevision int
+		expectCache    bool
+	}{{
+		path:           "~charmers/precise/wordpress-0/resources/data",
+		expectContent:  "first",
+		expectRevision: 0,
+	}, {
+		path:           "~charmers/trusty/wordpress-1/resources/data",
+		expectContent:  "second",
+		expectRevision: 1,
+	}, {
+		path:           "~charmers/wordpress/resources/data",
+		expectContent:  "second",
+		expectRevision: 1,
+	}, {
+		path:           "~charmers/trusty/wordpress-1/resources/data/0",
+		expectContent:  "first",
+		expectRevision: 0,
+		expectCache:    true,
+	}, {
+		path:           "~charmers/trusty/wordpress-1/resources/config",
+		expectContent:  "third",
+		expectRevision: 0,
+	}} {
+		c.Logf("test %d: %s", i, test.path)
+		rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+			Handler: s.srv,
+			URL:     storeURL(test.path),
+		})
+		c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %q", rec.Body.Bytes()))
+		c.Assert(rec.Body.String(), gc.Equals, test.expectContent)
+		c.Assert(rec.Header().Get(params.ContentHashHeader), gc.Equals, hashOfString(test.expectContent))
+		c.Assert(rec.Header().Get(params.ContentHash256Header), gc.Equals, fmt.Sprintf("%x", sha256.Sum256([]byte(test.expectContent))))
+		c.Assert(rec.Header().Get(params.ResourceRevisionHeader), gc.Equals, fmt.Sprint(test.expectRevision))
+		assertCacheControl(c, rec.Header(), test.expectCache)
+	}
+
+	// The resources linked to a charm can be listed.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/trusty/wordpress-1/resources"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %q", rec.Body.Bytes()))
+	var resources []params.Resource
+	err := json.Unmarshal(rec.Body.Bytes(), &resources)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resources, gc.HasLen, 2)
+	for i := range resources {
+		c.Assert(resources[i].UploadTime.IsZero(), jc.IsFalse)
+		resources[i].UploadTime = time.Time{}
+	}
+	c.Assert(resources, jc.DeepEquals, []params.Resource{{
+		Name:     "config",
+		Revision: 0,
+		Size:     5,
+		Hash:     hashOfString("third"),
+		Hash256:  fmt.Sprintf("%x", sha256.Sum256([]byte("third"))),
+	}, {
+		Name:     "data",
+		Revision: 1,
+		Size:     6,
+		Hash:     hashOfString("second"),
+		Hash256:  fmt.Sprintf("%x", sha256.Sum256([]byte("second"))),
+	}})
+}
+
+func (s *ResourcesSuite) TestLinkResource(c *gc.C) {
+	s.assertUploadResource(c, "~charmers/precise/wordpress-0", "data", "first", 0)
+	s.assertUploadResource(c, "~charmers/precise/wordpress-0", "data", "second", 1)
+
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/resources/data"),
+		Method:  "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Body:     strings.NewReader(`{"Revision": 0}`),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~charmers/precise/wordpress-0/resources/data"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %q", rec.Body.Bytes()))
+	c.Assert(rec.Body.String(), gc.Equals, "first")
+	c.Assert(rec.Header().Get(params.ResourceRevisionHeader), gc.Equals, "0")
+}
+
+var resourcesErrorsTests = []struct {
+	about        string
+	method       string
+	path         string
+	body         string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "invalid resource name",
+	method:       "GET",
+	path:         "~charmers/precise/wordpress-0/resources/Data",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid resource name "Data"`,
+	},
+}, {
+	about:        "invalid resource revision",
+	method:       "GET",
+	path:         "~charmers/precise/wordpress-0/resources/data/bad",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid resource revision "bad"`,
+	},
+}, {
+	about:        "invalid resource path",
+	method:       "GET",
+	path:         "~charmers/precise/wordpress-0/resources/data/0/extra",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid resource path "/data/0/extra"`,
+	},
+}, {
+	about:        "resource not found",
+	method:       "GET",
+	path:         "~charmers/precise/wordpress-0/resources/data",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `resource "data" not found`,
+	},
+}, {
+	about:        "resource revision not found",
+	method:       "GET",
+	path:         "~charmers/precise/wordpress-0/resources/data/5",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `resource "data" not found`,
+	},
+}, {
+	about:        "upload with partial id",
+	method:       "POST",
+	path:         "~charmers/wordpress/resources/data?hash=foo",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `entity id "cs:~charmers/trusty/wordpress-1" is not fully specified`,
+	},
+}, {
+	about:        "upload with revision",
+	method:       "POST",
+	path:         "~charmers/precise/wordpress-0/resources/data/0?hash=foo",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `resource revision specified, but should not be specified`,
+	},
+}, {
+	about:        "upload without hash",
+	method:       "POST",
+	path:         "~charmers/precise/wordpress-0/resources/data",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `hash parameter not specified`,
+	},
+}, {
+	about:        "upload to bundle",
+	method:       "POST",
+	path:         "~charmers/bundle/wordpress-simple-0/resources/data?hash=" + hashOfString("content"),
+	body:         "content",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot add resource: cannot add resources to a bundle`,
+	},
+}, {
+	about:        "link missing revision",
+	method:       "PUT",
+	path:         "~charmers/precise/wordpress-0/resources/data",
+	body:         `{"Revision": 3}`,
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `resource "data" not found`,
+	},
+}, {
+	about:        "link with bad body",
+	method:       "PUT",
+	path:         "~charmers/precise/wordpress-0/resources/data",
+	body:         `bad`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot unmarshal resource request: invalid character 'b' looking for beginning of value`,
+	},
+}, {
+	about:        "list with bad method",
+	method:       "POST",
+	path:         "~charmers/precise/wordpress-0/resources",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: `POST method not allowed`,
+	},
+}}
+
+func (s *ResourcesSuite) TestResourcesErrors(c *gc.C) {
+	for i, test := range resourcesErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:       s.srv,
+			URL:           storeURL(test.path),
+			Method:        test.method,
+			ContentLength: int64(len(test.body)),
+			Body:          strings.NewReader(test.body),
+			Username:      testUsername,
+			Password:      testPassword,
+			ExpectStatus:  test.expectStatus,
+			ExpectBody:    test.expectBody,
+		})
+	}
+}
+
+func hashOfString(s string) string {
+	return hashOfBytes([]byte(s))
+}
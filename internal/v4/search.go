@@ -149,6 +149,11 @@ func parseSearchParams(req *http.Request) (charmstore.SearchParams, error) {
 			if sp.Skip < 0 {
 				return charmstore.SearchParams{}, badRequestf(nil, "invalid skip parameter: expected non-negative integer")
 			}
+		case "channel":
+			sp.Channel = params.Channel(v[0])
+			if sp.Channel != params.StableChannel && sp.Channel != params.DevelopmentChannel {
+				return charmstore.SearchParams{}, badRequestf(nil, "cannot search in %q channel", v[0])
+			}
 		case "sort":
 			err = sp.ParseSortFields(v...)
 			if err != nil {
@@ -263,6 +263,20 @@ func (s *SearchSuite) TestParseSearchParams(c *gc.C) {
 		about:       "promulgated filter - bad",
 		query:       "promulgated=bad",
 		expectError: `invalid promulgated filter parameter: unexpected bool value "bad" (must be "0" or "1")`,
+	}, {
+		about: "channel",
+		query: "channel=development",
+		expectParams: charmstore.SearchParams{
+			Channel: params.DevelopmentChannel,
+		},
+	}, {
+		about:       "unpublished channel",
+		query:       "channel=unpublished",
+		expectError: `cannot search in "unpublished" channel`,
+	}, {
+		about:       "invalid channel",
+		query:       "channel=bad-wolf",
+		expectError: `cannot search in "bad-wolf" channel`,
 	}}
 	for i, test := range tests {
 		c.Logf("test %d. %s", i, test.about)
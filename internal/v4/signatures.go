@@ -0,0 +1,151 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/juju/utils/jsonhttp"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// GET id/meta/signatures
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetasignatures
+func (h *Handler) metaSignatures(entity *mongodoc.Entity, id *router.ResolvedURL, path string, flags url.Values, req *http.Request) (interface{}, error) {
+	if len(entity.Signatures) == 0 {
+		return nil, nil
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	sigs := make([]params.Signature, len(entity.Signatures))
+	for i, sig := range entity.Signatures {
+		trusted, err := store.IsTrustedKey(sig.User, sig.KeyId)
+		if err != nil {
+			return nil, errgo.Mask(err)
+		}
+		sigs[i] = signatureParams(&sig, trusted)
+	}
+	return sigs, nil
+}
+
+// POST id/signatures
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idsignatures
+func (h *Handler) serveSignatures(id *router.ResolvedURL, fullySpecified bool, w http.ResponseWriter, req *http.Request) error {
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	if !fullySpecified {
+		return badRequestf(nil, "entity id %q is not fully specified", id)
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	baseEntity, err := store.FindBaseEntity(&id.URL, "acls")
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	// Adding a signature changes the entity, so
+	// write permission is required to add one.
+	if _, err := h.authorize(req, baseEntity.ACLs.Write, false, id); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	var sigReq params.SignatureRequest
+	if err := json.NewDecoder(req.Body).Decode(&sigReq); err != nil {
+		return badRequestf(err, "cannot unmarshal signature request")
+	}
+	if sigReq.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	sig, err := store.AddSignature(id, sigReq.User, sigReq.Signature)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot add signature", errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	return jsonhttp.WriteJSON(w, http.StatusOK, signatureParams(sig, true))
+}
+
+// GET keys/user
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-keysuser
+//
+// POST keys/user
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-keysuser
+//
+// DELETE keys/user/keyid
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#delete-keysuserkeyid
+func (h *Handler) serveKeys(w http.ResponseWriter, req *http.Request) error {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if len(parts) > 2 || parts[0] == "" || len(parts) == 2 && parts[1] == "" {
+		return errgo.WithCausef(nil, params.ErrNotFound, "not found")
+	}
+	user := parts[0]
+	store := h.pool.Store()
+	defer store.Close()
+	if len(parts) == 2 {
+		if req.Method != "DELETE" {
+			return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+		}
+		// Only the user can choose which keys they trust.
+		if _, err := h.authorize(req, []string{user}, true, nil); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		if err := store.RemovePublicKey(user, parts[1]); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return nil
+	}
+	switch req.Method {
+	case "GET":
+		keys, err := store.PublicKeys(user)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		result := make([]params.PublicKey, len(keys))
+		for i, key := range keys {
+			result[i] = publicKeyParams(key)
+		}
+		return jsonhttp.WriteJSON(w, http.StatusOK, result)
+	case "POST":
+		if _, err := h.authorize(req, []string{user}, true, nil); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		var keyReq params.PublicKeyRequest
+		if err := json.NewDecoder(req.Body).Decode(&keyReq); err != nil {
+			return badRequestf(err, "cannot unmarshal public key request")
+		}
+		key, err := store.AddPublicKey(user, []byte(keyReq.Key))
+		if err != nil {
+			return errgo.NoteMask(err, "cannot add public key", errgo.Is(params.ErrBadRequest))
+		}
+		return jsonhttp.WriteJSON(w, http.StatusOK, publicKeyParams(key))
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+}
+
+// signatureParams returns the external representation of the
+// given signature, which was verified by a key with the given
+// trust.
+func signatureParams(sig *mongodoc.Signature, trusted bool) params.Signature {
+	return params.Signature{
+		User:      sig.User,
+		KeyId:     sig.KeyId,
+		Signature: sig.Signature,
+		Time:      sig.Time.UTC(),
+		Trusted:   trusted,
+	}
+}
+
+// publicKeyParams returns the external
+// representation of the given public key.
+func publicKeyParams(key *mongodoc.PublicKey) params.PublicKey {
+	return params.PublicKey{
+		Id:      key.Id,
+		Key:     string(key.Key),
+		AddTime: key.AddTime.UTC(),
+	}
+}
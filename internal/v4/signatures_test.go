@@ -0,0 +1,492 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/router"
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+	"gopkg.in/juju/charmstore.v4/signature"
+)
+
+type SignaturesSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&SignaturesSuite{})
+
+func (s *SignaturesSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *SignaturesSuite) SetUpTest(c *gc.C) {
+	s.commonSuite.SetUpTest(c)
+	url := newResolvedURL("~bob/precise/wordpress-0", -1)
+	err := s.store.AddCharmWithArchive(url, storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"))
+	c.Assert(err, gc.IsNil)
+	err = s.store.SetPerms(&url.URL, "read", params.Everyone, url.URL.User)
+	c.Assert(err, gc.IsNil)
+}
+
+// addSignature signs the archive of the entity with the given id
+// with a new key trusted for the given user, and returns the key.
+func (s *commonSuite) addSignature(c *gc.C, id *router.ResolvedURL, user string) *ecdsa.PrivateKey {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	s.addPublicKey(c, user, key)
+	sig := s.sign(c, id, key)
+	_, err = s.store.AddSignature(id, user, sig)
+	c.Assert(err, gc.IsNil)
+	return key
+}
+
+// addPublicKey adds the public key of the given
+// private key to the keys trusted for the given user.
+func (s *commonSuite) addPublicKey(c *gc.C, user string, key *ecdsa.PrivateKey) string {
+	data, err := signature.MarshalPublicKey(key.Public())
+	c.Assert(err, gc.IsNil)
+	doc, err := s.store.AddPublicKey(user, data)
+	c.Assert(err, gc.IsNil)
+	return doc.Id
+}
+
+// sign returns the signature of the archive of the entity
+// with the given id made with the given key.
+func (s *commonSuite) sign(c *gc.C, id *router.ResolvedURL, key *ecdsa.PrivateKey) []byte {
+	entity, err := s.store.FindEntity(id, "blobhash")
+	c.Assert(err, gc.IsNil)
+	sig, err := signature.Sign(key, entity.BlobHash)
+	c.Assert(err, gc.IsNil)
+	return sig
+}
+
+func jsonBody(c *gc.C, v interface{}) *bytes.Reader {
+	data, err := json.Marshal(v)
+	c.Assert(err, gc.IsNil)
+	return bytes.NewReader(data)
+}
+
+func (s *SignaturesSuite) TestKeys(c *gc.C) {
+	s.discharge = dischargeForUser("bob")
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	data, err := signature.MarshalPublicKey(key.Public())
+	c.Assert(err, gc.IsNil)
+	keyId, err := signature.KeyId(key.Public())
+	c.Assert(err, gc.IsNil)
+
+	// Bob can add a key for himself.
+	var added params.PublicKey
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Do:      bakeryDo(nil),
+		URL:     storeURL("keys/bob"),
+		Method:  "POST",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Body: jsonBody(c, params.PublicKeyRequest{
+			Key: string(data),
+		}),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &added)
+			c.Assert(err, gc.IsNil)
+		}),
+	})
+	c.Assert(added.Id, gc.Equals, keyId)
+	c.Assert(added.Key, gc.Equals, string(data))
+
+	// Anyone can list the keys.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("keys/bob"),
+		ExpectBody: []params.PublicKey{added},
+	})
+
+	// Alice cannot change Bob's keys.
+	s.discharge = dischargeForUser("alice")
+	for _, method := range []string{"POST", "DELETE"} {
+		path := "keys/bob"
+		if method == "DELETE" {
+			path += "/" + keyId
+		}
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			Do:      bakeryDo(nil),
+			URL:     storeURL(path),
+			Method:  method,
+			Body: jsonBody(c, params.PublicKeyRequest{
+				Key: string(data),
+			}),
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Code:    params.ErrUnauthorized,
+				Message: `unauthorized: access denied for user "alice"`,
+			},
+		})
+	}
+
+	// Bob can remove his key.
+	s.discharge = dischargeForUser("bob")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Do:      bakeryDo(nil),
+		URL:     storeURL("keys/bob/" + keyId),
+		Method:  "DELETE",
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("keys/bob"),
+		ExpectBody: []params.PublicKey{},
+	})
+}
+
+var keysErrorsTests = []struct {
+	about        string
+	method       string
+	path         string
+	body         string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "no user",
+	method:       "GET",
+	path:         "keys/",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
+}, {
+	about:        "path too long",
+	method:       "DELETE",
+	path:         "keys/bob/1234/5678",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
+}, {
+	about:        "invalid key",
+	method:       "POST",
+	path:         "keys/bob",
+	body:         `{"Key": "bad key"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot add public key: invalid public key: no PEM data found",
+	},
+}, {
+	about:        "invalid body",
+	method:       "POST",
+	path:         "keys/bob",
+	body:         `bad`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot unmarshal public key request: invalid character 'b' looking for beginning of value",
+	},
+}, {
+	about:        "key not found",
+	method:       "DELETE",
+	path:         "keys/bob/1234",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `public key "1234" not found`,
+	},
+}, {
+	about:        "method not allowed on key",
+	method:       "GET",
+	path:         "keys/bob/1234",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET method not allowed",
+	},
+}, {
+	about:        "method not allowed on keys",
+	method:       "PUT",
+	path:         "keys/bob",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "PUT method not allowed",
+	},
+}}
+
+func (s *SignaturesSuite) TestKeysErrors(c *gc.C) {
+	for i, test := range keysErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       test.method,
+			Body:         bytes.NewReader([]byte(test.body)),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *SignaturesSuite) TestAddSignature(c *gc.C) {
+	id := newResolvedURL("~bob/precise/wordpress-0", -1)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	keyId := s.addPublicKey(c, "bob", key)
+	sig := s.sign(c, id, key)
+
+	before := time.Now()
+	var added params.Signature
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/precise/wordpress-0/signatures"),
+		Method:  "POST",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Body: jsonBody(c, params.SignatureRequest{
+			User:      "bob",
+			Signature: sig,
+		}),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &added)
+			c.Assert(err, gc.IsNil)
+		}),
+	})
+	after := time.Now()
+	c.Assert(added.Time, jc.TimeBetween(before, after))
+	added.Time = time.Time{}
+	c.Assert(added, jc.DeepEquals, params.Signature{
+		User:      "bob",
+		KeyId:     keyId,
+		Signature: sig,
+		Trusted:   true,
+	})
+
+	var sigs []params.Signature
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/precise/wordpress-0/meta/signatures"),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &sigs)
+			c.Assert(err, gc.IsNil)
+		}),
+	})
+	c.Assert(sigs, gc.HasLen, 1)
+	c.Assert(sigs[0].Signature, jc.DeepEquals, sig)
+	c.Assert(sigs[0].Trusted, jc.IsTrue)
+
+	// Once the key has been removed, the signature
+	// is no longer trusted.
+	err = s.store.RemovePublicKey("bob", keyId)
+	c.Assert(err, gc.IsNil)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		URL:     storeURL("~bob/precise/wordpress-0/meta/signatures"),
+		ExpectBody: httptesting.BodyAsserter(func(c *gc.C, m json.RawMessage) {
+			err := json.Unmarshal(m, &sigs)
+			c.Assert(err, gc.IsNil)
+		}),
+	})
+	c.Assert(sigs, gc.HasLen, 1)
+	c.Assert(sigs[0].Trusted, jc.IsFalse)
+}
+
+func (s *SignaturesSuite) TestAddSignatureErrors(c *gc.C) {
+	id := newResolvedURL("~bob/precise/wordpress-0", -1)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	sig := s.sign(c, id, key)
+
+	tests := []struct {
+		about        string
+		method       string
+		path         string
+		body         interface{}
+		expectStatus int
+		expectBody   params.Error
+	}{{
+		about:        "method not allowed",
+		method:       "PUT",
+		path:         "~bob/precise/wordpress-0/signatures",
+		expectStatus: http.StatusMethodNotAllowed,
+		expectBody: params.Error{
+			Code:    params.ErrMethodNotAllowed,
+			Message: "PUT method not allowed",
+		},
+	}, {
+		about:        "partial id",
+		method:       "POST",
+		path:         "~bob/wordpress/signatures",
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `entity id "cs:~bob/precise/wordpress-0" is not fully specified`,
+		},
+	}, {
+		about:        "no user",
+		method:       "POST",
+		path:         "~bob/precise/wordpress-0/signatures",
+		body:         params.SignatureRequest{Signature: sig},
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: "user not specified",
+		},
+	}, {
+		about:        "no keys",
+		method:       "POST",
+		path:         "~bob/precise/wordpress-0/signatures",
+		body:         params.SignatureRequest{User: "bob", Signature: sig},
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `cannot add signature: no public keys found for user "bob"`,
+		},
+	}, {
+		about:        "not verified",
+		method:       "POST",
+		path:         "~bob/precise/wordpress-0/signatures",
+		body:         params.SignatureRequest{User: "alice", Signature: sig},
+		expectStatus: http.StatusBadRequest,
+		expectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `cannot add signature: signature not verified by any public key of user "alice"`,
+		},
+	}}
+	// Alice has a key, but not the one that made the signature.
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	s.addPublicKey(c, "alice", otherKey)
+
+	for i, test := range tests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(test.path),
+			Method:       test.method,
+			Body:         jsonBody(c, test.body),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
+
+func (s *SignaturesSuite) TestAddSignatureRequiresWritePermission(c *gc.C) {
+	id := newResolvedURL("~bob/precise/wordpress-0", -1)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	s.addPublicKey(c, "bob", key)
+	sig := s.sign(c, id, key)
+
+	// Alice can read the entity but cannot change it.
+	s.discharge = dischargeForUser("alice")
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler: s.srv,
+		Do:      bakeryDo(nil),
+		URL:     storeURL("~bob/precise/wordpress-0/signatures"),
+		Method:  "POST",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Body: jsonBody(c, params.SignatureRequest{
+			User:      "bob",
+			Signature: sig,
+		}),
+		ExpectStatus: http.StatusUnauthorized,
+		ExpectBody: params.Error{
+			Code:    params.ErrUnauthorized,
+			Message: `unauthorized: access denied for user "alice"`,
+		},
+	})
+}
+
+// uploadWithSignature uploads the wordpress charm to the given id
+// with a signature of its archive made with the given key by the
+// given user, and returns the response.
+func (s *SignaturesSuite) uploadWithSignature(c *gc.C, id, user string, key *ecdsa.PrivateKey) *httptest.ResponseRecorder {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	f, err := os.Open(ch.Path)
+	c.Assert(err, gc.IsNil)
+	defer f.Close()
+	hash, size := hashOf(f)
+	_, err = f.Seek(0, 0)
+	c.Assert(err, gc.IsNil)
+	sig, err := signature.Sign(key, hash)
+	c.Assert(err, gc.IsNil)
+	return httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL: storeURL(fmt.Sprintf("%s/archive?hash=%s&signature-user=%s&signature=%s",
+			charm.MustParseReference(id).Path(), hash, user, url.QueryEscape(base64.StdEncoding.EncodeToString(sig)))),
+		Method: "PUT",
+		Header: http.Header{
+			"Content-Type": {"application/zip"},
+		},
+		ContentLength: size,
+		Body:          f,
+		Username:      testUsername,
+		Password:      testPassword,
+	})
+}
+
+func (s *SignaturesSuite) TestUploadWithSignature(c *gc.C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	keyId := s.addPublicKey(c, "bob", key)
+
+	rec := s.uploadWithSignature(c, "~bob/precise/wordpress-1", "bob", key)
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	entity, err := s.store.FindEntity(newResolvedURL("~bob/precise/wordpress-1", -1), "signatures")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.Signatures, gc.HasLen, 1)
+	c.Assert(entity.Signatures[0].User, gc.Equals, "bob")
+	c.Assert(entity.Signatures[0].KeyId, gc.Equals, keyId)
+}
+
+func (s *SignaturesSuite) TestUploadWithUnverifiedSignature(c *gc.C) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+	s.addPublicKey(c, "bob", key)
+	otherKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	c.Assert(err, gc.IsNil)
+
+	rec := s.uploadWithSignature(c, "~bob/precise/wordpress-1", "bob", otherKey)
+	c.Assert(rec.Code, gc.Equals, http.StatusBadRequest, gc.Commentf("body: %s", rec.Body.String()))
+	var errResp params.Error
+	err = json.Unmarshal(rec.Body.Bytes(), &errResp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(errResp.Code, gc.Equals, params.ErrBadRequest)
+	c.Assert(errResp.Message, gc.Equals, `cannot verify signature: signature not verified by any public key of user "bob"`)
+
+	// The entity has not been added.
+	_, err = s.store.FindEntity(newResolvedURL("~bob/precise/wordpress-1", -1))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+}
@@ -42,6 +42,7 @@ func (h *Handler) serveDebugStatus(_ http.Header, req *http.Request) (interface{
 			mongodoc.LegacyStatisticsType,
 			params.LegacyStatisticsImportStart, params.LegacyStatisticsImportComplete,
 		),
+		h.checkScrub(store),
 	), nil
 }
 
@@ -133,15 +134,79 @@ func (h *Handler) checkLogs(
 	}
 }
 
+// checkScrub reports the results of the most
+// recently completed archive scrub.
+func (h *Handler) checkScrub(store *charmstore.Store) debugstatus.CheckerFunc {
+	return func() (key string, result debugstatus.CheckResult) {
+		resultKey := "scrub"
+		result.Name = "Archive integrity scrub"
+		start, end, err := h.findLastScrub(store)
+		if err != nil {
+			result.Value = err.Error()
+			return resultKey, result
+		}
+		if end.IsZero() {
+			// The scrubber is optional, so it is not
+			// an error if it has never completed.
+			result.Value = "no scrub has completed"
+			result.Passed = true
+			return resultKey, result
+		}
+		problems, err := store.DB.Logs().Find(bson.D{
+			{"level", mongodoc.ErrorLevel},
+			{"type", mongodoc.ScrubType},
+			{"time", bson.D{{"$gte", start}, {"$lte", end}}},
+		}).Count()
+		if err != nil {
+			result.Value = "Cannot count scrub problems: " + err.Error()
+			return resultKey, result
+		}
+		result.Value = fmt.Sprintf("started: %s, completed: %s, problems: %d", start.Format(time.RFC3339), end.Format(time.RFC3339), problems)
+		result.Passed = problems == 0
+		return resultKey, result
+	}
+}
+
+// findLastScrub returns the start and end times of the
+// most recently completed scrub.
+func (h *Handler) findLastScrub(store *charmstore.Store) (start, end time.Time, err error) {
+	var log mongodoc.Log
+	iter := store.DB.Logs().
+		Find(bson.D{
+			{"level", mongodoc.InfoLevel},
+			{"type", mongodoc.ScrubType},
+		}).Sort("-time", "-id").Iter()
+	for iter.Next(&log) {
+		var msg string
+		if err := json.Unmarshal(log.Data, &msg); err != nil {
+			continue
+		}
+		if end.IsZero() {
+			if strings.HasPrefix(msg, params.ScrubComplete) {
+				end = log.Time
+			}
+			continue
+		}
+		if strings.HasPrefix(msg, params.ScrubStart) {
+			start = log.Time
+			break
+		}
+	}
+	if err = iter.Close(); err != nil {
+		return time.Time{}, time.Time{}, errgo.Notef(err, "Cannot query logs")
+	}
+	return
+}
+
 // findTimesInLogs goes through logs in reverse order finding when the start and
 // end messages were last added.
 func (h *Handler) findTimesInLogs(store *charmstore.Store, logType mongodoc.LogType, startPrefix, endPrefix string) (start, end time.Time, err error) {
 	var log mongodoc.Log
 	iter := store.DB.Logs().
 		Find(bson.D{
-		{"level", mongodoc.InfoLevel},
-		{"type", logType},
-	}).Sort("-time", "-id").Iter()
+			{"level", mongodoc.InfoLevel},
+			{"type", logType},
+		}).Sort("-time", "-id").Iter()
 	for iter.Next(&log) {
 		var msg string
 		if err := json.Unmarshal(log.Data, &msg); err != nil {
@@ -107,6 +107,11 @@ func (s *APISuite) TestStatus(c *gc.C) {
 			Value:  "started: " + statisticsStart.Format(time.RFC3339) + ", completed: " + statisticsEnd.Format(time.RFC3339),
 			Passed: true,
 		},
+		"scrub": {
+			Name:   "Archive integrity scrub",
+			Value:  "no scrub has completed",
+			Passed: true,
+		},
 	})
 }
 
@@ -232,6 +237,66 @@ func (s *APISuite) TestStatusBaseEntitiesError(c *gc.C) {
 	})
 }
 
+func (s *APISuite) TestStatusScrub(c *gc.C) {
+	now := time.Now()
+	s.addLog(c, &mongodoc.Log{
+		Data:  []byte(`"scrub started"`),
+		Level: mongodoc.InfoLevel,
+		Type:  mongodoc.ScrubType,
+		Time:  now.Add(-3 * time.Hour),
+	})
+	s.addLog(c, &mongodoc.Log{
+		Data:  []byte(`"cs:~charmers/precise/wordpress-0: archive hash mismatch"`),
+		Level: mongodoc.ErrorLevel,
+		Type:  mongodoc.ScrubType,
+		Time:  now.Add(-150 * time.Minute),
+	})
+	s.addLog(c, &mongodoc.Log{
+		Data:  []byte(`"scrub completed: 1 entities checked, 1 problems found"`),
+		Level: mongodoc.InfoLevel,
+		Type:  mongodoc.ScrubType,
+		Time:  now.Add(-2 * time.Hour),
+	})
+	s.AssertDebugStatus(c, false, map[string]params.DebugStatus{
+		"scrub": {
+			Name:   "Archive integrity scrub",
+			Value:  "started: " + now.Add(-3*time.Hour).Format(time.RFC3339) + ", completed: " + now.Add(-2*time.Hour).Format(time.RFC3339) + ", problems: 1",
+			Passed: false,
+		},
+	})
+
+	// A later scrub that starts but does not complete does not
+	// affect the results.
+	s.addLog(c, &mongodoc.Log{
+		Data:  []byte(`"scrub started"`),
+		Level: mongodoc.InfoLevel,
+		Type:  mongodoc.ScrubType,
+		Time:  now.Add(-1 * time.Hour),
+	})
+	s.AssertDebugStatus(c, false, map[string]params.DebugStatus{
+		"scrub": {
+			Name:   "Archive integrity scrub",
+			Value:  "started: " + now.Add(-3*time.Hour).Format(time.RFC3339) + ", completed: " + now.Add(-2*time.Hour).Format(time.RFC3339) + ", problems: 1",
+			Passed: false,
+		},
+	})
+
+	// A subsequent clean scrub passes.
+	s.addLog(c, &mongodoc.Log{
+		Data:  []byte(`"scrub completed: 1 entities checked, 0 problems found"`),
+		Level: mongodoc.InfoLevel,
+		Type:  mongodoc.ScrubType,
+		Time:  now.Add(-30 * time.Minute),
+	})
+	s.AssertDebugStatus(c, false, map[string]params.DebugStatus{
+		"scrub": {
+			Name:   "Archive integrity scrub",
+			Value:  "started: " + now.Add(-1*time.Hour).Format(time.RFC3339) + ", completed: " + now.Add(-30*time.Minute).Format(time.RFC3339) + ", problems: 0",
+			Passed: true,
+		},
+	})
+}
+
 // AssertDebugStatus asserts that the current /debug/status endpoint
 // matches the given status, ignoring status duration.
 // If complete is true, it fails if the results contain
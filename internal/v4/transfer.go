@@ -0,0 +1,50 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/juju/utils/jsonhttp"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// POST id/transfer
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idtransfer
+func (h *Handler) serveTransfer(id *charm.Reference, w http.ResponseWriter, req *http.Request) error {
+	if _, err := h.authorize(req, nil, true, nil); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if req.Method != "POST" {
+		return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	if id.User == "" {
+		return badRequestf(nil, "user not specified")
+	}
+	if id.Series != "" || id.Revision != -1 {
+		return badRequestf(nil, "base entity id %q must not specify a series or revision", id)
+	}
+	var transfer params.TransferRequest
+	if err := json.NewDecoder(req.Body).Decode(&transfer); err != nil {
+		return badRequestf(err, "cannot unmarshal transfer request")
+	}
+	if transfer.User == "" {
+		return badRequestf(nil, "new owner not specified")
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	result, err := store.TransferBaseEntity(id, transfer.User)
+	if err != nil {
+		return errgo.NoteMask(err, "cannot transfer base entity", errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest), errgo.Is(params.ErrDuplicateUpload))
+	}
+	return jsonhttp.WriteJSON(w, http.StatusOK, params.TransferResponse{
+		Id:       result.URL,
+		Entities: result.Entities,
+		Counters: result.Counters,
+	})
+}
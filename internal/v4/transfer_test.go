@@ -0,0 +1,227 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type TransferSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&TransferSuite{})
+
+func (s *TransferSuite) SetUpTest(c *gc.C) {
+	s.commonSuite.SetUpTest(c)
+	for _, id := range []string{
+		"~alice/precise/wordpress-0",
+		"~alice/trusty/wordpress-1",
+	} {
+		url := newResolvedURL(id, -1)
+		err := s.store.AddCharmWithArchive(url, storetesting.Charms.CharmArchive(c.MkDir(), "wordpress"))
+		c.Assert(err, gc.IsNil)
+		err = s.store.SetPerms(&url.URL, "read", params.Everyone, url.URL.User)
+		c.Assert(err, gc.IsNil)
+	}
+}
+
+func (s *TransferSuite) TestTransfer(c *gc.C) {
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~alice/wordpress/transfer"),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Body: strings.NewReader(`{"User": "bob"}`),
+		ExpectBody: params.TransferResponse{
+			Id: charm.MustParseReference("cs:~bob/wordpress"),
+			Entities: []*charm.Reference{
+				charm.MustParseReference("cs:~bob/precise/wordpress-0"),
+				charm.MustParseReference("cs:~bob/trusty/wordpress-1"),
+			},
+		},
+	})
+
+	// The old ids are redirected to the new ones.
+	for id, expect := range map[string]string{
+		"~alice/wordpress":           "cs:~bob/trusty/wordpress-1",
+		"~alice/precise/wordpress":   "cs:~bob/precise/wordpress-0",
+		"~alice/precise/wordpress-0": "cs:~bob/precise/wordpress-0",
+		"~bob/wordpress":             "cs:~bob/trusty/wordpress-1",
+	} {
+		c.Logf("id %s", id)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			URL:     storeURL(id + "/meta/id"),
+			ExpectBody: params.IdResponse{
+				Id:       charm.MustParseReference(expect),
+				User:     "bob",
+				Name:     "wordpress",
+				Revision: charm.MustParseReference(expect).Revision,
+				Series:   charm.MustParseReference(expect).Series,
+			},
+		})
+	}
+
+	// Fully specified old ids that are not found are
+	// redirected by the id handlers too.
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("~alice/precise/wordpress-0/archive"),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body))
+	c.Assert(rec.Header().Get(params.EntityIdHeader), gc.Equals, "cs:~bob/precise/wordpress-0")
+
+	// The permissions have been transferred.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~bob/wordpress/meta/perm"),
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.PermResponse{
+			Read:  []string{params.Everyone, "bob"},
+			Write: []string{"bob"},
+		},
+	})
+
+	// Ids that never existed are still not found.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~alice/utopic/wordpress/meta/id"),
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `no matching charm or bundle for "cs:~bob/utopic/wordpress"`,
+		},
+	})
+}
+
+var transferErrorsTests = []struct {
+	about        string
+	method       string
+	path         string
+	username     string
+	body         string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "not an admin",
+	method:       "POST",
+	path:         "~alice/wordpress/transfer",
+	username:     "bad",
+	body:         `{"User": "bob"}`,
+	expectStatus: http.StatusUnauthorized,
+	expectBody: params.Error{
+		Message: "invalid user name or password",
+		Code:    params.ErrUnauthorized,
+	},
+}, {
+	about:        "bad method",
+	method:       "PUT",
+	path:         "~alice/wordpress/transfer",
+	body:         `{"User": "bob"}`,
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Message: "PUT method not allowed",
+		Code:    params.ErrMethodNotAllowed,
+	},
+}, {
+	about:        "no user",
+	method:       "POST",
+	path:         "wordpress/transfer",
+	body:         `{"User": "bob"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: "user not specified",
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "series specified",
+	method:       "POST",
+	path:         "~alice/precise/wordpress/transfer",
+	body:         `{"User": "bob"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: `base entity id "cs:~alice/precise/wordpress" must not specify a series or revision`,
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "invalid body",
+	method:       "POST",
+	path:         "~alice/wordpress/transfer",
+	body:         `{"User": 42}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: "cannot unmarshal transfer request: json: cannot unmarshal number into Go value of type string",
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "new owner not specified",
+	method:       "POST",
+	path:         "~alice/wordpress/transfer",
+	body:         `{}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: "new owner not specified",
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "invalid new owner",
+	method:       "POST",
+	path:         "~alice/wordpress/transfer",
+	body:         `{"User": "bad/wolf"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Message: `cannot transfer base entity: invalid user name "bad/wolf"`,
+		Code:    params.ErrBadRequest,
+	},
+}, {
+	about:        "not found",
+	method:       "POST",
+	path:         "~alice/mysql/transfer",
+	body:         `{"User": "bob"}`,
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Message: "cannot transfer base entity: base entity not found",
+		Code:    params.ErrNotFound,
+	},
+}}
+
+func (s *TransferSuite) TestTransferErrors(c *gc.C) {
+	for i, test := range transferErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		username := testUsername
+		if test.username != "" {
+			username = test.username
+		}
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:  s.srv,
+			URL:      storeURL(test.path),
+			Method:   test.method,
+			Username: username,
+			Password: testPassword,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+			},
+			Body:         strings.NewReader(test.body),
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+	// The charm has not been transferred.
+	_, err := s.store.FindBaseEntity(charm.MustParseReference("~alice/wordpress"))
+	c.Assert(err, gc.IsNil)
+}
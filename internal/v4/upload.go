@@ -0,0 +1,207 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/juju/utils/jsonhttp"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+// POST upload
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-upload
+func (h *Handler) serveUpload(_ http.Header, req *http.Request) (interface{}, error) {
+	auth, err := h.authorize(req, []string{params.Everyone}, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	if req.Method != "POST" {
+		return nil, errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	upload, err := store.NewUpload(auth.Username)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot create upload")
+	}
+	return params.NewUploadResponse{
+		UploadId: upload.Id,
+		Expires:  upload.Expires,
+	}, nil
+}
+
+// GET upload/id
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-uploadid
+//
+// DELETE upload/id
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#delete-uploadid
+//
+// PUT upload/id/chunk?hash=sha384hash
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#put-uploadidchunk
+func (h *Handler) serveUploadId(w http.ResponseWriter, req *http.Request) error {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if len(parts) > 2 || parts[0] == "" {
+		return errgo.WithCausef(nil, params.ErrNotFound, "not found")
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	upload, err := h.authorizedUpload(store, req, parts[0])
+	if err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if len(parts) == 2 {
+		if req.Method != "PUT" {
+			return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+		}
+		return h.putUploadChunk(store, upload, parts[1], req)
+	}
+	switch req.Method {
+	case "GET":
+		return jsonhttp.WriteJSON(w, http.StatusOK, uploadInfo(upload))
+	case "DELETE":
+		if err := store.RemoveUpload(upload.Id); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+}
+
+func (h *Handler) putUploadChunk(store *charmstore.Store, upload *mongodoc.Upload, chunk string, req *http.Request) error {
+	n, err := strconv.Atoi(chunk)
+	if err != nil || n < 0 || n >= charmstore.MaxUploadChunks {
+		return badRequestf(nil, "invalid chunk number %q", chunk)
+	}
+	hash := req.Form.Get("hash")
+	if hash == "" {
+		return badRequestf(nil, "hash parameter not specified")
+	}
+	if req.ContentLength == -1 {
+		return badRequestf(nil, "Content-Length not specified")
+	}
+	if upload.User != "" {
+		// The chunks of an upload count towards the quota of the
+		// user that created it. Uploads created by admins do not.
+		replaced := upload.Chunks[strconv.Itoa(n)].Size
+		if err := h.checkBlobQuota(store, upload.User, "chunk", req.ContentLength, replaced); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrQuotaExceeded))
+		}
+	}
+	if err := store.PutUploadChunk(upload, n, req.Body, req.ContentLength, hash); err != nil {
+		return errgo.NoteMask(err, "cannot put chunk", errgo.Is(params.ErrNotFound), errgo.Is(params.ErrBadRequest))
+	}
+	return nil
+}
+
+// uploadInfo returns the information on the given
+// upload that is sent to clients.
+func uploadInfo(upload *mongodoc.Upload) *params.UploadInfoResponse {
+	info := &params.UploadInfoResponse{
+		UploadId: upload.Id,
+		Expires:  upload.Expires,
+		Chunks:   make([]params.UploadChunk, 0, len(upload.Chunks)),
+	}
+	for key, chunk := range upload.Chunks {
+		n, err := strconv.Atoi(key)
+		if err != nil {
+			logger.Errorf("invalid chunk number %q in upload %q", key, upload.Id)
+			continue
+		}
+		info.Chunks = append(info.Chunks, params.UploadChunk{
+			Number: n,
+			Size:   chunk.Size,
+			Hash:   chunk.Hash,
+		})
+	}
+	sort.Sort(uploadChunksByNumber(info.Chunks))
+	return info
+}
+
+type uploadChunksByNumber []params.UploadChunk
+
+func (c uploadChunksByNumber) Len() int           { return len(c) }
+func (c uploadChunksByNumber) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
+func (c uploadChunksByNumber) Less(i, j int) bool { return c[i].Number < c[j].Number }
+
+// authorizedUpload returns the upload with the given id, checking
+// that the request has been made by the user that created it
+// or by an admin.
+func (h *Handler) authorizedUpload(store *charmstore.Store, req *http.Request, id string) (*mongodoc.Upload, error) {
+	auth, err := h.authorize(req, []string{params.Everyone}, true, nil)
+	if err != nil {
+		return nil, err
+	}
+	upload, err := store.Upload(id)
+	if err != nil {
+		return nil, errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if !auth.Admin && auth.Username != upload.User {
+		return nil, errgo.WithCausef(nil, params.ErrUnauthorized, "upload %q belongs to another user", id)
+	}
+	return upload, nil
+}
+
+// archiveBody returns the archive data for an archive upload
+// request along with its size. If the request specifies an
+// upload parameter, the data is read from the chunks of that
+// upload rather than from the request body, and the upload is
+// also returned so that it can be removed when the archive
+// has been added. If the request specifies a size parameter,
+// the archive content is not sent at all, and a nil reader is
+// returned. The returned reader must be closed after use
+// and before the given store is closed.
+func (h *Handler) archiveBody(store *charmstore.Store, req *http.Request) (io.ReadCloser, int64, *mongodoc.Upload, error) {
+	uploadId := req.Form.Get("upload")
+	if sizeStr := req.Form.Get("size"); sizeStr != "" {
+		size, err := strconv.ParseInt(sizeStr, 10, 64)
+		if err != nil || size < 0 {
+			return nil, 0, nil, badRequestf(nil, "invalid size value %q", sizeStr)
+		}
+		if uploadId != "" {
+			return nil, 0, nil, badRequestf(nil, "size and upload parameters both specified")
+		}
+		if req.ContentLength > 0 {
+			return nil, 0, nil, badRequestf(nil, "request body provided with size parameter")
+		}
+		return nil, size, nil, nil
+	}
+	if uploadId == "" {
+		if req.ContentLength == -1 {
+			return nil, 0, nil, badRequestf(nil, "Content-Length not specified")
+		}
+		return ioutil.NopCloser(req.Body), req.ContentLength, nil, nil
+	}
+	upload, err := h.authorizedUpload(store, req, uploadId)
+	if err != nil {
+		return nil, 0, nil, errgo.Mask(err, errgo.Any)
+	}
+	r, size, err := store.OpenUpload(upload)
+	if err != nil {
+		return nil, 0, nil, errgo.Mask(err, errgo.Is(params.ErrBadRequest))
+	}
+	return r, size, upload, nil
+}
+
+// removeCommittedUpload removes the given upload, if any,
+// after its data has been added to the store as an archive.
+func removeCommittedUpload(store *charmstore.Store, upload *mongodoc.Upload) {
+	if upload == nil {
+		return
+	}
+	if err := store.RemoveUpload(upload.Id); err != nil {
+		// The upload will expire in time, and its chunks
+		// will then be reclaimed by the blob garbage collector.
+		logger.Errorf("cannot remove upload %q: %v", upload.Id, err)
+	}
+}
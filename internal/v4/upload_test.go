@@ -0,0 +1,369 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/errgo.v1"
+	"gopkg.in/juju/charm.v5"
+
+	"gopkg.in/juju/charmstore.v4/internal/storetesting"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type UploadSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&UploadSuite{})
+
+// newUpload creates a new upload through the API
+// and returns its id.
+func (s *UploadSuite) newUpload(c *gc.C) string {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("upload"),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var resp params.NewUploadResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &resp)
+	c.Assert(err, gc.IsNil)
+	c.Assert(resp.UploadId, gc.Not(gc.Equals), "")
+	c.Assert(resp.Expires.After(time.Now()), gc.Equals, true)
+	return resp.UploadId
+}
+
+// putChunk uploads the given data as chunk n of the given upload.
+func (s *UploadSuite) putChunk(c *gc.C, id string, n int, data []byte) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:       s.srv,
+		URL:           storeURL("upload/" + id + "/" + strconv.Itoa(n) + "?hash=" + hashOfBytes(data)),
+		Method:        "PUT",
+		ContentLength: int64(len(data)),
+		Body:          bytes.NewReader(data),
+		Username:      testUsername,
+		Password:      testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+}
+
+// uploadInfo returns information on the upload with the given id.
+func (s *UploadSuite) uploadInfo(c *gc.C, id string) *params.UploadInfoResponse {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("upload/" + id),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var info params.UploadInfoResponse
+	err := json.Unmarshal(rec.Body.Bytes(), &info)
+	c.Assert(err, gc.IsNil)
+	return &info
+}
+
+// uploadArchiveChunks uploads the archive of the wordpress
+// charm in three chunks to a new upload, and returns the upload
+// id and the hash of the archive.
+func (s *UploadSuite) uploadArchiveChunks(c *gc.C) (string, string) {
+	ch := storetesting.Charms.CharmArchive(c.MkDir(), "wordpress")
+	data, err := ioutil.ReadFile(ch.Path)
+	c.Assert(err, gc.IsNil)
+	id := s.newUpload(c)
+	third := len(data) / 3
+	// Upload the chunks out of order.
+	s.putChunk(c, id, 2, data[2*third:])
+	s.putChunk(c, id, 0, data[0:third])
+	s.putChunk(c, id, 1, data[third:2*third])
+	return id, hashOfBytes(data)
+}
+
+func (s *UploadSuite) TestUploadInfo(c *gc.C) {
+	id := s.newUpload(c)
+	info := s.uploadInfo(c, id)
+	c.Assert(info.UploadId, gc.Equals, id)
+	c.Assert(info.Chunks, gc.HasLen, 0)
+
+	s.putChunk(c, id, 1, []byte("world"))
+	s.putChunk(c, id, 0, []byte("hello"))
+	info = s.uploadInfo(c, id)
+	c.Assert(info.Chunks, jc.DeepEquals, []params.UploadChunk{{
+		Number: 0,
+		Size:   5,
+		Hash:   hashOfBytes([]byte("hello")),
+	}, {
+		Number: 1,
+		Size:   5,
+		Hash:   hashOfBytes([]byte("world")),
+	}})
+}
+
+func (s *UploadSuite) TestPostArchiveFromUpload(c *gc.C) {
+	id, hash := s.uploadArchiveChunks(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/wordpress/archive?hash=" + hash + "&upload=" + id),
+		Method:   "POST",
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseReference("cs:~charmers/precise/wordpress-0"),
+		},
+	})
+	entity, err := s.store.FindEntity(newResolvedURL("cs:~charmers/precise/wordpress-0", -1), "blobhash")
+	c.Assert(err, gc.IsNil)
+	c.Assert(entity.BlobHash, gc.Equals, hash)
+
+	// The upload has been removed.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("upload/" + id),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `upload "` + id + `" not found`,
+		},
+	})
+}
+
+func (s *UploadSuite) TestPostArchiveDryRunFromUpload(c *gc.C) {
+	id, hash := s.uploadArchiveChunks(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("~charmers/precise/wordpress/archive?dry-run=1&hash=" + hash + "&upload=" + id),
+		Method:     "POST",
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: params.ArchiveValidateResponse{},
+	})
+
+	// Nothing has been added, and the upload has been removed.
+	_, err := s.store.FindEntity(newResolvedURL("cs:~charmers/precise/wordpress-0", -1))
+	c.Assert(errgo.Cause(err), gc.Equals, params.ErrNotFound)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("upload/" + id),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `upload "` + id + `" not found`,
+		},
+	})
+}
+
+func (s *UploadSuite) TestPutArchiveFromUpload(c *gc.C) {
+	id, hash := s.uploadArchiveChunks(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:  s.srv,
+		URL:      storeURL("~charmers/precise/wordpress-5/archive?hash=" + hash + "&upload=" + id),
+		Method:   "PUT",
+		Username: testUsername,
+		Password: testPassword,
+		ExpectBody: params.ArchiveUploadResponse{
+			Id: charm.MustParseReference("cs:~charmers/precise/wordpress-5"),
+		},
+	})
+	_, err := s.store.FindEntity(newResolvedURL("cs:~charmers/precise/wordpress-5", -1))
+	c.Assert(err, gc.IsNil)
+}
+
+func (s *UploadSuite) TestPostArchiveFromUploadHashMismatch(c *gc.C) {
+	id, _ := s.uploadArchiveChunks(c)
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/wordpress/archive?hash=" + hashOfBytes([]byte("other")) + "&upload=" + id),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusInternalServerError,
+		ExpectBody: params.Error{
+			Message: "cannot put archive blob: hash mismatch",
+		},
+	})
+	// The upload is left in place so that the
+	// client can fix it.
+	info := s.uploadInfo(c, id)
+	c.Assert(info.Chunks, gc.HasLen, 3)
+}
+
+func (s *UploadSuite) TestPostArchiveFromUploadMissingChunk(c *gc.C) {
+	id := s.newUpload(c)
+	s.putChunk(c, id, 1, []byte("world"))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("~charmers/precise/wordpress/archive?hash=" + hashOfBytes([]byte("world")) + "&upload=" + id),
+		Method:       "POST",
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusBadRequest,
+		ExpectBody: params.Error{
+			Code:    params.ErrBadRequest,
+			Message: `upload "` + id + `" is missing chunk 0`,
+		},
+	})
+}
+
+func (s *UploadSuite) TestDeleteUpload(c *gc.C) {
+	id := s.newUpload(c)
+	s.putChunk(c, id, 0, []byte("hello"))
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("upload/" + id),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	_, err := s.store.Upload(id)
+	c.Assert(err, gc.ErrorMatches, `upload ".*" not found`)
+	names, err := s.store.BlobStore.List()
+	c.Assert(err, gc.IsNil)
+	c.Assert(names, gc.HasLen, 0)
+}
+
+func (s *UploadSuite) TestUploadRequiresAuth(c *gc.C) {
+	upload, err := s.store.NewUpload("bob")
+	c.Assert(err, gc.IsNil)
+	for _, path := range []string{"upload", "upload/" + upload.Id} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			URL:          storeURL(path),
+			Method:       "POST",
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Code:    params.ErrUnauthorized,
+				Message: "authentication failed: missing HTTP auth header",
+			},
+		})
+	}
+}
+
+var uploadErrorTests = []struct {
+	about        string
+	method       string
+	path         string
+	body         string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "new upload with GET",
+	method:       "GET",
+	path:         "upload",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET method not allowed",
+	},
+}, {
+	about:        "unknown upload",
+	method:       "GET",
+	path:         "upload/no-such-upload",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `upload "no-such-upload" not found`,
+	},
+}, {
+	about:        "unknown upload commit",
+	method:       "POST",
+	path:         "~charmers/precise/wordpress/archive?hash=x&upload=no-such-upload",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `upload "no-such-upload" not found`,
+	},
+}, {
+	about:        "upload POST",
+	method:       "POST",
+	path:         "upload/$id",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "POST method not allowed",
+	},
+}, {
+	about:        "chunk GET",
+	method:       "GET",
+	path:         "upload/$id/0",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "GET method not allowed",
+	},
+}, {
+	about:        "invalid chunk number",
+	method:       "PUT",
+	path:         "upload/$id/foo?hash=x",
+	body:         "x",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid chunk number "foo"`,
+	},
+}, {
+	about:        "negative chunk number",
+	method:       "PUT",
+	path:         "upload/$id/-1?hash=x",
+	body:         "x",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `invalid chunk number "-1"`,
+	},
+}, {
+	about:        "no hash",
+	method:       "PUT",
+	path:         "upload/$id/0",
+	body:         "x",
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "hash parameter not specified",
+	},
+}, {
+	about:        "too many path elements",
+	method:       "PUT",
+	path:         "upload/$id/0/1",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
+}}
+
+func (s *UploadSuite) TestUploadErrors(c *gc.C) {
+	upload, err := s.store.NewUpload("")
+	c.Assert(err, gc.IsNil)
+	for i, test := range uploadErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:       s.srv,
+			URL:           storeURL(strings.Replace(test.path, "$id", upload.Id, -1)),
+			Method:        test.method,
+			Body:          strings.NewReader(test.body),
+			ContentLength: int64(len(test.body)),
+			Username:      testUsername,
+			Password:      testPassword,
+			ExpectStatus:  test.expectStatus,
+			ExpectBody:    test.expectBody,
+		})
+	}
+}
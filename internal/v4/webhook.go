@@ -0,0 +1,182 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/juju/utils/jsonhttp"
+	"gopkg.in/errgo.v1"
+
+	"gopkg.in/juju/charmstore.v4/internal/charmstore"
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+const (
+	// defaultDeliveriesLimit holds the number of deliveries
+	// returned by webhooks/id/deliveries when no limit
+	// is specified.
+	defaultDeliveriesLimit = 100
+
+	// maxDeliveriesLimit holds the maximum number of deliveries
+	// returned by a single webhooks/id/deliveries request.
+	maxDeliveriesLimit = 1000
+)
+
+// GET webhooks[?user=name]
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-webhooks
+//
+// POST webhooks
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#post-webhooks
+func (h *Handler) serveWebhooks(w http.ResponseWriter, req *http.Request) error {
+	store := h.pool.Store()
+	defer store.Close()
+	switch req.Method {
+	case "GET":
+		user := req.Form.Get("user")
+		if _, err := h.authorizeWebhookUser(req, user); err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		hooks, err := store.Webhooks(user)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		result := make([]params.Webhook, len(hooks))
+		for i, hook := range hooks {
+			result[i] = webhookParams(hook, false)
+		}
+		return jsonhttp.WriteJSON(w, http.StatusOK, result)
+	case "POST":
+		var hookReq params.WebhookRequest
+		if err := json.NewDecoder(req.Body).Decode(&hookReq); err != nil {
+			return badRequestf(err, "cannot unmarshal webhook request")
+		}
+		auth, err := h.authorizeWebhookUser(req, hookReq.User)
+		if err != nil {
+			return errgo.Mask(err, errgo.Any)
+		}
+		hook, err := store.AddWebhook(auth.Username, &hookReq)
+		if err != nil {
+			return errgo.NoteMask(err, "cannot add webhook", errgo.Is(params.ErrBadRequest))
+		}
+		return jsonhttp.WriteJSON(w, http.StatusOK, webhookParams(hook, true))
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+}
+
+// GET webhooks/id
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-webhooksid
+//
+// DELETE webhooks/id
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#delete-webhooksid
+//
+// GET webhooks/id/deliveries[?limit=count]
+// https://github.com/juju/charmstore/blob/v4/docs/API.md#get-webhooksiddeliveries
+func (h *Handler) serveWebhook(w http.ResponseWriter, req *http.Request) error {
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/"), "/")
+	if len(parts) > 2 || parts[0] == "" || len(parts) == 2 && parts[1] != "deliveries" {
+		return errgo.WithCausef(nil, params.ErrNotFound, "not found")
+	}
+	store := h.pool.Store()
+	defer store.Close()
+	hook, err := store.Webhook(parts[0])
+	if err != nil {
+		return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+	}
+	if _, err := h.authorizeWebhookUser(req, hook.User); err != nil {
+		return errgo.Mask(err, errgo.Any)
+	}
+	if len(parts) == 2 {
+		if req.Method != "GET" {
+			return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+		}
+		limit := defaultDeliveriesLimit
+		if s := req.Form.Get("limit"); s != "" {
+			limit, err = strconv.Atoi(s)
+			if err != nil || limit <= 0 {
+				return badRequestf(nil, "invalid 'limit' value")
+			}
+			if limit > maxDeliveriesLimit {
+				limit = maxDeliveriesLimit
+			}
+		}
+		deliveries, err := store.WebhookDeliveries(hook.Id, limit)
+		if err != nil {
+			return errgo.Mask(err)
+		}
+		result := make([]params.WebhookDelivery, len(deliveries))
+		for i, d := range deliveries {
+			result[i] = webhookDeliveryParams(d)
+		}
+		return jsonhttp.WriteJSON(w, http.StatusOK, result)
+	}
+	switch req.Method {
+	case "GET":
+		return jsonhttp.WriteJSON(w, http.StatusOK, webhookParams(hook, false))
+	case "DELETE":
+		if err := store.RemoveWebhook(hook.Id); err != nil {
+			return errgo.Mask(err, errgo.Is(params.ErrNotFound))
+		}
+		return nil
+	}
+	return errgo.WithCausef(nil, params.ErrMethodNotAllowed, "%s method not allowed", req.Method)
+}
+
+// authorizeWebhookUser checks that the given request may manage
+// the webhooks for the given user's entities. Only admins may
+// manage the webhooks for all entities, which have no user.
+func (h *Handler) authorizeWebhookUser(req *http.Request, user string) (authorization, error) {
+	var acl []string
+	if user != "" {
+		acl = []string{user}
+	}
+	auth, err := h.authorize(req, acl, true, nil)
+	if err != nil {
+		return authorization{}, errgo.Mask(err, errgo.Any)
+	}
+	return auth, nil
+}
+
+// webhookParams returns the external representation of the
+// given webhook. The secret is included only if withSecret
+// is true.
+func webhookParams(hook *mongodoc.Webhook, withSecret bool) params.Webhook {
+	p := params.Webhook{
+		Id:         hook.Id,
+		User:       hook.User,
+		URL:        hook.URL,
+		Owner:      hook.Owner,
+		CreateTime: hook.CreateTime.UTC(),
+	}
+	for _, kind := range hook.Kinds {
+		p.Kinds = append(p.Kinds, params.EventKind(kind))
+	}
+	if withSecret {
+		p.Secret = hook.Secret
+	}
+	return p
+}
+
+// webhookDeliveryParams returns the external
+// representation of the given webhook delivery.
+func webhookDeliveryParams(d *mongodoc.WebhookDelivery) params.WebhookDelivery {
+	p := params.WebhookDelivery{
+		Id:          d.Id,
+		Event:       charmstore.EventParams(&d.Event),
+		Status:      params.WebhookDeliveryStatus(d.Status),
+		Time:        d.Time.UTC(),
+		Attempts:    d.Attempts,
+		LastAttempt: d.LastAttempt.UTC(),
+		StatusCode:  d.StatusCode,
+		Error:       d.Error,
+	}
+	if p.Status == params.WebhookPending {
+		p.NextAttempt = d.NextAttempt.UTC()
+	}
+	return p
+}
@@ -0,0 +1,277 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the AGPLv3, see LICENCE file for details.
+
+package v4_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	jc "github.com/juju/testing/checkers"
+	"github.com/juju/testing/httptesting"
+	gc "gopkg.in/check.v1"
+	"gopkg.in/juju/charm.v5"
+	"gopkg.in/macaroon-bakery.v0/httpbakery"
+
+	"gopkg.in/juju/charmstore.v4/internal/mongodoc"
+	"gopkg.in/juju/charmstore.v4/params"
+)
+
+type WebhooksSuite struct {
+	commonSuite
+}
+
+var _ = gc.Suite(&WebhooksSuite{})
+
+func (s *WebhooksSuite) SetUpSuite(c *gc.C) {
+	s.enableIdentity = true
+	s.commonSuite.SetUpSuite(c)
+}
+
+func (s *WebhooksSuite) TestGlobalWebhook(c *gc.C) {
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		URL:     storeURL("webhooks"),
+		Method:  "POST",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Username: testUsername,
+		Password: testPassword,
+		Body:     strings.NewReader(`{"URL": "http://example.com/hook", "Kinds": ["upload", "publish"]}`),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var hook params.Webhook
+	err := json.Unmarshal(rec.Body.Bytes(), &hook)
+	c.Assert(err, gc.IsNil)
+	c.Assert(hook.Id, gc.Not(gc.Equals), "")
+	c.Assert(hook.Secret, gc.Not(gc.Equals), "")
+	c.Assert(hook.URL, gc.Equals, "http://example.com/hook")
+	c.Assert(hook.Kinds, jc.DeepEquals, []params.EventKind{params.EventUpload, params.EventPublish})
+
+	// The secret is not returned once the webhook has been created.
+	hook.Secret = ""
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("webhooks"),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: []params.Webhook{hook},
+	})
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("webhooks/" + hook.Id),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: hook,
+	})
+
+	// Deliveries are listed most recent first.
+	t0 := time.Now().UTC().Truncate(time.Millisecond)
+	for i, status := range []params.WebhookDeliveryStatus{params.WebhookDelivered, params.WebhookPending} {
+		err := s.store.DB.WebhookDeliveries().Insert(&mongodoc.WebhookDelivery{
+			Id:        fmt.Sprintf("%s-%d", hook.Id, i+1),
+			WebhookId: hook.Id,
+			Event: mongodoc.Event{
+				Seq:  int64(i + 1),
+				Time: t0,
+				Kind: string(params.EventUpload),
+				Id:   charm.MustParseReference("cs:~charmers/precise/wordpress-0"),
+			},
+			Status:      string(status),
+			Time:        t0.Add(time.Duration(i) * time.Second),
+			Attempts:    1,
+			NextAttempt: t0.Add(time.Hour),
+			LastAttempt: t0,
+			StatusCode:  http.StatusOK,
+		})
+		c.Assert(err, gc.IsNil)
+	}
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("webhooks/" + hook.Id + "/deliveries?limit=1"),
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var deliveries []params.WebhookDelivery
+	err = json.Unmarshal(rec.Body.Bytes(), &deliveries)
+	c.Assert(err, gc.IsNil)
+	c.Assert(deliveries, jc.DeepEquals, []params.WebhookDelivery{{
+		Id: hook.Id + "-2",
+		Event: params.Event{
+			Seq:  2,
+			Time: t0,
+			Kind: params.EventUpload,
+			Id:   charm.MustParseReference("cs:~charmers/precise/wordpress-0"),
+		},
+		Status:      params.WebhookPending,
+		Time:        t0.Add(time.Second),
+		Attempts:    1,
+		NextAttempt: t0.Add(time.Hour),
+		LastAttempt: t0,
+		StatusCode:  http.StatusOK,
+	}})
+
+	rec = httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler:  s.srv,
+		URL:      storeURL("webhooks/" + hook.Id),
+		Method:   "DELETE",
+		Username: testUsername,
+		Password: testPassword,
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:      s.srv,
+		URL:          storeURL("webhooks/" + hook.Id),
+		Username:     testUsername,
+		Password:     testPassword,
+		ExpectStatus: http.StatusNotFound,
+		ExpectBody: params.Error{
+			Code:    params.ErrNotFound,
+			Message: `webhook "` + hook.Id + `" not found`,
+		},
+	})
+}
+
+func (s *WebhooksSuite) TestUserWebhook(c *gc.C) {
+	s.discharge = dischargeForUser("bob")
+	client := httpbakery.NewHTTPClient()
+	rec := httptesting.DoRequest(c, httptesting.DoRequestParams{
+		Handler: s.srv,
+		Do:      bakeryDo(client),
+		URL:     storeURL("webhooks"),
+		Method:  "POST",
+		Header: http.Header{
+			"Content-Type": {"application/json"},
+		},
+		Body: strings.NewReader(`{"User": "bob", "URL": "https://example.com/hook", "Secret": "sekrit"}`),
+	})
+	c.Assert(rec.Code, gc.Equals, http.StatusOK, gc.Commentf("body: %s", rec.Body.String()))
+	var hook params.Webhook
+	err := json.Unmarshal(rec.Body.Bytes(), &hook)
+	c.Assert(err, gc.IsNil)
+	c.Assert(hook.User, gc.Equals, "bob")
+	c.Assert(hook.Owner, gc.Equals, "bob")
+	c.Assert(hook.Secret, gc.Equals, "sekrit")
+
+	hook.Secret = ""
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		Do:         bakeryDo(client),
+		URL:        storeURL("webhooks?user=bob"),
+		ExpectBody: []params.Webhook{hook},
+	})
+
+	// The user cannot manage the global webhooks
+	// or the webhooks of other users.
+	for _, path := range []string{"webhooks", "webhooks?user=alice"} {
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler:      s.srv,
+			Do:           bakeryDo(client),
+			URL:          storeURL(path),
+			ExpectStatus: http.StatusUnauthorized,
+			ExpectBody: params.Error{
+				Code:    params.ErrUnauthorized,
+				Message: `unauthorized: access denied for user "bob"`,
+			},
+		})
+	}
+
+	// Admins can manage all webhooks.
+	httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+		Handler:    s.srv,
+		URL:        storeURL("webhooks/" + hook.Id),
+		Username:   testUsername,
+		Password:   testPassword,
+		ExpectBody: hook,
+	})
+}
+
+var webhooksErrorsTests = []struct {
+	about        string
+	method       string
+	path         string
+	body         string
+	expectStatus int
+	expectBody   params.Error
+}{{
+	about:        "invalid body",
+	method:       "POST",
+	path:         "webhooks",
+	body:         `{`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: "cannot unmarshal webhook request: unexpected EOF",
+	},
+}, {
+	about:        "invalid URL",
+	method:       "POST",
+	path:         "webhooks",
+	body:         `{"URL": "ftp://example.com"}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot add webhook: invalid webhook URL "ftp://example.com"`,
+	},
+}, {
+	about:        "invalid event kind",
+	method:       "POST",
+	path:         "webhooks",
+	body:         `{"URL": "http://example.com", "Kinds": ["reboot"]}`,
+	expectStatus: http.StatusBadRequest,
+	expectBody: params.Error{
+		Code:    params.ErrBadRequest,
+		Message: `cannot add webhook: invalid event kind "reboot"`,
+	},
+}, {
+	about:        "unknown webhook",
+	method:       "GET",
+	path:         "webhooks/unknown",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: `webhook "unknown" not found`,
+	},
+}, {
+	about:        "unknown webhook path",
+	method:       "GET",
+	path:         "webhooks/unknown/other",
+	expectStatus: http.StatusNotFound,
+	expectBody: params.Error{
+		Code:    params.ErrNotFound,
+		Message: "not found",
+	},
+}, {
+	about:        "method not allowed",
+	method:       "PUT",
+	path:         "webhooks",
+	expectStatus: http.StatusMethodNotAllowed,
+	expectBody: params.Error{
+		Code:    params.ErrMethodNotAllowed,
+		Message: "PUT method not allowed",
+	},
+}}
+
+func (s *WebhooksSuite) TestWebhooksErrors(c *gc.C) {
+	for i, test := range webhooksErrorsTests {
+		c.Logf("test %d: %s", i, test.about)
+		httptesting.AssertJSONCall(c, httptesting.JSONCallParams{
+			Handler: s.srv,
+			URL:     storeURL(test.path),
+			Method:  test.method,
+			Header: http.Header{
+				"Content-Type": {"application/json"},
+			},
+			Body:         strings.NewReader(test.body),
+			Username:     testUsername,
+			Password:     testPassword,
+			ExpectStatus: test.expectStatus,
+			ExpectBody:   test.expectBody,
+		})
+	}
+}
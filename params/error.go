@@ -5,6 +5,7 @@ package params
 
 import (
 	"fmt"
+	"strconv"
 )
 
 // ErrorCode holds the class of an error in machine-readable format.
@@ -30,6 +31,34 @@ const (
 	ErrUnauthorized     ErrorCode = "unauthorized"
 	ErrMethodNotAllowed ErrorCode = "method not allowed"
 
+	// ErrContentChallenge is returned when an archive is
+	// uploaded without its content and the charm store
+	// requires proof that the client holds the content.
+	// The Info field of the error holds the challenge - see
+	// ContentChallengeFromError.
+	ErrContentChallenge ErrorCode = "content challenge"
+
+	// ErrPolicyViolation is returned when an uploaded archive
+	// violates the content policy of the charm store. The Info
+	// field of the error holds an entry for each violated rule,
+	// keyed by rule name.
+	ErrPolicyViolation ErrorCode = "policy violation"
+
+	// ErrQuotaExceeded is returned when an upload would take
+	// the storage used by a user beyond their quota.
+	ErrQuotaExceeded ErrorCode = "quota exceeded"
+
+	// ErrCursorExpired is returned when events in the change
+	// feed following the requested cursor have been discarded,
+	// so the feed cannot be resumed without missing changes.
+	ErrCursorExpired ErrorCode = "cursor expired"
+
+	// ErrPreconditionFailed is returned when the entity tag
+	// in the If-Match header of a metadata PUT request does
+	// not match the current entity tag of the metadata,
+	// usually because it has been changed by another client.
+	ErrPreconditionFailed ErrorCode = "precondition failed"
+
 	// Note that these error codes sit in the same name space
 	// as the bakery error codes defined in gopkg.in/macaroon-bakery.v0/httpbakery .
 	// In particular, ErrBadRequest is a shared error code
@@ -78,3 +107,68 @@ func (e *Error) Cause() error {
 	}
 	return nil
 }
+
+// Keys used in the Info field of an error with
+// the ErrContentChallenge code.
+const (
+	ContentChallengeRequestIdKey   = "request-id"
+	ContentChallengeRangeStartKey  = "range-start"
+	ContentChallengeRangeLengthKey = "range-length"
+)
+
+// ContentChallenge holds a proof-of-content-ownership challenge.
+// A client can satisfy the challenge by repeating its request with
+// the challenge-id parameter set to RequestId and the
+// challenge-hash parameter set to the SHA384 hash of RangeLength
+// bytes of the content starting at RangeStart.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idarchive
+type ContentChallenge struct {
+	RequestId   string
+	RangeStart  int64
+	RangeLength int64
+}
+
+// ErrorInfo returns the challenge in the form used
+// for the Info field of an error with the
+// ErrContentChallenge code.
+func (c *ContentChallenge) ErrorInfo() map[string]*Error {
+	return map[string]*Error{
+		ContentChallengeRequestIdKey:   {Message: c.RequestId},
+		ContentChallengeRangeStartKey:  {Message: strconv.FormatInt(c.RangeStart, 10)},
+		ContentChallengeRangeLengthKey: {Message: strconv.FormatInt(c.RangeLength, 10)},
+	}
+}
+
+// ContentChallengeFromError returns the challenge held
+// in the given error, which must have the
+// ErrContentChallenge code.
+func ContentChallengeFromError(e *Error) (*ContentChallenge, error) {
+	if e.Code != ErrContentChallenge {
+		return nil, fmt.Errorf("unexpected error code %q", e.Code)
+	}
+	var chal ContentChallenge
+	if info := e.Info[ContentChallengeRequestIdKey]; info != nil {
+		chal.RequestId = info.Message
+	}
+	if chal.RequestId == "" {
+		return nil, fmt.Errorf("no challenge request id found")
+	}
+	for _, f := range []struct {
+		key string
+		val *int64
+	}{
+		{ContentChallengeRangeStartKey, &chal.RangeStart},
+		{ContentChallengeRangeLengthKey, &chal.RangeLength},
+	} {
+		info := e.Info[f.key]
+		if info == nil {
+			return nil, fmt.Errorf("no challenge %s found", f.key)
+		}
+		n, err := strconv.ParseInt(info.Message, 10, 64)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid challenge %s %q", f.key, info.Message)
+		}
+		*f.val = n
+	}
+	return &chal, nil
+}
@@ -7,6 +7,9 @@
 package params
 
 import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"time"
 
@@ -19,6 +22,14 @@ const (
 	// that will hold the content hash for archive GET responses.
 	ContentHashHeader = "Content-Sha384"
 
+	// ContentHash256Header specifies the header attribute that
+	// will hold the SHA256 content hash for resource GET responses.
+	ContentHash256Header = "Content-Sha256"
+
+	// ResourceRevisionHeader specifies the header attribute that
+	// will hold the revision of the resource for resource GET responses.
+	ResourceRevisionHeader = "Resource-Revision"
+
 	// EntityIdHeader specifies the header attribute that will hold the
 	// id of the entity for archive GET responses.
 	EntityIdHeader = "Entity-Id"
@@ -30,6 +41,24 @@ const (
 	Admin    = "admin"
 )
 
+// Channel is the name of a channel in which
+// a charm or bundle may be published.
+type Channel string
+
+const (
+	// UnpublishedChannel holds all charms and bundles,
+	// whether published or not.
+	UnpublishedChannel Channel = "unpublished"
+
+	// DevelopmentChannel holds charms and bundles published
+	// in the development or stable channels.
+	DevelopmentChannel Channel = "development"
+
+	// StableChannel holds charms and bundles published
+	// in the stable channel.
+	StableChannel Channel = "stable"
+)
+
 // MetaAnyResponse holds the result of a meta/any request.
 // See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetaany
 type MetaAnyResponse struct {
@@ -44,6 +73,14 @@ type ArchiveUploadResponse struct {
 	PromulgatedId *charm.Reference `json:",omitempty"`
 }
 
+// ArchiveValidateResponse holds the result of a dry-run post to /id/archive.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idarchive
+type ArchiveValidateResponse struct {
+	// Problems holds all the problems found with the archive.
+	// It is empty if the archive could be uploaded.
+	Problems []*Error `json:",omitempty"`
+}
+
 // ExpandedId holds a charm or bundle fully qualified id.
 // A slice of ExpandedId is used as response for
 // id/expand-id GET requests.
@@ -58,6 +95,21 @@ type ArchiveSizeResponse struct {
 	Size int64
 }
 
+// ColorResponse holds the result of an id/meta/color GET request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetacolor
+type ColorResponse struct {
+	Color string
+}
+
+// AppearanceResponse holds the result of an id/meta/appearance GET
+// request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetaappearance
+type AppearanceResponse struct {
+	Color       string
+	Palette     []string `json:",omitempty"`
+	DefaultIcon bool     `json:",omitempty"`
+}
+
 // HashResponse holds the result of id/meta/hash and id/meta/hash256 GET
 // requests.
 // See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetahash
@@ -97,6 +149,10 @@ type RelatedResponse struct {
 // request. See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetarevision-info
 type RevisionInfoResponse struct {
 	Revisions []*charm.Reference
+
+	// Deprecations holds the deprecation information of any
+	// deprecated or yanked revisions, keyed by revision id.
+	Deprecations map[string]*Deprecation `json:",omitempty"`
 }
 
 // BundleCount holds the result of an id/meta/bundle-unit-count
@@ -118,6 +174,214 @@ type TagsResponse struct {
 type Published struct {
 	Id          *charm.Reference
 	PublishTime time.Time
+
+	// ReleaseNotes holds the release notes of the
+	// entity. It is omitted if there are none.
+	ReleaseNotes string `json:",omitempty"`
+}
+
+// EventKind identifies the kind of change recorded
+// by an event in the change feed.
+type EventKind string
+
+const (
+	// EventUpload records the upload of a new entity.
+	EventUpload EventKind = "upload"
+
+	// EventDelete records the deletion of an entity, or the
+	// removal of a base entity along with all its entities.
+	EventDelete EventKind = "delete"
+
+	// EventRestore records the restoration of a deleted entity.
+	EventRestore EventKind = "restore"
+
+	// EventPublish records the publication of an entity in a channel.
+	EventPublish EventKind = "publish"
+
+	// EventPerm records a change to the permissions of a base entity.
+	EventPerm EventKind = "perm"
+
+	// EventPromulgate records a change to whether a base
+	// entity is promulgated.
+	EventPromulgate EventKind = "promulgate"
+
+	// EventExtraInfo records a change to the extra-info
+	// of an entity or base entity.
+	EventExtraInfo EventKind = "extra-info"
+
+	// EventMeta records a change to any other metadata
+	// of an entity or base entity.
+	EventMeta EventKind = "meta"
+)
+
+// Event holds an event in the change feed.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-changesevents
+type Event struct {
+	// Seq holds the sequence number of the event. Sequence
+	// numbers start at one and increase by one with each event.
+	Seq int64
+
+	// Time holds the time at which the event was recorded.
+	Time time.Time
+
+	// Kind holds the kind of the event.
+	Kind EventKind
+
+	// Id holds the id of the entity changed. For changes
+	// to a base entity, it holds the base entity URL.
+	Id *charm.Reference
+
+	// PromulgatedId holds the promulgated id of the
+	// entity, if it has one.
+	PromulgatedId *charm.Reference `json:",omitempty"`
+
+	// Channel holds the channel an entity was published in,
+	// for publish events and upload events of entities
+	// published when they were uploaded.
+	Channel Channel `json:",omitempty"`
+
+	// Fields holds, for perm and extra-info events, the names
+	// of the permissions or extra-info keys that were changed.
+	Fields []string `json:",omitempty"`
+}
+
+// EventsResponse holds the result of a changes/events GET request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-changesevents
+type EventsResponse struct {
+	// Events holds the events found, in sequence order.
+	Events []Event
+
+	// Cursor holds the sequence number of the last event
+	// returned, or the requested cursor if no events were
+	// returned. It should be passed as the after parameter
+	// of the next request to resume the feed.
+	Cursor int64
+}
+
+// StreamEvent holds the data of an event sent by the
+// changes/stream endpoint.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-changesstream
+type StreamEvent struct {
+	Event
+
+	// Meta holds the metadata of the entity
+	// requested with the include parameters.
+	Meta map[string]interface{} `json:",omitempty"`
+}
+
+// WebhookRequest holds the body of a webhooks POST request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-webhooks
+type WebhookRequest struct {
+	// User holds the user whose entities' events are
+	// delivered to the webhook. If it is empty, the events
+	// for all entities are delivered.
+	User string `json:",omitempty"`
+
+	// URL holds the http or https URL that events are posted to.
+	URL string
+
+	// Kinds holds the kinds of event that are delivered.
+	// If it is empty, events of all kinds are delivered.
+	Kinds []EventKind `json:",omitempty"`
+
+	// Secret holds the key used to sign the payloads.
+	// If it is empty, a random key is generated.
+	Secret string `json:",omitempty"`
+}
+
+// Webhook holds a registered webhook.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-webhooks
+type Webhook struct {
+	Id    string
+	User  string `json:",omitempty"`
+	URL   string
+	Kinds []EventKind `json:",omitempty"`
+
+	// Secret holds the key used to sign the payloads. It is
+	// only returned when the webhook is registered.
+	Secret string `json:",omitempty"`
+
+	// Owner holds the name of the user that registered
+	// the webhook. It is empty for webhooks registered
+	// with the admin credentials.
+	Owner      string `json:",omitempty"`
+	CreateTime time.Time
+}
+
+// WebhookDeliveryStatus holds the status of the
+// delivery of an event to a webhook.
+type WebhookDeliveryStatus string
+
+const (
+	// WebhookPending is the status of a delivery
+	// that has not yet succeeded and will be retried.
+	WebhookPending WebhookDeliveryStatus = "pending"
+
+	// WebhookDelivered is the status of a delivery
+	// that has succeeded.
+	WebhookDelivered WebhookDeliveryStatus = "delivered"
+
+	// WebhookFailed is the status of a delivery that
+	// has failed and will not be retried.
+	WebhookFailed WebhookDeliveryStatus = "failed"
+)
+
+// WebhookDelivery holds the delivery of an event to a webhook.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-webhooksiddeliveries
+type WebhookDelivery struct {
+	Id       string
+	Event    Event
+	Status   WebhookDeliveryStatus
+	Time     time.Time
+	Attempts int
+
+	// NextAttempt holds the time of the next delivery
+	// attempt. It is zero unless the delivery is pending.
+	NextAttempt time.Time
+
+	// LastAttempt holds the time of the last delivery
+	// attempt. It is zero if there has been none.
+	LastAttempt time.Time
+
+	// StatusCode holds the HTTP status code of the response
+	// to the last delivery attempt, if any.
+	StatusCode int `json:",omitempty"`
+
+	// Error holds the error from the last delivery
+	// attempt, if it failed.
+	Error string `json:",omitempty"`
+}
+
+// WebhookPayload holds the body of the requests
+// that deliver events to webhooks.
+type WebhookPayload struct {
+	WebhookId  string
+	DeliveryId string
+	Event      Event
+}
+
+// The following headers are set on the requests
+// that deliver events to webhooks.
+const (
+	// WebhookSignatureHeader holds the signature of the
+	// request body - see WebhookSignature.
+	WebhookSignatureHeader = "X-Charmstore-Signature"
+
+	// WebhookEventHeader holds the kind of the event.
+	WebhookEventHeader = "X-Charmstore-Event"
+
+	// WebhookDeliveryHeader holds the id of the delivery.
+	WebhookDeliveryHeader = "X-Charmstore-Delivery"
+)
+
+// WebhookSignature returns the signature of the given webhook
+// request body made with the given secret, as found in the
+// WebhookSignatureHeader header. The signature is the hex-encoded
+// HMAC-SHA256 of the body, prefixed with "sha256=".
+func WebhookSignature(secret string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
 }
 
 // DebugStatus holds the result of the status checks.
@@ -203,6 +467,342 @@ type PromulgateRequest struct {
 	Promulgated bool
 }
 
+// PublishRequest holds the request of an id/publish PUT request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#put-idpublish
+type PublishRequest struct {
+	Channel Channel
+}
+
+// Deprecation holds the deprecation information of an entity revision.
+// It is used in id/meta/deprecation GET and PUT requests.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetadeprecation
+type Deprecation struct {
+	// Yanked holds whether the revision has been yanked.
+	Yanked bool `json:",omitempty"`
+
+	// Reason holds the reason for the deprecation.
+	Reason string
+
+	// Replacement optionally holds the id of the
+	// revision that should be used instead.
+	Replacement *charm.Reference `json:",omitempty"`
+
+	// Time holds the time the revision was deprecated.
+	// It is ignored in PUT requests.
+	Time time.Time
+}
+
+// BlobGCResponse holds the result of a gc POST request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-gc
+type BlobGCResponse struct {
+	// DryRun reports whether the orphaned blobs
+	// were left in place.
+	DryRun bool
+
+	// Orphans holds the names of the blobs that
+	// are not referred to by any entity.
+	Orphans []string
+
+	// Removed holds the names of the orphans
+	// that were removed.
+	Removed []string
+
+	// Errors holds any errors encountered when
+	// removing orphans, keyed by blob name.
+	Errors map[string]string `json:",omitempty"`
+}
+
+// BaseEntityDeleteResponse holds the result of a DELETE request
+// on a base entity id such as ~user/name.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#delete-id
+type BaseEntityDeleteResponse struct {
+	// Entities holds the ids of all the charms or bundles
+	// that were removed, including deleted ones.
+	Entities []*charm.Reference
+
+	// Blobs holds the number of archive blobs removed.
+	Blobs int
+
+	// SearchRecords holds the number of search
+	// records removed.
+	SearchRecords int
+
+	// Counters holds the number of statistics
+	// counter data points removed.
+	Counters int
+
+	// Errors holds any errors encountered when
+	// removing blobs, keyed by blob name.
+	Errors map[string]string `json:",omitempty"`
+}
+
+// Resource holds information on a revision of a charm resource.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idresources
+type Resource struct {
+	// Name holds the name of the resource.
+	Name string
+
+	// Revision holds the revision of the resource.
+	Revision int
+
+	// Size holds the size of the resource data.
+	Size int64
+
+	// Hash holds the SHA384 hash of the resource data,
+	// in hexadecimal format.
+	Hash string
+
+	// Hash256 holds the SHA256 hash of the resource data,
+	// in hexadecimal format.
+	Hash256 string
+
+	// UploadTime holds the time the resource
+	// revision was uploaded.
+	UploadTime time.Time
+}
+
+// ResourceUploadResponse holds the result of a POST to
+// id/resources/name.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idresourcesname
+type ResourceUploadResponse struct {
+	// Revision holds the revision of the newly uploaded resource.
+	Revision int
+}
+
+// ResourceRequest holds the request body of a PUT to
+// id/resources/name.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#put-idresourcesname
+type ResourceRequest struct {
+	// Revision holds the revision of the resource
+	// to link to the charm.
+	Revision int
+}
+
+// Signature holds a detached signature of the archive of a charm or
+// bundle, as returned by an id/meta/signatures GET request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-idmetasignatures
+type Signature struct {
+	// User holds the name of the user that made the signature.
+	User string
+
+	// KeyId holds the id of the public key that verified
+	// the signature when it was added.
+	KeyId string
+
+	// Signature holds the signature of the SHA384
+	// hash of the archive.
+	Signature []byte
+
+	// Time holds the time the signature was added.
+	Time time.Time
+
+	// Trusted holds whether the key is still trusted by
+	// the user, i.e. it has not been removed since the
+	// signature was added.
+	Trusted bool
+}
+
+// SignatureRequest holds the request body of a POST to
+// id/signatures.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idsignatures
+type SignatureRequest struct {
+	// User holds the name of the user that made the signature.
+	User string
+
+	// Signature holds the signature of the SHA384
+	// hash of the archive.
+	Signature []byte
+}
+
+// PublicKey holds a public key trusted to verify the
+// signatures made by a user.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-keysuser
+type PublicKey struct {
+	// Id holds the id of the key: the hex-encoded SHA256
+	// hash of its PKIX encoding.
+	Id string
+
+	// Key holds the PEM-encoded PKIX public key.
+	Key string
+
+	// AddTime holds the time the key was added.
+	AddTime time.Time
+}
+
+// PublicKeyRequest holds the request body of a POST to keys/user.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-keysuser
+type PublicKeyRequest struct {
+	// Key holds the PEM-encoded PKIX public key.
+	Key string
+}
+
+// QuotaResponse holds the result of a GET to ~user/quota.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-userquota
+type QuotaResponse struct {
+	// Entities holds the number of charms and
+	// bundles owned by the user.
+	Entities int
+
+	// Bytes holds the total size of the archives,
+	// resources and upload chunks owned by the user.
+	Bytes int64
+
+	// MaxEntities and MaxBytes hold the quotas of the
+	// user. They are omitted when there is no limit.
+	MaxEntities int   `json:",omitempty"`
+	MaxBytes    int64 `json:",omitempty"`
+}
+
+// TransferRequest holds the request body of a POST to
+// id/transfer.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idtransfer
+type TransferRequest struct {
+	// User holds the name of the user that will own
+	// the charm or bundle.
+	User string
+}
+
+// TransferResponse holds the result of a POST to id/transfer.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-idtransfer
+type TransferResponse struct {
+	// Id holds the new base id of the charm or bundle.
+	Id *charm.Reference
+
+	// Entities holds the new ids of all the transferred
+	// charms or bundles, including deleted ones.
+	Entities []*charm.Reference
+
+	// Counters holds the number of statistics
+	// counter data points moved to the new ids.
+	Counters int
+}
+
+// DiffResponse holds the result of a GET to id/diff.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-iddiff
+type DiffResponse struct {
+	// Id holds the id of the compared revision.
+	Id *charm.Reference
+
+	// Against holds the id of the revision it is compared against.
+	Against *charm.Reference
+
+	// Added and Removed hold the names of the files
+	// in the archive of Id that are not in the archive
+	// of Against, and vice versa.
+	Added   []string `json:",omitempty"`
+	Removed []string `json:",omitempty"`
+
+	// Changed holds the files with different
+	// contents in the two archives.
+	Changed []FileDiff `json:",omitempty"`
+
+	// Config, Relations and Actions hold the differences
+	// between the configuration options, relations and
+	// actions of two charms. They are omitted for bundles
+	// and when there are no differences.
+	Config    *ConfigDiff    `json:",omitempty"`
+	Relations *RelationsDiff `json:",omitempty"`
+	Actions   *ActionsDiff   `json:",omitempty"`
+}
+
+// FileDiff holds the differences between
+// two versions of a file.
+type FileDiff struct {
+	Name string
+
+	// OldSize and NewSize hold the size of the file
+	// in the archive of Against and Id respectively.
+	OldSize int64
+	NewSize int64
+
+	// Diff holds a unified diff between the two versions
+	// of the file. It is omitted for binary and large files.
+	Diff string `json:",omitempty"`
+}
+
+// ConfigDiff holds the differences between
+// the configuration options of two charms.
+type ConfigDiff struct {
+	Added   map[string]charm.Option `json:",omitempty"`
+	Removed map[string]charm.Option `json:",omitempty"`
+	Changed map[string]OptionChange `json:",omitempty"`
+}
+
+// OptionChange holds the old and new
+// versions of a configuration option.
+type OptionChange struct {
+	Old charm.Option
+	New charm.Option
+}
+
+// RelationsDiff holds the differences between
+// the relations of two charms.
+type RelationsDiff struct {
+	Added   map[string]charm.Relation `json:",omitempty"`
+	Removed map[string]charm.Relation `json:",omitempty"`
+	Changed map[string]RelationChange `json:",omitempty"`
+}
+
+// RelationChange holds the old and new
+// versions of a relation.
+type RelationChange struct {
+	Old charm.Relation
+	New charm.Relation
+}
+
+// ActionsDiff holds the differences between
+// the actions of two charms.
+type ActionsDiff struct {
+	Added   map[string]charm.ActionSpec `json:",omitempty"`
+	Removed map[string]charm.ActionSpec `json:",omitempty"`
+	Changed map[string]ActionChange     `json:",omitempty"`
+}
+
+// ActionChange holds the old and new
+// versions of an action.
+type ActionChange struct {
+	Old charm.ActionSpec
+	New charm.ActionSpec
+}
+
+// NewUploadResponse holds the result of an upload POST request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#post-upload
+type NewUploadResponse struct {
+	// UploadId holds the id of the new upload.
+	UploadId string
+
+	// Expires holds the time after which the
+	// upload can no longer be used.
+	Expires time.Time
+}
+
+// UploadInfoResponse holds the result of an upload/id GET request.
+// See https://github.com/juju/charmstore/blob/v4/docs/API.md#get-uploadid
+type UploadInfoResponse struct {
+	// UploadId holds the id of the upload.
+	UploadId string
+
+	// Expires holds the time after which the
+	// upload can no longer be used.
+	Expires time.Time
+
+	// Chunks holds the chunks uploaded so far,
+	// ordered by chunk number.
+	Chunks []UploadChunk
+}
+
+// UploadChunk holds information on a chunk of an upload.
+type UploadChunk struct {
+	// Number holds the chunk number.
+	Number int
+
+	// Size holds the size of the chunk data.
+	Size int64
+
+	// Hash holds the SHA384 hash of the chunk data.
+	Hash string
+}
+
 const (
 	// BzrDigestKey is the extra-info key used to store the Bazaar digest
 	BzrDigestKey = "bzr-digest"
@@ -268,10 +868,14 @@ type LogType string
 const (
 	IngestionType        LogType = "ingestion"
 	LegacyStatisticsType LogType = "legacyStatistics"
+	ScrubType            LogType = "scrub"
 
 	IngestionStart    = "ingestion started"
 	IngestionComplete = "ingestion completed"
 
 	LegacyStatisticsImportStart    = "legacy statistics import started"
 	LegacyStatisticsImportComplete = "legacy statistics import completed"
+
+	ScrubStart    = "scrub started"
+	ScrubComplete = "scrub completed"
 )
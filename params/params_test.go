@@ -22,8 +22,14 @@ func (*suite) TestContentHashHeaderCanonicalized(c *gc.C) {
 	// The header key should be canonicalized, because otherwise
 	// the actually produced header will be different from that
 	// specified.
-	canon := textproto.CanonicalMIMEHeaderKey(params.ContentHashHeader)
-	c.Assert(canon, gc.Equals, params.ContentHashHeader)
+	for _, header := range []string{
+		params.ContentHashHeader,
+		params.ContentHash256Header,
+		params.ResourceRevisionHeader,
+	} {
+		canon := textproto.CanonicalMIMEHeaderKey(header)
+		c.Assert(canon, gc.Equals, header)
+	}
 }
 
 func (*suite) TestBakeryErrorCompatibility(c *gc.C) {
@@ -39,3 +45,72 @@ func (*suite) TestBakeryErrorCompatibility(c *gc.C) {
 	c.Assert(err, gc.IsNil)
 	c.Assert(string(data1), jc.JSONEquals, err2)
 }
+
+func (*suite) TestContentChallengeErrorInfo(c *gc.C) {
+	chal := &params.ContentChallenge{
+		RequestId:   "some-id",
+		RangeStart:  12,
+		RangeLength: 345,
+	}
+	perr := &params.Error{
+		Code: params.ErrContentChallenge,
+		Info: chal.ErrorInfo(),
+	}
+	// Check that the challenge survives a round trip through JSON.
+	data, err := json.Marshal(perr)
+	c.Assert(err, gc.IsNil)
+	var perr1 params.Error
+	err = json.Unmarshal(data, &perr1)
+	c.Assert(err, gc.IsNil)
+	chal1, err := params.ContentChallengeFromError(&perr1)
+	c.Assert(err, gc.IsNil)
+	c.Assert(chal1, jc.DeepEquals, chal)
+}
+
+var contentChallengeFromErrorTests = []struct {
+	about       string
+	err         params.Error
+	expectError string
+}{{
+	about: "wrong code",
+	err: params.Error{
+		Code: params.ErrNotFound,
+	},
+	expectError: `unexpected error code "not found"`,
+}, {
+	about: "no request id",
+	err: params.Error{
+		Code: params.ErrContentChallenge,
+	},
+	expectError: `no challenge request id found`,
+}, {
+	about: "missing range length",
+	err: params.Error{
+		Code: params.ErrContentChallenge,
+		Info: map[string]*params.Error{
+			params.ContentChallengeRequestIdKey:  {Message: "some-id"},
+			params.ContentChallengeRangeStartKey: {Message: "0"},
+		},
+	},
+	expectError: `no challenge range-length found`,
+}, {
+	about: "invalid range start",
+	err: params.Error{
+		Code: params.ErrContentChallenge,
+		Info: map[string]*params.Error{
+			params.ContentChallengeRequestIdKey:   {Message: "some-id"},
+			params.ContentChallengeRangeStartKey:  {Message: "-1"},
+			params.ContentChallengeRangeLengthKey: {Message: "10"},
+		},
+	},
+	expectError: `invalid challenge range-start "-1"`,
+}}
+
+func (*suite) TestContentChallengeFromErrorErrors(c *gc.C) {
+	for i, test := range contentChallengeFromErrorTests {
+		c.Logf("test %d: %s", i, test.about)
+		chal, err := params.ContentChallengeFromError(&test.err)
+		c.Assert(chal, gc.IsNil)
+		c.Assert(err, gc.ErrorMatches, test.expectError)
+	}
+}
@@ -11,9 +11,12 @@ import (
 	"gopkg.in/macaroon-bakery.v0/bakery"
 	"gopkg.in/mgo.v2"
 
+	cfg "gopkg.in/juju/charmstore.v4/config"
+	"gopkg.in/juju/charmstore.v4/internal/blobstore"
 	"gopkg.in/juju/charmstore.v4/internal/charmstore"
 	"gopkg.in/juju/charmstore.v4/internal/elasticsearch"
 	"gopkg.in/juju/charmstore.v4/internal/legacy"
+	"gopkg.in/juju/charmstore.v4/internal/policy"
 	"gopkg.in/juju/charmstore.v4/internal/v4"
 )
 
@@ -63,6 +66,45 @@ type ServerParams struct {
 	// to be used when querying the identity manager API.
 	IdentityAPIUsername string
 	IdentityAPIPassword string
+
+	// BlobStore holds the kind of storage used for archive
+	// blobs, one of the config.BlobStore constants. If it is
+	// empty, blobs are stored in the database. BlobStorePath
+	// and the S3 fields configure the filesystem and S3 blob
+	// stores as the fields of config.Config with the same
+	// names do.
+	BlobStore     string
+	BlobStorePath string
+	S3Endpoint    string
+	S3Region      string
+	S3Bucket      string
+	S3AccessKey   string
+	S3SecretKey   string
+
+	// ScrubRate holds the number of entities per second
+	// checked by the archive integrity scrubber.
+	// If it is zero, the scrubber is not started.
+	ScrubRate float64
+
+	// The policy fields configure the content policy applied
+	// to uploaded archives as the fields of config.Config with
+	// the same names do. All of them are optional.
+	PolicyMaxArchiveSize  int64
+	PolicyForbiddenFiles  []string
+	PolicyRequireReadme   bool
+	PolicyAllowedLicences []string
+	PolicyRequiredHooks   []string
+
+	// QuotaMaxEntities and QuotaMaxBytes hold the maximum
+	// number of entities that a user may own and the maximum
+	// total size of their archives, resources and upload chunks.
+	// Zero values mean no limit.
+	QuotaMaxEntities int
+	QuotaMaxBytes    int64
+
+	// DeliverWebhooks specifies that the server delivers
+	// the events in the change feed to registered webhooks.
+	DeliverWebhooks bool
 }
 
 // NewServer returns a new handler that handles charm store requests and stores
@@ -84,5 +126,37 @@ func NewServer(db *mgo.Database, es *elasticsearch.Database, idx string, config
 			Index:    idx,
 		}
 	}
-	return charmstore.NewServer(db, si, charmstore.ServerParams(config), newAPIs)
+	conf := &cfg.Config{
+		BlobStore:             config.BlobStore,
+		BlobStorePath:         config.BlobStorePath,
+		S3Endpoint:            config.S3Endpoint,
+		S3Region:              config.S3Region,
+		S3Bucket:              config.S3Bucket,
+		S3AccessKey:           config.S3AccessKey,
+		S3SecretKey:           config.S3SecretKey,
+		PolicyMaxArchiveSize:  config.PolicyMaxArchiveSize,
+		PolicyForbiddenFiles:  config.PolicyForbiddenFiles,
+		PolicyRequireReadme:   config.PolicyRequireReadme,
+		PolicyAllowedLicences: config.PolicyAllowedLicences,
+		PolicyRequiredHooks:   config.PolicyRequiredHooks,
+	}
+	bs, err := blobstore.NewFromConfig(db, conf)
+	if err != nil {
+		return nil, fmt.Errorf("cannot create blob store: %v", err)
+	}
+	return charmstore.NewServer(db, si, charmstore.ServerParams{
+		AuthUsername:        config.AuthUsername,
+		AuthPassword:        config.AuthPassword,
+		IdentityLocation:    config.IdentityLocation,
+		PublicKeyLocator:    config.PublicKeyLocator,
+		IdentityAPIURL:      config.IdentityAPIURL,
+		IdentityAPIUsername: config.IdentityAPIUsername,
+		IdentityAPIPassword: config.IdentityAPIPassword,
+		BlobStore:           bs,
+		ScrubRate:           config.ScrubRate,
+		Policy:              policy.NewFromConfig(conf),
+		QuotaMaxEntities:    config.QuotaMaxEntities,
+		QuotaMaxBytes:       config.QuotaMaxBytes,
+		DeliverWebhooks:     config.DeliverWebhooks,
+	}, newAPIs)
 }
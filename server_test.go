@@ -13,6 +13,7 @@ import (
 	gc "gopkg.in/check.v1"
 
 	"gopkg.in/juju/charmstore.v4"
+	"gopkg.in/juju/charmstore.v4/config"
 	"gopkg.in/juju/charmstore.v4/internal/storetesting"
 	"gopkg.in/juju/charmstore.v4/params"
 )
@@ -50,6 +51,21 @@ func (s *ServerSuite) TestNewServerWithUnregisteredVersion(c *gc.C) {
 	c.Assert(h, gc.IsNil)
 }
 
+func (s *ServerSuite) TestNewServerWithUnknownBlobStore(c *gc.C) {
+	s.config.BlobStore = "foo"
+	h, err := charmstore.NewServer(s.Session.DB("foo"), nil, "", s.config, charmstore.V4)
+	c.Assert(err, gc.ErrorMatches, `cannot create blob store: unknown blob store type "foo"`)
+	c.Assert(h, gc.IsNil)
+}
+
+func (s *ServerSuite) TestNewServerWithFilesystemBlobStore(c *gc.C) {
+	s.config.BlobStore = config.BlobStoreFilesystem
+	s.config.BlobStorePath = c.MkDir()
+	s.config.PolicyRequireReadme = true
+	_, err := charmstore.NewServer(s.Session.DB("foo"), nil, "", s.config, charmstore.V4)
+	c.Assert(err, gc.IsNil)
+}
+
 type versionResponse struct {
 	Version string
 	Path    string
@@ -0,0 +1,137 @@
+// Copyright 2015 Canonical Ltd.
+// Licensed under the LGPLv3, see LICENCE file for details.
+
+// The signature package implements the signing of charm and bundle
+// archives and the verification of their signatures. A signature
+// is made over the SHA384 hash of an archive, using either an RSA key
+// (with PKCS #1 v1.5 padding) or an ECDSA key. Public keys are
+// exchanged as PEM-encoded PKIX public keys.
+package signature
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/hex"
+	"encoding/pem"
+	"fmt"
+	"math/big"
+
+	"gopkg.in/errgo.v1"
+)
+
+// pemType holds the type of the PEM blocks holding public keys.
+const pemType = "PUBLIC KEY"
+
+// ParsePublicKey parses the given PEM-encoded PKIX public key,
+// which must be an RSA or ECDSA key.
+func ParsePublicKey(data []byte) (crypto.PublicKey, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errgo.New("no PEM data found")
+	}
+	if block.Type != pemType {
+		return nil, errgo.Newf("unexpected PEM block type %q", block.Type)
+	}
+	key, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot parse public key")
+	}
+	switch key.(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+		return key, nil
+	}
+	return nil, errgo.Newf("unsupported public key type %T", key)
+}
+
+// MarshalPublicKey returns the PEM-encoded PKIX
+// form of the given public key.
+func MarshalPublicKey(key crypto.PublicKey) ([]byte, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot marshal public key")
+	}
+	return pem.EncodeToMemory(&pem.Block{
+		Type:  pemType,
+		Bytes: der,
+	}), nil
+}
+
+// KeyId returns the id of the given public key: the
+// hex-encoded SHA256 hash of its PKIX encoding.
+func KeyId(key crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(key)
+	if err != nil {
+		return "", errgo.Notef(err, "cannot marshal public key")
+	}
+	sum := sha256.Sum256(der)
+	return fmt.Sprintf("%x", sum[:]), nil
+}
+
+// Sign signs the archive with the given hex-encoded
+// SHA384 hash using the given private key, which must
+// be an RSA or ECDSA key.
+func Sign(key crypto.Signer, hash string) ([]byte, error) {
+	digest, err := decodeHash(hash)
+	if err != nil {
+		return nil, errgo.Mask(err)
+	}
+	switch key.Public().(type) {
+	case *rsa.PublicKey, *ecdsa.PublicKey:
+	default:
+		return nil, errgo.Newf("unsupported public key type %T", key.Public())
+	}
+	sig, err := key.Sign(rand.Reader, digest, crypto.SHA384)
+	if err != nil {
+		return nil, errgo.Notef(err, "cannot sign")
+	}
+	return sig, nil
+}
+
+// ErrVerificationFailed is returned by Verify when
+// a signature does not match the hash and key.
+var ErrVerificationFailed = errgo.New("signature verification failed")
+
+// Verify checks that sig is a signature of the archive with the given
+// hex-encoded SHA384 hash made with the private key corresponding to
+// the given public key. If the signature does not match, it returns
+// ErrVerificationFailed.
+func Verify(key crypto.PublicKey, hash string, sig []byte) error {
+	digest, err := decodeHash(hash)
+	if err != nil {
+		return errgo.Mask(err)
+	}
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if err := rsa.VerifyPKCS1v15(key, crypto.SHA384, digest, sig); err != nil {
+			return ErrVerificationFailed
+		}
+		return nil
+	case *ecdsa.PublicKey:
+		var esig struct {
+			R, S *big.Int
+		}
+		if rest, err := asn1.Unmarshal(sig, &esig); err != nil || len(rest) > 0 {
+			return ErrVerificationFailed
+		}
+		if !ecdsa.Verify(key, digest, esig.R, esig.S) {
+			return ErrVerificationFailed
+		}
+		return nil
+	}
+	return errgo.Newf("unsupported public key type %T", key)
+}
+
+// decodeHash returns the digest held in the
+// given hex-encoded SHA384 hash.
+func decodeHash(hash string) ([]byte, error) {
+	digest, err := hex.DecodeString(hash)
+	if err != nil || len(digest) != crypto.SHA384.Size() {
+		return nil, errgo.Newf("invalid SHA384 hash %q", hash)
+	}
+	return digest, nil
+}